@@ -13,6 +13,7 @@ import (
 var (
 	ErrEmptyServerURL   = errors.New("empty contentserver url provided")
 	ErrInvalidServerURL = errors.New("invalid contentserver url provided")
+	ErrWatchUnsupported = errors.New("transport does not support watching for changes")
 )
 
 // Client a content server client
@@ -59,6 +60,19 @@ func (c *Client) GetContent(ctx context.Context, request *requests.Content) (*co
 	return resp.Reply, nil
 }
 
+// GetContentBatch request many site contents in a single round trip.
+// The results are returned in the order of the given requests.
+func (c *Client) GetContentBatch(ctx context.Context, contentRequests []*requests.Content) ([]*responses.ContentBatchItem, error) {
+	type serverResponse struct {
+		Reply []*responses.ContentBatchItem
+	}
+	resp := serverResponse{}
+	if err := c.t.Call(ctx, handler.RouteGetContentBatch, &requests.ContentBatch{Requests: contentRequests}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Reply, nil
+}
+
 // GetURIs resolve uris for ids in a dimension
 func (c *Client) GetURIs(ctx context.Context, dimension string, ids []string) (map[string]string, error) {
 	type serverResponse struct {
@@ -100,6 +114,28 @@ func (c *Client) GetRepo(ctx context.Context) (map[string]*content.RepoNode, err
 	return resp.Reply, nil
 }
 
+// Status get the served revision and update status of the server
+func (c *Client) Status(ctx context.Context) (*responses.Status, error) {
+	type serverResponse struct {
+		Reply *responses.Status
+	}
+	resp := serverResponse{}
+	if err := c.t.Call(ctx, handler.RouteStatus, &requests.Status{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Reply, nil
+}
+
+// Watch streams changes of the repo until the context is canceled.
+// The returned channel is closed when the stream ends, call Watch again to resume.
+func (c *Client) Watch(ctx context.Context) (<-chan *responses.Change, error) {
+	t, ok := c.t.(WatchTransport)
+	if !ok {
+		return nil, ErrWatchUnsupported
+	}
+	return t.Watch(ctx)
+}
+
 func (c *Client) Close() {
 	c.t.Close()
 }
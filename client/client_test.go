@@ -2,18 +2,33 @@ package client_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/foomo/contentserver/client"
 	"github.com/foomo/contentserver/content"
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/handler"
 	"github.com/foomo/contentserver/pkg/repo"
 	"github.com/foomo/contentserver/pkg/repo/mock"
+	"github.com/foomo/contentserver/pkg/socket"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/nettest"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 func TestUpdate(t *testing.T) {
@@ -85,6 +100,222 @@ func TestGetContent(t *testing.T) {
 	})
 }
 
+func TestGetContentBatch(t *testing.T) {
+	testWithClients(t, func(t *testing.T, c *client.Client) {
+		t.Helper()
+		t.Parallel()
+		requestA := mock.MakeValidContentRequest()
+		requestB := mock.MakeValidContentRequest()
+		requestB.URI = "/b"
+		items, err := c.GetContentBatch(t.Context(), []*requests.Content{requestA, requestB})
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+		for i, request := range []*requests.Content{requestA, requestB} {
+			require.Nil(t, items[i].Error)
+			assert.Equal(t, request.URI, items[i].Content.URI)
+			assert.Equal(t, content.StatusOk, items[i].Content.Status)
+		}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	testWithClients(t, func(t *testing.T, c *client.Client) {
+		t.Helper()
+		t.Parallel()
+		status, err := c.Status(t.Context())
+		require.NoError(t, err)
+		assert.True(t, status.Loaded)
+		require.NotNil(t, status.Revision)
+		assert.NotEmpty(t, status.Revision.ID)
+		assert.NotEmpty(t, status.Revision.Hash)
+		assert.Len(t, status.Dimensions, 2)
+		assert.Positive(t, status.Dimensions["dimension_foo"].NumberOfNodes)
+		assert.NotEmpty(t, status.History)
+	})
+}
+
+func TestDispatcher(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	r := initRepo(t, l)
+	d := handler.NewDispatcher(l, r, handler.DispatcherWithMiddlewares(
+		handler.MiddlewareRateLimit(rate.NewLimiter(rate.Every(time.Hour), 2)),
+	))
+	d.Handle("echo", func(ctx context.Context, req *handler.Request) (*handler.Reply, error) {
+		return &handler.Reply{Value: req.Source, Version: req.Snapshot.Version()}, nil
+	})
+
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	s := socket.NewServer(l, "socket", ln, handler.NewSocket(l, r, handler.SocketWithDispatcher(d)))
+	go s.Start(t.Context())             //nolint:errcheck
+	defer s.Close(context.Background()) //nolint:errcheck
+	httpServer := httptest.NewServer(handler.NewHTTP(l, r, handler.WithDispatcher(d)))
+	defer httpServer.Close()
+
+	// custom routes are served by all transports
+	var source struct {
+		Reply string `json:"reply"`
+	}
+	httpTransport := client.NewHTTPTransport(httpServer.URL + "/contentserver")
+	require.NoError(t, httpTransport.Call(t.Context(), "echo", struct{}{}, &source))
+	assert.Equal(t, "webserver", source.Reply)
+	socketTransport := client.NewSocketTransport(ln.Addr().String(), 1, time.Second)
+	defer socketTransport.Close()
+	require.NoError(t, socketTransport.Call(t.Context(), "echo", struct{}{}, &source))
+	assert.NotEqual(t, "webserver", source.Reply)
+
+	// the limit is shared by the transports
+	var remoteErr responses.Error
+	err = socketTransport.Call(t.Context(), "echo", struct{}{}, &source)
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusTooManyRequests, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeRateLimited, remoteErr.Code)
+}
+
+func TestAuth(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	r := initRepo(t, l)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject: "jwt",
+		Expiry:  jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).Claims(map[string]interface{}{
+		"scope":  auth.PermissionRead,
+		"groups": []string{"www"},
+	}).Serialize()
+	require.NoError(t, err)
+
+	authenticator := auth.Chain(
+		auth.NewBearer([]*auth.Identity{
+			{Subject: "reader", Secret: "read-token", Permissions: []string{auth.PermissionRead}},
+		}),
+		auth.NewHMAC([]*auth.Identity{
+			{Subject: "updater", Secret: "secret", Permissions: []string{auth.PermissionRead, auth.PermissionUpdate, auth.PermissionRepo}},
+		}),
+		auth.NewJWT(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "test", Algorithm: string(jose.ES256)}}}),
+	)
+	d := handler.NewDispatcher(l, r, handler.DispatcherWithMiddlewares(
+		handler.MiddlewareAuth(l, authenticator,
+			handler.AuthWithPermissions(map[handler.Route]string{"groups": auth.PermissionRead}),
+			handler.AuthWithGroupsFromClaims(true),
+		),
+	))
+	d.Handle("groups", func(ctx context.Context, req *handler.Request) (*handler.Reply, error) {
+		return &handler.Reply{Value: req.Groups}, nil
+	})
+
+	httpServer := httptest.NewServer(handler.NewHTTP(l, r, handler.WithDispatcher(d)))
+	defer httpServer.Close()
+	socketListener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	socketServer := socket.NewServer(l, "socket", socketListener, handler.NewSocket(l, r, handler.SocketWithDispatcher(d)))
+	go socketServer.Start(t.Context())             //nolint:errcheck
+	defer socketServer.Close(context.Background()) //nolint:errcheck
+	grpcListener, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer(grpc.ForceServerCodec(handler.GRPCCodec{}))
+	handler.NewGRPC(l, r, handler.GRPCWithDispatcher(d)).Register(grpcServer)
+	go grpcServer.Serve(grpcListener) //nolint:errcheck
+	defer grpcServer.Stop()
+
+	transports := map[string]func(credentials *client.Credentials) client.Transport{
+		"http": func(credentials *client.Credentials) client.Transport {
+			return client.NewHTTPTransport(httpServer.URL+"/contentserver", client.HTTPTransportWithCredentials(credentials))
+		},
+		"socket": func(credentials *client.Credentials) client.Transport {
+			return client.NewSocketTransport(socketListener.Addr().String(), 1, time.Second,
+				client.SocketTransportWithCredentials(credentials),
+				client.SocketTransportWithMultiplexing(true),
+			)
+		},
+		"socket v1": func(credentials *client.Credentials) client.Transport {
+			return client.NewSocketTransport(socketListener.Addr().String(), 1, time.Second,
+				client.SocketTransportWithCredentials(credentials),
+				client.SocketTransportWithProtocol(handler.ProtocolV1),
+			)
+		},
+		"grpc": func(credentials *client.Credentials) client.Transport {
+			transport, err := client.NewGRPCTransport(grpcListener.Addr().String(), client.GRPCTransportWithCredentials(credentials))
+			require.NoError(t, err)
+			return transport
+		},
+	}
+	for name, newTransport := range transports {
+		t.Run(name, func(t *testing.T) {
+			var remoteErr responses.Error
+
+			// requests without credentials are anonymous
+			anonymous := client.New(newTransport(nil))
+			defer anonymous.Close()
+			_, err := anonymous.GetURIs(t.Context(), "dimension_foo", []string{"id-a"})
+			require.ErrorAs(t, err, &remoteErr)
+			assert.Equal(t, http.StatusUnauthorized, remoteErr.Status)
+
+			reader := client.New(newTransport(&client.Credentials{Token: "read-token"}))
+			defer reader.Close()
+			uris, err := reader.GetURIs(t.Context(), "dimension_foo", []string{"id-a"})
+			require.NoError(t, err)
+			assert.Equal(t, "/a", uris["id-a"])
+			_, err = reader.Update(t.Context())
+			require.ErrorAs(t, err, &remoteErr)
+			assert.Equal(t, http.StatusForbidden, remoteErr.Status)
+			_, err = reader.GetRepo(t.Context())
+			require.ErrorAs(t, err, &remoteErr)
+			assert.Equal(t, http.StatusForbidden, remoteErr.Status)
+
+			updater := client.New(newTransport(&client.Credentials{Key: "updater", Secret: "secret"}))
+			defer updater.Close()
+			update, err := updater.Update(t.Context())
+			require.NoError(t, err)
+			assert.True(t, update.Success)
+			_, err = updater.GetRepo(t.Context())
+			require.NoError(t, err)
+
+			invalid := client.New(newTransport(&client.Credentials{Key: "updater", Secret: "invalid"}))
+			defer invalid.Close()
+			_, err = invalid.Status(t.Context())
+			require.Error(t, err)
+
+			// the groups are taken from the claims, grpc has no custom routes
+			if name != "grpc" {
+				var groups struct {
+					Reply []string `json:"reply"`
+				}
+				transport := newTransport(&client.Credentials{Token: token})
+				defer transport.Close()
+				require.NoError(t, transport.Call(t.Context(), "groups", struct{}{}, &groups))
+				assert.Equal(t, []string{"www"}, groups.Reply)
+			}
+		})
+	}
+
+	// GET replies to clients with credentials must not be shared, their etags depend on the groups of the client
+	get := func(t *testing.T, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, httpServer.URL+"/contentserver/content?uri=/a&dimensions=dimension_foo", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res
+	}
+	reader := get(t, "read-token")
+	require.Equal(t, http.StatusOK, reader.StatusCode)
+	assert.Equal(t, handler.PrivateCacheControl, reader.Header.Get("Cache-Control"))
+	assert.Equal(t, "Authorization", reader.Header.Get("Vary"))
+	jwtReader := get(t, token)
+	require.Equal(t, http.StatusOK, jwtReader.StatusCode)
+	assert.Equal(t, handler.PrivateCacheControl, jwtReader.Header.Get("Cache-Control"))
+	assert.Equal(t, reader.Header.Get(handler.HeaderVersion), jwtReader.Header.Get(handler.HeaderVersion))
+	assert.NotEqual(t, reader.Header.Get("ETag"), jwtReader.Header.Get("ETag"))
+	assert.NotEqual(t, `"`+reader.Header.Get(handler.HeaderVersion)+`"`, jwtReader.Header.Get("ETag"))
+}
+
 func benchmarkServerAndClientGetContent(b *testing.B, numGroups, numCalls int, client GetContentClient) {
 	b.Helper()
 	b.ResetTimer()
@@ -144,6 +375,37 @@ func testWithClients(t *testing.T, testFunc func(t *testing.T, c *client.Client)
 		}()
 		testFunc(t, c)
 	})
+	t.Run("socket v1", func(t *testing.T) {
+		l := zaptest.NewLogger(t)
+		s := initSocketRepoServer(t, l)
+		c := client.New(client.NewSocketTransport(s.Addr().String(), 25, 100*time.Millisecond,
+			client.SocketTransportWithProtocol(handler.ProtocolV1),
+		))
+		defer func() {
+			s.Close()
+			c.Close()
+		}()
+		testFunc(t, c)
+	})
+	t.Run("socket multiplexed", func(t *testing.T) {
+		l := zaptest.NewLogger(t)
+		s := initSocketRepoServer(t, l)
+		c := client.New(client.NewSocketTransport(s.Addr().String(), 2, 100*time.Millisecond,
+			client.SocketTransportWithMultiplexing(true),
+		))
+		defer func() {
+			s.Close()
+			c.Close()
+		}()
+		testFunc(t, c)
+	})
+	t.Run("grpc", func(t *testing.T) {
+		l := zaptest.NewLogger(t)
+		s := initGRPCRepoServer(t, l)
+		c := newGRPCClient(t, s.Addr().String())
+		defer c.Close()
+		testFunc(t, c)
+	})
 }
 
 func initRepo(tb testing.TB, l *zap.Logger) *repo.Repo {
@@ -7,16 +7,16 @@ import (
 )
 
 type connectionPool struct {
-	url string
+	dial func(ctx context.Context) (net.Conn, error)
 	// conn           net.Conn
 	chanConnGet    chan chan net.Conn
 	chanConnReturn chan connReturn
 	chanDrainPool  chan int
 }
 
-func newConnectionPool(url string, connectionPoolSize int, waitTimeout time.Duration) *connectionPool {
+func newConnectionPool(dial func(ctx context.Context) (net.Conn, error), connectionPoolSize int, waitTimeout time.Duration) *connectionPool {
 	connPool := &connectionPool{
-		url:            url,
+		dial:           dial,
 		chanConnGet:    make(chan chan net.Conn),
 		chanConnReturn: make(chan connReturn),
 		chanDrainPool:  make(chan int),
@@ -93,8 +93,7 @@ RunLoop:
 		// refill connection pool
 		for _, poolEntry := range connectionPool {
 			if poolEntry.conn == nil {
-				var d net.Dialer
-				newConn, errDial := d.DialContext(context.Background(), "tcp", c.url)
+				newConn, errDial := c.dial(context.Background())
 				poolEntry.err = errDial
 				poolEntry.conn = newConn
 			}
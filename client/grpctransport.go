@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/responses"
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type (
+	// GRPCTransport calls the grpc service of the server, see handler.GRPC
+	GRPCTransport struct {
+		conn        *grpc.ClientConn
+		tlsConfig   *tls.Config
+		credentials *Credentials
+		dialOptions []grpc.DialOption
+	}
+	GRPCTransportOption func(*GRPCTransport)
+)
+
+var (
+	grpcGetRepoStreamDesc = &grpc.StreamDesc{StreamName: handler.GRPCMethods[handler.RouteGetRepo], ServerStreams: true}
+	grpcWatchStreamDesc   = &grpc.StreamDesc{StreamName: handler.GRPCMethods[handler.RouteWatch], ServerStreams: true}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// GRPCTransportWithTLSConfig connects with TLS, set Certificates or GetClientCertificate for mutual TLS
+func GRPCTransportWithTLSConfig(v *tls.Config) GRPCTransportOption {
+	return func(o *GRPCTransport) {
+		o.tlsConfig = v
+	}
+}
+
+// GRPCTransportWithCredentials authenticates every call with metadata
+func GRPCTransportWithCredentials(v *Credentials) GRPCTransportOption {
+	return func(o *GRPCTransport) {
+		o.credentials = v
+	}
+}
+
+// GRPCTransportWithDialOptions adds options to the grpc client, e.g. interceptors
+func GRPCTransportWithDialOptions(v ...grpc.DialOption) GRPCTransportOption {
+	return func(o *GRPCTransport) {
+		o.dialOptions = append(o.dialOptions, v...)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewGRPCTransport creates a grpc client for the target, e.g. localhost:8082, connections are established lazily
+func NewGRPCTransport(target string, opts ...GRPCTransportOption) (*GRPCTransport, error) {
+	inst := &GRPCTransport{}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	creds := insecure.NewCredentials()
+	if inst.tlsConfig != nil {
+		creds = credentials.NewTLS(inst.tlsConfig)
+	}
+	conn, err := grpc.NewClient(target, append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(handler.GRPCCodec{})),
+	}, inst.dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	inst.conn = conn
+	return inst, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (t *GRPCTransport) Call(ctx context.Context, route handler.Route, request interface{}, response interface{}) error {
+	method, ok := handler.GRPCMethods[route]
+	if !ok || route == handler.RouteWatch {
+		return responses.Error{Status: http.StatusNotFound, Code: 1, Message: "unknown handler: " + string(route)}
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	ctx = t.authenticate(ctx, route, requestBytes)
+	var replyBytes []byte
+	if route == handler.RouteGetRepo {
+		replyBytes, err = t.getRepo(ctx, requestBytes)
+	} else {
+		err = t.conn.Invoke(ctx, t.fullMethod(method), requestBytes, &replyBytes)
+	}
+	if err != nil {
+		return decodeGRPCError(err)
+	}
+
+	// the replies are wrapped like the replies of the other transports
+	return json.Unmarshal(append(append([]byte(`{"reply":`), replyBytes...), '}'), response)
+}
+
+// Watch streams the changes of the repo
+func (t *GRPCTransport) Watch(ctx context.Context) (<-chan *responses.Change, error) {
+	requestBytes := []byte("{}")
+	stream, err := t.conn.NewStream(t.authenticate(ctx, handler.RouteWatch, requestBytes), grpcWatchStreamDesc, t.fullMethod(grpcWatchStreamDesc.StreamName))
+	if err != nil {
+		return nil, decodeGRPCError(err)
+	}
+	if err := t.send(stream, requestBytes); err != nil {
+		return nil, err
+	}
+	// waits for the server to accept the stream
+	if _, err := stream.Header(); err != nil {
+		return nil, decodeGRPCError(err)
+	}
+
+	changes := make(chan *responses.Change)
+	go func() {
+		defer close(changes)
+		for {
+			change := &responses.Change{}
+			if err := stream.RecvMsg(change); err != nil {
+				return
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (t *GRPCTransport) Close() {
+	_ = t.conn.Close()
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// getRepo collects the dimensions of the stream into a json object
+func (t *GRPCTransport) getRepo(ctx context.Context, requestBytes []byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := t.conn.NewStream(ctx, grpcGetRepoStreamDesc, t.fullMethod(grpcGetRepoStreamDesc.StreamName))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.send(stream, requestBytes); err != nil {
+		return nil, err
+	}
+	nodes := map[string]jsoniter.RawMessage{}
+	for {
+		var dimension struct {
+			Dimension string              `json:"dimension"`
+			Node      jsoniter.RawMessage `json:"node"`
+		}
+		if err := stream.RecvMsg(&dimension); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		nodes[dimension.Dimension] = dimension.Node
+	}
+	return json.Marshal(nodes)
+}
+
+func (t *GRPCTransport) send(stream grpc.ClientStream, requestBytes []byte) error {
+	if err := stream.SendMsg(requestBytes); err != nil {
+		return err
+	}
+	return stream.CloseSend()
+}
+
+// authenticate adds the credentials to the outgoing metadata
+func (t *GRPCTransport) authenticate(ctx context.Context, route handler.Route, body []byte) context.Context {
+	if t.credentials == nil {
+		return ctx
+	}
+	for key, value := range t.credentials.headers(auth.MethodGRPC, route, body) {
+		ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+	}
+	return ctx
+}
+
+func (t *GRPCTransport) fullMethod(method string) string {
+	return "/" + handler.GRPCServiceName + "/" + method
+}
+
+// decodeGRPCError returns errors of the server as responses.Error with the matching http status,
+// context and connection errors are returned as they are
+func decodeGRPCError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var httpStatus int
+	switch s.Code() {
+	case codes.InvalidArgument:
+		httpStatus = http.StatusBadRequest
+	case codes.NotFound, codes.Unimplemented:
+		httpStatus = http.StatusNotFound
+	case codes.Unauthenticated:
+		httpStatus = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		httpStatus = http.StatusForbidden
+	case codes.ResourceExhausted:
+		httpStatus = http.StatusTooManyRequests
+	case codes.Unavailable:
+		httpStatus = http.StatusServiceUnavailable
+	case codes.Internal, codes.Unknown:
+		httpStatus = http.StatusInternalServerError
+	default:
+		return err
+	}
+	return responses.Error{Status: httpStatus, Message: s.Message()}
+}
@@ -0,0 +1,134 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/client"
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/nettest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestGRPCWatch(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initGRPCRepoServer(t, l)
+	c := newGRPCClient(t, s.Addr().String())
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	changes, err := c.Watch(ctx)
+	require.NoError(t, err)
+
+	response, err := c.Update(t.Context())
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	select {
+	case change, ok := <-changes:
+		require.True(t, ok)
+		assert.Equal(t, response.Revision.ID, change.Revision.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initGRPCRepoServer(t, l)
+	transport, err := client.NewGRPCTransport(s.Addr().String())
+	require.NoError(t, err)
+	defer transport.Close()
+
+	// invalid requests are rejected
+	var response any
+	err = transport.Call(t.Context(), handler.RouteGetContent, []string{"invalid"}, &response)
+	var remoteErr responses.Error
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusBadRequest, remoteErr.Status)
+
+	// deadlines are passed to the server
+	ctx, cancel := context.WithTimeout(t.Context(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = client.New(transport).Status(ctx)
+	require.Error(t, err)
+	require.NotErrorAs(t, err, &remoteErr)
+}
+
+func TestGRPCNotLoaded(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	h, err := repo.NewHistory(l, repo.HistoryWithHistoryDir(t.TempDir()))
+	require.NoError(t, err)
+	r := repo.New(l, "", h)
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.ForceServerCodec(handler.GRPCCodec{}))
+	handler.NewGRPC(l, r).Register(server)
+	go server.Serve(ln) //nolint:errcheck
+	t.Cleanup(server.Stop)
+	c := newGRPCClient(t, ln.Addr().String())
+	defer c.Close()
+
+	// the content is not available before the first load
+	var remoteErr responses.Error
+	_, err = c.GetURIs(t.Context(), "dimension_foo", []string{"id-a"})
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+	_, err = c.GetRepo(t.Context())
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+
+	// but the status is
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	assert.False(t, status.Loaded)
+
+	// and the repo once there is a snapshot in the storage
+	_, err = h.Add(t.Context(), []byte(`{"dimension_foo":{"id":"id-root","URI":"/"}}`))
+	require.NoError(t, err)
+	nodes, err := c.GetRepo(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, nodes, "dimension_foo")
+	assert.Equal(t, "id-root", nodes["dimension_foo"].ID)
+	_, err = c.GetURIs(t.Context(), "dimension_foo", []string{"id-root"})
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+}
+
+func TestGRPCCodec(t *testing.T) {
+	// importing the packages must not replace the codecs of other grpc services
+	assert.Nil(t, encoding.GetCodec("json"))
+	assert.Nil(t, encoding.GetCodec(handler.GRPCCodecName))
+	assert.Equal(t, handler.GRPCCodecName, handler.GRPCCodec{}.Name())
+}
+
+func newGRPCClient(tb testing.TB, address string) *client.Client {
+	tb.Helper()
+	transport, err := client.NewGRPCTransport(address)
+	require.NoError(tb, err)
+	return client.New(transport)
+}
+
+func initGRPCRepoServer(tb testing.TB, l *zap.Logger) net.Listener {
+	tb.Helper()
+	r := initRepo(tb, l)
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(tb, err)
+	server := grpc.NewServer(grpc.ForceServerCodec(handler.GRPCCodec{}))
+	handler.NewGRPC(l, r).Register(server)
+	go server.Serve(ln) //nolint:errcheck
+	tb.Cleanup(server.Stop)
+	return ln
+}
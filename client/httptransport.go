@@ -1,20 +1,31 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/foomo/contentserver/pkg/handler"
 	"github.com/foomo/contentserver/pkg/utils"
+	"github.com/foomo/contentserver/responses"
+)
+
+const (
+	// maxWatchEventSize limits the size of a single change event
+	maxWatchEventSize = 16 * 1024 * 1024
+	// maxErrorSize limits the size of error replies
+	maxErrorSize = 64 * 1024
 )
 
 type (
 	HTTPTransport struct {
-		httpClient *http.Client
-		endpoint   string
+		httpClient  *http.Client
+		endpoint    string
+		credentials *Credentials
 	}
 	HTTPTransportOption func(*HTTPTransport)
 )
@@ -63,6 +74,13 @@ func HTTPTransportWithHTTPClient(v *http.Client) HTTPTransportOption {
 	}
 }
 
+// HTTPTransportWithCredentials authenticates every request
+func HTTPTransportWithCredentials(v *Credentials) HTTPTransportOption {
+	return func(o *HTTPTransport) {
+		o.credentials = v
+	}
+}
+
 // ------------------------------------------------------------------------------------------------
 // ~ Public methods
 // ------------------------------------------------------------------------------------------------
@@ -81,6 +99,7 @@ func (t *HTTPTransport) Call(ctx context.Context, route handler.Route, request i
 	if errNewRequest != nil {
 		return errNewRequest
 	}
+	t.authenticate(req, route, requestBytes)
 	httpResponse, errDo := t.httpClient.Do(req)
 	if errDo != nil {
 		return errDo
@@ -88,7 +107,7 @@ func (t *HTTPTransport) Call(ctx context.Context, route handler.Route, request i
 	defer httpResponse.Body.Close()
 
 	if httpResponse.StatusCode != http.StatusOK {
-		return errors.New("non 200 reply")
+		return decodeHTTPError(httpResponse)
 	}
 	if httpResponse.Body == nil {
 		return errors.New("empty response body")
@@ -100,6 +119,90 @@ func (t *HTTPTransport) Call(ctx context.Context, route handler.Route, request i
 	return json.Unmarshal(responseBytes, response)
 }
 
+// Watch consumes the server-sent events of the watch route
+func (t *HTTPTransport) Watch(ctx context.Context) (<-chan *responses.Change, error) {
+	req, errNewRequest := http.NewRequestWithContext(ctx, http.MethodGet, t.endpoint+"/"+string(handler.RouteWatch), nil)
+	if errNewRequest != nil {
+		return nil, errNewRequest
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	t.authenticate(req, handler.RouteWatch, nil)
+	httpResponse, errDo := t.httpClient.Do(req)
+	if errDo != nil {
+		return nil, errDo
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		defer httpResponse.Body.Close()
+		return nil, decodeHTTPError(httpResponse)
+	}
+
+	changes := make(chan *responses.Change)
+	go func() {
+		defer close(changes)
+		defer httpResponse.Body.Close()
+
+		var (
+			event   string
+			data    strings.Builder
+			scanner = bufio.NewScanner(httpResponse.Body)
+		)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxWatchEventSize)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event == handler.EventChange && data.Len() > 0 {
+					change := &responses.Change{}
+					if err := json.Unmarshal([]byte(data.String()), change); err == nil {
+						select {
+						case changes <- change:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+				event = ""
+				data.Reset()
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			}
+		}
+	}()
+	return changes, nil
+}
+
 func (t *HTTPTransport) Close() {
 	// nothing to do here
 }
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// authenticate sets the headers of the credentials, the signed body of GET requests is the raw query
+func (t *HTTPTransport) authenticate(req *http.Request, route handler.Route, body []byte) {
+	if t.credentials == nil {
+		return
+	}
+	for key, value := range t.credentials.headers(req.Method, route, body) {
+		req.Header.Set(key, value)
+	}
+}
+
+// decodeHTTPError returns the problem details of a failed request as responses.Error,
+// replies without problem details are returned with their status and body as message
+func decodeHTTPError(httpResponse *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxErrorSize))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(httpResponse.Header.Get("Content-Type"), responses.ContentTypeProblem) {
+		problem := &responses.Problem{}
+		if err := json.Unmarshal(body, problem); err == nil {
+			return problem.ToError()
+		}
+	}
+	return responses.Error{Status: httpResponse.StatusCode, Message: strings.TrimSpace(string(body))}
+}
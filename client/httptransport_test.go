@@ -2,13 +2,20 @@ package client_test
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/foomo/contentserver/client"
 	"github.com/foomo/contentserver/content"
 	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/repo"
 	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -39,6 +46,231 @@ func TestInvalidHTTPClientInit(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestWatch(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initHTTPRepoServer(t, l)
+	c := newHTTPClient(t, s)
+	defer func() {
+		s.Close()
+		c.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	changes, err := c.Watch(ctx)
+	require.NoError(t, err)
+
+	response, err := c.Update(t.Context())
+	require.NoError(t, err)
+	require.True(t, response.Success)
+
+	select {
+	case change, ok := <-changes:
+		require.True(t, ok)
+		assert.Equal(t, response.Revision.ID, change.Revision.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initHTTPRepoServer(t, l)
+	defer s.Close()
+
+	query := func(t *testing.T, body string) (int, string) {
+		t.Helper()
+		res, err := http.Post(s.URL+pathContentserver+"/graphql", "application/json", strings.NewReader(body)) //nolint:noctx
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.NotEmpty(t, res.Header.Get(handler.HeaderVersion))
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(data)
+	}
+
+	status, body := query(t, `{"query": "query($id: String) { node(dimension: \"dimension_foo\", id: $id) { id uri baz: int(field: \"baz\") parent { id } path { uri } ...children } } fragment children on Node { children { id } }", "variables": {"id": "id-a"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"data": {"node": {"id": "id-a", "uri": "/a", "baz": 1, "parent": {"id": "id-root"}, "path": [{"uri": "/"}], "children": []}}}`, body)
+
+	status, body = query(t, `{"query": "{ dimensions { name root { uris { dimension uri } children { id foo: string(field: \"baz\") } } } }"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{
+		"data": {"dimensions": [
+			{"name": "dimension_bar", "root": {"uris": [{"dimension": "dimension_bar", "uri": "/"}, {"dimension": "dimension_foo", "uri": "/"}], "children": [{"id": "id-a", "foo": null}, {"id": "id-b", "foo": null}]}},
+			{"name": "dimension_foo", "root": {"uris": [{"dimension": "dimension_bar", "uri": "/"}, {"dimension": "dimension_foo", "uri": "/"}], "children": [{"id": "id-a", "foo": null}, {"id": "id-b", "foo": null}]}}
+		]},
+		"errors": [
+			{"message": "data field \"baz\" has another type", "locations": [{"line": 1, "column": 65}], "path": ["dimensions", 0, "root", "children", 0, "foo"]},
+			{"message": "data field \"baz\" has another type", "locations": [{"line": 1, "column": 65}], "path": ["dimensions", 1, "root", "children", 0, "foo"]}
+		]
+	}`, body)
+
+	// the fields are encoded in the order of the query
+	_, body = query(t, `{"query": "{ dimension(name: \"dimension_foo\") { root { uri id } name } }"}`)
+	assert.Equal(t, `{"data":{"dimension":{"root":{"uri":"/","id":"id-root"},"name":"dimension_foo"}}}`, body)
+
+	// the schema can be introspected
+	status, body = query(t, `{"query": "{ __schema { queryType { name } } __type(name: \"URI\") { fields { name } } }"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"data": {"__schema": {"queryType": {"name": "Query"}}, "__type": {"fields": [{"name": "id"}, {"name": "dimension"}, {"name": "uri"}]}}}`, body)
+
+	status, body = query(t, `{"query": "{ node(dimension: \"dimension_foo\", uri: \"/b\") { id "}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "syntax error")
+
+	// deeply nested documents and queries are rejected
+	status, body = query(t, `{"query": "{ dimensions(name: `+strings.Repeat("[", 3_000_000)+`) { name } }"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "maximum nesting depth")
+	status, body = query(t, `{"query": "{ node(dimension: \"dimension_foo\", id: \"id-root\") { `+strings.Repeat("children { parent { ", 10)+"id"+strings.Repeat(" } }", 10)+` } }"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "maximum depth")
+}
+
+func TestHTTPErrors(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initHTTPRepoServer(t, l)
+	defer s.Close()
+	transport := client.NewHTTPTransport(s.URL + pathContentserver)
+
+	var response any
+	var remoteErr responses.Error
+	err := transport.Call(t.Context(), handler.Route("unknown"), struct{}{}, &response)
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusNotFound, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeUnknownRoute, remoteErr.Code)
+
+	err = transport.Call(t.Context(), handler.RouteGetContent, []string{"invalid"}, &response)
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusBadRequest, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeInvalidJSON, remoteErr.Code)
+
+	_, err = client.New(transport).GetContent(t.Context(), &requests.Content{
+		URI: "/a",
+		Env: &requests.Env{Dimensions: []string{"dimension_unknown"}},
+	})
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusBadRequest, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeInvalidRequest, remoteErr.Code)
+
+	// errors are problem details
+	res, err := http.Get(s.URL + pathContentserver + "/" + string(handler.RouteGetContent)) //nolint:noctx
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Equal(t, http.MethodPost, res.Header.Get("Allow"))
+	assert.Equal(t, responses.ContentTypeProblem, res.Header.Get("Content-Type"))
+	problem := &responses.Problem{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(problem))
+	assert.Equal(t, responses.ErrorCodeMethodNotAllowed, problem.Code)
+	assert.Equal(t, pathContentserver+"/"+string(handler.RouteGetContent), problem.Instance)
+
+	// request bodies are limited
+	limited := httptest.NewServer(handler.NewHTTP(l, initRepo(t, l), handler.WithMaxRequestSize(64)))
+	defer limited.Close()
+	err = client.NewHTTPTransport(limited.URL+pathContentserver).Call(t.Context(), handler.RouteGetURIs, &requests.URIs{
+		Dimension: "dimension_foo",
+		IDs:       []string{strings.Repeat("a", 64)},
+	}, &response)
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeRequestTooLarge, remoteErr.Code)
+
+	// only status, update and getRepo are answered before the repo is loaded
+	h, err := repo.NewHistory(l, repo.HistoryWithHistoryDir(t.TempDir()))
+	require.NoError(t, err)
+	notLoaded := httptest.NewServer(handler.NewHTTP(l, repo.New(l, "http://127.0.0.1:1/repo.json", h)))
+	defer notLoaded.Close()
+	c := client.New(client.NewHTTPTransport(notLoaded.URL + pathContentserver))
+	_, err = c.GetURIs(t.Context(), "dimension_foo", []string{"id-a"})
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeNotLoaded, remoteErr.Code)
+	_, err = c.GetRepo(t.Context())
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+	assert.Equal(t, responses.ErrorCodeNotLoaded, remoteErr.Code)
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	assert.False(t, status.Loaded)
+
+	// getRepo falls back to the snapshot in the storage
+	_, err = h.Add(t.Context(), []byte(`{"dimension_foo":{"id":"id-root","URI":"/"}}`))
+	require.NoError(t, err)
+	nodes, err := c.GetRepo(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, nodes, "dimension_foo")
+	assert.Equal(t, "id-root", nodes["dimension_foo"].ID)
+	_, err = c.GetURIs(t.Context(), "dimension_foo", []string{"id-root"})
+	require.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, http.StatusServiceUnavailable, remoteErr.Status)
+}
+
+func TestGetRoutes(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initHTTPRepoServer(t, l)
+	defer s.Close()
+
+	get := func(t *testing.T, path, etag string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, s.URL+pathContentserver+path, nil)
+		require.NoError(t, err)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, string(data)
+	}
+
+	res, body := get(t, "/content?uri=/a&dimensions=dimension_foo,dimension_bar", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	etag := res.Header.Get("ETag")
+	assert.Equal(t, `"`+res.Header.Get(handler.HeaderVersion)+`"`, etag)
+	assert.Equal(t, handler.DefaultCacheControl, res.Header.Get("Cache-Control"))
+	assert.Equal(t, "Authorization", res.Header.Get("Vary"))
+	assert.Contains(t, body, `"dimension":"dimension_foo"`)
+
+	// unchanged responses are not sent again
+	res, body = get(t, "/content?uri=/a&dimensions=dimension_foo", "W/"+etag)
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, etag, res.Header.Get("ETag"))
+
+	res, _ = get(t, "/content?uri=/a&dimensions=dimension_unknown", "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body = get(t, "/uris?dimension=dimension_foo&ids=id-a&ids=id-b", `"other"`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"id-a": "/a", "id-b": "/b"}`, body)
+
+	res, body = get(t, "/nodes/id-root?dimension=dimension_foo&expand=true", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	node := &content.Node{}
+	require.NoError(t, json.Unmarshal([]byte(body), node))
+	assert.Equal(t, []string{"id-a", "id-b"}, node.Index)
+
+	res, _ = get(t, "/nodes/id-missing?dimension=dimension_foo", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = get(t, "/uris", "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Empty(t, res.Header.Get("ETag"))
+
+	// a new revision invalidates the etag
+	c := newHTTPClient(t, s)
+	defer c.Close()
+	_, err := c.Update(t.Context())
+	require.NoError(t, err)
+	res, _ = get(t, "/content?uri=/a&dimensions=dimension_foo", etag)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.NotEqual(t, etag, res.Header.Get("ETag"))
+}
+
 func BenchmarkWebClientAndServerGetContent(b *testing.B) {
 	l := zaptest.NewLogger(b)
 	server := initHTTPRepoServer(b, l)
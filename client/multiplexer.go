@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/handler"
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// muxConn sends concurrent requests over one v2 connection,
+// the replies are correlated by their request id and may arrive in any order
+type muxConn struct {
+	conn    *protocolConn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint64]chan *handler.Frame
+	err     error
+}
+
+func newMuxConn(conn *protocolConn) *muxConn {
+	m := &muxConn{
+		conn:    conn,
+		pending: map[uint64]chan *handler.Frame{},
+	}
+	go m.readLoop()
+	return m
+}
+
+// roundTrip writes the request and waits for its reply or the end of the context
+func (m *muxConn) roundTrip(ctx context.Context, request *handler.Frame) (*handler.Frame, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	replyChan := make(chan *handler.Frame, 1)
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	m.pending[request.ID] = replyChan
+	m.mu.Unlock()
+
+	if err := m.write(ctx, request); err != nil {
+		m.fail(err)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replyChan:
+		if !ok {
+			return nil, m.broken()
+		}
+		return reply, nil
+	case <-ctx.Done():
+		// a late reply is dropped by the read loop
+		m.mu.Lock()
+		delete(m.pending, request.ID)
+		m.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// broken returns the error which broke the connection
+func (m *muxConn) broken() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *muxConn) close() {
+	m.fail(errConnectionClosed)
+}
+
+func (m *muxConn) write(ctx context.Context, request *handler.Frame) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := m.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+		defer m.conn.SetWriteDeadline(time.Time{}) //nolint:errcheck
+	}
+	return handler.WriteFrame(m.conn, request)
+}
+
+func (m *muxConn) readLoop() {
+	for {
+		reply, err := handler.ReadFrame(m.conn.reader, handler.DefaultMaxFrameSize)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.mu.Lock()
+		replyChan, ok := m.pending[reply.ID]
+		delete(m.pending, reply.ID)
+		m.mu.Unlock()
+		if ok {
+			replyChan <- reply
+		}
+	}
+}
+
+// fail closes the connection and all pending requests
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for id, replyChan := range m.pending {
+		close(replyChan)
+		delete(m.pending, id)
+	}
+	_ = m.conn.Close()
+}
@@ -1,35 +1,122 @@
 package client
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/foomo/contentserver/pkg/auth"
 	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/utils"
+	"github.com/foomo/contentserver/requests"
 	"github.com/foomo/contentserver/responses"
 )
 
+// negotiationTimeout limits the protocol negotiation of new connections
+const negotiationTimeout = 5 * time.Second
+
 type connReturn struct {
 	conn net.Conn
 	err  error
 }
 
-type SocketTransport struct {
-	connPool *connectionPool
+type (
+	SocketTransport struct {
+		url            string
+		protocol       int
+		compression    bool
+		multiplexing   bool
+		tlsConfig      *tls.Config
+		credentials    *Credentials
+		requestID      atomic.Uint64
+		poolSize       int
+		waitTimeout    time.Duration
+		connPool       *connectionPool
+		connPoolOnce   sync.Once
+		muxConns       []*muxConn
+		muxConnsMu     sync.Mutex
+		muxNext        atomic.Uint64
+		muxUnsupported atomic.Bool
+	}
+	SocketTransportOption func(*SocketTransport)
+	// protocolConn is a connection using the socket protocol v2
+	protocolConn struct {
+		net.Conn
+		reader *bufio.Reader
+	}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// SocketTransportWithProtocol forces handler.ProtocolV1 or handler.ProtocolV2,
+// by default v2 is negotiated with the server and v1 is used if the server does not support it.
+func SocketTransportWithProtocol(v int) SocketTransportOption {
+	return func(o *SocketTransport) {
+		o.protocol = v
+	}
+}
+
+// SocketTransportWithCompression compresses large requests and allows the server to compress replies (v2 only)
+func SocketTransportWithCompression(v bool) SocketTransportOption {
+	return func(o *SocketTransport) {
+		o.compression = v
+	}
+}
+
+// SocketTransportWithMultiplexing sends concurrent requests over the same connections instead of
+// taking a connection from the pool for each request, the pool size sets the number of connections.
+// It requires protocol v2, the pool is used if the server does not support it.
+func SocketTransportWithMultiplexing(v bool) SocketTransportOption {
+	return func(o *SocketTransport) {
+		o.multiplexing = v
+	}
+}
+
+// SocketTransportWithTLSConfig connects with TLS, set Certificates or GetClientCertificate for mutual TLS
+func SocketTransportWithTLSConfig(v *tls.Config) SocketTransportOption {
+	return func(o *SocketTransport) {
+		o.tlsConfig = v
+	}
+}
+
+// SocketTransportWithCredentials authenticates every new connection through handler.RouteAuthenticate
+func SocketTransportWithCredentials(v *Credentials) SocketTransportOption {
+	return func(o *SocketTransport) {
+		o.credentials = v
+	}
 }
 
 // ------------------------------------------------------------------------------------------------
 // ~ Constructor
 // ------------------------------------------------------------------------------------------------
 
-func NewSocketTransport(url string, connectionPoolSize int, waitTimeout time.Duration) *SocketTransport {
-	return &SocketTransport{
-		connPool: newConnectionPool(url, connectionPoolSize, waitTimeout),
+// NewSocketTransport connects to a tcp address like localhost:8081 or a unix socket like unix:///run/contentserver.sock
+func NewSocketTransport(url string, connectionPoolSize int, waitTimeout time.Duration, opts ...SocketTransportOption) *SocketTransport {
+	inst := &SocketTransport{
+		url:         url,
+		poolSize:    max(connectionPoolSize, 1),
+		waitTimeout: waitTimeout,
+	}
+	for _, opt := range opts {
+		opt(inst)
 	}
+	if inst.multiplexing && inst.protocol != handler.ProtocolV1 {
+		inst.muxConns = make([]*muxConn, inst.poolSize)
+	} else {
+		inst.pool()
+	}
+	return inst
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -37,25 +124,272 @@ func NewSocketTransport(url string, connectionPoolSize int, waitTimeout time.Dur
 // ------------------------------------------------------------------------------------------------
 
 func (t *SocketTransport) Call(ctx context.Context, route handler.Route, request interface{}, response interface{}) error {
-	if t.connPool.chanDrainPool == nil {
-		return errors.New("connection pool has been drained, client is dead")
-	}
 	jsonBytes, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("could not marshal request : %q", err)
 	}
+	var (
+		status        uint16
+		responseBytes []byte
+	)
+	if t.muxConns != nil && !t.muxUnsupported.Load() {
+		status, responseBytes, err = t.callMultiplexed(ctx, route, jsonBytes)
+	} else {
+		status, responseBytes, err = t.callPooled(ctx, route, jsonBytes)
+	}
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return decodeRemoteError(status, responseBytes)
+	}
+
+	// unmarshal response
+	errResponse := json.Unmarshal(responseBytes, response)
+	if errResponse != nil {
+		// is it an error ?
+		var (
+			remoteErr        = responses.Error{}
+			remoteErrJSONErr = json.Unmarshal(responseBytes, &remoteErr)
+		)
+		if remoteErrJSONErr == nil {
+			return remoteErr
+		}
+		return fmt.Errorf("could not unmarshal response : %q %q", remoteErrJSONErr, string(responseBytes))
+	}
+	return nil
+}
+
+func (t *SocketTransport) Close() {
+	t.muxConnsMu.Lock()
+	for _, m := range t.muxConns {
+		if m != nil {
+			m.close()
+		}
+	}
+	t.muxConnsMu.Unlock()
+	if t.connPool != nil && t.connPool.chanDrainPool != nil {
+		t.connPool.chanDrainPool <- 1
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// callPooled takes a connection from the pool for the request
+func (t *SocketTransport) callPooled(ctx context.Context, route handler.Route, jsonBytes []byte) (uint16, []byte, error) {
+	connPool := t.pool()
+	if connPool.chanDrainPool == nil {
+		return 0, nil, errors.New("connection pool has been drained, client is dead")
+	}
 	netChan := make(chan net.Conn)
-	t.connPool.chanConnGet <- netChan
+	connPool.chanConnGet <- netChan
 	conn := <-netChan
 	if conn == nil {
-		return errors.New("could not get a connection")
+		return 0, nil, errors.New("could not get a connection")
 	}
+	deadline, hasDeadline := ctx.Deadline()
 	returnConn := func(err error) {
-		t.connPool.chanConnReturn <- connReturn{
+		if hasDeadline && err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		connPool.chanConnReturn <- connReturn{
 			conn: conn,
 			err:  err,
 		}
 	}
+	if hasDeadline {
+		if err := conn.SetDeadline(deadline); err != nil {
+			returnConn(err)
+			return 0, nil, fmt.Errorf("failed to set deadline: %w", err)
+		}
+	}
+
+	if pc, ok := conn.(*protocolConn); ok {
+		status, responseBytes, err := t.callV2(pc, route, jsonBytes)
+		returnConn(err)
+		return status, responseBytes, err
+	}
+	responseBytes, err := callV1(conn, route, jsonBytes)
+	returnConn(err)
+	return v1Status(responseBytes), responseBytes, err
+}
+
+// callMultiplexed sends the request over one of the shared connections
+func (t *SocketTransport) callMultiplexed(ctx context.Context, route handler.Route, jsonBytes []byte) (uint16, []byte, error) {
+	m, err := t.muxConn(ctx)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.muxUnsupported.Store(true)
+		return t.callPooled(ctx, route, jsonBytes)
+	} else if err != nil {
+		return 0, nil, err
+	}
+	reply, err := m.roundTrip(ctx, t.newFrame(route, jsonBytes))
+	if err != nil {
+		return 0, nil, fmt.Errorf("an error occurred while reading the response: %w", err)
+	}
+	return reply.Status, reply.Body, nil
+}
+
+// muxConn returns the next shared connection, broken connections are replaced.
+// It returns errors.ErrUnsupported if the server does not support protocol v2.
+func (t *SocketTransport) muxConn(ctx context.Context) (*muxConn, error) {
+	i := t.muxNext.Add(1) % uint64(len(t.muxConns))
+	t.muxConnsMu.Lock()
+	defer t.muxConnsMu.Unlock()
+	if m := t.muxConns[i]; m != nil && m.broken() == nil {
+		return m, nil
+	}
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(*protocolConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.ErrUnsupported
+	}
+	t.muxConns[i] = newMuxConn(pc)
+	return t.muxConns[i], nil
+}
+
+// pool returns the connection pool, it is created on first use
+func (t *SocketTransport) pool() *connectionPool {
+	t.connPoolOnce.Do(func() {
+		t.connPool = newConnectionPool(t.dial, t.poolSize, t.waitTimeout)
+	})
+	return t.connPool
+}
+
+func (t *SocketTransport) newFrame(route handler.Route, jsonBytes []byte) *handler.Frame {
+	request := &handler.Frame{
+		ID:       t.requestID.Add(1),
+		Route:    route,
+		Encoding: handler.FrameEncodingJSON,
+		Body:     jsonBytes,
+	}
+	if t.compression {
+		request.Flags |= handler.FrameFlagAcceptCompressed
+		if len(jsonBytes) > handler.FrameCompressionThreshold {
+			request.Flags |= handler.FrameFlagCompressed
+		}
+	}
+	return request
+}
+
+// dial connects to the server, negotiates the protocol version and authenticates the connection
+func (t *SocketTransport) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := t.dialProtocol(ctx)
+	if err != nil || t.credentials == nil {
+		return conn, err
+	}
+	if err := t.authenticate(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialProtocol connects to the server and negotiates the protocol version
+func (t *SocketTransport) dialProtocol(ctx context.Context) (net.Conn, error) {
+	var (
+		conn          net.Conn
+		err           error
+		network, addr = utils.NetworkAddress(t.url)
+	)
+	if t.tlsConfig != nil {
+		d := tls.Dialer{Config: t.tlsConfig}
+		conn, err = d.DialContext(ctx, network, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch t.protocol {
+	case handler.ProtocolV1:
+		return conn, nil
+	case handler.ProtocolV2:
+		return newProtocolConn(conn), nil
+	}
+
+	// ask the server to upgrade the connection, servers without v2 reply with an unknown handler error
+	jsonBytes, err := json.Marshal(&requests.Protocol{Versions: []int{handler.ProtocolV1, handler.ProtocolV2}})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(negotiationTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	responseBytes, err := callV1(conn, handler.RouteProtocol, jsonBytes)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to negotiate protocol: %w", err)
+	}
+	var resp struct {
+		Reply *responses.Protocol
+	}
+	if err := json.Unmarshal(responseBytes, &resp); err == nil && resp.Reply != nil && resp.Reply.Version == handler.ProtocolV2 {
+		return newProtocolConn(conn), nil
+	}
+	return conn, nil
+}
+
+// authenticate sends the credentials on a new connection
+func (t *SocketTransport) authenticate(conn net.Conn) error {
+	jsonBytes, err := json.Marshal(t.credentials.authenticate(auth.MethodSocket, handler.RouteAuthenticate, nil))
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(negotiationTimeout)); err != nil {
+		return err
+	}
+	var (
+		status        uint16
+		responseBytes []byte
+	)
+	if pc, ok := conn.(*protocolConn); ok {
+		status, responseBytes, err = t.callV2(pc, handler.RouteAuthenticate, jsonBytes)
+	} else {
+		responseBytes, err = callV1(conn, handler.RouteAuthenticate, jsonBytes)
+		status = v1Status(responseBytes)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	if status != http.StatusOK {
+		return decodeRemoteError(status, responseBytes)
+	}
+	return nil
+}
+
+func (t *SocketTransport) callV2(conn *protocolConn, route handler.Route, jsonBytes []byte) (uint16, []byte, error) {
+	request := t.newFrame(route, jsonBytes)
+	if err := handler.WriteFrame(conn, request); err != nil {
+		return 0, nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	reply, err := handler.ReadFrame(conn.reader, handler.DefaultMaxFrameSize)
+	if err != nil {
+		return 0, nil, fmt.Errorf("an error occurred while reading the response: %w", err)
+	}
+	if reply.ID != request.ID {
+		return 0, nil, fmt.Errorf("unexpected reply id %d for request %d", reply.ID, request.ID)
+	}
+	return reply.Status, reply.Body, nil
+}
+
+// callV1 writes the request with a "route:length" header and reads the length prefixed reply
+func callV1(conn net.Conn, route handler.Route, jsonBytes []byte) ([]byte, error) {
 	// write header result will be like handler:2{}
 	jsonBytes = append([]byte(fmt.Sprintf("%s:%d", route, len(jsonBytes))), jsonBytes...)
 
@@ -67,8 +401,7 @@ func (t *SocketTransport) Call(ctx context.Context, route handler.Route, request
 	for written < l {
 		n, err := conn.Write(jsonBytes[written:])
 		if err != nil {
-			returnConn(err)
-			return fmt.Errorf("failed to send request: %q", err)
+			return nil, fmt.Errorf("failed to send request: %q", err)
 		}
 		written += n
 	}
@@ -82,8 +415,7 @@ func (t *SocketTransport) Call(ctx context.Context, route handler.Route, request
 	for {
 		n, err := conn.Read(buf)
 		if err != nil && err != io.EOF {
-			returnConn(err)
-			return fmt.Errorf("an error occurred while reading the response: %q", err)
+			return nil, fmt.Errorf("an error occurred while reading the response: %q", err)
 		}
 		if n == 0 {
 			break
@@ -95,8 +427,7 @@ func (t *SocketTransport) Call(ctx context.Context, route handler.Route, request
 					// opening bracket
 					responseLength, err = strconv.Atoi(string(responseBytes[0:index]))
 					if err != nil {
-						returnConn(err)
-						return errors.New("could not read response length: " + err.Error())
+						return nil, errors.New("could not read response length: " + err.Error())
 					}
 					responseBytes = responseBytes[index:]
 					break
@@ -107,27 +438,41 @@ func (t *SocketTransport) Call(ctx context.Context, route handler.Route, request
 			break
 		}
 	}
+	return responseBytes, nil
+}
 
-	// unmarshal response
-	errResponse := json.Unmarshal(responseBytes, response)
-	if errResponse != nil {
-		// is it an error ?
-		var (
-			remoteErr        = responses.Error{}
-			remoteErrJSONErr = json.Unmarshal(responseBytes, &remoteErr)
-		)
-		if remoteErrJSONErr == nil {
-			returnConn(remoteErrJSONErr)
-			return remoteErr
+// v1Status returns the status of a v1 reply, which has no status of its own. Errors are recognized by their code.
+func v1Status(responseBytes []byte) uint16 {
+	if len(responseBytes) > maxErrorSize {
+		return http.StatusOK
+	}
+	var resp struct {
+		Reply struct {
+			Status int `json:"status"`
+			Code   int `json:"code"`
 		}
-		return fmt.Errorf("could not unmarshal response : %q %q", remoteErrJSONErr, string(responseBytes))
 	}
-	returnConn(nil)
-	return nil
+	if err := json.Unmarshal(responseBytes, &resp); err == nil && resp.Reply.Code != 0 && resp.Reply.Status >= http.StatusBadRequest {
+		return uint16(resp.Reply.Status) //nolint:gosec
+	}
+	return http.StatusOK
 }
 
-func (t *SocketTransport) Close() {
-	if t.connPool.chanDrainPool != nil {
-		t.connPool.chanDrainPool <- 1
+// decodeRemoteError returns the error reply of the server
+func decodeRemoteError(status uint16, responseBytes []byte) error {
+	var resp struct {
+		Reply *responses.Error
+	}
+	if err := json.Unmarshal(responseBytes, &resp); err != nil || resp.Reply == nil {
+		return fmt.Errorf("unexpected reply with status %d: %q", status, string(responseBytes))
+	}
+	resp.Reply.Status = int(status)
+	return *resp.Reply
+}
+
+func newProtocolConn(conn net.Conn) *protocolConn {
+	return &protocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
 	}
 }
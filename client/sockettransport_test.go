@@ -2,12 +2,29 @@ package client_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/foomo/contentserver/client"
 	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/socket"
+	"github.com/foomo/contentserver/pkg/utils"
+	"github.com/foomo/contentserver/responses"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -31,12 +48,17 @@ func newSocketClient(tb testing.TB, address string) *client.Client {
 
 func initSocketRepoServer(tb testing.TB, l *zap.Logger) net.Listener {
 	tb.Helper()
-	r := initRepo(tb, l)
-	h := handler.NewSocket(l, r)
-
 	// listen on socket
 	ln, err := nettest.NewLocalListener("tcp")
 	require.NoError(tb, err)
+	serveSocket(tb, l, ln)
+	return ln
+}
+
+func serveSocket(tb testing.TB, l *zap.Logger, ln net.Listener) {
+	tb.Helper()
+	r := initRepo(tb, l)
+	h := handler.NewSocket(l, r)
 
 	go func() {
 		for {
@@ -56,6 +78,245 @@ func initSocketRepoServer(tb testing.TB, l *zap.Logger) net.Listener {
 			}()
 		}
 	}()
+}
 
-	return ln
+func TestSocketTransportV2(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initSocketRepoServer(t, l)
+	defer s.Close()
+	transport := client.NewSocketTransport(s.Addr().String(), 2, 100*time.Millisecond,
+		client.SocketTransportWithProtocol(handler.ProtocolV2),
+		client.SocketTransportWithCompression(true),
+	)
+	c := client.New(transport)
+	defer c.Close()
+
+	// the repo is larger than the compression threshold
+	nodes, err := c.GetRepo(t.Context())
+	require.NoError(t, err)
+	require.NotEmpty(t, nodes)
+
+	// errors carry the status of the frame
+	var response any
+	err = transport.Call(t.Context(), handler.Route("unknown"), struct{}{}, &response)
+	var remoteErr responses.Error
+	require.ErrorAs(t, err, &remoteErr)
+	require.Equal(t, http.StatusNotFound, remoteErr.Status)
+
+	// the connection is still usable
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	require.True(t, status.Loaded)
+}
+
+func TestSocketTransportMultiplexing(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	s := initSocketRepoServer(t, l)
+	defer s.Close()
+	c := client.New(client.NewSocketTransport(s.Addr().String(), 1, 100*time.Millisecond,
+		client.SocketTransportWithMultiplexing(true),
+	))
+	defer c.Close()
+
+	// all requests share one connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+			defer cancel()
+			_, err := c.GetRepo(ctx)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// a canceled request does not break the connection
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err := c.GetRepo(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	require.True(t, status.Loaded)
+}
+
+func TestSocketTransportUnix(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	// unix socket paths are limited to ~100 bytes, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "cs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "contentserver.sock")
+	ln, err := net.Listen("unix", address)
+	require.NoError(t, err)
+	defer ln.Close()
+	serveSocket(t, l, ln)
+
+	c := client.New(client.NewSocketTransport("unix://"+address, 2, 100*time.Millisecond))
+	defer c.Close()
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	require.True(t, status.Loaded)
+}
+
+func TestSocketTransportMutualTLS(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	dir := t.TempDir()
+	caCert, caKey := newTestCertificate(t, nil, nil, dir, "ca")
+	newTestCertificate(t, caCert, caKey, dir, "server")
+	newTestCertificate(t, caCert, caKey, dir, "client")
+	caPool, err := utils.LoadCertPool(filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+
+	serverCert, err := utils.NewCertificateReloader(l, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	tcpLn, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	ln := tls.NewListener(tcpLn, &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: serverCert.GetCertificate,
+		ClientCAs:      caPool,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+	})
+	defer ln.Close()
+	serveSocket(t, l, ln)
+
+	clientCert, err := utils.NewCertificateReloader(l, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.NoError(t, err)
+	c := client.New(client.NewSocketTransport(ln.Addr().String(), 2, 100*time.Millisecond,
+		client.SocketTransportWithTLSConfig(&tls.Config{
+			MinVersion:           tls.VersionTLS12,
+			RootCAs:              caPool,
+			ServerName:           "localhost",
+			GetClientCertificate: clientCert.GetClientCertificate,
+		}),
+	))
+	defer c.Close()
+	status, err := c.Status(t.Context())
+	require.NoError(t, err)
+	require.True(t, status.Loaded)
+
+	// clients without a certificate are rejected
+	c = client.New(client.NewSocketTransport(ln.Addr().String(), 1, 100*time.Millisecond,
+		client.SocketTransportWithProtocol(handler.ProtocolV2),
+		client.SocketTransportWithTLSConfig(&tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    caPool,
+			ServerName: "localhost",
+		}),
+	))
+	defer c.Close()
+	_, err = c.Status(t.Context())
+	require.Error(t, err)
+}
+
+// newTestCertificate writes <name>.crt and <name>.key to dir, it is self signed without a parent
+func newTestCertificate(tb testing.TB, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, dir, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(tb, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(tb, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(tb, err)
+	require.NoError(tb, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(tb, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(tb, err)
+	return cert, key
+}
+
+func TestSocketServerLimits(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	r := initRepo(t, l)
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	s := socket.NewServer(l, "socket", ln,
+		handler.NewSocket(l, r,
+			handler.SocketWithMaxRequestSize(100),
+			handler.SocketWithIdleTimeout(100*time.Millisecond),
+		),
+		socket.ServerWithMaxConnections(1),
+	)
+	go s.Start(t.Context())    //nolint:errcheck
+	defer s.Close(t.Context()) //nolint:errcheck
+
+	// requests larger than the limit are rejected
+	c := client.New(client.NewSocketTransport(ln.Addr().String(), 1, time.Second,
+		client.SocketTransportWithProtocol(handler.ProtocolV2),
+	))
+	_, err = c.GetURIs(t.Context(), "dimension_foo", []string{strings.Repeat("id", 100)})
+	var remoteErr responses.Error
+	require.ErrorAs(t, err, &remoteErr)
+	require.Equal(t, http.StatusRequestEntityTooLarge, remoteErr.Status)
+	c.Close()
+
+	// the second connection is closed at once
+	time.Sleep(50 * time.Millisecond)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	_, err = rejected.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// idle connections are closed
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestSocketServerShutdown(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	r := initRepo(t, l)
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	s := socket.NewServer(l, "socket", ln, handler.NewSocket(l, r))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start(t.Context())
+	}()
+
+	c := client.New(client.NewSocketTransport(ln.Addr().String(), 1, time.Second))
+	defer c.Close()
+	_, err = c.Status(t.Context())
+	require.NoError(t, err)
+
+	// the idle pooled connection does not delay the shutdown
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, s.Close(ctx))
+	require.Less(t, time.Since(start), time.Second)
+	require.NoError(t, <-done)
+
+	_, err = c.Status(t.Context())
+	require.Error(t, err)
 }
@@ -2,11 +2,60 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"strconv"
+	"time"
 
+	"github.com/foomo/contentserver/pkg/auth"
 	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
 )
 
 type Transport interface {
 	Call(ctx context.Context, route handler.Route, request interface{}, response interface{}) error
 	Close()
 }
+
+// WatchTransport is implemented by transports which can stream repo changes
+type WatchTransport interface {
+	Watch(ctx context.Context) (<-chan *responses.Change, error)
+}
+
+// Credentials authenticate the requests of a transport with a bearer token, which may be a JWT,
+// or with an hmac signature of the key and secret
+type Credentials struct {
+	Token  string
+	Key    string
+	Secret string
+}
+
+// authenticate returns the credentials of a request with the method to the route with the body,
+// every signature has a new random nonce
+func (c *Credentials) authenticate(method string, route handler.Route, body []byte) *requests.Authenticate {
+	if c.Token != "" {
+		return &requests.Authenticate{Token: c.Token}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := rand.Text()
+	return &requests.Authenticate{
+		Key:       c.Key,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: auth.Sign([]byte(c.Secret), method, timestamp, nonce, string(route), body),
+	}
+}
+
+// headers returns the http headers or grpc metadata of the credentials
+func (c *Credentials) headers(method string, route handler.Route, body []byte) map[string]string {
+	a := c.authenticate(method, route, body)
+	if a.Token != "" {
+		return map[string]string{"Authorization": "Bearer " + a.Token}
+	}
+	return map[string]string{
+		auth.HeaderKey:       a.Key,
+		auth.HeaderTimestamp: a.Timestamp,
+		auth.HeaderNonce:     a.Nonce,
+		auth.HeaderSignature: a.Signature,
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/foomo/contentserver/pkg/cluster"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func addClusterFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addClusterNATSURLFlag(flags, v)
+	addClusterNATSSubjectFlag(flags, v)
+}
+
+// createCluster connects to the cluster pub sub or returns nil if clustering is disabled
+func createCluster(v *viper.Viper, l *zap.Logger) (cluster.PubSub, error) {
+	url := clusterNATSURLFlag(v)
+	if url == "" {
+		return nil, nil //nolint:nilnil
+	}
+	if storageTypeFlag(v) != "blob" {
+		l.Warn("cluster mode expects a storage shared by all replicas, consider using storage-type 'blob'")
+	}
+	l.Info("sharing updates with the cluster", zap.String("subject", clusterNATSSubjectFlag(v)))
+	return cluster.NewNATS(l, url, clusterNATSSubjectFlag(v))
+}
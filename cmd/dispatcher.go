@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+func addDispatcherFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addRateLimitFlag(flags, v)
+	addRateLimitBurstFlag(flags, v)
+	addAuthTokensFileFlag(flags, v)
+	addAuthHMACKeysFileFlag(flags, v)
+	addAuthJWKSFileFlag(flags, v)
+	addAuthJWTIssuerFlag(flags, v)
+	addAuthJWTAudienceFlag(flags, v)
+	addAuthJWTPermissionsClaimFlag(flags, v)
+	addAuthJWTGroupsClaimFlag(flags, v)
+	addAuthAnonymousPermissionsFlag(flags, v)
+	addAuthRoutePermissionsFlag(flags, v)
+	addAuthGroupsFromClaimsFlag(flags, v)
+}
+
+// createDispatcher returns the dispatcher shared by all transports of the command
+func createDispatcher(v *viper.Viper, l *zap.Logger, r *repo.Repo) (*handler.Dispatcher, error) {
+	// spans are outermost so they cover the log lines, requests are authenticated before they count against the
+	// rate limit and validated last
+	var middlewares []handler.Middleware
+	if otelEnabledFlag(v) {
+		middlewares = append(middlewares, handler.MiddlewareTracing())
+	}
+	middlewares = append(middlewares, handler.MiddlewareLogger(l.Named("inst.dispatcher")))
+	authenticator, err := createAuthenticator(v)
+	if err != nil {
+		return nil, err
+	}
+	if authenticator != nil {
+		permissions := map[handler.Route]string{}
+		for route, permission := range authRoutePermissionsFlag(v) {
+			permissions[handler.Route(route)] = permission
+		}
+		middlewares = append(middlewares, handler.MiddlewareAuth(l.Named("inst.dispatcher"), authenticator,
+			handler.AuthWithPermissions(permissions),
+			handler.AuthWithAnonymousPermissions(authAnonymousPermissionsFlag(v)...),
+			handler.AuthWithGroupsFromClaims(authGroupsFromClaimsFlag(v)),
+		))
+	}
+	if limit := rateLimitFlag(v); limit > 0 {
+		middlewares = append(middlewares, handler.MiddlewareRateLimit(rate.NewLimiter(rate.Limit(limit), rateLimitBurstFlag(v))))
+	}
+	middlewares = append(middlewares, handler.MiddlewareValidate())
+	return handler.NewDispatcher(l.Named("inst.handler"), r, handler.DispatcherWithMiddlewares(middlewares...)), nil
+}
+
+// createAuthenticator returns nil if no credentials are configured, all requests are allowed then
+func createAuthenticator(v *viper.Viper) (auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	if filename := authTokensFileFlag(v); filename != "" {
+		identities, err := auth.LoadIdentities(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tokens: %w", err)
+		}
+		authenticators = append(authenticators, auth.NewBearer(identities))
+	}
+	if filename := authHMACKeysFileFlag(v); filename != "" {
+		identities, err := auth.LoadIdentities(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hmac keys: %w", err)
+		}
+		authenticators = append(authenticators, auth.NewHMAC(identities))
+	}
+	if filename := authJWKSFileFlag(v); filename != "" {
+		keys, err := auth.LoadJWKS(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jwks: %w", err)
+		}
+		authenticators = append(authenticators, auth.NewJWT(keys,
+			auth.JWTWithIssuer(authJWTIssuerFlag(v)),
+			auth.JWTWithAudience(authJWTAudienceFlag(v)),
+			auth.JWTWithPermissionsClaim(authJWTPermissionsClaimFlag(v)),
+			auth.JWTWithGroupsClaim(authJWTGroupsClaimFlag(v)),
+		))
+	}
+	if len(authenticators) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+	return auth.Chain(authenticators...), nil
+}
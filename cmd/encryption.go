@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func addStorageEncryptionFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addStorageEncryptionKeysFlag(flags, v)
+	addStorageEncryptionKeyFileFlag(flags, v)
+	addStorageEncryptionAllowPlaintextFlag(flags, v)
+}
+
+// createEncryptedStorage wraps the storage if encryption keys are configured
+func createEncryptedStorage(v *viper.Viper, l *zap.Logger, storage repo.Storage) (repo.Storage, error) {
+	keys, err := encryptionKeys(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return storage, nil
+	}
+	l.Info("encrypting storage", zap.Int("keys", len(keys)))
+	return repo.NewEncryptedStorage(storage, keys,
+		repo.EncryptedStorageWithPlaintext(storageEncryptionAllowPlaintextFlag(v)),
+	)
+}
+
+// encryptionKeys returns the keys of the flag followed by the keys of the key file
+func encryptionKeys(v *viper.Viper) ([][]byte, error) {
+	values := storageEncryptionKeysFlag(v)
+	if filename := storageEncryptionKeyFileFlag(v); filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				values = append(values, line)
+			}
+		}
+	}
+	keys := make([][]byte, 0, len(values))
+	for i, value := range values {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption key %d: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -4,6 +4,7 @@ import (
 	"compress/gzip"
 	"time"
 
+	"github.com/foomo/contentserver/pkg/handler"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -48,6 +49,26 @@ func addBasePathFlag(flags *pflag.FlagSet, v *viper.Viper) {
 	_ = v.BindEnv("base_path", "CONTENT_SERVER_BASE_PATH")
 }
 
+func cacheControlFlag(v *viper.Viper) string {
+	return v.GetString("cache_control")
+}
+
+func addCacheControlFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("cache-control", handler.DefaultCacheControl, "Cache-Control header of the GET routes")
+	_ = v.BindPFlag("cache_control", flags.Lookup("cache-control"))
+	_ = v.BindEnv("cache_control", "CONTENT_SERVER_CACHE_CONTROL")
+}
+
+func maxRequestSizeFlag(v *viper.Viper) int {
+	return v.GetInt("max_request_size")
+}
+
+func addMaxRequestSizeFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("max-request-size", handler.DefaultMaxRequestSize, "Maximum size of an http request body in bytes")
+	_ = v.BindPFlag("max_request_size", flags.Lookup("max-request-size"))
+	_ = v.BindEnv("max_request_size", "CONTENT_SERVER_MAX_REQUEST_SIZE")
+}
+
 func pollFlag(v *viper.Viper) bool {
 	return v.GetBool("poll.enabled")
 }
@@ -140,7 +161,7 @@ func storageTypeFlag(v *viper.Viper) string {
 }
 
 func addStorageTypeFlag(flags *pflag.FlagSet, v *viper.Viper) {
-	flags.String("storage-type", "filesystem", "Storage backend type: filesystem or blob")
+	flags.String("storage-type", "filesystem", "Storage backend type: filesystem, bolt or blob")
 	_ = v.BindPFlag("storage.type", flags.Lookup("storage-type"))
 	_ = v.BindEnv("storage.type", "CONTENT_SERVER_STORAGE_TYPE")
 }
@@ -184,3 +205,496 @@ func addGzipLevelFlag(flags *pflag.FlagSet, v *viper.Viper) {
 	_ = v.BindPFlag("gzip.level", flags.Lookup("gzip-level"))
 	_ = v.BindEnv("gzip.level", "CONTENT_SERVER_GZIP_LEVEL")
 }
+
+func webhookURLsFlag(v *viper.Viper) []string {
+	return v.GetStringSlice("webhook.urls")
+}
+
+func addWebhookURLsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringSlice("webhook-url", nil, "URLs to notify after each repo update (repeatable)")
+	_ = v.BindPFlag("webhook.urls", flags.Lookup("webhook-url"))
+	_ = v.BindEnv("webhook.urls", "CONTENT_SERVER_WEBHOOK_URLS")
+}
+
+func webhookSecretFlag(v *viper.Viper) string {
+	return v.GetString("webhook.secret")
+}
+
+func addWebhookSecretFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("webhook-secret", "", "Secret to sign webhook notifications with (HMAC-SHA256)")
+	_ = v.BindPFlag("webhook.secret", flags.Lookup("webhook-secret"))
+	_ = v.BindEnv("webhook.secret", "CONTENT_SERVER_WEBHOOK_SECRET")
+}
+
+func webhookMaxAttemptsFlag(v *viper.Viper) int {
+	return v.GetInt("webhook.max_attempts")
+}
+
+func addWebhookMaxAttemptsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("webhook-max-attempts", 5, "Number of attempts to deliver a webhook notification")
+	_ = v.BindPFlag("webhook.max_attempts", flags.Lookup("webhook-max-attempts"))
+	_ = v.BindEnv("webhook.max_attempts", "CONTENT_SERVER_WEBHOOK_MAX_ATTEMPTS")
+}
+
+func webhookTimeoutFlag(v *viper.Viper) time.Duration {
+	return v.GetDuration("webhook.timeout")
+}
+
+func addWebhookTimeoutFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Duration("webhook-timeout", 10*time.Second, "HTTP client timeout for a single webhook delivery")
+	_ = v.BindPFlag("webhook.timeout", flags.Lookup("webhook-timeout"))
+	_ = v.BindEnv("webhook.timeout", "CONTENT_SERVER_WEBHOOK_TIMEOUT")
+}
+
+func webhookAllReplicasFlag(v *viper.Viper) bool {
+	return v.GetBool("webhook.all_replicas")
+}
+
+func addWebhookAllReplicasFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("webhook-all-replicas", false, "Notify the webhooks from every replica instead of the leader only")
+	_ = v.BindPFlag("webhook.all_replicas", flags.Lookup("webhook-all-replicas"))
+	_ = v.BindEnv("webhook.all_replicas", "CONTENT_SERVER_WEBHOOK_ALL_REPLICAS")
+}
+
+func clusterNATSURLFlag(v *viper.Viper) string {
+	return v.GetString("cluster.nats.url")
+}
+
+func addClusterNATSURLFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("cluster-nats-url", "", "NATS url to share updates with the other replicas, requires a shared storage")
+	_ = v.BindPFlag("cluster.nats.url", flags.Lookup("cluster-nats-url"))
+	_ = v.BindEnv("cluster.nats.url", "CONTENT_SERVER_CLUSTER_NATS_URL")
+}
+
+func clusterNATSSubjectFlag(v *viper.Viper) string {
+	return v.GetString("cluster.nats.subject")
+}
+
+func addClusterNATSSubjectFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("cluster-nats-subject", "contentserver.updates", "NATS subject to share updates on")
+	_ = v.BindPFlag("cluster.nats.subject", flags.Lookup("cluster-nats-subject"))
+	_ = v.BindEnv("cluster.nats.subject", "CONTENT_SERVER_CLUSTER_NATS_SUBJECT")
+}
+
+func leaderElectionFlag(v *viper.Viper) bool {
+	return v.GetBool("leader_election.enabled")
+}
+
+func addLeaderElectionFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("leader-election", false, "If true, only the replica holding the lease in the storage polls and writes the history")
+	_ = v.BindPFlag("leader_election.enabled", flags.Lookup("leader-election"))
+	_ = v.BindEnv("leader_election.enabled", "CONTENT_SERVER_LEADER_ELECTION")
+}
+
+func leaderElectionTTLFlag(v *viper.Viper) time.Duration {
+	return v.GetDuration("leader_election.ttl")
+}
+
+func addLeaderElectionTTLFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Duration("leader-election-ttl", 30*time.Second, "Time after which the lease of a leader that stopped renewing it expires")
+	_ = v.BindPFlag("leader_election.ttl", flags.Lookup("leader-election-ttl"))
+	_ = v.BindEnv("leader_election.ttl", "CONTENT_SERVER_LEADER_ELECTION_TTL")
+}
+
+func followStorageFlag(v *viper.Viper) bool {
+	return v.GetBool("follow_storage")
+}
+
+func addFollowStorageFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("follow-storage", false, "If true, the repository url is never contacted and the current snapshot is loaded from the storage every poll interval")
+	_ = v.BindPFlag("follow_storage", flags.Lookup("follow-storage"))
+	_ = v.BindEnv("follow_storage", "CONTENT_SERVER_FOLLOW_STORAGE")
+}
+
+func historyKeepWithinFlag(v *viper.Viper) time.Duration {
+	return v.GetDuration("history.keep_within")
+}
+
+func addHistoryKeepWithinFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Duration("history-keep-within", 0, "Keep all history records added within this duration (e.g. 168h)")
+	_ = v.BindPFlag("history.keep_within", flags.Lookup("history-keep-within"))
+	_ = v.BindEnv("history.keep_within", "CONTENT_SERVER_HISTORY_KEEP_WITHIN")
+}
+
+func historyKeepDailyFlag(v *viper.Viper) int {
+	return v.GetInt("history.keep_daily")
+}
+
+func addHistoryKeepDailyFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("history-keep-daily", 0, "Keep the newest history record of each of the last n days")
+	_ = v.BindPFlag("history.keep_daily", flags.Lookup("history-keep-daily"))
+	_ = v.BindEnv("history.keep_daily", "CONTENT_SERVER_HISTORY_KEEP_DAILY")
+}
+
+func historyMaxBytesFlag(v *viper.Viper) int64 {
+	return v.GetInt64("history.max_bytes")
+}
+
+func addHistoryMaxBytesFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int64("history-max-bytes", 0, "Remove the oldest history records until the history is smaller (0=unlimited)")
+	_ = v.BindPFlag("history.max_bytes", flags.Lookup("history-max-bytes"))
+	_ = v.BindEnv("history.max_bytes", "CONTENT_SERVER_HISTORY_MAX_BYTES")
+}
+
+func historyPinFlag(v *viper.Viper) []string {
+	return v.GetStringSlice("history.pin")
+}
+
+func addHistoryPinFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringSlice("history-pin", nil, "Keys or hash prefixes of history records which are never removed (repeatable)")
+	_ = v.BindPFlag("history.pin", flags.Lookup("history-pin"))
+	_ = v.BindEnv("history.pin", "CONTENT_SERVER_HISTORY_PIN")
+}
+
+func historyLegacyCurrentFlag(v *viper.Viper) bool {
+	return v.GetBool("history.legacy_current")
+}
+
+func addHistoryLegacyCurrentFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("history-legacy-current", true, "Keep writing contentserver-repo-current.json, so older releases can restore the current snapshot after a rollback")
+	_ = v.BindPFlag("history.legacy_current", flags.Lookup("history-legacy-current"))
+	_ = v.BindEnv("history.legacy_current", "CONTENT_SERVER_HISTORY_LEGACY_CURRENT")
+}
+
+func outputFlag(v *viper.Viper) string {
+	return v.GetString("output")
+}
+
+func addOutputFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringP("output", "o", "table", "Output format: table or json")
+	_ = v.BindPFlag("output", flags.Lookup("output"))
+}
+
+func storageBoltPathFlag(v *viper.Viper) string {
+	return v.GetString("storage.bolt.path")
+}
+
+func addStorageBoltPathFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("storage-bolt-path", "", "Bolt database file (default <history-dir>/contentserver.db)")
+	_ = v.BindPFlag("storage.bolt.path", flags.Lookup("storage-bolt-path"))
+	_ = v.BindEnv("storage.bolt.path", "CONTENT_SERVER_STORAGE_BOLT_PATH")
+}
+
+func storageFSSyncFlag(v *viper.Viper) bool {
+	return v.GetBool("storage.fs.sync")
+}
+
+func storageFSChecksumsFlag(v *viper.Viper) bool {
+	return v.GetBool("storage.fs.checksums")
+}
+
+func addStorageFSFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("storage-fs-sync", true, "Flush filesystem storage writes to disk before they complete")
+	_ = v.BindPFlag("storage.fs.sync", flags.Lookup("storage-fs-sync"))
+	_ = v.BindEnv("storage.fs.sync", "CONTENT_SERVER_STORAGE_FS_SYNC")
+	flags.Bool("storage-fs-checksums", false, "Store and verify a checksum in the first line of every file of the filesystem storage, older versions can not read them")
+	_ = v.BindPFlag("storage.fs.checksums", flags.Lookup("storage-fs-checksums"))
+	_ = v.BindEnv("storage.fs.checksums", "CONTENT_SERVER_STORAGE_FS_CHECKSUMS")
+}
+
+func storageEncryptionKeysFlag(v *viper.Viper) []string {
+	return v.GetStringSlice("storage.encryption.keys")
+}
+
+func addStorageEncryptionKeysFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringSlice("storage-encryption-key", nil, "Base64 encoded AES key encrypting the storage, the first key encrypts and all keys decrypt (repeatable)")
+	_ = v.BindPFlag("storage.encryption.keys", flags.Lookup("storage-encryption-key"))
+	_ = v.BindEnv("storage.encryption.keys", "CONTENT_SERVER_STORAGE_ENCRYPTION_KEYS")
+}
+
+func storageEncryptionKeyFileFlag(v *viper.Viper) string {
+	return v.GetString("storage.encryption.keyfile")
+}
+
+func addStorageEncryptionKeyFileFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("storage-encryption-key-file", "", "File with one base64 encoded AES key per line, the first key encrypts and all keys decrypt")
+	_ = v.BindPFlag("storage.encryption.keyfile", flags.Lookup("storage-encryption-key-file"))
+	_ = v.BindEnv("storage.encryption.keyfile", "CONTENT_SERVER_STORAGE_ENCRYPTION_KEY_FILE")
+}
+
+func storageEncryptionAllowPlaintextFlag(v *viper.Viper) bool {
+	return v.GetBool("storage.encryption.allowplaintext")
+}
+
+func addStorageEncryptionAllowPlaintextFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("storage-encryption-allow-plaintext", false, "Read unencrypted data written before encryption was enabled")
+	_ = v.BindPFlag("storage.encryption.allowplaintext", flags.Lookup("storage-encryption-allow-plaintext"))
+	_ = v.BindEnv("storage.encryption.allowplaintext", "CONTENT_SERVER_STORAGE_ENCRYPTION_ALLOW_PLAINTEXT")
+}
+
+func storageRetryMaxAttemptsFlag(v *viper.Viper) int {
+	return v.GetInt("storage.retry.maxattempts")
+}
+
+func addStorageRetryMaxAttemptsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("storage-retry-max-attempts", 5, "How often storage operations failing with a transient error are attempted")
+	_ = v.BindPFlag("storage.retry.maxattempts", flags.Lookup("storage-retry-max-attempts"))
+	_ = v.BindEnv("storage.retry.maxattempts", "CONTENT_SERVER_STORAGE_RETRY_MAX_ATTEMPTS")
+}
+
+func storageCacheDirFlag(v *viper.Viper) string {
+	return v.GetString("storage.cache.dir")
+}
+
+func addStorageCacheDirFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("storage-cache-dir", "", "Local directory caching the snapshots read from the storage, e.g. to restore blob storage quickly")
+	_ = v.BindPFlag("storage.cache.dir", flags.Lookup("storage-cache-dir"))
+	_ = v.BindEnv("storage.cache.dir", "CONTENT_SERVER_STORAGE_CACHE_DIR")
+}
+
+func socketMaxConcurrentRequestsFlag(v *viper.Viper) int {
+	return v.GetInt("socket.maxconcurrentrequests")
+}
+
+func addSocketMaxConcurrentRequestsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("socket-max-concurrent-requests", 64, "Maximum number of requests processed concurrently per multiplexed socket connection")
+	_ = v.BindPFlag("socket.maxconcurrentrequests", flags.Lookup("socket-max-concurrent-requests"))
+	_ = v.BindEnv("socket.maxconcurrentrequests", "CONTENT_SERVER_SOCKET_MAX_CONCURRENT_REQUESTS")
+}
+
+func socketUnixPermissionsFlag(v *viper.Viper) string {
+	return v.GetString("socket.unix.permissions")
+}
+
+func addSocketUnixPermissionsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("socket-unix-permissions", "0660", "Octal file permissions of a unix:// socket address")
+	_ = v.BindPFlag("socket.unix.permissions", flags.Lookup("socket-unix-permissions"))
+	_ = v.BindEnv("socket.unix.permissions", "CONTENT_SERVER_SOCKET_UNIX_PERMISSIONS")
+}
+
+func socketTLSCertFlag(v *viper.Viper) string {
+	return v.GetString("socket.tls.cert")
+}
+
+func addSocketTLSCertFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("socket-tls-cert", "", "PEM certificate file enabling TLS, it is reloaded when it changes")
+	_ = v.BindPFlag("socket.tls.cert", flags.Lookup("socket-tls-cert"))
+	_ = v.BindEnv("socket.tls.cert", "CONTENT_SERVER_SOCKET_TLS_CERT")
+}
+
+func socketTLSKeyFlag(v *viper.Viper) string {
+	return v.GetString("socket.tls.key")
+}
+
+func addSocketTLSKeyFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("socket-tls-key", "", "PEM private key file of the TLS certificate")
+	_ = v.BindPFlag("socket.tls.key", flags.Lookup("socket-tls-key"))
+	_ = v.BindEnv("socket.tls.key", "CONTENT_SERVER_SOCKET_TLS_KEY")
+}
+
+func socketTLSClientCAFlag(v *viper.Viper) string {
+	return v.GetString("socket.tls.clientca")
+}
+
+func addSocketTLSClientCAFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("socket-tls-client-ca", "", "PEM CA file, clients must present a certificate signed by it (mutual TLS)")
+	_ = v.BindPFlag("socket.tls.clientca", flags.Lookup("socket-tls-client-ca"))
+	_ = v.BindEnv("socket.tls.clientca", "CONTENT_SERVER_SOCKET_TLS_CLIENT_CA")
+}
+
+func addSocketLimitFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addSocketIdleTimeoutFlag(flags, v)
+	addSocketReadTimeoutFlag(flags, v)
+	addSocketMaxRequestSizeFlag(flags, v)
+	addSocketMaxConnectionsFlag(flags, v)
+}
+
+func socketIdleTimeoutFlag(v *viper.Viper) time.Duration {
+	return v.GetDuration("socket.idletimeout")
+}
+
+func addSocketIdleTimeoutFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Duration("socket-idle-timeout", 0, "Close socket connections without a request for this duration, 0 keeps them open")
+	_ = v.BindPFlag("socket.idletimeout", flags.Lookup("socket-idle-timeout"))
+	_ = v.BindEnv("socket.idletimeout", "CONTENT_SERVER_SOCKET_IDLE_TIMEOUT")
+}
+
+func socketReadTimeoutFlag(v *viper.Viper) time.Duration {
+	return v.GetDuration("socket.readtimeout")
+}
+
+func addSocketReadTimeoutFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Duration("socket-read-timeout", 30*time.Second, "Maximum duration to read a started request, 0 disables the timeout")
+	_ = v.BindPFlag("socket.readtimeout", flags.Lookup("socket-read-timeout"))
+	_ = v.BindEnv("socket.readtimeout", "CONTENT_SERVER_SOCKET_READ_TIMEOUT")
+}
+
+func socketMaxRequestSizeFlag(v *viper.Viper) int {
+	return v.GetInt("socket.maxrequestsize")
+}
+
+func addSocketMaxRequestSizeFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("socket-max-request-size", handler.DefaultMaxRequestSize, "Maximum size of a socket request in bytes")
+	_ = v.BindPFlag("socket.maxrequestsize", flags.Lookup("socket-max-request-size"))
+	_ = v.BindEnv("socket.maxrequestsize", "CONTENT_SERVER_SOCKET_MAX_REQUEST_SIZE")
+}
+
+func socketMaxConnectionsFlag(v *viper.Viper) int {
+	return v.GetInt("socket.maxconnections")
+}
+
+func addSocketMaxConnectionsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("socket-max-connections", 0, "Maximum number of open socket connections, 0 is unlimited")
+	_ = v.BindPFlag("socket.maxconnections", flags.Lookup("socket-max-connections"))
+	_ = v.BindEnv("socket.maxconnections", "CONTENT_SERVER_SOCKET_MAX_CONNECTIONS")
+}
+
+func grpcAddressFlag(v *viper.Viper) string {
+	return v.GetString("grpc.address")
+}
+
+func addGRPCAddressFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("grpc-address", "", "Address of the grpc server (host:port or unix://), empty disables it")
+	_ = v.BindPFlag("grpc.address", flags.Lookup("grpc-address"))
+	_ = v.BindEnv("grpc.address", "CONTENT_SERVER_GRPC_ADDRESS")
+}
+
+func grpcTLSCertFlag(v *viper.Viper) string {
+	return v.GetString("grpc.tls.cert")
+}
+
+func addGRPCTLSCertFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("grpc-tls-cert", "", "PEM certificate file enabling TLS for grpc, it is reloaded when it changes")
+	_ = v.BindPFlag("grpc.tls.cert", flags.Lookup("grpc-tls-cert"))
+	_ = v.BindEnv("grpc.tls.cert", "CONTENT_SERVER_GRPC_TLS_CERT")
+}
+
+func grpcTLSKeyFlag(v *viper.Viper) string {
+	return v.GetString("grpc.tls.key")
+}
+
+func addGRPCTLSKeyFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("grpc-tls-key", "", "PEM private key file of the grpc TLS certificate")
+	_ = v.BindPFlag("grpc.tls.key", flags.Lookup("grpc-tls-key"))
+	_ = v.BindEnv("grpc.tls.key", "CONTENT_SERVER_GRPC_TLS_KEY")
+}
+
+func grpcTLSClientCAFlag(v *viper.Viper) string {
+	return v.GetString("grpc.tls.clientca")
+}
+
+func addGRPCTLSClientCAFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("grpc-tls-client-ca", "", "PEM CA file, grpc clients must present a certificate signed by it (mutual TLS)")
+	_ = v.BindPFlag("grpc.tls.clientca", flags.Lookup("grpc-tls-client-ca"))
+	_ = v.BindEnv("grpc.tls.clientca", "CONTENT_SERVER_GRPC_TLS_CLIENT_CA")
+}
+
+func rateLimitFlag(v *viper.Viper) float64 {
+	return v.GetFloat64("rate_limit.requests")
+}
+
+func addRateLimitFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Float64("rate-limit", 0, "Maximum requests per second of all clients, 0 disables the limit")
+	_ = v.BindPFlag("rate_limit.requests", flags.Lookup("rate-limit"))
+	_ = v.BindEnv("rate_limit.requests", "CONTENT_SERVER_RATE_LIMIT")
+}
+
+func rateLimitBurstFlag(v *viper.Viper) int {
+	return v.GetInt("rate_limit.burst")
+}
+
+func addRateLimitBurstFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Int("rate-limit-burst", 100, "Requests exceeding the rate limit at once")
+	_ = v.BindPFlag("rate_limit.burst", flags.Lookup("rate-limit-burst"))
+	_ = v.BindEnv("rate_limit.burst", "CONTENT_SERVER_RATE_LIMIT_BURST")
+}
+
+func authTokensFileFlag(v *viper.Viper) string {
+	return v.GetString("auth.tokens_file")
+}
+
+func addAuthTokensFileFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-tokens-file", "", "JSON file with the static bearer tokens of the clients, see auth.Identity")
+	_ = v.BindPFlag("auth.tokens_file", flags.Lookup("auth-tokens-file"))
+	_ = v.BindEnv("auth.tokens_file", "CONTENT_SERVER_AUTH_TOKENS_FILE")
+}
+
+func authHMACKeysFileFlag(v *viper.Viper) string {
+	return v.GetString("auth.hmac_keys_file")
+}
+
+func addAuthHMACKeysFileFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-hmac-keys-file", "", "JSON file with the hmac keys of the clients, the subjects are the key ids")
+	_ = v.BindPFlag("auth.hmac_keys_file", flags.Lookup("auth-hmac-keys-file"))
+	_ = v.BindEnv("auth.hmac_keys_file", "CONTENT_SERVER_AUTH_HMAC_KEYS_FILE")
+}
+
+func authJWKSFileFlag(v *viper.Viper) string {
+	return v.GetString("auth.jwks_file")
+}
+
+func addAuthJWKSFileFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-jwks-file", "", "JSON web key set file with the keys verifying JWT bearer tokens")
+	_ = v.BindPFlag("auth.jwks_file", flags.Lookup("auth-jwks-file"))
+	_ = v.BindEnv("auth.jwks_file", "CONTENT_SERVER_AUTH_JWKS_FILE")
+}
+
+func authJWTIssuerFlag(v *viper.Viper) string {
+	return v.GetString("auth.jwt.issuer")
+}
+
+func addAuthJWTIssuerFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-jwt-issuer", "", "Required iss claim of JWTs")
+	_ = v.BindPFlag("auth.jwt.issuer", flags.Lookup("auth-jwt-issuer"))
+	_ = v.BindEnv("auth.jwt.issuer", "CONTENT_SERVER_AUTH_JWT_ISSUER")
+}
+
+func authJWTAudienceFlag(v *viper.Viper) string {
+	return v.GetString("auth.jwt.audience")
+}
+
+func addAuthJWTAudienceFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-jwt-audience", "", "Required audience of JWTs")
+	_ = v.BindPFlag("auth.jwt.audience", flags.Lookup("auth-jwt-audience"))
+	_ = v.BindEnv("auth.jwt.audience", "CONTENT_SERVER_AUTH_JWT_AUDIENCE")
+}
+
+func authJWTPermissionsClaimFlag(v *viper.Viper) string {
+	return v.GetString("auth.jwt.permissions_claim")
+}
+
+func addAuthJWTPermissionsClaimFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-jwt-permissions-claim", "scope", "JWT claim with the permissions, a list or a space separated string")
+	_ = v.BindPFlag("auth.jwt.permissions_claim", flags.Lookup("auth-jwt-permissions-claim"))
+	_ = v.BindEnv("auth.jwt.permissions_claim", "CONTENT_SERVER_AUTH_JWT_PERMISSIONS_CLAIM")
+}
+
+func authJWTGroupsClaimFlag(v *viper.Viper) string {
+	return v.GetString("auth.jwt.groups_claim")
+}
+
+func addAuthJWTGroupsClaimFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.String("auth-jwt-groups-claim", "groups", "JWT claim with the groups, a list or a space separated string")
+	_ = v.BindPFlag("auth.jwt.groups_claim", flags.Lookup("auth-jwt-groups-claim"))
+	_ = v.BindEnv("auth.jwt.groups_claim", "CONTENT_SERVER_AUTH_JWT_GROUPS_CLAIM")
+}
+
+func authAnonymousPermissionsFlag(v *viper.Viper) []string {
+	return v.GetStringSlice("auth.anonymous_permissions")
+}
+
+func addAuthAnonymousPermissionsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringSlice("auth-anonymous-permissions", nil, "Permissions of requests without credentials, e.g. read (repeatable)")
+	_ = v.BindPFlag("auth.anonymous_permissions", flags.Lookup("auth-anonymous-permissions"))
+	_ = v.BindEnv("auth.anonymous_permissions", "CONTENT_SERVER_AUTH_ANONYMOUS_PERMISSIONS")
+}
+
+func authRoutePermissionsFlag(v *viper.Viper) map[string]string {
+	return v.GetStringMapString("auth.route_permissions")
+}
+
+func addAuthRoutePermissionsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.StringToString("auth-route-permission", nil, "Permission required by a route, e.g. status=read, an empty permission opens the route (repeatable)")
+	_ = v.BindPFlag("auth.route_permissions", flags.Lookup("auth-route-permission"))
+	_ = v.BindEnv("auth.route_permissions", "CONTENT_SERVER_AUTH_ROUTE_PERMISSIONS")
+}
+
+func authGroupsFromClaimsFlag(v *viper.Viper) bool {
+	return v.GetBool("auth.groups_from_claims")
+}
+
+func addAuthGroupsFromClaimsFlag(flags *pflag.FlagSet, v *viper.Viper) {
+	flags.Bool("auth-groups-from-claims", false, "Replace the groups of requests by the groups of the authenticated client")
+	_ = v.BindPFlag("auth.groups_from_claims", flags.Lookup("auth-groups-from-claims"))
+	_ = v.BindEnv("auth.groups_from_claims", "CONTENT_SERVER_AUTH_GROUPS_FROM_CLAIMS")
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/pkg/utils"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// grpcService serves the grpc handler as keel service
+type grpcService struct {
+	l      *zap.Logger
+	ln     net.Listener
+	server *grpc.Server
+}
+
+func addGRPCFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addGRPCAddressFlag(flags, v)
+	addGRPCTLSCertFlag(flags, v)
+	addGRPCTLSKeyFlag(flags, v)
+	addGRPCTLSClientCAFlag(flags, v)
+}
+
+// createGRPCService returns nil if no grpc address is configured
+func createGRPCService(ctx context.Context, v *viper.Viper, l *zap.Logger, r *repo.Repo, dispatcher *handler.Dispatcher) (*grpcService, error) {
+	address := grpcAddressFlag(v)
+	if address == "" {
+		return nil, nil //nolint:nilnil
+	}
+	tlsConfig, err := createTLSConfig(l, grpcTLSCertFlag(v), grpcTLSKeyFlag(v), grpcTLSClientCAFlag(v))
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(handler.GRPCCodec{})}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	network, addr := utils.NetworkAddress(address)
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(opts...)
+	handler.NewGRPC(l.Named("inst.handler"), r, handler.GRPCWithDispatcher(dispatcher)).Register(server)
+	return &grpcService{
+		l:      l,
+		ln:     ln,
+		server: server,
+	}, nil
+}
+
+func (s *grpcService) Name() string {
+	return "grpc"
+}
+
+func (s *grpcService) Start(ctx context.Context) error {
+	s.l.Info("starting grpc server", zap.String("address", s.ln.Addr().String()))
+	if err := s.server.Serve(s.ln); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("failed to serve grpc: %w", err)
+	}
+	return nil
+}
+
+// Close waits for running calls until the context is done, watch streams are ended then
+func (s *grpcService) Close(ctx context.Context) error {
+	s.l.Info("stopping grpc server")
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
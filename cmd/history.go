@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/keel/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func NewHistoryCommand() *cobra.Command {
+	v := newViper()
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the snapshots in the history",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.Logger()
+
+			storage, err := createStorage(cmd.Context(), v, l)
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+
+			history, err := repo.NewHistory(l, repo.HistoryWithStorage(storage))
+			if err != nil {
+				return fmt.Errorf("failed to create history: %w", err)
+			}
+			defer func() {
+				if closeErr := history.Close(); closeErr != nil {
+					l.Error("failed to close history storage", zap.Error(closeErr))
+				}
+			}()
+
+			snapshots, err := history.List(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to list history: %w", err)
+			}
+
+			switch outputFlag(v) {
+			case "json":
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(snapshots)
+			case "table", "":
+				return writeHistoryTable(cmd.OutOrStdout(), snapshots)
+			default:
+				return fmt.Errorf("unknown output format: %s (supported: table, json)", outputFlag(v))
+			}
+		},
+	}
+
+	flags := cmd.Flags()
+	addHistoryStorageFlags(flags, v)
+	addOutputFlag(flags, v)
+
+	cmd.AddCommand(NewHistoryRemoveLegacyCurrentCommand())
+
+	return cmd
+}
+
+func NewHistoryRemoveLegacyCurrentCommand() *cobra.Command {
+	v := newViper()
+	cmd := &cobra.Command{
+		Use:   "remove-legacy-current",
+		Short: "Remove contentserver-repo-current.json once no older release will be rolled back to",
+		Long: "Remove the legacy copy of the current snapshot, which releases before the history manifest restore on startup.\n" +
+			"Run the servers with --history-legacy-current=false afterwards, otherwise they write it again.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l := log.Logger()
+
+			storage, err := createStorage(cmd.Context(), v, l)
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+
+			history, err := repo.NewHistory(l, repo.HistoryWithStorage(storage))
+			if err != nil {
+				return fmt.Errorf("failed to create history: %w", err)
+			}
+			defer func() {
+				if closeErr := history.Close(); closeErr != nil {
+					l.Error("failed to close history storage", zap.Error(closeErr))
+				}
+			}()
+
+			if err := history.RemoveLegacyCurrent(cmd.Context()); err != nil {
+				return fmt.Errorf("failed to remove legacy current snapshot: %w", err)
+			}
+			return nil
+		},
+	}
+
+	addHistoryStorageFlags(cmd.Flags(), v)
+
+	return cmd
+}
+
+// addHistoryStorageFlags adds the flags of the storage the history commands read
+func addHistoryStorageFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addHistoryDirFlag(flags, v)
+	addStorageTypeFlag(flags, v)
+	addStorageBlobBucketFlag(flags, v)
+	addStorageBlobPrefixFlag(flags, v)
+	addStorageBoltPathFlag(flags, v)
+	addStorageFSFlags(flags, v)
+	addStorageEncryptionFlags(flags, v)
+	addStorageRetryMaxAttemptsFlag(flags, v)
+	addStorageCacheDirFlag(flags, v)
+}
+
+func writeHistoryTable(w io.Writer, snapshots []*repo.SnapshotMetadata) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ADDED\tHASH\tSIZE\tNODES\tURIS\tTRIGGER\tDURATION\tSOURCE")
+	for _, s := range snapshots {
+		var nodes, uris int
+		for _, dimension := range s.Dimensions {
+			nodes += dimension.NumberOfNodes
+			uris += dimension.NumberOfURIs
+		}
+		hash, source := s.Hash, s.SourceURL
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		if hash == "" {
+			hash = s.Key
+		}
+		if s.ETag != "" {
+			source += " (" + s.ETag + ")"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			s.Added.Format(time.RFC3339), hash, s.Size, nodes, uris, s.Trigger, s.LoadDuration.Round(time.Millisecond), source,
+		)
+	}
+	return tw.Flush()
+}
+
+func addHistoryRetentionFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addHistoryKeepWithinFlag(flags, v)
+	addHistoryKeepDailyFlag(flags, v)
+	addHistoryMaxBytesFlag(flags, v)
+	addHistoryPinFlag(flags, v)
+}
+
+// historyOptions returns the history options of the history flags
+func historyOptions(v *viper.Viper, storage repo.Storage) []repo.HistoryOption {
+	return []repo.HistoryOption{
+		repo.HistoryWithStorage(storage),
+		repo.HistoryWithHistoryDir(historyDirFlag(v)),
+		repo.HistoryWithHistoryLimit(historyLimitFlag(v)),
+		repo.HistoryWithKeepWithin(historyKeepWithinFlag(v)),
+		repo.HistoryWithKeepDaily(historyKeepDailyFlag(v)),
+		repo.HistoryWithMaxBytes(historyMaxBytesFlag(v)),
+		repo.HistoryWithPinned(historyPinFlag(v)...),
+		repo.HistoryWithLegacyCurrent(historyLegacyCurrentFlag(v)),
+	}
+}
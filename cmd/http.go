@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/foomo/contentserver/pkg/handler"
@@ -24,9 +25,9 @@ func NewHTTPCommand() *cobra.Command {
 	service.DefaultHTTPPProfAddr = ":6060"
 
 	cmd := &cobra.Command{
-		Use:   "http <url>",
+		Use:   "http [url]",
 		Short: "Start http server",
-		Args:  cobra.ExactArgs(1),
+		Args:  repositoryURLArgs(v),
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			var comps []string
 			if len(args) == 0 {
@@ -55,17 +56,13 @@ func NewHTTPCommand() *cobra.Command {
 			}
 
 			history, err := repo.NewHistory(l.Named("inst.history"),
-				repo.HistoryWithStorage(storage),
-				repo.HistoryWithHistoryDir(historyDirFlag(v)),
-				repo.HistoryWithHistoryLimit(historyLimitFlag(v)),
+				historyOptions(v, storage)...,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to create history: %w", err)
 			}
 
-			r := repo.New(l.Named("inst.repo"),
-				args[0],
-				history,
+			repoOpts := []repo.Option{
 				repo.WithHTTPClient(
 					keelhttp.NewHTTPClient(
 						keelhttp.HTTPClientWithTimeout(repositoryTimeoutFlag(v)),
@@ -74,6 +71,30 @@ func NewHTTPCommand() *cobra.Command {
 				),
 				repo.WithPollInterval(pollIntevalFlag(v)),
 				repo.WithPoll(pollFlag(v)),
+				repo.WithFollowStorage(followStorageFlag(v)),
+			}
+			if leaderElectionFlag(v) {
+				repoOpts = append(repoOpts, repo.WithLeaderElection(leaderElectionTTLFlag(v)))
+			}
+			pubSub, err := createCluster(v, l.Named("inst.cluster"))
+			if err != nil {
+				return fmt.Errorf("failed to create cluster: %w", err)
+			}
+			if pubSub != nil {
+				repoOpts = append(repoOpts, repo.WithCluster(pubSub))
+				svr.AddClosers(func(ctx context.Context) error {
+					return pubSub.Close()
+				})
+			}
+			if wh := createWebhook(v, l.Named("inst.webhook")); wh != nil {
+				repoOpts = append(repoOpts, webhookUpdateHook(v, wh))
+				svr.AddClosers(wh.Close)
+			}
+
+			r := repo.New(l.Named("inst.repo"),
+				repositoryURL(args),
+				history,
+				repoOpts...,
 			)
 
 			isLoadedHealtherFn := healthz.NewHealthzerFn(func(ctx context.Context) error {
@@ -90,12 +111,21 @@ func NewHTTPCommand() *cobra.Command {
 				return history.Close()
 			})
 
+			dispatcher, err := createDispatcher(v, l, r)
+			if err != nil {
+				return fmt.Errorf("failed to create dispatcher: %w", err)
+			}
 			svr.AddServices(
 				service.NewGoRoutine(l.Named("go.repo"), "repo", func(ctx context.Context, l *zap.Logger) error {
 					return r.Start(ctx)
 				}),
 				service.NewHTTP(l.Named("svc.http"), "http", addressFlag(v),
-					handler.NewHTTP(l.Named("inst.handler"), r, handler.WithBasePath(basePathFlag(v))),
+					handler.NewHTTP(l.Named("inst.handler"), r,
+						handler.WithBasePath(basePathFlag(v)),
+						handler.WithCacheControl(cacheControlFlag(v)),
+						handler.WithMaxRequestSize(maxRequestSizeFlag(v)),
+						handler.WithDispatcher(dispatcher),
+					),
 					middleware.Telemetry(),
 					middleware.Logger(),
 					middleware.GZip(middleware.GZipWithLevel(gzipLevelFlag(v))),
@@ -103,6 +133,14 @@ func NewHTTPCommand() *cobra.Command {
 				),
 			)
 
+			grpcService, err := createGRPCService(cmd.Context(), v, l, r, dispatcher)
+			if err != nil {
+				return fmt.Errorf("failed to create grpc service: %w", err)
+			}
+			if grpcService != nil {
+				svr.AddService(grpcService)
+			}
+
 			svr.Run()
 			return nil
 		},
@@ -110,11 +148,17 @@ func NewHTTPCommand() *cobra.Command {
 
 	flags := cmd.Flags()
 	addAddressFlag(flags, v)
+	addGRPCFlags(flags, v)
+	addDispatcherFlags(flags, v)
 	addBasePathFlag(flags, v)
+	addCacheControlFlag(flags, v)
+	addMaxRequestSizeFlag(flags, v)
 	addPollFlag(flags, v)
 	addPollIntervalFlag(flags, v)
 	addHistoryDirFlag(flags, v)
 	addHistoryLimitFlag(flags, v)
+	addHistoryRetentionFlags(flags, v)
+	addHistoryLegacyCurrentFlag(flags, v)
 	addShutdownTimeoutFlag(flags, v)
 	addOtelEnabledFlag(flags, v)
 	addServiceHealthzEnabledFlag(flags, v)
@@ -123,17 +167,78 @@ func NewHTTPCommand() *cobra.Command {
 	addStorageTypeFlag(flags, v)
 	addStorageBlobBucketFlag(flags, v)
 	addStorageBlobPrefixFlag(flags, v)
+	addStorageBoltPathFlag(flags, v)
+	addStorageFSFlags(flags, v)
+	addStorageEncryptionFlags(flags, v)
+	addStorageRetryMaxAttemptsFlag(flags, v)
+	addStorageCacheDirFlag(flags, v)
 	addRepositoryTimeoutFlag(flags, v)
 	addGzipLevelFlag(flags, v)
+	addWebhookFlags(flags, v)
+	addClusterFlags(flags, v)
+	addLeaderElectionFlag(flags, v)
+	addLeaderElectionTTLFlag(flags, v)
+	addFollowStorageFlag(flags, v)
 
 	return cmd
 }
 
+// repositoryURLArgs requires the repository url unless the server follows the storage
+func repositoryURLArgs(v *viper.Viper) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if followStorageFlag(v) {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	}
+}
+
+// repositoryURL returns the repository url argument, which is optional when following the storage
+func repositoryURL(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
 // supportedBlobSchemes lists the URL schemes supported by blob storage
 var supportedBlobSchemes = []string{"gs://", "s3://", "azblob://"}
 
-// createStorage creates a storage backend based on the configuration
+// createStorage creates the storage backend and wraps it based on the configuration
 func createStorage(ctx context.Context, v *viper.Viper, l *zap.Logger) (repo.Storage, error) {
+	storage, err := createBackendStorage(ctx, v, l)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cache stores the encrypted data and avoids the retries and metrics of the backend
+	var middlewares []repo.StorageMiddleware
+	if dir := storageCacheDirFlag(v); dir != "" {
+		// only read by this process, so the files may carry checksums
+		cache, err := repo.NewFilesystemStorage(dir, repo.FilesystemStorageWithChecksums(true))
+		if err != nil {
+			_ = storage.Close()
+			return nil, fmt.Errorf("failed to create storage cache: %w", err)
+		}
+		l.Info("caching storage", zap.String("dir", dir))
+		middlewares = append(middlewares, repo.CacheMiddleware(l, cache))
+	}
+	if attempts := storageRetryMaxAttemptsFlag(v); attempts > 1 {
+		middlewares = append(middlewares, repo.RetryMiddleware(l, repo.RetryStorageWithMaxAttempts(attempts)))
+	}
+	middlewares = append(middlewares, repo.MetricsMiddleware())
+	storage = repo.ChainStorage(storage, middlewares...)
+
+	wrapped, err := createEncryptedStorage(v, l, storage)
+	if err != nil {
+		_ = storage.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// createBackendStorage creates a storage backend based on the configuration
+func createBackendStorage(ctx context.Context, v *viper.Viper, l *zap.Logger) (repo.Storage, error) {
 	storageType := storageTypeFlag(v)
 	blobBucket := storageBlobBucketFlag(v)
 	blobPrefix := storageBlobPrefixFlag(v)
@@ -163,12 +268,26 @@ func createStorage(ctx context.Context, v *viper.Viper, l *zap.Logger) (repo.Sto
 			zap.String("provider", detectBlobProvider(blobBucket)),
 		)
 		return repo.NewBlobStorage(ctx, blobBucket, blobPrefix)
+	case "bolt":
+		path := storageBoltPathFlag(v)
+		if path == "" {
+			path = filepath.Join(historyDirFlag(v), "contentserver.db")
+		}
+		l.Info("using bolt storage", zap.String("path", path))
+		return repo.NewBoltStorage(path)
 	case "filesystem", "":
 		dir := historyDirFlag(v)
-		l.Info("using filesystem storage", zap.String("dir", dir))
-		return repo.NewFilesystemStorage(dir)
+		l.Info("using filesystem storage",
+			zap.String("dir", dir),
+			zap.Bool("sync", storageFSSyncFlag(v)),
+			zap.Bool("checksums", storageFSChecksumsFlag(v)),
+		)
+		return repo.NewFilesystemStorage(dir,
+			repo.FilesystemStorageWithSync(storageFSSyncFlag(v)),
+			repo.FilesystemStorageWithChecksums(storageFSChecksumsFlag(v)),
+		)
 	default:
-		return nil, fmt.Errorf("unknown storage type: %s (supported: filesystem, blob)", storageType)
+		return nil, fmt.Errorf("unknown storage type: %s (supported: filesystem, bolt, blob)", storageType)
 	}
 }
 
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/foomo/contentserver/pkg/utils"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func addSocketListenerFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addSocketUnixPermissionsFlag(flags, v)
+	addSocketTLSCertFlag(flags, v)
+	addSocketTLSKeyFlag(flags, v)
+	addSocketTLSClientCAFlag(flags, v)
+}
+
+// createSocketListener listens on a tcp address or a unix:// socket, optionally with (mutual) TLS
+func createSocketListener(ctx context.Context, v *viper.Viper, l *zap.Logger) (net.Listener, error) {
+	network, addr := utils.NetworkAddress(addressFlag(v))
+	if network == "unix" {
+		// a stale socket of a previous process would fail the listen
+		if info, err := os.Stat(addr); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+			}
+		}
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		perm, err := strconv.ParseUint(socketUnixPermissionsFlag(v), 8, 32)
+		if err == nil {
+			err = os.Chmod(addr, fs.FileMode(perm))
+		}
+		if err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+	}
+
+	tlsConfig, err := createTLSConfig(l, socketTLSCertFlag(v), socketTLSKeyFlag(v), socketTLSClientCAFlag(v))
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+// createTLSConfig returns nil if no certificate is configured, a client CA enables mutual TLS
+func createTLSConfig(l *zap.Logger, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("a client CA requires a TLS certificate and key")
+		}
+		return nil, nil //nolint:nilnil
+	}
+	reloader, err := utils.NewCertificateReloader(l, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		clientCAs, err := utils.LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	l.Info("TLS enabled", zap.String("cert", certFile), zap.Bool("mutual", clientCAFile != ""))
+	return tlsConfig, nil
+}
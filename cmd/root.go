@@ -28,6 +28,7 @@ func NewRootCommand() *cobra.Command {
 
 	cmd.AddCommand(NewHTTPCommand())
 	cmd.AddCommand(NewSocketCommand())
+	cmd.AddCommand(NewHistoryCommand())
 	cmd.AddCommand(NewVersionCommand())
 
 	return cmd
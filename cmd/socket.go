@@ -2,24 +2,26 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
 
 	"github.com/foomo/contentserver/pkg/handler"
 	"github.com/foomo/contentserver/pkg/repo"
-	"github.com/foomo/keel/log"
+	"github.com/foomo/contentserver/pkg/socket"
+	"github.com/foomo/keel"
+	"github.com/foomo/keel/healthz"
 	keelhttp "github.com/foomo/keel/net/http"
+	"github.com/foomo/keel/service"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
 func NewSocketCommand() *cobra.Command {
-	v := viper.New()
+	v := newViper()
 	cmd := &cobra.Command{
-		Use:   "socket <url>",
+		Use:   "socket [url]",
 		Short: "Start socket server",
-		Args:  cobra.ExactArgs(1),
+		Args:  repositoryURLArgs(v),
 		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 			var comps []string
 			if len(args) == 0 {
@@ -30,7 +32,16 @@ func NewSocketCommand() *cobra.Command {
 			return comps, cobra.ShellCompDirectiveNoFileComp
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			l := log.Logger()
+			svr := keel.NewServer(
+				keel.WithHTTPPrometheusService(servicePrometheusEnabledFlag(v)),
+				keel.WithHTTPHealthzService(serviceHealthzEnabledFlag(v)),
+				keel.WithPrometheusMeter(servicePrometheusEnabledFlag(v)),
+				keel.WithGracefulPeriod(gracefulPeriodFlag(v)),
+				keel.WithOTLPGRPCTracer(otelEnabledFlag(v)),
+				keel.WithHTTPPProfService(servicePProfEnabledFlag(v)),
+			)
+
+			l := svr.Logger()
 
 			// Create storage based on configuration
 			storage, err := createStorage(cmd.Context(), v, l)
@@ -38,23 +49,14 @@ func NewSocketCommand() *cobra.Command {
 				return fmt.Errorf("failed to create storage: %w", err)
 			}
 
-			history, err := repo.NewHistory(l,
-				repo.HistoryWithStorage(storage),
-				repo.HistoryWithHistoryDir(historyDirFlag(v)),
-				repo.HistoryWithHistoryLimit(historyLimitFlag(v)),
+			history, err := repo.NewHistory(l.Named("inst.history"),
+				historyOptions(v, storage)...,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to create history: %w", err)
 			}
-			defer func() {
-				if closeErr := history.Close(); closeErr != nil {
-					l.Error("failed to close history storage", zap.Error(closeErr))
-				}
-			}()
 
-			r := repo.New(l,
-				args[0],
-				history,
+			repoOpts := []repo.Option{
 				repo.WithHTTPClient(
 					keelhttp.NewHTTPClient(
 						keelhttp.HTTPClientWithTimeout(repositoryTimeoutFlag(v)),
@@ -63,58 +65,130 @@ func NewSocketCommand() *cobra.Command {
 				),
 				repo.WithPoll(pollFlag(v)),
 				repo.WithPollInterval(pollIntevalFlag(v)),
+				repo.WithFollowStorage(followStorageFlag(v)),
+			}
+			if leaderElectionFlag(v) {
+				repoOpts = append(repoOpts, repo.WithLeaderElection(leaderElectionTTLFlag(v)))
+			}
+			pubSub, err := createCluster(v, l.Named("inst.cluster"))
+			if err != nil {
+				return fmt.Errorf("failed to create cluster: %w", err)
+			}
+			if pubSub != nil {
+				repoOpts = append(repoOpts, repo.WithCluster(pubSub))
+			}
+			wh := createWebhook(v, l.Named("inst.webhook"))
+			if wh != nil {
+				repoOpts = append(repoOpts, webhookUpdateHook(v, wh))
+			}
+
+			r := repo.New(l.Named("inst.repo"),
+				repositoryURL(args),
+				history,
+				repoOpts...,
 			)
 
 			// create socket server
-			handle := handler.NewSocket(l, r)
+			dispatcher, err := createDispatcher(v, l, r)
+			if err != nil {
+				return fmt.Errorf("failed to create dispatcher: %w", err)
+			}
+			handle := handler.NewSocket(l.Named("inst.handler"), r,
+				handler.SocketWithDispatcher(dispatcher),
+				handler.SocketWithMaxConcurrentRequests(socketMaxConcurrentRequestsFlag(v)),
+				handler.SocketWithMaxRequestSize(socketMaxRequestSizeFlag(v)),
+				handler.SocketWithIdleTimeout(socketIdleTimeoutFlag(v)),
+				handler.SocketWithReadTimeout(socketReadTimeoutFlag(v)),
+			)
 
 			// listen on socket
-			var lc net.ListenConfig
-			ln, err := lc.Listen(cmd.Context(), "tcp", addressFlag(v))
+			ln, err := createSocketListener(cmd.Context(), v, l)
 			if err != nil {
 				return err
 			}
 
-			// start repo
-			up := make(chan bool, 1)
+			loaded := make(chan struct{})
 			r.OnLoaded(func() {
-				up <- true
+				close(loaded)
+			})
+			isLoadedHealtherFn := healthz.NewHealthzerFn(func(ctx context.Context) error {
+				if !r.Loaded() {
+					return errors.New("repo not loaded yet")
+				}
+				return nil
 			})
-			go r.Start(context.Background()) //nolint:errcheck
-			<-up
+			// start initial update and handle error
+			svr.AddStartupHealthzers(isLoadedHealtherFn)
+			svr.AddReadinessHealthzers(isLoadedHealtherFn)
 
-			l.Info("started listening", zap.String("address", addressFlag(v)))
+			svr.AddServices(
+				service.NewGoRoutine(l.Named("go.repo"), "repo", func(ctx context.Context, l *zap.Logger) error {
+					return r.Start(ctx)
+				}),
+				socket.NewServer(l.Named("svc.socket"), "socket", ln, handle,
+					socket.ServerWithMaxConnections(socketMaxConnectionsFlag(v)),
+					socket.ServerWithStartAfter(loaded),
+				),
+			)
 
-			for {
-				// this blocks until connection or error
-				conn, err := ln.Accept()
-				if err != nil {
-					l.Error("runSocketServer: could not accept connection", zap.Error(err))
-					continue
-				}
+			grpcService, err := createGRPCService(cmd.Context(), v, l, r, dispatcher)
+			if err != nil {
+				return fmt.Errorf("failed to create grpc service: %w", err)
+			}
+			if grpcService != nil {
+				svr.AddService(grpcService)
+			}
 
-				// a goroutine handles conn so that the loop can accept other connections
-				go func() {
-					l.Debug("accepted connection", zap.String("source", conn.RemoteAddr().String()))
-					handle.Serve(conn)
-					if err := conn.Close(); err != nil {
-						l.Warn("failed to close connection", zap.Error(err))
-					}
-				}()
+			// closed after the socket server has been drained
+			if pubSub != nil {
+				svr.AddClosers(func(ctx context.Context) error {
+					return pubSub.Close()
+				})
 			}
+			if wh != nil {
+				svr.AddClosers(wh.Close)
+			}
+			svr.AddClosers(func(ctx context.Context) error {
+				return history.Close()
+			})
+
+			svr.Run()
+			return nil
 		},
 	}
 
 	flags := cmd.Flags()
 	addAddressFlag(flags, v)
+	addGRPCFlags(flags, v)
+	addDispatcherFlags(flags, v)
+	addSocketMaxConcurrentRequestsFlag(flags, v)
+	addSocketListenerFlags(flags, v)
+	addSocketLimitFlags(flags, v)
+	addShutdownTimeoutFlag(flags, v)
+	addOtelEnabledFlag(flags, v)
+	addServiceHealthzEnabledFlag(flags, v)
+	addServicePrometheusEnabledFlag(flags, v)
+	addServicePProfEnabledFlag(flags, v)
 	addPollFlag(flags, v)
 	addPollIntervalFlag(flags, v)
 	addHistoryDirFlag(flags, v)
 	addHistoryLimitFlag(flags, v)
+	addHistoryRetentionFlags(flags, v)
+	addHistoryLegacyCurrentFlag(flags, v)
 	addStorageTypeFlag(flags, v)
 	addStorageBlobBucketFlag(flags, v)
 	addStorageBlobPrefixFlag(flags, v)
+	addStorageBoltPathFlag(flags, v)
+	addStorageFSFlags(flags, v)
+	addStorageEncryptionFlags(flags, v)
+	addStorageRetryMaxAttemptsFlag(flags, v)
+	addStorageCacheDirFlag(flags, v)
 	addRepositoryTimeoutFlag(flags, v)
+	addWebhookFlags(flags, v)
+	addClusterFlags(flags, v)
+	addLeaderElectionFlag(flags, v)
+	addLeaderElectionTTLFlag(flags, v)
+	addFollowStorageFlag(flags, v)
 
 	return cmd
 }
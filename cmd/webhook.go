@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/pkg/webhook"
+	keelhttp "github.com/foomo/keel/net/http"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func addWebhookFlags(flags *pflag.FlagSet, v *viper.Viper) {
+	addWebhookURLsFlag(flags, v)
+	addWebhookSecretFlag(flags, v)
+	addWebhookMaxAttemptsFlag(flags, v)
+	addWebhookTimeoutFlag(flags, v)
+	addWebhookAllReplicasFlag(flags, v)
+}
+
+// createWebhook creates a webhook notifier or returns nil if no urls are configured
+func createWebhook(v *viper.Viper, l *zap.Logger) *webhook.Webhook {
+	urls := webhookURLsFlag(v)
+	if len(urls) == 0 {
+		return nil
+	}
+	if webhookSecretFlag(v) == "" {
+		l.Warn("webhook urls are configured without a secret; notifications will not be signed")
+	}
+	l.Info("notifying webhooks after updates", zap.Strings("urls", urls))
+	return webhook.New(l, urls,
+		webhook.WithSecret(webhookSecretFlag(v)),
+		webhook.WithMaxAttempts(webhookMaxAttemptsFlag(v)),
+		webhook.WithHTTPClient(
+			keelhttp.NewHTTPClient(
+				keelhttp.HTTPClientWithTimeout(webhookTimeoutFlag(v)),
+				keelhttp.HTTPClientWithTelemetry(),
+			),
+		),
+	)
+}
+
+// webhookUpdateHook registers the webhook as update hook of the leader or of every replica
+func webhookUpdateHook(v *viper.Viper, wh *webhook.Webhook) repo.Option {
+	if webhookAllReplicasFlag(v) {
+		return repo.WithUpdateHook(wh.Notify)
+	}
+	return repo.WithLeaderUpdateHook(wh.Notify)
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"slices"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// Permissions required by the routes, see handler.DefaultPermissions
+const (
+	// PermissionRead read content, nodes, uris and changes
+	PermissionRead = "read"
+	// PermissionUpdate trigger updates of the repo
+	PermissionUpdate = "update"
+	// PermissionRepo get the whole repo including restricted nodes
+	PermissionRepo = "repo"
+	// PermissionAdmin the status and all routes without a permission of their own
+	PermissionAdmin = "admin"
+)
+
+const (
+	// HeaderKey identifies the secret of an hmac signed request
+	HeaderKey = "X-Contentserver-Key"
+	// HeaderTimestamp contains the unix timestamp the request was signed at
+	HeaderTimestamp = "X-Contentserver-Timestamp"
+	// HeaderNonce contains a random value of the request, signatures are accepted only once per nonce
+	HeaderNonce = "X-Contentserver-Nonce"
+	// HeaderSignature contains the hmac signature of the request, see Sign
+	HeaderSignature = "X-Contentserver-Signature"
+)
+
+// Methods of the transports without http methods, signatures cover the method to bind them to a transport
+const (
+	MethodGRPC   = "GRPC"
+	MethodSocket = "SOCKET"
+)
+
+var (
+	// ErrNoCredentials the authenticator does not support the kind of credentials
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials the credentials are not valid
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+type (
+	// Credentials of a request, a bearer token or an hmac signature of the method, route and body
+	Credentials struct {
+		// Token is a static bearer token or a JWT
+		Token string
+		// Key identifies the secret of the signature
+		Key string
+		// Timestamp the request was signed at in unix seconds
+		Timestamp string
+		// Nonce is a random value which must not be repeated by the client within the max skew of the timestamp
+		Nonce string
+		// Signature of the method, timestamp, nonce, route and body, see Sign
+		Signature string
+		// Method is the http method of the request, MethodGRPC or MethodSocket
+		Method string
+		Route  string
+		Body   []byte
+	}
+	// Principal is an authenticated client
+	Principal struct {
+		Subject     string   `json:"subject"`
+		Permissions []string `json:"permissions"`
+		// Groups the client may access, see handler.AuthWithGroupsFromClaims
+		Groups []string `json:"groups"`
+	}
+	// Identity is a client with a static secret, the secret is its bearer token or hmac key
+	Identity struct {
+		Subject     string   `json:"subject"`
+		Secret      string   `json:"secret"`
+		Permissions []string `json:"permissions"`
+		Groups      []string `json:"groups"`
+	}
+	// Authenticator returns the principal of the credentials.
+	// ErrNoCredentials is returned if the credentials are not of its kind, e.g. a JWT for static tokens.
+	Authenticator interface {
+		Authenticate(ctx context.Context, credentials *Credentials) (*Principal, error)
+	}
+	chain []Authenticator
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// Chain returns an authenticator asking the authenticators in their order until one supports the credentials
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+// LoadIdentities reads a json file with a list of identities
+func LoadIdentities(filename string) ([]*Identity, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read identities")
+	}
+	var ret []*Identity
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, errors.Wrap(err, "failed to decode identities")
+	}
+	for i, identity := range ret {
+		if identity == nil || identity.Secret == "" {
+			return nil, errors.Errorf("identity %d has no secret", i)
+		}
+	}
+	return ret, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Empty reports whether there are no credentials at all
+func (c *Credentials) Empty() bool {
+	return c == nil || (c.Token == "" && c.Key == "" && c.Signature == "")
+}
+
+// HasPermission reports whether the principal has the permission
+func (p *Principal) HasPermission(permission string) bool {
+	return p != nil && slices.Contains(p.Permissions, permission)
+}
+
+func (i *Identity) principal() *Principal {
+	return &Principal{
+		Subject:     i.Subject,
+		Permissions: i.Permissions,
+		Groups:      i.Groups,
+	}
+}
+
+func (c chain) Authenticate(ctx context.Context, credentials *Credentials) (*Principal, error) {
+	for _, a := range c {
+		principal, err := a.Authenticate(ctx, credentials)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	identities := []*Identity{{Subject: "updater", Secret: "secret", Permissions: []string{PermissionRead}}}
+	a := Chain(NewBearer(identities), NewHMAC(identities))
+
+	principal, err := a.Authenticate(t.Context(), &Credentials{Token: "secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "updater", principal.Subject)
+
+	// the first authenticator supporting the credentials decides
+	principal, err = a.Authenticate(t.Context(), signedCredentials("secret", time.Now(), "nonce"))
+	require.NoError(t, err)
+	assert.Equal(t, "updater", principal.Subject)
+	_, err = a.Authenticate(t.Context(), signedCredentials("invalid", time.Now(), "other"))
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = a.Authenticate(t.Context(), &Credentials{Token: "unknown"})
+	require.ErrorIs(t, err, ErrNoCredentials)
+	_, err = Chain().Authenticate(t.Context(), &Credentials{Token: "secret"})
+	require.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestCredentialsEmpty(t *testing.T) {
+	assert.True(t, (*Credentials)(nil).Empty())
+	assert.True(t, (&Credentials{Route: "update", Body: []byte("{}")}).Empty())
+	assert.False(t, (&Credentials{Token: "token"}).Empty())
+	assert.False(t, (&Credentials{Key: "key"}).Empty())
+	assert.False(t, (&Credentials{Signature: "signature"}).Empty())
+}
+
+func TestPrincipalHasPermission(t *testing.T) {
+	assert.False(t, (*Principal)(nil).HasPermission(PermissionRead))
+	p := &Principal{Permissions: []string{PermissionRead}}
+	assert.True(t, p.HasPermission(PermissionRead))
+	assert.False(t, p.HasPermission(PermissionAdmin))
+}
+
+func TestLoadIdentities(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "identities.json")
+	require.NoError(t, os.WriteFile(filename, []byte(`[{"subject": "client", "secret": "secret", "permissions": ["read"], "groups": ["www"]}]`), 0o600))
+	identities, err := LoadIdentities(filename)
+	require.NoError(t, err)
+	assert.Equal(t, []*Identity{{Subject: "client", Secret: "secret", Permissions: []string{"read"}, Groups: []string{"www"}}}, identities)
+
+	require.NoError(t, os.WriteFile(filename, []byte(`[{"subject": "client"}]`), 0o600))
+	_, err = LoadIdentities(filename)
+	require.EqualError(t, err, "identity 0 has no secret")
+
+	_, err = LoadIdentities(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+)
+
+// Bearer authenticates static bearer tokens, the secrets of the identities are the tokens
+type Bearer struct {
+	// principals by the hash of their token, so tokens are not compared byte by byte
+	principals map[[sha256.Size]byte]*Principal
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewBearer(identities []*Identity) *Bearer {
+	inst := &Bearer{
+		principals: make(map[[sha256.Size]byte]*Principal, len(identities)),
+	}
+	for _, identity := range identities {
+		inst.principals[sha256.Sum256([]byte(identity.Secret))] = identity.principal()
+	}
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Authenticate returns ErrNoCredentials for unknown tokens, they may be JWTs
+func (b *Bearer) Authenticate(ctx context.Context, credentials *Credentials) (*Principal, error) {
+	if credentials.Token == "" {
+		return nil, ErrNoCredentials
+	}
+	principal, ok := b.principals[sha256.Sum256([]byte(credentials.Token))]
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return principal, nil
+}
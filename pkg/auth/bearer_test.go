@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearer(t *testing.T) {
+	b := NewBearer([]*Identity{
+		{Subject: "reader", Secret: "read-token", Permissions: []string{PermissionRead}, Groups: []string{"www"}},
+		{Subject: "admin", Secret: "admin-token", Permissions: []string{PermissionAdmin}},
+	})
+
+	principal, err := b.Authenticate(t.Context(), &Credentials{Token: "read-token"})
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "reader", Permissions: []string{PermissionRead}, Groups: []string{"www"}}, principal)
+	principal, err = b.Authenticate(t.Context(), &Credentials{Token: "admin-token"})
+	require.NoError(t, err)
+	assert.Equal(t, "admin", principal.Subject)
+
+	// unknown tokens may be JWTs, signatures are left to the hmac authenticator
+	for _, credentials := range []*Credentials{
+		{Token: "unknown"},
+		{Token: "read-token "},
+		{Key: "reader", Signature: "read-token"},
+	} {
+		_, err = b.Authenticate(t.Context(), credentials)
+		require.ErrorIs(t, err, ErrNoCredentials)
+	}
+}
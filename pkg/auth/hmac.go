@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxNonceLength limits the nonces kept to detect replayed signatures
+const maxNonceLength = 64
+
+type (
+	// HMAC authenticates requests signed with the secret of an identity, the subject of the identity is the key.
+	// Every signature is accepted once, the nonces are kept in memory until their signatures have expired.
+	HMAC struct {
+		identities map[string]*Identity
+		maxSkew    time.Duration
+		// noncesMu guards nonces and nextPrune, nonces maps the used nonces of every key to their expiry
+		noncesMu  sync.Mutex
+		nonces    map[[2]string]time.Time
+		nextPrune time.Time
+	}
+	HMACOption func(*HMAC)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewHMAC(identities []*Identity, opts ...HMACOption) *HMAC {
+	inst := &HMAC{
+		identities: make(map[string]*Identity, len(identities)),
+		maxSkew:    5 * time.Minute,
+		nonces:     map[[2]string]time.Time{},
+	}
+	for _, identity := range identities {
+		inst.identities[identity.Subject] = identity
+	}
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// HMACWithMaxSkew limits the age of signatures and the clock skew between clients and server
+func HMACWithMaxSkew(v time.Duration) HMACOption {
+	return func(o *HMAC) {
+		o.maxSkew = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Authenticate verifies the signature, signatures which have been accepted before are rejected as replayed
+func (h *HMAC) Authenticate(ctx context.Context, credentials *Credentials) (*Principal, error) {
+	if credentials.Key == "" && credentials.Signature == "" {
+		return nil, ErrNoCredentials
+	}
+	identity, ok := h.identities[credentials.Key]
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidCredentials, "unknown key")
+	}
+	timestamp, err := strconv.ParseInt(credentials.Timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid timestamp")
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > h.maxSkew || skew < -h.maxSkew {
+		return nil, errors.Wrap(ErrInvalidCredentials, "expired signature")
+	}
+	if credentials.Nonce == "" || len(credentials.Nonce) > maxNonceLength {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid nonce")
+	}
+	expected := Sign([]byte(identity.Secret), credentials.Method, credentials.Timestamp, credentials.Nonce, credentials.Route, credentials.Body)
+	if !hmac.Equal([]byte(expected), []byte(credentials.Signature)) {
+		return nil, errors.Wrap(ErrInvalidCredentials, "invalid signature")
+	}
+	// only valid signatures use up nonces
+	if !h.useNonce(credentials.Key, credentials.Nonce, signedAt.Add(h.maxSkew)) {
+		return nil, errors.Wrap(ErrInvalidCredentials, "replayed signature")
+	}
+	return identity.principal(), nil
+}
+
+// Sign returns the signature of a request with the method to the route with the body at the given unix timestamp.
+// The nonce must be a random value of at most 64 bytes, e.g. 16 random bytes in hex.
+func Sign(secret []byte, method, timestamp, nonce, route string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, field := range []string{method, timestamp, nonce, route} {
+		mac.Write([]byte(field))
+		mac.Write([]byte("."))
+	}
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// useNonce reports whether the nonce of the key has not been used before and keeps it until its expiry
+func (h *HMAC) useNonce(key, nonce string, expiry time.Time) bool {
+	h.noncesMu.Lock()
+	defer h.noncesMu.Unlock()
+	now := time.Now()
+	if now.After(h.nextPrune) {
+		for k, v := range h.nonces {
+			if now.After(v) {
+				delete(h.nonces, k)
+			}
+		}
+		h.nextPrune = now.Add(h.maxSkew)
+	}
+	k := [2]string{key, nonce}
+	if v, ok := h.nonces[k]; ok && !now.After(v) {
+		return false
+	}
+	h.nonces[k] = expiry
+	return true
+}
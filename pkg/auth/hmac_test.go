@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHMAC(opts ...HMACOption) *HMAC {
+	return NewHMAC([]*Identity{
+		{Subject: "updater", Secret: "secret", Permissions: []string{PermissionUpdate}, Groups: []string{"www"}},
+	}, opts...)
+}
+
+// signedCredentials returns credentials of a POST request signed with the secret at the time
+func signedCredentials(secret string, at time.Time, nonce string) *Credentials {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return &Credentials{
+		Key:       "updater",
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: Sign([]byte(secret), http.MethodPost, timestamp, nonce, "update", []byte("{}")),
+		Method:    http.MethodPost,
+		Route:     "update",
+		Body:      []byte("{}"),
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	h := newTestHMAC()
+
+	principal, err := h.Authenticate(t.Context(), signedCredentials("secret", time.Now(), "nonce-1"))
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "updater", Permissions: []string{PermissionUpdate}, Groups: []string{"www"}}, principal)
+
+	// tokens are left to the other authenticators
+	_, err = h.Authenticate(t.Context(), &Credentials{Token: "token"})
+	require.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestHMACRejected(t *testing.T) {
+	h := newTestHMAC(HMACWithMaxSkew(time.Minute))
+	now := time.Now()
+	for name, test := range map[string]struct {
+		credentials func(c *Credentials)
+		message     string
+	}{
+		"unknown key":       {func(c *Credentials) { c.Key = "unknown" }, "unknown key"},
+		"invalid timestamp": {func(c *Credentials) { c.Timestamp = "now" }, "invalid timestamp"},
+		"expired":           {func(c *Credentials) { *c = *signedCredentials("secret", now.Add(-2*time.Minute), "nonce") }, "expired signature"},
+		"skewed":            {func(c *Credentials) { *c = *signedCredentials("secret", now.Add(2*time.Minute), "nonce") }, "expired signature"},
+		"missing nonce":     {func(c *Credentials) { *c = *signedCredentials("secret", now, "") }, "invalid nonce"},
+		"long nonce":        {func(c *Credentials) { *c = *signedCredentials("secret", now, string(make([]byte, 65))) }, "invalid nonce"},
+		"secret":            {func(c *Credentials) { *c = *signedCredentials("invalid", now, "nonce") }, "invalid signature"},
+		"method":            {func(c *Credentials) { c.Method = http.MethodGet }, "invalid signature"},
+		"nonce":             {func(c *Credentials) { c.Nonce = "other" }, "invalid signature"},
+		"timestamp":         {func(c *Credentials) { c.Timestamp = strconv.FormatInt(now.Unix()+1, 10) }, "invalid signature"},
+		"route":             {func(c *Credentials) { c.Route = "getRepo" }, "invalid signature"},
+		"body":              {func(c *Credentials) { c.Body = []byte(`{"a":1}`) }, "invalid signature"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			credentials := signedCredentials("secret", now, "nonce")
+			test.credentials(credentials)
+			_, err := h.Authenticate(t.Context(), credentials)
+			require.ErrorIs(t, err, ErrInvalidCredentials)
+			assert.Contains(t, err.Error(), test.message)
+		})
+	}
+
+	// the rejected signatures did not use up the nonce
+	_, err := h.Authenticate(t.Context(), signedCredentials("secret", now, "nonce"))
+	require.NoError(t, err)
+}
+
+func TestHMACReplay(t *testing.T) {
+	h := newTestHMAC()
+	credentials := signedCredentials("secret", time.Now(), "nonce")
+	_, err := h.Authenticate(t.Context(), credentials)
+	require.NoError(t, err)
+
+	_, err = h.Authenticate(t.Context(), credentials)
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	assert.Contains(t, err.Error(), "replayed signature")
+
+	// a new nonce is a new signature
+	_, err = h.Authenticate(t.Context(), signedCredentials("secret", time.Now(), "other"))
+	require.NoError(t, err)
+}
+
+func TestHMACNonceExpiry(t *testing.T) {
+	h := newTestHMAC()
+	past := time.Now().Add(-time.Second)
+	assert.True(t, h.useNonce("updater", "a", past))
+	assert.True(t, h.useNonce("other", "a", time.Now().Add(time.Minute)))
+	// expired nonces can not be replayed, their signatures are rejected before
+	assert.True(t, h.useNonce("updater", "a", time.Now().Add(time.Minute)))
+	assert.False(t, h.useNonce("updater", "a", time.Now().Add(time.Minute)))
+
+	// expired nonces are removed
+	assert.True(t, h.useNonce("updater", "b", past))
+	h.nextPrune = past
+	assert.True(t, h.useNonce("updater", "c", time.Now().Add(time.Minute)))
+	assert.Len(t, h.nonces, 3)
+	assert.NotContains(t, h.nonces, [2]string{"updater", "b"})
+}
+
+func TestSign(t *testing.T) {
+	signature := Sign([]byte("secret"), http.MethodPost, "1700000000", "nonce", "update", []byte("{}"))
+	assert.Equal(t, "sha256=", signature[:7])
+	assert.Len(t, signature, 7+64)
+	assert.Equal(t, signature, Sign([]byte("secret"), http.MethodPost, "1700000000", "nonce", "update", []byte("{}")))
+	assert.NotEqual(t, signature, Sign([]byte("secret"), MethodGRPC, "1700000000", "nonce", "update", []byte("{}")))
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pkg/errors"
+)
+
+// jwtAlgorithms are the asymmetric algorithms accepted for signed tokens
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+type (
+	// JWT authenticates bearer tokens signed by one of the keys of a key set. The tokens need an expiry,
+	// permissions and groups are read from their claims.
+	JWT struct {
+		keys             *jose.JSONWebKeySet
+		issuer           string
+		audience         string
+		permissionsClaim string
+		groupsClaim      string
+	}
+	JWTOption func(*JWT)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewJWT(keys *jose.JSONWebKeySet, opts ...JWTOption) *JWT {
+	inst := &JWT{
+		keys:             keys,
+		permissionsClaim: "scope",
+		groupsClaim:      "groups",
+	}
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+
+	return inst
+}
+
+// LoadJWKS reads a json web key set file, the keys need a key id
+func LoadJWKS(filename string) (*jose.JSONWebKeySet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key set")
+	}
+	ret := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, errors.Wrap(err, "failed to decode key set")
+	}
+	return ret, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// JWTWithIssuer requires the iss claim
+func JWTWithIssuer(v string) JWTOption {
+	return func(o *JWT) {
+		o.issuer = v
+	}
+}
+
+// JWTWithAudience requires the audience in the aud claim
+func JWTWithAudience(v string) JWTOption {
+	return func(o *JWT) {
+		o.audience = v
+	}
+}
+
+// JWTWithPermissionsClaim sets the claim with the permissions, a list or a space separated string, default scope
+func JWTWithPermissionsClaim(v string) JWTOption {
+	return func(o *JWT) {
+		o.permissionsClaim = v
+	}
+}
+
+// JWTWithGroupsClaim sets the claim with the groups, a list or a space separated string, default groups
+func JWTWithGroupsClaim(v string) JWTOption {
+	return func(o *JWT) {
+		o.groupsClaim = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Authenticate returns ErrNoCredentials for tokens which are not JWTs, they may be static tokens
+func (j *JWT) Authenticate(ctx context.Context, credentials *Credentials) (*Principal, error) {
+	if strings.Count(credentials.Token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	token, err := jwt.ParseSigned(credentials.Token, jwtAlgorithms)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+	var (
+		claims jwt.Claims
+		custom map[string]interface{}
+	)
+	if err := token.Claims(j.keys, &claims, &custom); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+	if claims.Expiry == nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, "missing exp claim")
+	}
+	expected := jwt.Expected{Issuer: j.issuer}
+	if j.audience != "" {
+		expected.AnyAudience = jwt.Audience{j.audience}
+	}
+	if err := claims.Validate(expected); err != nil {
+		return nil, errors.Wrap(ErrInvalidCredentials, err.Error())
+	}
+	return &Principal{
+		Subject:     claims.Subject,
+		Permissions: claimStrings(custom[j.permissionsClaim]),
+		Groups:      claimStrings(custom[j.groupsClaim]),
+	}, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// claimStrings returns a list claim or the fields of a string claim
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		ret := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestKey returns a key and a key set with its public key
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, *jose.JSONWebKeySet) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "test", Algorithm: string(jose.ES256)}}}
+}
+
+// newTestToken returns a JWT with the claims signed by the key
+func newTestToken(t *testing.T, key interface{}, algorithm jose.SignatureAlgorithm, claims jwt.Claims, custom map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).Claims(custom).Serialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestJWT(t *testing.T) {
+	key, keys := newTestKey(t)
+	expiry := jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	j := NewJWT(keys)
+	principal, err := j.Authenticate(t.Context(), &Credentials{Token: newTestToken(t, key, jose.ES256,
+		jwt.Claims{Subject: "client", Expiry: expiry},
+		map[string]interface{}{"scope": "read update", "groups": []string{"www", "intern"}},
+	)})
+	require.NoError(t, err)
+	assert.Equal(t, &Principal{Subject: "client", Permissions: []string{PermissionRead, PermissionUpdate}, Groups: []string{"www", "intern"}}, principal)
+
+	// the claims are configurable
+	j = NewJWT(keys, JWTWithPermissionsClaim("permissions"), JWTWithGroupsClaim("roles"))
+	principal, err = j.Authenticate(t.Context(), &Credentials{Token: newTestToken(t, key, jose.ES256,
+		jwt.Claims{Subject: "client", Expiry: expiry},
+		map[string]interface{}{"permissions": []string{"read"}, "roles": "www", "scope": "admin"},
+	)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{PermissionRead}, principal.Permissions)
+	assert.Equal(t, []string{"www"}, principal.Groups)
+
+	// tokens which are not JWTs are left to the other authenticators
+	for _, credentials := range []*Credentials{{Token: "static-token"}, {Key: "key", Signature: "a.b.c"}} {
+		_, err = j.Authenticate(t.Context(), credentials)
+		require.ErrorIs(t, err, ErrNoCredentials)
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	key, keys := newTestKey(t)
+	otherKey, _ := newTestKey(t)
+	j := NewJWT(keys, JWTWithIssuer("issuer"), JWTWithAudience("contentserver"))
+	valid := jwt.Claims{
+		Issuer:   "issuer",
+		Audience: jwt.Audience{"contentserver"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	with := func(fn func(c *jwt.Claims)) jwt.Claims {
+		c := valid
+		fn(&c)
+		return c
+	}
+
+	for name, token := range map[string]string{
+		"malformed":   "a.b.c",
+		"other key":   newTestToken(t, otherKey, jose.ES256, valid, nil),
+		"symmetric":   newTestToken(t, []byte("0123456789abcdef0123456789abcdef"), jose.HS256, valid, nil),
+		"expired":     newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }), nil),
+		"not before":  newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) }), nil),
+		"no expiry":   newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Expiry = nil }), nil),
+		"issuer":      newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Issuer = "other" }), nil),
+		"audience":    newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Audience = jwt.Audience{"other"} }), nil),
+		"no audience": newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Audience = nil }), nil),
+		"no issuer":   newTestToken(t, key, jose.ES256, with(func(c *jwt.Claims) { c.Issuer = "" }), nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := j.Authenticate(t.Context(), &Credentials{Token: token})
+			require.ErrorIs(t, err, ErrInvalidCredentials)
+		})
+	}
+
+	_, err := j.Authenticate(t.Context(), &Credentials{Token: newTestToken(t, key, jose.ES256, valid, nil)})
+	require.NoError(t, err)
+}
@@ -0,0 +1,29 @@
+package cluster
+
+import (
+	"context"
+
+	"github.com/foomo/contentserver/responses"
+)
+
+type (
+	// Message announces a snapshot that has been written to the shared history
+	Message struct {
+		// Origin identifies the replica which published the message
+		Origin string `json:"origin"`
+		// Key is the history key the snapshot has been written to
+		Key string `json:"key"`
+		// Revision of the snapshot, followers reuse it to serve the same version
+		Revision *responses.Revision `json:"revision"`
+	}
+	// PubSub distributes messages between the replicas of a cluster.
+	// Implementations must be safe for concurrent use.
+	PubSub interface {
+		// Publish sends the message to all subscribers, including the ones of the publishing replica
+		Publish(ctx context.Context, msg *Message) error
+		// Subscribe returns a channel of messages, which is closed when the context is done
+		Subscribe(ctx context.Context) (<-chan *Message, error)
+		// Close releases any resources held by the implementation
+		Close() error
+	}
+)
@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+)
+
+// Local is an in-process PubSub, replicas sharing an instance form a cluster.
+// It is meant for tests and for running several repos within one process.
+// Publish never blocks, subscribers which fall behind lose their oldest messages.
+type Local struct {
+	subscribers map[chan *Message]struct{}
+	lock        sync.RWMutex
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewLocal() *Local {
+	return &Local{
+		subscribers: map[chan *Message]struct{}{},
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (p *Local) Publish(ctx context.Context, msg *Message) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for c := range p.subscribers {
+		for sent := false; !sent; {
+			select {
+			case c <- msg:
+				sent = true
+			default:
+				// only the latest snapshot matters, make room by dropping the oldest message
+				select {
+				case <-c:
+				default:
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (p *Local) Subscribe(ctx context.Context) (<-chan *Message, error) {
+	c := make(chan *Message, 8)
+	p.lock.Lock()
+	p.subscribers[c] = struct{}{}
+	p.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		p.lock.Lock()
+		delete(p.subscribers, c)
+		close(c)
+		p.lock.Unlock()
+	}()
+	return c, nil
+}
+
+func (p *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"context"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// NATS distributes messages through a NATS subject
+type NATS struct {
+	l       *zap.Logger
+	conn    *nats.Conn
+	subject string
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewNATS connects to the NATS server(s) given as comma separated url
+func NewNATS(l *zap.Logger, url, subject string, opts ...nats.Option) (*NATS, error) {
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to nats")
+	}
+	return &NATS{
+		l:       l.Named("nats"),
+		conn:    conn,
+		subject: subject,
+	}, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (p *NATS) Publish(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode message")
+	}
+	if err := p.conn.Publish(p.subject, data); err != nil {
+		return errors.Wrap(err, "failed to publish message")
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *NATS) Subscribe(ctx context.Context) (<-chan *Message, error) {
+	natsMsgs := make(chan *nats.Msg, 64)
+	sub, err := p.conn.ChanSubscribe(p.subject, natsMsgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe")
+	}
+	c := make(chan *Message, 8)
+	go func() {
+		defer close(c)
+		defer func() {
+			if err := sub.Unsubscribe(); err != nil {
+				p.l.Warn("failed to unsubscribe", zap.Error(err))
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case natsMsg := <-natsMsgs:
+				msg := &Message{}
+				if err := json.Unmarshal(natsMsg.Data, msg); err != nil {
+					p.l.Error("failed to decode message", zap.Error(err))
+					continue
+				}
+				select {
+				case c <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (p *NATS) Close() error {
+	return p.conn.Drain()
+}
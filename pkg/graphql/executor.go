@@ -0,0 +1,444 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type (
+	// Request is a GraphQL request as sent by clients over http
+	Request struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName,omitempty"`
+		Variables     map[string]interface{} `json:"variables,omitempty"`
+	}
+	// Response is the result of a request, Data is encoded as json object in the order of the query
+	Response struct {
+		Data   *Result  `json:"data,omitempty"`
+		Errors []*Error `json:"errors,omitempty"`
+	}
+	// Result holds the values of the fields of an object
+	Result struct {
+		Keys   []string
+		Values map[string]interface{}
+	}
+	// Error is a request or field error
+	Error struct {
+		Message   string        `json:"message"`
+		Locations []Location    `json:"locations,omitempty"`
+		Path      []interface{} `json:"path,omitempty"`
+	}
+	Location struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+	}
+
+	// Object is a resolved value of an object type, its fields are resolved by the resolvers of the type
+	Object struct {
+		Type  string
+		Value interface{}
+	}
+	// Resolver resolves a field of the source value, it returns a json value, an Object or a []Object
+	Resolver func(ctx context.Context, source interface{}, args Arguments) (interface{}, error)
+	// Arguments of a field with the variables replaced
+	Arguments map[string]interface{}
+	// Schema maps type names to their field resolvers, Query is the root type
+	Schema map[string]map[string]Resolver
+	// ExecuteOption limits the execution of a request
+	ExecuteOption func(*executor)
+)
+
+// QueryType is the name of the root type
+const QueryType = "Query"
+
+const (
+	// DefaultMaxDepth limits the nesting of the selection sets, e.g. of children { parent { children ... } }
+	DefaultMaxDepth = 16
+	// DefaultMaxFields limits the number of resolved fields including the fields of all list items
+	DefaultMaxFields = 100000
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// MarshalJSON encodes the fields in their order
+func (r *Result) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, key := range r.Keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		keyBytes, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueBytes, err := json.Marshal(r.Values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(append(buf, keyBytes...), ':'), valueBytes...)
+	}
+	return append(buf, '}'), nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// ExecuteWithMaxDepth limits the nesting of the selection sets, default DefaultMaxDepth
+func ExecuteWithMaxDepth(v int) ExecuteOption {
+	return func(o *executor) {
+		o.maxDepth = v
+	}
+}
+
+// ExecuteWithMaxFields limits the number of resolved fields, default DefaultMaxFields
+func ExecuteWithMaxFields(v int) ExecuteOption {
+	return func(o *executor) {
+		o.maxFields = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Execute parses and executes a query operation, field errors are collected in the response
+// and do not fail the whole request. The error is returned for requests which can not be executed
+// or exceed the limits of the execution.
+func (s Schema) Execute(ctx context.Context, req *Request, root interface{}, opts ...ExecuteOption) (*Response, error) {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return nil, err
+	}
+	if op.typ != "query" {
+		return nil, &Error{Message: "only query operations are supported, not " + op.typ}
+	}
+	variables := map[string]interface{}{}
+	for _, def := range op.variables {
+		if value, ok := req.Variables[def.name]; ok {
+			variables[def.name] = value
+		} else {
+			variables[def.name] = def.defaultValue
+		}
+	}
+	e := &executor{
+		schema:    s,
+		doc:       doc,
+		variables: variables,
+		maxDepth:  DefaultMaxDepth,
+		maxFields: DefaultMaxFields,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	data := e.executeSelectionSet(ctx, QueryType, root, op.selectionSet, nil, 1)
+	if e.requestErr != nil {
+		return nil, e.requestErr
+	}
+	return &Response{Data: data, Errors: e.errors}, nil
+}
+
+// String returns the argument or an empty string
+func (a Arguments) String(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+}
+
+// Strings returns the argument as a list of strings, a single string is coerced to a list
+func (a Arguments) Strings(name string) ([]string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		ret := make([]string, len(v))
+		for i, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %q must be a list of strings", name)
+			}
+			ret[i] = s
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("argument %q must be a list of strings", name)
+	}
+}
+
+// Bool returns the argument or false
+func (a Arguments) Bool(name string) (bool, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	default:
+		return false, fmt.Errorf("argument %q must be a boolean", name)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+type executor struct {
+	schema    Schema
+	doc       *document
+	variables map[string]interface{}
+	errors    []*Error
+	maxDepth  int
+	maxFields int
+	fields    int
+	// requestErr stops the execution once a limit has been exceeded or the query is invalid
+	requestErr *Error
+}
+
+func selectOperation(doc *document, name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, &Error{Message: "operationName is required for documents with several operations"}
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: "unknown operation " + name}
+}
+
+// executeSelectionSet resolves the fields of an object, fields with the same response key are merged
+func (e *executor) executeSelectionSet(ctx context.Context, typ string, source interface{}, selections []selection, path []interface{}, depth int) *Result {
+	if depth > e.maxDepth {
+		e.limit(fmt.Sprintf("query exceeds the maximum depth of %d", e.maxDepth), path)
+		return nil
+	}
+	result := &Result{Values: map[string]interface{}{}}
+	merged := map[string]*field{}
+	for _, f := range e.collectFields(typ, selections, map[string]bool{}) {
+		key := f.name
+		if f.alias != "" {
+			key = f.alias
+		}
+		if m, ok := merged[key]; ok {
+			if m.name != f.name || !sameArguments(m.arguments, f.arguments) {
+				e.conflict(key, m, f, path)
+				return nil
+			}
+			m.selectionSet = append(m.selectionSet, f.selectionSet...)
+			continue
+		}
+		m := *f
+		m.selectionSet = append([]selection{}, f.selectionSet...)
+		merged[key] = &m
+		result.Keys = append(result.Keys, key)
+	}
+	for _, key := range result.Keys {
+		fieldPath := append(append([]interface{}{}, path...), key)
+		result.Values[key] = e.executeField(ctx, typ, source, merged[key], fieldPath, depth)
+	}
+	return result
+}
+
+func (e *executor) executeField(ctx context.Context, typ string, source interface{}, f *field, path []interface{}, depth int) interface{} {
+	if e.requestErr != nil {
+		return nil
+	}
+	if e.fields++; e.fields > e.maxFields {
+		e.limit(fmt.Sprintf("query exceeds the maximum of %d fields", e.maxFields), path)
+		return nil
+	}
+	if f.name == "__typename" {
+		return typ
+	}
+	resolver, ok := e.schema[typ][f.name]
+	if !ok {
+		e.fieldError(f, path, fmt.Errorf("unknown field %q on type %s", f.name, typ))
+		return nil
+	}
+	args, err := e.arguments(f.arguments)
+	if err != nil {
+		e.fieldError(f, path, err)
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		e.fieldError(f, path, err)
+		return nil
+	}
+	value, err := resolver(ctx, source, args)
+	if err != nil {
+		e.fieldError(f, path, err)
+		return nil
+	}
+	return e.completeValue(ctx, f, value, path, depth)
+}
+
+func (e *executor) completeValue(ctx context.Context, f *field, value interface{}, path []interface{}, depth int) interface{} {
+	switch v := value.(type) {
+	case Object:
+		if len(f.selectionSet) == 0 {
+			e.fieldError(f, path, fmt.Errorf("field %q of type %s must have a selection of subfields", f.name, v.Type))
+			return nil
+		}
+		return e.executeSelectionSet(ctx, v.Type, v.Value, f.selectionSet, path, depth+1)
+	case *Object:
+		if v == nil {
+			return nil
+		}
+		return e.completeValue(ctx, f, *v, path, depth)
+	case []Object:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.completeValue(ctx, f, item, append(append([]interface{}{}, path...), i), depth)
+		}
+		return list
+	case nil:
+		return nil
+	default:
+		if len(f.selectionSet) > 0 {
+			e.fieldError(f, path, fmt.Errorf("field %q is a scalar and must not have a selection", f.name))
+			return nil
+		}
+		return value
+	}
+}
+
+// collectFields flattens fragments and applies the skip and include directives
+func (e *executor) collectFields(typ string, selections []selection, visited map[string]bool) []*field {
+	var fields []*field
+	for _, sel := range selections {
+		switch s := sel.(type) {
+		case *field:
+			if e.included(s.directives) {
+				fields = append(fields, s)
+			}
+		case *fragment:
+			if e.included(s.directives) && (s.typeCondition == "" || s.typeCondition == typ) {
+				fields = append(fields, e.collectFields(typ, s.selectionSet, visited)...)
+			}
+		case *fragmentSpread:
+			f, ok := e.doc.fragments[s.name]
+			if !ok || visited[s.name] || !e.included(s.directives) || f.typeCondition != typ {
+				if !ok {
+					e.errors = append(e.errors, &Error{Message: "unknown fragment " + s.name})
+				}
+				continue
+			}
+			visited[s.name] = true
+			fields = append(fields, e.collectFields(typ, f.selectionSet, visited)...)
+		}
+	}
+	return fields
+}
+
+func (e *executor) included(directives []*directive) bool {
+	for _, d := range directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		value, err := e.value(d.arguments["if"])
+		if err != nil {
+			continue
+		}
+		if condition, _ := value.(bool); condition == (d.name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+// arguments replaces the variables of the arguments
+func (e *executor) arguments(args map[string]interface{}) (Arguments, error) {
+	ret := make(Arguments, len(args))
+	for name, value := range args {
+		v, err := e.value(value)
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = v
+	}
+	return ret, nil
+}
+
+func (e *executor) value(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case variable:
+		ret, ok := e.variables[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("undefined variable $%s", v)
+		}
+		return ret, nil
+	case enumValue:
+		return string(v), nil
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if ret[i], err = e.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if ret[key], err = e.value(item); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	default:
+		return v, nil
+	}
+}
+
+// limit stops the execution, the request fails with the error
+func (e *executor) limit(message string, path []interface{}) {
+	if e.requestErr == nil {
+		e.requestErr = &Error{Message: message, Path: path}
+	}
+}
+
+// conflict stops the execution, fields with the same response key must have the same name and arguments
+func (e *executor) conflict(key string, a, b *field, path []interface{}) {
+	if e.requestErr == nil {
+		e.requestErr = &Error{
+			Message:   fmt.Sprintf("fields %q conflict because they select different fields or arguments, use different aliases", key),
+			Locations: []Location{{Line: a.line, Column: a.column}, {Line: b.line, Column: b.column}},
+			Path:      path,
+		}
+	}
+}
+
+// sameArguments compares the arguments as written, variables by name
+func sameArguments(a, b map[string]interface{}) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (e *executor) fieldError(f *field, path []interface{}, err error) {
+	e.errors = append(e.errors, &Error{
+		Message:   strings.TrimSpace(err.Error()),
+		Locations: []Location{{Line: f.line, Column: f.column}},
+		Path:      path,
+	})
+}
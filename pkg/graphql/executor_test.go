@@ -0,0 +1,244 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNode struct {
+	id       string
+	parent   *testNode
+	children []*testNode
+}
+
+// testSchema serves a tree of nodes, the fields parent and children allow queries of any depth
+var testSchema = Schema{
+	QueryType: {
+		"node": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			id, err := args.String("id")
+			if err != nil {
+				return nil, err
+			}
+			root, _ := source.(*testNode)
+			if node := findTestNode(root, id); node != nil {
+				return Object{Type: "Node", Value: node}, nil
+			}
+			return nil, nil
+		},
+		"fail": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+	},
+	"Node": {
+		"id": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return source.(*testNode).id, nil
+		},
+		"parent": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			if parent := source.(*testNode).parent; parent != nil {
+				return &Object{Type: "Node", Value: parent}, nil
+			}
+			return (*Object)(nil), nil
+		},
+		"children": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			children := []Object{}
+			for _, child := range source.(*testNode).children {
+				children = append(children, Object{Type: "Node", Value: child})
+			}
+			return children, nil
+		},
+	},
+}
+
+// newTestTree returns a root with the children a and b, which have the children a1, a2 and b1, b2
+func newTestTree() *testNode {
+	root := &testNode{id: "root"}
+	for _, id := range []string{"a", "b"} {
+		child := &testNode{id: id, parent: root}
+		for _, suffix := range []string{"1", "2"} {
+			child.children = append(child.children, &testNode{id: id + suffix, parent: child})
+		}
+		root.children = append(root.children, child)
+	}
+	return root
+}
+
+func findTestNode(node *testNode, id string) *testNode {
+	if node == nil || node.id == id {
+		return node
+	}
+	for _, child := range node.children {
+		if found := findTestNode(child, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func executeTestQuery(t *testing.T, req *Request, opts ...ExecuteOption) (string, []*Error, error) {
+	t.Helper()
+	res, err := testSchema.Execute(t.Context(), req, newTestTree(), opts...)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(res.Data)
+	require.NoError(t, err)
+	return string(data), res.Errors, nil
+}
+
+func TestExecute(t *testing.T) {
+	data, errs, err := executeTestQuery(t, &Request{
+		Query: `query ($id: String, $withParent: Boolean = false) {
+			node(id: $id) {
+				__typename
+				key: id
+				...Children
+				parent @include(if: $withParent) { id }
+				parent @skip(if: true) { never: id }
+			}
+			missing: node(id: "missing") { id }
+		}
+		fragment Children on Node { children { id } children { parent { id } } }`,
+		Variables: map[string]interface{}{"id": "a"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, errs)
+	// fields are returned in the order of the query, fields with the same key are merged
+	assert.JSONEq(t, `{
+		"node": {
+			"__typename": "Node",
+			"key": "a",
+			"children": [{"id": "a1", "parent": {"id": "a"}}, {"id": "a2", "parent": {"id": "a"}}]
+		},
+		"missing": null
+	}`, data)
+	assert.Regexp(t, `^\{"node":\{"__typename":"Node","key":"a","children":`, data)
+}
+
+func TestExecuteFieldErrors(t *testing.T) {
+	data, errs, err := executeTestQuery(t, &Request{
+		Query: `{
+			fail
+			node(id: "root") { id unknown }
+			scalar: node(id: "root") { id { value } }
+			object: node(id: "root") { parent { id } children }
+		}`,
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"fail": null,
+		"node": {"id": "root", "unknown": null},
+		"scalar": {"id": null},
+		"object": {"parent": null, "children": [null, null]}
+	}`, data)
+
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	assert.Equal(t, []string{
+		"failed",
+		`unknown field "unknown" on type Node`,
+		`field "id" is a scalar and must not have a selection`,
+		`field "children" of type Node must have a selection of subfields`,
+		`field "children" of type Node must have a selection of subfields`,
+	}, messages)
+	assert.Equal(t, []interface{}{"node", "unknown"}, errs[1].Path)
+	assert.Equal(t, []Location{{Line: 3, Column: 26}}, errs[1].Locations)
+	assert.Equal(t, []interface{}{"object", "children", 1}, errs[4].Path)
+}
+
+func TestExecuteRequestErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		req     *Request
+		message string
+	}{
+		"syntax":             {&Request{Query: `{`}, "syntax error: expected name, found end of document"},
+		"mutation":           {&Request{Query: `mutation { a }`}, "only query operations are supported, not mutation"},
+		"operation required": {&Request{Query: `query A { a } query B { b }`}, "operationName is required for documents with several operations"},
+		"unknown operation":  {&Request{Query: `query A { a }`, OperationName: "B"}, "unknown operation B"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := executeTestQuery(t, test.req)
+			var gqlErr *Error
+			require.ErrorAs(t, err, &gqlErr)
+			assert.Equal(t, test.message, gqlErr.Message)
+		})
+	}
+
+	data, _, err := executeTestQuery(t, &Request{Query: `query A { a: node(id: "a") { id } } query B { b: node(id: "b") { id } }`, OperationName: "B"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"b": {"id": "b"}}`, data)
+}
+
+func TestExecuteFieldConflicts(t *testing.T) {
+	for name, query := range map[string]string{
+		"names":     `{ node(id: "a") { id: parent { id } id } }`,
+		"arguments": `{ node(id: "a") { id } node(id: "b") { id } }`,
+		"variables": `query ($a: String, $b: String) { node(id: $a) { id } node(id: $b) { id } }`,
+		"missing":   `{ node(id: "a") { id } node { id } }`,
+		"fragment":  `{ node(id: "a") { id ...Parent } } fragment Parent on Node { id: parent { id } }`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := executeTestQuery(t, &Request{Query: query})
+			var gqlErr *Error
+			require.ErrorAs(t, err, &gqlErr)
+			assert.Contains(t, gqlErr.Message, "conflict")
+			assert.Len(t, gqlErr.Locations, 2)
+		})
+	}
+
+	// the same field with the same arguments is merged
+	data, _, err := executeTestQuery(t, &Request{Query: `query ($id: String) { node(id: $id) { id } node(id: $id) { key: id } }`, Variables: map[string]interface{}{"id": "a"}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"node": {"id": "a", "key": "a"}}`, data)
+}
+
+func TestExecuteMaxDepth(t *testing.T) {
+	// depth 1 is the query, node is depth 2 and every parent one more
+	query := `{ node(id: "a1") { parent { parent { id } } } }`
+
+	data, _, err := executeTestQuery(t, &Request{Query: query}, ExecuteWithMaxDepth(4))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"node": {"parent": {"parent": {"id": "root"}}}}`, data)
+
+	_, _, err = executeTestQuery(t, &Request{Query: query}, ExecuteWithMaxDepth(3))
+	var gqlErr *Error
+	require.ErrorAs(t, err, &gqlErr)
+	assert.Equal(t, "query exceeds the maximum depth of 3", gqlErr.Message)
+	assert.Equal(t, []interface{}{"node", "parent", "parent"}, gqlErr.Path)
+}
+
+func TestExecuteMaxFields(t *testing.T) {
+	// children { parent { children ... } } doubles the fields with every level
+	query := `{ node(id: "root") { children { parent { children { parent { children { id } } } } } } }`
+
+	// node, children, 2 parents, 2 children, 4 parents, 4 children and 8 ids
+	data, _, err := executeTestQuery(t, &Request{Query: query}, ExecuteWithMaxFields(22))
+	require.NoError(t, err)
+	assert.NotEmpty(t, data)
+
+	_, _, err = executeTestQuery(t, &Request{Query: query}, ExecuteWithMaxFields(21))
+	var gqlErr *Error
+	require.ErrorAs(t, err, &gqlErr)
+	assert.Equal(t, "query exceeds the maximum of 21 fields", gqlErr.Message)
+
+	// the defaults stop cycles which would grow exponentially
+	cyclic := `{ node(id: "root") { ` + strings.Repeat("children { parent { ", 12) + "id" + strings.Repeat(" } }", 12) + " } }"
+	_, _, err = executeTestQuery(t, &Request{Query: cyclic})
+	require.ErrorAs(t, err, &gqlErr)
+	assert.Equal(t, "query exceeds the maximum depth of 16", gqlErr.Message)
+}
+
+func TestExecuteCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	res, err := testSchema.Execute(ctx, &Request{Query: `{ node(id: "a") { id } }`}, newTestTree())
+	require.NoError(t, err)
+	require.Len(t, res.Errors, 1)
+	assert.Equal(t, context.Canceled.Error(), res.Errors[0].Message)
+}
@@ -0,0 +1,431 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// introspectionSDL describes the built-in scalars, directives and introspection types
+const introspectionSDL = `
+"The String scalar type represents textual data, represented as UTF-8 character sequences."
+scalar String
+"The Int scalar type represents non-fractional signed whole numeric values between -(2^31) and 2^31 - 1."
+scalar Int
+"The Float scalar type represents signed double-precision fractional values."
+scalar Float
+"The Boolean scalar type represents true or false."
+scalar Boolean
+"The ID scalar type represents a unique identifier."
+scalar ID
+
+"Directs the executor to include this field or fragment only when the if argument is true."
+directive @include("Included when true." if: Boolean!) on FIELD | FRAGMENT_SPREAD | INLINE_FRAGMENT
+"Directs the executor to skip this field or fragment when the if argument is true."
+directive @skip("Skipped when true." if: Boolean!) on FIELD | FRAGMENT_SPREAD | INLINE_FRAGMENT
+
+"A GraphQL Schema defines the capabilities of a GraphQL server."
+type __Schema {
+  description: String
+  types: [__Type!]!
+  queryType: __Type!
+  mutationType: __Type
+  subscriptionType: __Type
+  directives: [__Directive!]!
+}
+
+"The fundamental unit of any GraphQL Schema is the type."
+type __Type {
+  kind: __TypeKind!
+  name: String
+  description: String
+  specifiedByURL: String
+  fields(includeDeprecated: Boolean = false): [__Field!]
+  interfaces: [__Type!]
+  possibleTypes: [__Type!]
+  enumValues(includeDeprecated: Boolean = false): [__EnumValue!]
+  inputFields(includeDeprecated: Boolean = false): [__InputValue!]
+  ofType: __Type
+  isOneOf: Boolean
+}
+
+"An enum describing what kind of type a given __Type is."
+enum __TypeKind {
+  SCALAR
+  OBJECT
+  INTERFACE
+  UNION
+  ENUM
+  INPUT_OBJECT
+  LIST
+  NON_NULL
+}
+
+"Object and Interface types are described by a list of Fields, each of which has a name, potentially a list of arguments, and a return type."
+type __Field {
+  name: String!
+  description: String
+  args(includeDeprecated: Boolean = false): [__InputValue!]!
+  type: __Type!
+  isDeprecated: Boolean!
+  deprecationReason: String
+}
+
+"Arguments provided to Fields or Directives and the input fields of an InputObject are represented as Input Values which describe their type and optionally a default value."
+type __InputValue {
+  name: String!
+  description: String
+  type: __Type!
+  defaultValue: String
+  isDeprecated: Boolean!
+  deprecationReason: String
+}
+
+"One possible value for a given Enum."
+type __EnumValue {
+  name: String!
+  description: String
+  isDeprecated: Boolean!
+  deprecationReason: String
+}
+
+"A Directive provides a way to describe alternate runtime execution and type validation behavior in a GraphQL document."
+type __Directive {
+  name: String!
+  description: String
+  isRepeatable: Boolean!
+  locations: [__DirectiveLocation!]!
+  args(includeDeprecated: Boolean = false): [__InputValue!]!
+}
+
+"A Directive can be adjacent to many parts of the GraphQL language."
+enum __DirectiveLocation {
+  QUERY
+  MUTATION
+  SUBSCRIPTION
+  FIELD
+  FRAGMENT_DEFINITION
+  FRAGMENT_SPREAD
+  INLINE_FRAGMENT
+  VARIABLE_DEFINITION
+}
+`
+
+// introspection resolves the __schema and __type fields from the type system of a schema
+type introspection struct {
+	types *typeSystem
+}
+
+// WithIntrospection returns a copy of the schema answering the __schema and __type fields of the Query type.
+// The types are described by the sdl, a type system document with scalar, type and enum definitions.
+// Every field of the schema has to be described and every described object field has to be resolved.
+// Interfaces, unions, input objects and deprecations are not supported.
+func (s Schema) WithIntrospection(sdl string) (Schema, error) {
+	builtin, err := parseTypeSystem(introspectionSDL)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := parseTypeSystem(sdl)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range ts.names {
+		if _, ok := builtin.types[name]; ok {
+			return nil, fmt.Errorf("type %s is built in", name)
+		}
+		builtin.types[name] = ts.types[name]
+	}
+	builtin.names = append(builtin.names, ts.names...)
+	builtin.directives = append(builtin.directives, ts.directives...)
+	if err := s.validateTypes(builtin); err != nil {
+		return nil, err
+	}
+
+	i := &introspection{types: builtin}
+	ret := make(Schema, len(s)+6)
+	for typ, resolvers := range s {
+		ret[typ] = make(map[string]Resolver, len(resolvers)+2)
+		for name, resolver := range resolvers {
+			ret[typ][name] = resolver
+		}
+	}
+	ret[QueryType]["__schema"] = func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		return Object{Type: "__Schema"}, nil
+	}
+	ret[QueryType]["__type"] = func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		name, err := args.String("name")
+		if err != nil {
+			return nil, err
+		}
+		return i.namedType(name), nil
+	}
+	ret["__Schema"] = i.schemaResolvers()
+	ret["__Type"] = i.typeResolvers()
+	ret["__Field"] = i.fieldResolvers()
+	ret["__InputValue"] = i.inputValueResolvers()
+	ret["__EnumValue"] = i.enumValueResolvers()
+	ret["__Directive"] = i.directiveResolvers()
+	return ret, nil
+}
+
+// validateTypes checks that the types describe the resolvers of the schema and reference defined types only
+func (s Schema) validateTypes(ts *typeSystem) error {
+	if _, ok := s[QueryType]; !ok {
+		return fmt.Errorf("schema has no %s type", QueryType)
+	}
+	for typ, resolvers := range s {
+		def, ok := ts.types[typ]
+		if !ok || def.kind != "OBJECT" {
+			return fmt.Errorf("type %s is not described", typ)
+		}
+		for name := range resolvers {
+			if def.field(name) == nil {
+				return fmt.Errorf("field %s.%s is not described", typ, name)
+			}
+		}
+	}
+	for _, name := range ts.names {
+		def := ts.types[name]
+		for _, f := range def.fields {
+			if _, ok := s[name][f.name]; !ok && def.kind == "OBJECT" && !strings.HasPrefix(name, "__") {
+				return fmt.Errorf("field %s.%s is not resolved", name, f.name)
+			}
+			if err := ts.validateReference(f.typ); err != nil {
+				return fmt.Errorf("field %s.%s: %w", name, f.name, err)
+			}
+			for _, arg := range f.arguments {
+				if err := ts.validateReference(arg.typ); err != nil {
+					return fmt.Errorf("argument %s.%s(%s): %w", name, f.name, arg.name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (ts *typeSystem) validateReference(t *typeReference) error {
+	for t.ofType != nil {
+		t = t.ofType
+	}
+	if _, ok := ts.types[t.name]; !ok {
+		return fmt.Errorf("unknown type %s", t.name)
+	}
+	return nil
+}
+
+func (def *typeDefinition) field(name string) *fieldDefinition {
+	for _, f := range def.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// namedType returns the __Type of the named type or nil if it does not exist
+func (i *introspection) namedType(name string) interface{} {
+	if _, ok := i.types.types[name]; !ok {
+		return nil
+	}
+	return Object{Type: "__Type", Value: &typeReference{name: name}}
+}
+
+func (i *introspection) schemaResolvers() map[string]Resolver {
+	return map[string]Resolver{
+		"description": constantResolver(nil),
+		"types": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			ret := make([]Object, len(i.types.names))
+			for n, name := range i.types.names {
+				ret[n] = Object{Type: "__Type", Value: &typeReference{name: name}}
+			}
+			return ret, nil
+		},
+		"queryType": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return i.namedType(QueryType), nil
+		},
+		"mutationType":     constantResolver(nil),
+		"subscriptionType": constantResolver(nil),
+		"directives": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			ret := make([]Object, len(i.types.directives))
+			for n, d := range i.types.directives {
+				ret[n] = Object{Type: "__Directive", Value: d}
+			}
+			return ret, nil
+		},
+	}
+}
+
+func (i *introspection) typeResolvers() map[string]Resolver {
+	// named resolves fields of named types, they are null for LIST and NON_NULL
+	named := func(fn func(def *typeDefinition) interface{}) Resolver {
+		return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			t := source.(*typeReference) //nolint:forcetypeassert
+			if t.kind != "" {
+				return nil, nil
+			}
+			return fn(i.types.types[t.name]), nil
+		}
+	}
+	// kinds resolves fields of some kinds of named types only
+	kinds := func(fn func(def *typeDefinition) interface{}, kinds ...string) Resolver {
+		return named(func(def *typeDefinition) interface{} {
+			for _, kind := range kinds {
+				if def.kind == kind {
+					return fn(def)
+				}
+			}
+			return nil
+		})
+	}
+	return map[string]Resolver{
+		"kind": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			t := source.(*typeReference) //nolint:forcetypeassert
+			if t.kind != "" {
+				return t.kind, nil
+			}
+			return i.types.types[t.name].kind, nil
+		},
+		"name": named(func(def *typeDefinition) interface{} {
+			return def.name
+		}),
+		"description": named(func(def *typeDefinition) interface{} {
+			return description(def.description)
+		}),
+		"specifiedByURL": constantResolver(nil),
+		"fields": kinds(func(def *typeDefinition) interface{} {
+			ret := make([]Object, len(def.fields))
+			for n, f := range def.fields {
+				ret[n] = Object{Type: "__Field", Value: f}
+			}
+			return ret
+		}, "OBJECT"),
+		"interfaces": kinds(func(def *typeDefinition) interface{} {
+			return []Object{}
+		}, "OBJECT"),
+		"possibleTypes": constantResolver(nil),
+		"enumValues": kinds(func(def *typeDefinition) interface{} {
+			ret := make([]Object, len(def.enumValues))
+			for n, v := range def.enumValues {
+				ret[n] = Object{Type: "__EnumValue", Value: v}
+			}
+			return ret
+		}, "ENUM"),
+		"inputFields": constantResolver(nil),
+		"ofType": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			if t := source.(*typeReference); t.ofType != nil { //nolint:forcetypeassert
+				return Object{Type: "__Type", Value: t.ofType}, nil
+			}
+			return nil, nil
+		},
+		"isOneOf": constantResolver(nil),
+	}
+}
+
+func (i *introspection) fieldResolvers() map[string]Resolver {
+	field := func(fn func(f *fieldDefinition) interface{}) Resolver {
+		return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return fn(source.(*fieldDefinition)), nil //nolint:forcetypeassert
+		}
+	}
+	return map[string]Resolver{
+		"name": field(func(f *fieldDefinition) interface{} {
+			return f.name
+		}),
+		"description": field(func(f *fieldDefinition) interface{} {
+			return description(f.description)
+		}),
+		"args": field(func(f *fieldDefinition) interface{} {
+			return inputValues(f.arguments)
+		}),
+		"type": field(func(f *fieldDefinition) interface{} {
+			return Object{Type: "__Type", Value: f.typ}
+		}),
+		"isDeprecated":      constantResolver(false),
+		"deprecationReason": constantResolver(nil),
+	}
+}
+
+func (i *introspection) inputValueResolvers() map[string]Resolver {
+	inputValue := func(fn func(v *inputValueDefinition) interface{}) Resolver {
+		return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return fn(source.(*inputValueDefinition)), nil //nolint:forcetypeassert
+		}
+	}
+	return map[string]Resolver{
+		"name": inputValue(func(v *inputValueDefinition) interface{} {
+			return v.name
+		}),
+		"description": inputValue(func(v *inputValueDefinition) interface{} {
+			return description(v.description)
+		}),
+		"type": inputValue(func(v *inputValueDefinition) interface{} {
+			return Object{Type: "__Type", Value: v.typ}
+		}),
+		"defaultValue": inputValue(func(v *inputValueDefinition) interface{} {
+			if v.defaultValue == nil {
+				return nil
+			}
+			return *v.defaultValue
+		}),
+		"isDeprecated":      constantResolver(false),
+		"deprecationReason": constantResolver(nil),
+	}
+}
+
+func (i *introspection) enumValueResolvers() map[string]Resolver {
+	return map[string]Resolver{
+		"name": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return source.(*enumValueDefinition).name, nil //nolint:forcetypeassert
+		},
+		"description": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return description(source.(*enumValueDefinition).description), nil //nolint:forcetypeassert
+		},
+		"isDeprecated":      constantResolver(false),
+		"deprecationReason": constantResolver(nil),
+	}
+}
+
+func (i *introspection) directiveResolvers() map[string]Resolver {
+	directive := func(fn func(d *directiveDefinition) interface{}) Resolver {
+		return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			return fn(source.(*directiveDefinition)), nil //nolint:forcetypeassert
+		}
+	}
+	return map[string]Resolver{
+		"name": directive(func(d *directiveDefinition) interface{} {
+			return d.name
+		}),
+		"description": directive(func(d *directiveDefinition) interface{} {
+			return description(d.description)
+		}),
+		"isRepeatable": constantResolver(false),
+		"locations": directive(func(d *directiveDefinition) interface{} {
+			return d.locations
+		}),
+		"args": directive(func(d *directiveDefinition) interface{} {
+			return inputValues(d.arguments)
+		}),
+	}
+}
+
+func inputValues(values []*inputValueDefinition) []Object {
+	ret := make([]Object, len(values))
+	for n, v := range values {
+		ret[n] = Object{Type: "__InputValue", Value: v}
+	}
+	return ret
+}
+
+// description returns null for empty descriptions
+func description(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+func constantResolver(value interface{}) Resolver {
+	return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		return value, nil
+	}
+}
@@ -0,0 +1,140 @@
+package graphql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSDL = `
+type Query {
+  "A node by id."
+  node(id: String = "root"): Node
+  fail: String
+}
+type Node {
+  id: String!
+  parent: Node
+  children: [Node!]!
+}
+`
+
+// introspectionQuery is the query of GraphiQL and graphql-js getIntrospectionQuery
+const introspectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives { name description locations args { ...InputValue } }
+  }
+}
+fragment FullType on __Type {
+  kind
+  name
+  description
+  fields(includeDeprecated: true) {
+    name
+    description
+    args { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated
+    deprecationReason
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name description isDeprecated deprecationReason }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue {
+  name
+  description
+  type { ...TypeRef }
+  defaultValue
+}
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}
+`
+
+func TestWithIntrospection(t *testing.T) {
+	s, err := testSchema.WithIntrospection(testSDL)
+	require.NoError(t, err)
+	// the schema is not modified
+	assert.NotContains(t, testSchema[QueryType], "__schema")
+
+	res, err := s.Execute(t.Context(), &Request{Query: `{
+		__schema { queryType { name } directives { name } }
+		query: __type(name: "Query") { kind fields { name description args { name type { kind ofType { name } } defaultValue } } }
+		children: __type(name: "Node") { fields { name type { kind name ofType { kind ofType { kind ofType { name } } } } } }
+		kind: __type(name: "__TypeKind") { kind enumValues { name } fields { name } }
+		unknown: __type(name: "Unknown") { name }
+		node(id: "a") { id }
+	}`}, newTestTree())
+	require.NoError(t, err)
+	assert.Empty(t, res.Errors)
+	data, err := json.Marshal(res.Data)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"__schema": {"queryType": {"name": "Query"}, "directives": [{"name": "include"}, {"name": "skip"}]},
+		"query": {"kind": "OBJECT", "fields": [
+			{"name": "node", "description": "A node by id.", "args": [{"name": "id", "type": {"kind": "SCALAR", "ofType": null}, "defaultValue": "\"root\""}]},
+			{"name": "fail", "description": null, "args": []}
+		]},
+		"children": {"fields": [
+			{"name": "id", "type": {"kind": "NON_NULL", "name": null, "ofType": {"kind": "SCALAR", "ofType": null}}},
+			{"name": "parent", "type": {"kind": "OBJECT", "name": "Node", "ofType": null}},
+			{"name": "children", "type": {"kind": "NON_NULL", "name": null, "ofType": {"kind": "LIST", "ofType": {"kind": "NON_NULL", "ofType": {"name": "Node"}}}}}
+		]},
+		"kind": {"kind": "ENUM", "enumValues": [
+			{"name": "SCALAR"}, {"name": "OBJECT"}, {"name": "INTERFACE"}, {"name": "UNION"},
+			{"name": "ENUM"}, {"name": "INPUT_OBJECT"}, {"name": "LIST"}, {"name": "NON_NULL"}
+		], "fields": null},
+		"unknown": null,
+		"node": {"id": "a"}
+	}`, string(data))
+}
+
+func TestWithIntrospectionErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		sdl     string
+		message string
+	}{
+		"syntax":         {`type Query {`, "syntax error: expected name, found end of document"},
+		"built in":       {testSDL + `scalar String`, "type String is built in"},
+		"missing type":   {`type Query { node(id: String): Node fail: String }`, "type Node is not described"},
+		"missing field":  {`type Query { fail: String } type Node { id: String! parent: Node children: [Node!]! }`, "field Query.node is not described"},
+		"not resolved":   {testSDL + `type Other { id: String }`, "field Other.id is not resolved"},
+		"unknown type":   {`type Query { node(id: ID): Node fail: Unknown } type Node { id: String! parent: Node children: [Node!]! }`, "field Query.fail: unknown type Unknown"},
+		"unknown arg":    {`type Query { node(id: Unknown): Node fail: String } type Node { id: String! parent: Node children: [Node!]! }`, "argument Query.node(id): unknown type Unknown"},
+		"duplicate type": {testSDL + `type Node { id: String }`, `syntax error: duplicate type "Node"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := testSchema.WithIntrospection(test.sdl)
+			require.EqualError(t, err, test.message)
+		})
+	}
+}
+
+func TestContentSchemaIntrospection(t *testing.T) {
+	// the introspection does not resolve anything of the snapshot
+	res, err := ContentSchema.Execute(t.Context(), &Request{Query: introspectionQuery}, nil)
+	require.NoError(t, err)
+	require.Empty(t, res.Errors)
+
+	schema, ok := res.Data.Values["__schema"].(*Result)
+	require.True(t, ok)
+	types, ok := schema.Values["types"].([]interface{})
+	require.True(t, ok)
+	names := make([]interface{}, len(types))
+	for i, typ := range types {
+		names[i] = typ.(*Result).Values["name"] //nolint:forcetypeassert
+	}
+	for _, name := range []string{"String", "JSON", "Query", "Dimension", "Node", "URI", "__Schema", "__Type", "__TypeKind"} {
+		assert.Contains(t, names, name)
+	}
+}
@@ -0,0 +1,671 @@
+package graphql
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser supports the executable subset of the GraphQL language needed for queries:
+// operations with variable definitions, fields with aliases and arguments, fragments,
+// inline fragments and the @skip and @include directives. Type system definitions are rejected in queries,
+// parseTypeSystem reads the scalar, type, enum and directive definitions describing a schema.
+
+type (
+	document struct {
+		operations []*operation
+		fragments  map[string]*fragment
+	}
+	operation struct {
+		typ          string
+		name         string
+		variables    []*variableDefinition
+		selectionSet []selection
+	}
+	variableDefinition struct {
+		name         string
+		defaultValue interface{}
+	}
+	fragment struct {
+		name          string
+		typeCondition string
+		directives    []*directive
+		selectionSet  []selection
+	}
+	// selection is a *field, *fragmentSpread or *fragment (inline)
+	selection interface{}
+	field     struct {
+		alias        string
+		name         string
+		arguments    map[string]interface{}
+		directives   []*directive
+		selectionSet []selection
+		line         int
+		column       int
+	}
+	fragmentSpread struct {
+		name       string
+		directives []*directive
+	}
+	directive struct {
+		name      string
+		arguments map[string]interface{}
+	}
+	// variable is a reference to a variable in a value
+	variable string
+	// enumValue is an unquoted name in a value
+	enumValue string
+)
+
+// type system documents describe the schema for the introspection, see Schema.WithIntrospection
+type (
+	typeSystem struct {
+		types      map[string]*typeDefinition
+		names      []string
+		directives []*directiveDefinition
+	}
+	// typeDefinition is a SCALAR, OBJECT or ENUM type
+	typeDefinition struct {
+		kind        string
+		name        string
+		description string
+		fields      []*fieldDefinition
+		enumValues  []*enumValueDefinition
+	}
+	fieldDefinition struct {
+		name        string
+		description string
+		arguments   []*inputValueDefinition
+		typ         *typeReference
+	}
+	inputValueDefinition struct {
+		name        string
+		description string
+		typ         *typeReference
+		// defaultValue is the default as GraphQL value, nil without default
+		defaultValue *string
+	}
+	enumValueDefinition struct {
+		name        string
+		description string
+	}
+	directiveDefinition struct {
+		name        string
+		description string
+		arguments   []*inputValueDefinition
+		locations   []string
+	}
+	// typeReference is a named type or a LIST or NON_NULL wrapper of ofType
+	typeReference struct {
+		kind   string
+		name   string
+		ofType *typeReference
+	}
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind   tokenKind
+	value  string
+	line   int
+	column int
+}
+
+// maxParseDepth limits the nesting of selection sets, values and types,
+// so deeply nested documents can not exhaust the stack
+const maxParseDepth = 128
+
+type parser struct {
+	src    string
+	pos    int
+	line   int
+	lineAt int
+	token  token
+	depth  int
+}
+
+// parse parses an executable document
+func parse(src string) (doc *document, err error) {
+	p := &parser{src: strings.TrimPrefix(src, "\ufeff"), line: 1}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			doc, err = nil, syntaxErr
+		}
+	}()
+	p.next()
+	doc = &document{fragments: map[string]*fragment{}}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunctuator, "{"):
+			doc.operations = append(doc.operations, &operation{typ: "query", selectionSet: p.parseSelectionSet()})
+		case p.peek(tokenName, "query"), p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			doc.operations = append(doc.operations, p.parseOperation())
+		case p.peek(tokenName, "fragment"):
+			f := p.parseFragment()
+			if _, ok := doc.fragments[f.name]; ok {
+				p.fail("duplicate fragment %q", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			p.fail("unexpected %s", p.describe())
+		}
+	}
+	if len(doc.operations) == 0 {
+		p.fail("no operation")
+	}
+	return doc, nil
+}
+
+// parseTypeSystem parses a type system document with scalar, type, enum and directive definitions,
+// descriptions are single line strings
+func parseTypeSystem(src string) (ts *typeSystem, err error) {
+	p := &parser{src: strings.TrimPrefix(src, "\ufeff"), line: 1}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			ts, err = nil, syntaxErr
+		}
+	}()
+	p.next()
+	ts = &typeSystem{types: map[string]*typeDefinition{}}
+	for p.token.kind != tokenEOF {
+		description := p.parseDescription()
+		if p.skip("directive") {
+			p.expect(tokenPunctuator, "@")
+			d := &directiveDefinition{name: p.expect(tokenName, "").value, description: description}
+			d.arguments = p.parseArgumentDefinitions()
+			p.expect(tokenName, "on")
+			p.skip("|")
+			d.locations = append(d.locations, p.expect(tokenName, "").value)
+			for p.skip("|") {
+				d.locations = append(d.locations, p.expect(tokenName, "").value)
+			}
+			ts.directives = append(ts.directives, d)
+			continue
+		}
+		def := &typeDefinition{description: description}
+		switch {
+		case p.skip("scalar"):
+			def.kind = "SCALAR"
+			def.name = p.expect(tokenName, "").value
+		case p.skip("type"):
+			def.kind = "OBJECT"
+			def.name = p.expect(tokenName, "").value
+			p.expect(tokenPunctuator, "{")
+			for !p.skip("}") {
+				f := &fieldDefinition{description: p.parseDescription()}
+				f.name = p.expect(tokenName, "").value
+				f.arguments = p.parseArgumentDefinitions()
+				p.expect(tokenPunctuator, ":")
+				f.typ = p.parseType()
+				def.fields = append(def.fields, f)
+			}
+		case p.skip("enum"):
+			def.kind = "ENUM"
+			def.name = p.expect(tokenName, "").value
+			p.expect(tokenPunctuator, "{")
+			for !p.skip("}") {
+				v := &enumValueDefinition{description: p.parseDescription()}
+				v.name = p.expect(tokenName, "").value
+				def.enumValues = append(def.enumValues, v)
+			}
+		default:
+			p.fail("unexpected %s", p.describe())
+		}
+		if _, ok := ts.types[def.name]; ok {
+			p.fail("duplicate type %q", def.name)
+		}
+		ts.types[def.name] = def
+		ts.names = append(ts.names, def.name)
+	}
+	return ts, nil
+}
+
+func (p *parser) parseDescription() string {
+	if p.peekKind(tokenString) {
+		return p.expect(tokenString, "").value
+	}
+	return ""
+}
+
+func (p *parser) parseArgumentDefinitions() []*inputValueDefinition {
+	var args []*inputValueDefinition
+	if !p.skip("(") {
+		return args
+	}
+	for !p.skip(")") {
+		arg := &inputValueDefinition{description: p.parseDescription()}
+		arg.name = p.expect(tokenName, "").value
+		p.expect(tokenPunctuator, ":")
+		arg.typ = p.parseType()
+		if p.skip("=") {
+			value := printValue(p.parseValue(true))
+			arg.defaultValue = &value
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+func (p *parser) parseOperation() *operation {
+	op := &operation{typ: p.expect(tokenName, "").value}
+	if p.token.kind == tokenName {
+		op.name = p.expect(tokenName, "").value
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			p.expect(tokenPunctuator, "$")
+			def := &variableDefinition{name: p.expect(tokenName, "").value}
+			p.expect(tokenPunctuator, ":")
+			p.parseType()
+			if p.skip("=") {
+				def.defaultValue = p.parseValue(true)
+			}
+			p.parseDirectives()
+			op.variables = append(op.variables, def)
+		}
+	}
+	p.parseDirectives()
+	op.selectionSet = p.parseSelectionSet()
+	return op
+}
+
+func (p *parser) parseFragment() *fragment {
+	p.expect(tokenName, "fragment")
+	f := &fragment{name: p.expect(tokenName, "").value}
+	if f.name == "on" {
+		p.fail("invalid fragment name %q", f.name)
+	}
+	p.expect(tokenName, "on")
+	f.typeCondition = p.expect(tokenName, "").value
+	f.directives = p.parseDirectives()
+	f.selectionSet = p.parseSelectionSet()
+	return f
+}
+
+func (p *parser) parseSelectionSet() []selection {
+	p.enter()
+	defer p.leave()
+	p.expect(tokenPunctuator, "{")
+	var selections []selection
+	for !p.skip("}") {
+		if p.skip("...") {
+			if p.peek(tokenName, "on") || !p.peekKind(tokenName) {
+				inline := &fragment{}
+				if p.skip("on") {
+					inline.typeCondition = p.expect(tokenName, "").value
+				}
+				inline.directives = p.parseDirectives()
+				inline.selectionSet = p.parseSelectionSet()
+				selections = append(selections, inline)
+			} else {
+				spread := &fragmentSpread{name: p.expect(tokenName, "").value}
+				spread.directives = p.parseDirectives()
+				selections = append(selections, spread)
+			}
+			continue
+		}
+		selections = append(selections, p.parseField())
+	}
+	if len(selections) == 0 {
+		p.fail("empty selection set")
+	}
+	return selections
+}
+
+func (p *parser) parseField() *field {
+	name := p.expect(tokenName, "")
+	f := &field{name: name.value, line: name.line, column: name.column}
+	if p.skip(":") {
+		f.alias = f.name
+		f.name = p.expect(tokenName, "").value
+	}
+	f.arguments = p.parseArguments(false)
+	f.directives = p.parseDirectives()
+	if p.peek(tokenPunctuator, "{") {
+		f.selectionSet = p.parseSelectionSet()
+	}
+	return f
+}
+
+func (p *parser) parseArguments(constant bool) map[string]interface{} {
+	args := map[string]interface{}{}
+	if !p.skip("(") {
+		return args
+	}
+	for !p.skip(")") {
+		name := p.expect(tokenName, "").value
+		p.expect(tokenPunctuator, ":")
+		args[name] = p.parseValue(constant)
+	}
+	return args
+}
+
+func (p *parser) parseDirectives() []*directive {
+	var directives []*directive
+	for p.skip("@") {
+		d := &directive{name: p.expect(tokenName, "").value}
+		d.arguments = p.parseArguments(false)
+		directives = append(directives, d)
+	}
+	return directives
+}
+
+// parseType parses a type reference, the types of variables are not checked, they are coerced by the resolvers
+func (p *parser) parseType() *typeReference {
+	p.enter()
+	defer p.leave()
+	var t *typeReference
+	if p.skip("[") {
+		t = &typeReference{kind: "LIST", ofType: p.parseType()}
+		p.expect(tokenPunctuator, "]")
+	} else {
+		t = &typeReference{name: p.expect(tokenName, "").value}
+	}
+	if p.skip("!") {
+		t = &typeReference{kind: "NON_NULL", ofType: t}
+	}
+	return t
+}
+
+func (p *parser) parseValue(constant bool) interface{} {
+	p.enter()
+	defer p.leave()
+	t := p.token
+	switch {
+	case p.skip("$"):
+		if constant {
+			p.fail("unexpected variable in constant value")
+		}
+		return variable(p.expect(tokenName, "").value)
+	case p.skip("["):
+		list := []interface{}{}
+		for !p.skip("]") {
+			list = append(list, p.parseValue(constant))
+		}
+		return list
+	case p.skip("{"):
+		object := map[string]interface{}{}
+		for !p.skip("}") {
+			name := p.expect(tokenName, "").value
+			p.expect(tokenPunctuator, ":")
+			object[name] = p.parseValue(constant)
+		}
+		return object
+	}
+	p.next()
+	switch t.kind {
+	case tokenInt:
+		v, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			p.fail("invalid int %s", t.value)
+		}
+		return v
+	case tokenFloat:
+		v, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			p.fail("invalid float %s", t.value)
+		}
+		return v
+	case tokenString:
+		return t.value
+	case tokenName:
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enumValue(t.value)
+	}
+	p.token = t
+	p.fail("unexpected %s", p.describe())
+	return nil
+}
+
+// printValue returns a constant value as GraphQL value, e.g. the default value of an argument
+func printValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		// json strings are valid GraphQL strings
+		b, _ := json.Marshal(v)
+		return string(b)
+	case enumValue:
+		return string(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = printValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			items[i] = key + ": " + printValue(v[key])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Tokens
+// ------------------------------------------------------------------------------------------------
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+func (p *parser) peekKind(kind tokenKind) bool {
+	return p.token.kind == kind
+}
+
+// skip consumes the punctuator or name if it is next
+func (p *parser) skip(value string) bool {
+	if (p.token.kind == tokenPunctuator || p.token.kind == tokenName) && p.token.value == value {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, value string) token {
+	t := p.token
+	if t.kind != kind || (value != "" && t.value != value) {
+		if value == "" {
+			value = [...]string{"end of document", "punctuator", "name", "int", "float", "string"}[kind]
+		}
+		p.fail("expected %s, found %s", value, p.describe())
+	}
+	p.next()
+	return t
+}
+
+func (p *parser) describe() string {
+	if p.token.kind == tokenEOF {
+		return "end of document"
+	}
+	return strconv.Quote(p.token.value)
+}
+
+// enter starts a nested part of the document, see maxParseDepth
+func (p *parser) enter() {
+	if p.depth++; p.depth > maxParseDepth {
+		p.fail("maximum nesting depth of %d exceeded", maxParseDepth)
+	}
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(&Error{
+		Message:   "syntax error: " + fmt.Sprintf(format, args...),
+		Locations: []Location{{Line: p.token.line, Column: p.token.column}},
+	})
+}
+
+// next reads the next token, skipping whitespace, commas and comments
+func (p *parser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\n':
+			p.pos++
+			p.line++
+			p.lineAt = p.pos
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			p.token = p.readToken()
+			return
+		}
+	}
+	p.token = token{kind: tokenEOF, line: p.line, column: p.pos - p.lineAt + 1}
+}
+
+func (p *parser) readToken() token {
+	t := token{line: p.line, column: p.pos - p.lineAt + 1}
+	// errors within the token are reported at its start
+	p.token = t
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		t.kind, t.value = tokenPunctuator, "..."
+	case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+		p.pos++
+		t.kind, t.value = tokenPunctuator, string(c)
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		t.kind, t.value = tokenName, p.src[start:p.pos]
+	case c == '-' || isDigit(c):
+		t.kind = tokenInt
+		p.pos++
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if isDigit(c) {
+				p.pos++
+			} else if c == '.' || c == 'e' || c == 'E' || ((c == '+' || c == '-') && t.kind == tokenFloat) {
+				t.kind = tokenFloat
+				p.pos++
+			} else {
+				break
+			}
+		}
+		t.value = p.src[start:p.pos]
+	case c == '"':
+		t.kind, t.value = tokenString, p.readString()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.fail("unexpected character %q", r)
+	}
+	return t
+}
+
+// readString reads a quoted string, block strings are not supported
+func (p *parser) readString() string {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		p.fail("block strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String()
+		case '\n':
+			p.fail("unterminated string")
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				p.fail("unterminated string")
+			}
+			escaped := p.src[p.pos+1]
+			p.pos += 2
+			switch escaped {
+			case '"', '\\', '/':
+				b.WriteByte(escaped)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					p.fail("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					p.fail("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				p.fail("invalid escape \\%c", escaped)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	p.fail("unterminated string")
+	return ""
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,157 @@
+package graphql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := parse(`
+		# a comment
+		query Page($uri: String! = "/", $ids: [String!]) @cached {
+			page: node(uri: $uri, limit: 10, ratio: 1.5e2, deep: {list: [1, "two", true, null, ENUM]}) {
+				id
+				...Fields @include(if: true)
+				... on Node { name }
+			}
+		}
+		fragment Fields on Node { title: string(field: "title\nä") }
+	`)
+	require.NoError(t, err)
+	require.Len(t, doc.operations, 1)
+
+	op := doc.operations[0]
+	assert.Equal(t, "query", op.typ)
+	assert.Equal(t, "Page", op.name)
+	require.Len(t, op.variables, 2)
+	assert.Equal(t, "uri", op.variables[0].name)
+	assert.Equal(t, "/", op.variables[0].defaultValue)
+	assert.Nil(t, op.variables[1].defaultValue)
+
+	require.Len(t, op.selectionSet, 1)
+	page, ok := op.selectionSet[0].(*field)
+	require.True(t, ok)
+	assert.Equal(t, "page", page.alias)
+	assert.Equal(t, "node", page.name)
+	assert.Equal(t, 4, page.line)
+	assert.Equal(t, variable("uri"), page.arguments["uri"])
+	assert.Equal(t, int64(10), page.arguments["limit"])
+	assert.InDelta(t, 150.0, page.arguments["ratio"], 0)
+	assert.Equal(t, map[string]interface{}{
+		"list": []interface{}{int64(1), "two", true, nil, enumValue("ENUM")},
+	}, page.arguments["deep"])
+
+	require.Len(t, page.selectionSet, 3)
+	spread, ok := page.selectionSet[1].(*fragmentSpread)
+	require.True(t, ok)
+	assert.Equal(t, "Fields", spread.name)
+	require.Len(t, spread.directives, 1)
+	assert.Equal(t, "include", spread.directives[0].name)
+	inline, ok := page.selectionSet[2].(*fragment)
+	require.True(t, ok)
+	assert.Equal(t, "Node", inline.typeCondition)
+
+	require.Contains(t, doc.fragments, "Fields")
+	title, ok := doc.fragments["Fields"].selectionSet[0].(*field)
+	require.True(t, ok)
+	assert.Equal(t, "title\nä", title.arguments["field"])
+}
+
+func TestParseShorthand(t *testing.T) {
+	doc, err := parse(`{ a, b { c } }`)
+	require.NoError(t, err)
+	require.Len(t, doc.operations, 1)
+	assert.Equal(t, "query", doc.operations[0].typ)
+	assert.Len(t, doc.operations[0].selectionSet, 2)
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		query   string
+		message string
+		line    int
+		column  int
+	}{
+		"empty document":        {``, "syntax error: no operation", 1, 1},
+		"empty selection":       {`{}`, "syntax error: empty selection set", 1, 3},
+		"unterminated":          {`{ a`, "syntax error: expected name, found end of document", 1, 4},
+		"unexpected character":  {"{\n  a ? }", "syntax error: unexpected character '?'", 2, 5},
+		"unterminated string":   {`{ a(b: "c) }`, "syntax error: unterminated string", 1, 8},
+		"variable in constant":  {`query ($a: Int = $b) { a }`, "syntax error: unexpected variable in constant value", 1, 19},
+		"duplicate fragment":    {`{ a } fragment F on T { a } fragment F on T { a }`, "syntax error: duplicate fragment \"F\"", 1, 50},
+		"type system":           {`type Query { a: Int }`, "syntax error: unexpected \"type\"", 1, 1},
+		"fragment named on":     {`fragment on on T { a }`, "syntax error: invalid fragment name \"on\"", 1, 13},
+		"block string":          {`{ a(b: """c""") }`, "syntax error: block strings are not supported", 1, 8},
+		"invalid escape":        {`{ a(b: "\x") }`, "syntax error: invalid escape \\x", 1, 8},
+		"missing argument name": {`{ a(: 1) }`, "syntax error: expected name, found \":\"", 1, 5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parse(test.query)
+			require.Error(t, err)
+			var gqlErr *Error
+			require.ErrorAs(t, err, &gqlErr)
+			assert.Equal(t, test.message, gqlErr.Message)
+			assert.Equal(t, []Location{{Line: test.line, Column: test.column}}, gqlErr.Locations)
+		})
+	}
+}
+
+func TestParseMaxDepth(t *testing.T) {
+	for name, query := range map[string]string{
+		"selection sets": strings.Repeat("{ a ", maxParseDepth+1) + strings.Repeat("}", maxParseDepth+1),
+		"lists":          "{ a(b: " + strings.Repeat("[", 3_000_000) + ") }",
+		"objects":        "{ a(b: " + strings.Repeat("{c: ", maxParseDepth+1) + ") }",
+		"types":          "query ($a: " + strings.Repeat("[", maxParseDepth+1) + "Int" + " { a }",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parse(query)
+			var gqlErr *Error
+			require.ErrorAs(t, err, &gqlErr)
+			assert.Equal(t, "syntax error: maximum nesting depth of 128 exceeded", gqlErr.Message)
+		})
+	}
+
+	// the limit itself is fine
+	query := strings.Repeat("{ a ", maxParseDepth) + strings.Repeat("}", maxParseDepth)
+	_, err := parse(query)
+	require.NoError(t, err)
+}
+
+func TestParseTypeSystem(t *testing.T) {
+	ts, err := parseTypeSystem(`
+		"A scalar"
+		scalar JSON
+		enum Color { "the first" RED GREEN }
+		directive @cached(ttl: Int = 10, tags: [String!] = ["a", B], "nested" options: JSON = {b: null, a: 1.5}) on FIELD | QUERY
+		type Query {
+			"a field"
+			colors(first: Int!): [Color!]!
+		}
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"JSON", "Color", "Query"}, ts.names)
+	assert.Equal(t, "A scalar", ts.types["JSON"].description)
+	assert.Equal(t, "SCALAR", ts.types["JSON"].kind)
+	require.Len(t, ts.types["Color"].enumValues, 2)
+	assert.Equal(t, &enumValueDefinition{name: "RED", description: "the first"}, ts.types["Color"].enumValues[0])
+
+	require.Len(t, ts.directives, 1)
+	d := ts.directives[0]
+	assert.Equal(t, []string{"FIELD", "QUERY"}, d.locations)
+	defaults := make([]string, len(d.arguments))
+	for i, arg := range d.arguments {
+		defaults[i] = *arg.defaultValue
+	}
+	assert.Equal(t, []string{`10`, `["a", B]`, `{a: 1.5, b: null}`}, defaults)
+
+	f := ts.types["Query"].fields[0]
+	assert.Equal(t, "a field", f.description)
+	assert.Equal(t, &typeReference{kind: "NON_NULL", ofType: &typeReference{kind: "LIST", ofType: &typeReference{kind: "NON_NULL", ofType: &typeReference{name: "Color"}}}}, f.typ)
+	assert.Nil(t, f.arguments[0].defaultValue)
+
+	_, err = parseTypeSystem(`input Filter { a: Int }`)
+	require.EqualError(t, err, `syntax error: unexpected "input"`)
+}
@@ -0,0 +1,430 @@
+package graphql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/foomo/contentserver/content"
+	"github.com/foomo/contentserver/pkg/repo"
+)
+
+// ContentSDL describes ContentSchema, it is served by the introspection fields __schema and __type
+const ContentSDL = `
+"Arbitrary JSON data."
+scalar JSON
+
+type Query {
+  "All dimensions, sorted by name."
+  dimensions(groups: [String!]): [Dimension!]!
+  dimension(name: String!, groups: [String!]): Dimension
+  "A node by id or uri."
+  node(dimension: String!, id: String, uri: String, groups: [String!]): Node
+  "The uris of the nodes, links are followed."
+  uris(dimension: String!, ids: [String!]!): [URI!]!
+}
+
+type Dimension {
+  name: String!
+  root: Node
+  "A node by id or uri."
+  node(id: String, uri: String): Node
+  "The uris of the nodes, links are followed."
+  uris(ids: [String!]!): [URI!]!
+}
+
+type Node {
+  id: String!
+  name: String!
+  uri: String!
+  mimeType: String!
+  hidden: Boolean!
+  groups: [String!]!
+  linkId: String!
+  destinationId: String!
+  dimension: String!
+  destination: Node
+  parent: Node
+  "The ancestors, starting with the root."
+  path: [Node!]!
+  "The children, hidden children only if exposeHidden is true."
+  children(mimeTypes: [String!], exposeHidden: Boolean): [Node!]!
+  "The uris of the node in all dimensions."
+  uris: [URI!]!
+  "A data field or all data."
+  data(field: String): JSON
+  string(field: String!): String
+  int(field: String!): Int
+  float(field: String!): Float
+  boolean(field: String!): Boolean
+  strings(field: String!): [String!]
+}
+
+type URI {
+  id: String!
+  dimension: String!
+  uri: String!
+}
+`
+
+// ContentSchema exposes the content tree of a *repo.Snapshot, which has to be passed as root value.
+// All fields are resolved from the same snapshot. Nodes which can not be accessed by the groups given
+// to the query fields are null or omitted, like hidden children unless they are exposed explicitly.
+// The types are described by ContentSDL.
+var ContentSchema = func() Schema {
+	s, err := contentResolvers.WithIntrospection(ContentSDL)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}()
+
+var contentResolvers = Schema{
+	QueryType: {
+		"dimensions": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			s := source.(*repo.Snapshot) //nolint:forcetypeassert
+			groups, err := groupsArgument(ctx, args)
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(s.Directory()))
+			for name := range s.Directory() {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			ret := make([]Object, len(names))
+			for i, name := range names {
+				ret[i] = Object{Type: "Dimension", Value: newDimensionValue(s, name, groups)}
+			}
+			return ret, nil
+		},
+		"dimension": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			d, err := dimensionArgument(ctx, source.(*repo.Snapshot), args, "name") //nolint:forcetypeassert
+			if err != nil || d == nil {
+				return nil, err
+			}
+			return Object{Type: "Dimension", Value: d}, nil
+		},
+		"node": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			d, err := dimensionArgument(ctx, source.(*repo.Snapshot), args, "dimension") //nolint:forcetypeassert
+			if err != nil || d == nil {
+				return nil, err
+			}
+			return d.nodeByArguments(args)
+		},
+		"uris": func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+			d, err := dimensionArgument(ctx, source.(*repo.Snapshot), args, "dimension") //nolint:forcetypeassert
+			if err != nil || d == nil {
+				return nil, err
+			}
+			return d.uris(args)
+		},
+	},
+	"Dimension": {
+		"name": dimensionField(func(d *dimensionValue, args Arguments) (interface{}, error) {
+			return d.name, nil
+		}),
+		"root": dimensionField(func(d *dimensionValue, args Arguments) (interface{}, error) {
+			return d.object(d.dimension.Node), nil
+		}),
+		"node": dimensionField(func(d *dimensionValue, args Arguments) (interface{}, error) {
+			return d.nodeByArguments(args)
+		}),
+		"uris": dimensionField(func(d *dimensionValue, args Arguments) (interface{}, error) {
+			return d.uris(args)
+		}),
+	},
+	"Node": {
+		"id": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.ID, nil
+		}),
+		"name": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.Name, nil
+		}),
+		"uri": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			// follows links like getURIs
+			return n.dimension.snapshot.GetURIs(n.dimension.name, []string{n.node.ID})[n.node.ID], nil
+		}),
+		"mimeType": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.MimeType, nil
+		}),
+		"hidden": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.Hidden, nil
+		}),
+		"groups": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			if n.node.Groups == nil {
+				return []string{}, nil
+			}
+			return n.node.Groups, nil
+		}),
+		"linkId": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.LinkID, nil
+		}),
+		"destinationId": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.node.DestinationID, nil
+		}),
+		"dimension": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.dimension.name, nil
+		}),
+		"destination": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			if n.node.DestinationID == "" {
+				return nil, nil
+			}
+			return n.dimension.object(n.dimension.dimension.Directory[n.node.DestinationID]), nil
+		}),
+		"parent": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			return n.dimension.object(n.node.GetParent()), nil
+		}),
+		"path": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			var path []Object
+			for parent := n.node.GetParent(); parent != nil; parent = parent.GetParent() {
+				if !parent.CanBeAccessedByGroups(n.dimension.groups) {
+					return nil, errors.New("path contains a node which can not be accessed")
+				}
+				path = append([]Object{{Type: "Node", Value: &nodeValue{dimension: n.dimension, node: parent}}}, path...)
+			}
+			if path == nil {
+				path = []Object{}
+			}
+			return path, nil
+		}),
+		"children": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			mimeTypes, err := args.Strings("mimeTypes")
+			if err != nil {
+				return nil, err
+			}
+			exposeHidden, err := args.Bool("exposeHidden")
+			if err != nil {
+				return nil, err
+			}
+			children := []Object{}
+			for _, id := range n.node.Index {
+				child, ok := n.node.Nodes[id]
+				if !ok || (child.Hidden && !exposeHidden) || !child.IsOneOfTheseMimeTypes(mimeTypes) {
+					continue
+				}
+				if obj := n.dimension.object(child); obj != nil {
+					children = append(children, *obj)
+				}
+			}
+			return children, nil
+		}),
+		"uris": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			s := n.dimension.snapshot
+			names := make([]string, 0, len(s.Directory()))
+			for name, d := range s.Directory() {
+				if node, ok := d.Directory[n.node.ID]; ok && node.CanBeAccessedByGroups(n.dimension.groups) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			ret := make([]Object, len(names))
+			for i, name := range names {
+				ret[i] = Object{Type: "URI", Value: &uriValue{
+					ID:        n.node.ID,
+					Dimension: name,
+					URI:       s.GetURIs(name, []string{n.node.ID})[n.node.ID],
+				}}
+			}
+			return ret, nil
+		}),
+		"data": nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+			name, err := args.String("field")
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				return n.node.Data, nil
+			}
+			return n.node.Data[name], nil
+		}),
+		"string": dataField(func(value interface{}) (interface{}, bool) {
+			v, ok := value.(string)
+			return v, ok
+		}),
+		"int": dataField(func(value interface{}) (interface{}, bool) {
+			switch v := value.(type) {
+			case float64:
+				return int64(v), v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32
+			case int:
+				return v, v >= math.MinInt32 && v <= math.MaxInt32
+			}
+			return nil, false
+		}),
+		"float": dataField(func(value interface{}) (interface{}, bool) {
+			switch v := value.(type) {
+			case float64:
+				return v, true
+			case int:
+				return float64(v), true
+			}
+			return nil, false
+		}),
+		"boolean": dataField(func(value interface{}) (interface{}, bool) {
+			v, ok := value.(bool)
+			return v, ok
+		}),
+		"strings": dataField(func(value interface{}) (interface{}, bool) {
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			ret := make([]string, len(list))
+			for i, item := range list {
+				if ret[i], ok = item.(string); !ok {
+					return nil, false
+				}
+			}
+			return ret, true
+		}),
+	},
+	"URI": {
+		"id":        uriField(func(u *uriValue) interface{} { return u.ID }),
+		"dimension": uriField(func(u *uriValue) interface{} { return u.Dimension }),
+		"uri":       uriField(func(u *uriValue) interface{} { return u.URI }),
+	},
+}
+
+type (
+	// dimensionValue carries the groups of the query field to all nodes below it
+	dimensionValue struct {
+		snapshot  *repo.Snapshot
+		name      string
+		dimension *repo.Dimension
+		groups    []string
+	}
+	nodeValue struct {
+		dimension *dimensionValue
+		node      *content.RepoNode
+	}
+	uriValue struct {
+		ID        string
+		Dimension string
+		URI       string
+	}
+	groupsContextKey struct{}
+)
+
+// ContextWithGroups returns a context replacing the groups arguments of all query fields,
+// e.g. by the groups of an authenticated client
+func ContextWithGroups(ctx context.Context, groups []string) context.Context {
+	return context.WithValue(ctx, groupsContextKey{}, groups)
+}
+
+func newDimensionValue(s *repo.Snapshot, name string, groups []string) *dimensionValue {
+	return &dimensionValue{
+		snapshot:  s,
+		name:      name,
+		dimension: s.Directory()[name],
+		groups:    groups,
+	}
+}
+
+// dimensionArgument returns the dimension named by the argument or nil if it does not exist
+func dimensionArgument(ctx context.Context, s *repo.Snapshot, args Arguments, arg string) (*dimensionValue, error) {
+	name, err := args.String(arg)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("argument %q is required", arg)
+	}
+	groups, err := groupsArgument(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.Directory()[name]; !ok {
+		return nil, nil //nolint:nilnil
+	}
+	return newDimensionValue(s, name, groups), nil
+}
+
+// groupsArgument returns the groups of the context, see ContextWithGroups, or the groups argument
+func groupsArgument(ctx context.Context, args Arguments) ([]string, error) {
+	if groups, ok := ctx.Value(groupsContextKey{}).([]string); ok {
+		return groups, nil
+	}
+	return args.Strings("groups")
+}
+
+// object returns the node as object, nil if it does not exist or can not be accessed
+func (d *dimensionValue) object(node *content.RepoNode) *Object {
+	if node == nil || !node.CanBeAccessedByGroups(d.groups) {
+		return nil
+	}
+	return &Object{Type: "Node", Value: &nodeValue{dimension: d, node: node}}
+}
+
+func (d *dimensionValue) nodeByArguments(args Arguments) (interface{}, error) {
+	id, err := args.String("id")
+	if err != nil {
+		return nil, err
+	}
+	uri, err := args.String("uri")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case id != "" && uri != "":
+		return nil, errors.New("either id or uri must be given, not both")
+	case id != "":
+		return d.object(d.dimension.Directory[id]), nil
+	case uri != "":
+		return d.object(d.dimension.URIDirectory[uri]), nil
+	}
+	return nil, errors.New("id or uri is required")
+}
+
+func (d *dimensionValue) uris(args Arguments) (interface{}, error) {
+	ids, err := args.Strings("ids")
+	if err != nil {
+		return nil, err
+	}
+	uris := d.snapshot.GetURIs(d.name, ids)
+	ret := make([]Object, 0, len(ids))
+	for _, id := range ids {
+		if uri, ok := uris[id]; ok && uri != "" {
+			ret = append(ret, Object{Type: "URI", Value: &uriValue{ID: id, Dimension: d.name, URI: uri}})
+		}
+	}
+	return ret, nil
+}
+
+func dimensionField(fn func(d *dimensionValue, args Arguments) (interface{}, error)) Resolver {
+	return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		return fn(source.(*dimensionValue), args) //nolint:forcetypeassert
+	}
+}
+
+func nodeField(fn func(n *nodeValue, args Arguments) (interface{}, error)) Resolver {
+	return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		return fn(source.(*nodeValue), args) //nolint:forcetypeassert
+	}
+}
+
+// dataField resolves a typed data field, missing fields are null and fields of another type an error
+func dataField(convert func(value interface{}) (interface{}, bool)) Resolver {
+	return nodeField(func(n *nodeValue, args Arguments) (interface{}, error) {
+		name, err := args.String("field")
+		if err != nil {
+			return nil, err
+		}
+		value, ok := n.node.Data[name]
+		if !ok || value == nil {
+			return nil, nil
+		}
+		ret, ok := convert(value)
+		if !ok {
+			return nil, fmt.Errorf("data field %q has another type", name)
+		}
+		return ret, nil
+	})
+}
+
+func uriField(fn func(u *uriValue) interface{}) Resolver {
+	return func(ctx context.Context, source interface{}, args Arguments) (interface{}, error) {
+		return fn(source.(*uriValue)), nil //nolint:forcetypeassert
+	}
+}
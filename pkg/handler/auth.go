@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"maps"
+	"net/http"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+)
+
+// DefaultPermissions maps the routes to the permission they require, routes which are not listed require
+// auth.PermissionAdmin and routes with an empty permission are open to everyone
+var DefaultPermissions = map[Route]string{
+	RouteGetURIs:         auth.PermissionRead,
+	RouteGetContent:      auth.PermissionRead,
+	RouteGetContentBatch: auth.PermissionRead,
+	RouteGetNodes:        auth.PermissionRead,
+	RouteGraphQL:         auth.PermissionRead,
+	RouteWatch:           auth.PermissionRead,
+	RouteUpdate:          auth.PermissionUpdate,
+	RouteGetRepo:         auth.PermissionRepo,
+	RouteStatus:          auth.PermissionAdmin,
+	RouteAuthenticate:    "",
+}
+
+type (
+	authMiddleware struct {
+		l                *zap.Logger
+		authenticator    auth.Authenticator
+		permissions      map[Route]string
+		anonymous        *auth.Principal
+		groupsFromClaims bool
+	}
+	AuthOption func(*authMiddleware)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// MiddlewareAuth authenticates the credentials of the requests and rejects requests without the permission
+// of their route. Requests without credentials are anonymous, they have no permissions by default.
+func MiddlewareAuth(l *zap.Logger, authenticator auth.Authenticator, opts ...AuthOption) Middleware {
+	inst := &authMiddleware{
+		l:             l.Named("auth"),
+		authenticator: authenticator,
+		permissions:   maps.Clone(DefaultPermissions),
+		anonymous:     &auth.Principal{},
+	}
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+
+	return inst.middleware
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// AuthWithPermissions sets the permissions of routes, the other routes keep their DefaultPermissions
+func AuthWithPermissions(v map[Route]string) AuthOption {
+	return func(o *authMiddleware) {
+		maps.Copy(o.permissions, v)
+	}
+}
+
+// AuthWithAnonymousPermissions grants permissions to requests without credentials, e.g. auth.PermissionRead
+func AuthWithAnonymousPermissions(v ...string) AuthOption {
+	return func(o *authMiddleware) {
+		o.anonymous.Permissions = v
+	}
+}
+
+// AuthWithGroupsFromClaims replaces the groups of the requests by the groups of the principal,
+// anonymous requests can only access nodes without groups
+func AuthWithGroupsFromClaims(v bool) AuthOption {
+	return func(o *authMiddleware) {
+		o.groupsFromClaims = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+func (m *authMiddleware) middleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req *Request) (*Reply, error) {
+		// connections may be authenticated already
+		principal := req.Principal
+		if principal == nil {
+			principal = m.anonymous
+			if !req.Credentials.Empty() {
+				p, err := m.authenticator.Authenticate(ctx, req.Credentials)
+				if err != nil {
+					m.l.Debug("authentication failed", zap.String("route", string(req.Route)), zap.String("source", req.Source), zap.Error(err))
+					return nil, responses.NewStatusError(http.StatusUnauthorized, responses.ErrorCodeUnauthorized, "invalid credentials")
+				}
+				principal = p
+			}
+		}
+
+		permission, ok := m.permissions[req.Route]
+		if !ok {
+			permission = auth.PermissionAdmin
+		}
+		if permission != "" && !principal.HasPermission(permission) {
+			if principal == m.anonymous {
+				return nil, responses.NewStatusError(http.StatusUnauthorized, responses.ErrorCodeUnauthorized, "authentication required")
+			}
+			return nil, responses.NewStatusError(http.StatusForbidden, responses.ErrorCodeForbidden, "permission required: "+permission)
+		}
+
+		req.Principal = principal
+		if m.groupsFromClaims {
+			// not nil, so principals without groups are restricted, too
+			req.Groups = append([]string{}, principal.Groups...)
+		}
+		return next(ctx, req)
+	}
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// newTestAuthDispatcher returns a dispatcher authenticating the tokens reader and admin and the hmac key updater
+func newTestAuthDispatcher(t *testing.T, opts ...AuthOption) *Dispatcher {
+	t.Helper()
+	authenticator := auth.Chain(
+		auth.NewBearer([]*auth.Identity{
+			{Subject: "reader", Secret: "reader", Permissions: []string{auth.PermissionRead}, Groups: []string{"www"}},
+			{Subject: "admin", Secret: "admin", Permissions: []string{auth.PermissionAdmin}},
+		}),
+		auth.NewHMAC([]*auth.Identity{
+			{Subject: "updater", Secret: "secret", Permissions: []string{auth.PermissionUpdate}},
+		}),
+	)
+	return newTestDispatcher(t, DispatcherWithMiddlewares(MiddlewareAuth(zaptest.NewLogger(t), authenticator, opts...)))
+}
+
+// dispatchEcho replaces the handler of the route and returns the request as seen by it or the error
+func dispatchEcho(t *testing.T, d *Dispatcher, route Route, credentials *auth.Credentials) (*Request, *responses.Error) {
+	t.Helper()
+	d.Handle(route, func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: req}, nil
+	})
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: route, Credentials: credentials})
+	if replyErr != nil {
+		return nil, replyErr
+	}
+	return reply.Value.(*Request), nil //nolint:forcetypeassert
+}
+
+func TestMiddlewareAuth(t *testing.T) {
+	d := newTestAuthDispatcher(t)
+	for name, test := range map[string]struct {
+		route       Route
+		credentials *auth.Credentials
+		status      int
+		code        int
+	}{
+		"anonymous":         {RouteGetContent, nil, http.StatusUnauthorized, responses.ErrorCodeUnauthorized},
+		"empty credentials": {RouteGetContent, &auth.Credentials{Route: string(RouteGetContent)}, http.StatusUnauthorized, responses.ErrorCodeUnauthorized},
+		"unknown token":     {RouteGetContent, &auth.Credentials{Token: "unknown"}, http.StatusUnauthorized, responses.ErrorCodeUnauthorized},
+		"invalid signature": {RouteUpdate, &auth.Credentials{Key: "updater", Signature: "invalid"}, http.StatusUnauthorized, responses.ErrorCodeUnauthorized},
+		"forbidden":         {RouteUpdate, &auth.Credentials{Token: "reader"}, http.StatusForbidden, responses.ErrorCodeForbidden},
+		"unlisted route":    {"echo", &auth.Credentials{Token: "reader"}, http.StatusForbidden, responses.ErrorCodeForbidden},
+		"admin":             {RouteUpdate, &auth.Credentials{Token: "admin"}, http.StatusForbidden, responses.ErrorCodeForbidden},
+		"read":              {RouteGetContent, &auth.Credentials{Token: "reader"}, http.StatusOK, 0},
+		"admin route":       {"echo", &auth.Credentials{Token: "admin"}, http.StatusOK, 0},
+		"open route":        {RouteAuthenticate, nil, http.StatusOK, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, replyErr := dispatchEcho(t, d, test.route, test.credentials)
+			if test.status == http.StatusOK {
+				require.Nil(t, replyErr)
+				return
+			}
+			require.NotNil(t, replyErr)
+			assert.Equal(t, test.status, replyErr.Status)
+			assert.Equal(t, test.code, replyErr.Code)
+		})
+	}
+
+	// hmac signatures are verified with the method, route and body of the request
+	credentials := &auth.Credentials{
+		Key:       "updater",
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Nonce:     "nonce",
+		Method:    auth.MethodSocket,
+		Route:     string(RouteUpdate),
+	}
+	credentials.Signature = auth.Sign([]byte("secret"), credentials.Method, credentials.Timestamp, credentials.Nonce, credentials.Route, nil)
+	req, replyErr := dispatchEcho(t, d, RouteUpdate, credentials)
+	require.Nil(t, replyErr)
+	assert.Equal(t, "updater", req.Principal.Subject)
+	// but only once
+	_, replyErr = dispatchEcho(t, d, RouteUpdate, credentials)
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusUnauthorized, replyErr.Status)
+}
+
+func TestMiddlewareAuthPermissions(t *testing.T) {
+	d := newTestAuthDispatcher(t,
+		AuthWithAnonymousPermissions(auth.PermissionRead),
+		AuthWithPermissions(map[Route]string{RouteStatus: auth.PermissionRead, "echo": ""}),
+	)
+
+	req, replyErr := dispatchEcho(t, d, RouteGetContent, nil)
+	require.Nil(t, replyErr)
+	assert.Empty(t, req.Principal.Subject)
+	assert.Equal(t, []string{auth.PermissionRead}, req.Principal.Permissions)
+	_, replyErr = dispatchEcho(t, d, RouteStatus, nil)
+	require.Nil(t, replyErr)
+	_, replyErr = dispatchEcho(t, d, "echo", nil)
+	require.Nil(t, replyErr)
+
+	// anonymous requests are asked for credentials, authenticated ones are forbidden
+	_, replyErr = dispatchEcho(t, d, RouteUpdate, nil)
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusUnauthorized, replyErr.Status)
+	_, replyErr = dispatchEcho(t, d, RouteGetRepo, &auth.Credentials{Token: "reader"})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusForbidden, replyErr.Status)
+
+	// the defaults are not modified
+	assert.Equal(t, auth.PermissionAdmin, DefaultPermissions[RouteStatus])
+}
+
+func TestMiddlewareAuthPrincipal(t *testing.T) {
+	d := newTestAuthDispatcher(t)
+	d.Handle(RouteGetNodes, func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: req}, nil
+	})
+
+	// authenticated connections pass the principal, the credentials are not checked again
+	principal := &auth.Principal{Subject: "connection", Permissions: []string{auth.PermissionRead}}
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: RouteGetNodes, Principal: principal, Credentials: &auth.Credentials{Token: "unknown"}})
+	require.Nil(t, replyErr)
+	assert.Same(t, principal, reply.Value.(*Request).Principal) //nolint:forcetypeassert
+
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: RouteUpdate, Principal: principal})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusForbidden, replyErr.Status)
+}
+
+func TestMiddlewareAuthGroups(t *testing.T) {
+	// the groups of the requests are trusted by default
+	req, replyErr := dispatchEcho(t, newTestAuthDispatcher(t), RouteGetContent, &auth.Credentials{Token: "reader"})
+	require.Nil(t, replyErr)
+	assert.Nil(t, req.Groups)
+
+	d := newTestAuthDispatcher(t, AuthWithGroupsFromClaims(true), AuthWithAnonymousPermissions(auth.PermissionRead))
+	req, replyErr = dispatchEcho(t, d, RouteGetContent, &auth.Credentials{Token: "reader"})
+	require.Nil(t, replyErr)
+	assert.Equal(t, []string{"www"}, req.Groups)
+
+	// clients without groups can only access nodes without groups
+	for route, credentials := range map[Route]*auth.Credentials{RouteGetContent: nil, "echo": {Token: "admin"}} {
+		req, replyErr = dispatchEcho(t, d, route, credentials)
+		require.Nil(t, replyErr)
+		assert.NotNil(t, req.Groups)
+		assert.Empty(t, req.Groups)
+	}
+
+	// the groups replace the groups of the content and node requests
+	req = &Request{Groups: []string{"www"}}
+	content := &requests.Content{
+		Env:   &requests.Env{Groups: []string{"intern"}},
+		Nodes: map[string]*requests.Node{"main": {Groups: []string{"intern"}}, "empty": nil},
+	}
+	req.restrictContent(content)
+	assert.Equal(t, []string{"www"}, content.Env.Groups)
+	assert.Equal(t, []string{"www"}, content.Nodes["main"].Groups)
+	content = &requests.Content{}
+	req.restrictContent(content)
+	assert.Equal(t, []string{"www"}, content.Env.Groups)
+	content = &requests.Content{Env: &requests.Env{Groups: []string{"intern"}}}
+	(&Request{}).restrictContent(content)
+	assert.Equal(t, []string{"intern"}, content.Env.Groups)
+}
@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/graphql"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+)
+
+type (
+	// Dispatcher answers the requests of all transports. Routes are registered with Handle,
+	// every request passes the middlewares in the order they were added.
+	Dispatcher struct {
+		l           *zap.Logger
+		repo        *repo.Repo
+		routes      map[Route]HandlerFunc
+		middlewares []Middleware
+	}
+	DispatcherOption func(*Dispatcher)
+	// Request to a route, independent of the transport. Transports pass the json of the request as Body
+	// or the decoded request as Value.
+	Request struct {
+		Route  Route
+		Source string
+		Body   []byte
+		Value  interface{}
+		// Credentials of the client, see MiddlewareAuth
+		Credentials *auth.Credentials
+		// Principal is the authenticated client, it is set by MiddlewareAuth or by transports with
+		// authenticated connections
+		Principal *auth.Principal
+		// Groups replace the groups of the request if they are not nil, see AuthWithGroupsFromClaims
+		Groups []string
+		// Snapshot the request is answered from, it is set by the dispatcher
+		Snapshot *repo.Snapshot
+	}
+	// Reply of a route, Version is the version of the repo that answered it
+	Reply struct {
+		Value   interface{}
+		Version string
+	}
+	// HandlerFunc answers a request, a *responses.Error is returned to the client as it is
+	HandlerFunc func(ctx context.Context, req *Request) (*Reply, error)
+	// Middleware wraps the handlers of all routes
+	Middleware func(next HandlerFunc) HandlerFunc
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewDispatcher returns a dispatcher serving the routes of the repo, metrics are recorded for all requests
+func NewDispatcher(l *zap.Logger, r *repo.Repo, opts ...DispatcherOption) *Dispatcher {
+	inst := &Dispatcher{
+		l:           l.Named("dispatcher"),
+		repo:        r,
+		routes:      map[Route]HandlerFunc{},
+		middlewares: []Middleware{MiddlewareMetrics()},
+	}
+
+	inst.Handle(RouteGetURIs, newRoute(func(ctx context.Context, req *Request, value *requests.URIs) (interface{}, error) {
+		return req.Snapshot.GetURIs(value.Dimension, value.IDs), nil
+	}))
+	inst.Handle(RouteGetContent, newRoute(func(ctx context.Context, req *Request, value *requests.Content) (interface{}, error) {
+		req.restrictContent(value)
+		return req.Snapshot.GetContent(value)
+	}))
+	inst.Handle(RouteGetContentBatch, newRoute(func(ctx context.Context, req *Request, value *requests.ContentBatch) (interface{}, error) {
+		for _, content := range value.Requests {
+			req.restrictContent(content)
+		}
+		return req.Snapshot.GetContentBatch(value)
+	}))
+	inst.Handle(RouteGetNodes, newRoute(func(ctx context.Context, req *Request, value *requests.Nodes) (interface{}, error) {
+		if req.Groups != nil {
+			value.Env = req.restrictEnv(value.Env)
+			req.restrictNodes(value.Nodes)
+		}
+		return req.Snapshot.GetNodes(value), nil
+	}))
+	inst.Handle(RouteStatus, newRoute(func(ctx context.Context, req *Request, value *requests.Status) (interface{}, error) {
+		return r.Status(ctx)
+	}))
+	inst.Handle(RouteUpdate, newRoute(func(ctx context.Context, req *Request, value *requests.Update) (interface{}, error) {
+		// the trigger is set on the context by the transport
+		reply := r.Update(ctx)
+		// echo the version the update resulted in
+		req.Snapshot = r.Snapshot()
+		return reply, nil
+	}))
+	inst.Handle(RouteGetRepo, func(ctx context.Context, req *Request) (*Reply, error) {
+		// the transports write the repo of the snapshot
+		s, err := r.RepoSnapshot(ctx)
+		if errors.Is(err, repo.ErrNotLoaded) {
+			return nil, responses.NewStatusError(http.StatusServiceUnavailable, responses.ErrorCodeNotLoaded, "repo not loaded yet")
+		} else if err != nil {
+			return nil, responses.NewError(responses.ErrorCodeRepo, "failed to get repo: "+err.Error())
+		}
+		return &Reply{Value: s, Version: s.Version()}, nil
+	})
+	inst.Handle(RouteWatch, func(ctx context.Context, req *Request) (*Reply, error) {
+		// the transports stream the changes once the request passed the middlewares
+		return &Reply{Version: req.Snapshot.Version()}, nil
+	})
+	inst.Handle(RouteAuthenticate, newRoute(func(ctx context.Context, req *Request, value *requests.Authenticate) (interface{}, error) {
+		// the credentials are passed by the transport
+		if req.Principal == nil {
+			return &auth.Principal{}, nil
+		}
+		return req.Principal, nil
+	}))
+	inst.Handle(RouteGraphQL, newRoute(func(ctx context.Context, req *Request, value *graphql.Request) (interface{}, error) {
+		if req.Groups != nil {
+			ctx = graphql.ContextWithGroups(ctx, req.Groups)
+		}
+		res, err := graphql.ContentSchema.Execute(ctx, value, req.Snapshot)
+		if err != nil {
+			// requests which can not be executed have no data
+			var gqlErr *graphql.Error
+			if !errors.As(err, &gqlErr) {
+				gqlErr = &graphql.Error{Message: err.Error()}
+			}
+			res = &graphql.Response{Errors: []*graphql.Error{gqlErr}}
+		}
+		return res, nil
+	}))
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// DispatcherWithMiddlewares adds middlewares, they are called in the given order after the metrics middleware
+func DispatcherWithMiddlewares(v ...Middleware) DispatcherOption {
+	return func(o *Dispatcher) {
+		o.middlewares = append(o.middlewares, v...)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Handle registers the handler of a route, an existing handler is replaced
+func (d *Dispatcher) Handle(route Route, handler HandlerFunc) {
+	d.routes[route] = handler
+}
+
+// Has reports whether the route is registered
+func (d *Dispatcher) Has(route Route) bool {
+	_, ok := d.routes[route]
+	return ok
+}
+
+// Dispatch answers the request through the middlewares. The reply is returned with the version of the repo
+// in case of an error, too.
+func (d *Dispatcher) Dispatch(ctx context.Context, req *Request) (*Reply, *responses.Error) {
+	if req.Snapshot == nil {
+		req.Snapshot = d.repo.Snapshot()
+	}
+	handler, ok := d.routes[req.Route]
+	if !ok {
+		handler = func(ctx context.Context, req *Request) (*Reply, error) {
+			return nil, responses.NewStatusError(http.StatusNotFound, responses.ErrorCodeUnknownRoute, "unknown route: "+string(req.Route))
+		}
+	}
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		handler = d.middlewares[i](handler)
+	}
+
+	reply, err := handler(ctx, req)
+	if err != nil {
+		return &Reply{Version: req.Snapshot.Version()}, d.replyError(req, err)
+	}
+	return reply, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// replyError returns the error as it is sent to clients
+func (d *Dispatcher) replyError(req *Request, err error) *responses.Error {
+	var replyErr *responses.Error
+	var replyErrValue responses.Error
+	switch {
+	case errors.As(err, &replyErr):
+		return replyErr
+	case errors.As(err, &replyErrValue):
+		return &replyErrValue
+	case errors.Is(err, repo.ErrInvalidRequest):
+		d.l.Debug("invalid request", zap.String("route", string(req.Route)), zap.Error(err))
+		return responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidRequest, err.Error())
+	default:
+		d.l.Error("an API error occurred", zap.String("route", string(req.Route)), zap.Error(err))
+		return responses.NewError(responses.ErrorCodeInternal, "internal error "+err.Error())
+	}
+}
+
+// restrictContent replaces the groups of the content request, see Groups
+func (r *Request) restrictContent(value *requests.Content) {
+	if r.Groups == nil || value == nil {
+		return
+	}
+	value.Env = r.restrictEnv(value.Env)
+	r.restrictNodes(value.Nodes)
+}
+
+func (r *Request) restrictEnv(env *requests.Env) *requests.Env {
+	if env == nil {
+		env = &requests.Env{}
+	}
+	env.Groups = r.Groups
+	return env
+}
+
+func (r *Request) restrictNodes(nodes map[string]*requests.Node) {
+	for _, node := range nodes {
+		if node != nil {
+			node.Groups = r.Groups
+		}
+	}
+}
+
+// requestValue returns the value of the request, the body is decoded once and kept as Value
+func requestValue[Req any](req *Request) (*Req, error) {
+	value, ok := req.Value.(*Req)
+	if req.Value != nil && !ok {
+		return nil, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidRequest, "unexpected request type")
+	}
+	if value == nil {
+		value = new(Req)
+		if err := json.Unmarshal(req.Body, value); err != nil {
+			return nil, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "could not read incoming json "+err.Error())
+		}
+		req.Value = value
+	}
+	return value, nil
+}
+
+// newRoute returns a handler decoding the request into Req, the reply has the version of the snapshot of the request
+func newRoute[Req any](fn func(ctx context.Context, req *Request, value *Req) (interface{}, error)) HandlerFunc {
+	return func(ctx context.Context, req *Request) (*Reply, error) {
+		value, err := requestValue[Req](req)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := fn(ctx, req, value)
+		if err != nil {
+			return nil, err
+		}
+		return &Reply{Value: reply, Version: req.Snapshot.Version()}, nil
+	}
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/time/rate"
+)
+
+// newTestDispatcher returns a dispatcher of a repo which has not loaded anything, it serves custom routes only
+func newTestDispatcher(tb testing.TB, opts ...DispatcherOption) *Dispatcher {
+	tb.Helper()
+	l := zaptest.NewLogger(tb)
+	h, err := repo.NewHistory(l, repo.HistoryWithHistoryDir(tb.TempDir()))
+	require.NoError(tb, err)
+	return NewDispatcher(l, repo.New(l, "", h), opts...)
+}
+
+// requestCount returns the requests counted by the metrics middleware
+func requestCount(route Route, result, source string) float64 {
+	return testutil.ToFloat64(metrics.ServiceRequestCounter.WithLabelValues(string(route), result, source))
+}
+
+// recordingMiddleware appends name to calls before and after the next handler
+func recordingMiddleware(calls *[]string, name string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			*calls = append(*calls, name+" before")
+			reply, err := next(ctx, req)
+			*calls = append(*calls, name+" after")
+			return reply, err
+		}
+	}
+}
+
+func TestDispatcherMiddlewareOrder(t *testing.T) {
+	var calls []string
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(
+		recordingMiddleware(&calls, "a"),
+		recordingMiddleware(&calls, "b"),
+	))
+	d.Handle("echo", func(ctx context.Context, req *Request) (*Reply, error) {
+		calls = append(calls, "handler")
+		return &Reply{Value: req.Source}, nil
+	})
+
+	count := requestCount("echo", "success", "test-order")
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: "echo", Source: "test-order"})
+	require.Nil(t, replyErr)
+	assert.Equal(t, "test-order", reply.Value)
+	assert.Equal(t, []string{"a before", "b before", "handler", "b after", "a after"}, calls)
+
+	// the metrics middleware is always the first one
+	assert.InDelta(t, count+1, requestCount("echo", "success", "test-order"), 0)
+}
+
+func TestDispatcherUnknownRoute(t *testing.T) {
+	var calls []string
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(recordingMiddleware(&calls, "a")))
+
+	assert.True(t, d.Has(RouteGetContent))
+	assert.False(t, d.Has("unknown"))
+
+	// unknown routes pass the middlewares, too
+	count := requestCount("unknown", "error", "test-unknown")
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: "unknown", Source: "test-unknown"})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusNotFound, replyErr.Status)
+	assert.Equal(t, responses.ErrorCodeUnknownRoute, replyErr.Code)
+	assert.Equal(t, "unknown route: unknown", replyErr.Message)
+	require.NotNil(t, reply)
+	assert.Empty(t, reply.Version)
+	assert.Equal(t, []string{"a before", "a after"}, calls)
+	assert.InDelta(t, count+1, requestCount("unknown", "error", "test-unknown"), 0)
+
+	// registered routes can be replaced
+	d.Handle(RouteWatch, func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: "watch"}, nil
+	})
+	reply, replyErr = d.Dispatch(t.Context(), &Request{Route: RouteWatch})
+	require.Nil(t, replyErr)
+	assert.Equal(t, "watch", reply.Value)
+}
+
+func TestDispatcherErrors(t *testing.T) {
+	d := newTestDispatcher(t)
+	for name, test := range map[string]struct {
+		err    error
+		status int
+		code   int
+	}{
+		"reply error":       {responses.NewStatusError(http.StatusConflict, responses.ErrorCodeRepo, "conflict"), http.StatusConflict, responses.ErrorCodeRepo},
+		"reply error value": {*responses.NewStatusError(http.StatusForbidden, responses.ErrorCodeForbidden, "forbidden"), http.StatusForbidden, responses.ErrorCodeForbidden},
+		"invalid request":   {errors.Join(repo.ErrInvalidRequest, errors.New("invalid")), http.StatusBadRequest, responses.ErrorCodeInvalidRequest},
+		"internal":          {errors.New("failed"), http.StatusInternalServerError, responses.ErrorCodeInternal},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d.Handle("fail", func(ctx context.Context, req *Request) (*Reply, error) {
+				return nil, test.err
+			})
+			_, replyErr := d.Dispatch(t.Context(), &Request{Route: "fail"})
+			require.NotNil(t, replyErr)
+			assert.Equal(t, test.status, replyErr.Status)
+			assert.Equal(t, test.code, replyErr.Code)
+		})
+	}
+
+	// requests are decoded by the routes
+	_, replyErr := d.Dispatch(t.Context(), &Request{Route: RouteGetURIs, Body: []byte("{")})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, http.StatusBadRequest, replyErr.Status)
+	assert.Equal(t, responses.ErrorCodeInvalidJSON, replyErr.Code)
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: RouteGetURIs, Value: "uris"})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, responses.ErrorCodeInvalidRequest, replyErr.Code)
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	var calls []string
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(
+		MiddlewareRateLimit(rate.NewLimiter(rate.Every(time.Hour), 2)),
+		recordingMiddleware(&calls, "a"),
+	))
+	d.Handle("echo", func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{}, nil
+	})
+
+	count := requestCount("echo", "error", "test-rate-limit")
+	for range 2 {
+		_, replyErr := d.Dispatch(t.Context(), &Request{Route: "echo", Source: "test-rate-limit"})
+		require.Nil(t, replyErr)
+	}
+
+	// the limit is shared by all routes, rejected requests do not reach the following middlewares
+	for _, route := range []Route{"echo", "unknown"} {
+		_, replyErr := d.Dispatch(t.Context(), &Request{Route: route, Source: "test-rate-limit"})
+		require.NotNil(t, replyErr)
+		assert.Equal(t, http.StatusTooManyRequests, replyErr.Status)
+		assert.Equal(t, responses.ErrorCodeRateLimited, replyErr.Code)
+	}
+	assert.Equal(t, []string{"a before", "a after", "a before", "a after"}, calls)
+	// the metrics middleware comes first and counts rejected requests
+	assert.InDelta(t, count+1, requestCount("echo", "error", "test-rate-limit"), 0)
+}
+
+func TestMiddlewareLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(MiddlewareLogger(zap.New(core))))
+	d.Handle("echo", func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: "echo"}, nil
+	})
+
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: "echo", Source: "test"})
+	require.Nil(t, replyErr)
+	assert.Equal(t, "echo", reply.Value)
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: "unknown", Source: "test"})
+	require.NotNil(t, replyErr)
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 2)
+	assert.Equal(t, zap.DebugLevel, entries[0].Level)
+	assert.Equal(t, "request", entries[0].Message)
+	assert.Equal(t, "echo", entries[0].ContextMap()["route"])
+	assert.Equal(t, zap.InfoLevel, entries[1].Level)
+	assert.Equal(t, "request failed", entries[1].Message)
+	assert.Equal(t, "unknown", entries[1].ContextMap()["route"])
+	assert.Contains(t, entries[1].ContextMap()["error"], "unknown route: unknown")
+}
+
+func TestMiddlewareTracing(t *testing.T) {
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(MiddlewareTracing()))
+	d.Handle("echo", func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: "echo"}, nil
+	})
+
+	// replies and errors are passed through
+	reply, replyErr := d.Dispatch(t.Context(), &Request{Route: "echo"})
+	require.Nil(t, replyErr)
+	assert.Equal(t, "echo", reply.Value)
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: "unknown"})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, responses.ErrorCodeUnknownRoute, replyErr.Code)
+}
+
+func TestMiddlewareValidate(t *testing.T) {
+	d := newTestDispatcher(t, DispatcherWithMiddlewares(MiddlewareValidate()))
+	env := &requests.Env{Dimensions: []string{"dimension_foo"}}
+	for name, test := range map[string]struct {
+		route   Route
+		body    string
+		value   interface{}
+		message string
+	}{
+		"uris without dimension":     {RouteGetURIs, `{"ids": ["a"]}`, nil, "invalid request: dimension must not be empty"},
+		"content without uri":        {RouteGetContent, "", &requests.Content{Env: env}, "invalid request: uri must not be empty"},
+		"content without env":        {RouteGetContent, `{"URI": "/a"}`, nil, "invalid request: env must not be nil"},
+		"content without dimensions": {RouteGetContent, `{"URI": "/a", "env": {"groups": ["www"]}}`, nil, "invalid request: env.dimensions must not be empty"},
+		"content with nil node":      {RouteGetContent, `{"URI": "/a", "env": {"dimensions": ["a"]}, "nodes": {"main": null}}`, nil, `invalid request: node "main" must not be nil`},
+		"nodes without env":          {RouteGetNodes, `{"nodes": {"main": {"id": "a"}}}`, nil, "invalid request: env must not be nil"},
+		"nodes without nodes":        {RouteGetNodes, "", &requests.Nodes{Env: env}, "invalid request: nodes must not be nil"},
+		"nodes with nil node":        {RouteGetNodes, `{"env": {}, "nodes": {"main": null}}`, nil, `invalid request: node "main" must not be nil`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, replyErr := d.Dispatch(t.Context(), &Request{Route: test.route, Body: []byte(test.body), Value: test.value})
+			require.NotNil(t, replyErr)
+			assert.Equal(t, http.StatusBadRequest, replyErr.Status)
+			assert.Equal(t, responses.ErrorCodeInvalidRequest, replyErr.Code)
+			assert.Equal(t, test.message, replyErr.Message)
+		})
+	}
+
+	// decoding errors are left as they are
+	_, replyErr := d.Dispatch(t.Context(), &Request{Route: RouteGetContent, Body: []byte("{")})
+	require.NotNil(t, replyErr)
+	assert.Equal(t, responses.ErrorCodeInvalidJSON, replyErr.Code)
+
+	// valid requests reach the route with the decoded value, other routes are not validated
+	var value interface{}
+	for _, route := range []Route{RouteGetNodes, "echo"} {
+		d.Handle(route, func(ctx context.Context, req *Request) (*Reply, error) {
+			value = req.Value
+			return &Reply{}, nil
+		})
+	}
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: RouteGetNodes, Body: []byte(`{"env": {}, "nodes": {"main": {"id": "a"}}}`)})
+	require.Nil(t, replyErr)
+	require.IsType(t, &requests.Nodes{}, value)
+	assert.Equal(t, "a", value.(*requests.Nodes).Nodes["main"].ID) //nolint:forcetypeassert
+	_, replyErr = d.Dispatch(t.Context(), &Request{Route: "echo", Body: []byte("{")})
+	require.Nil(t, replyErr)
+	assert.Nil(t, value)
+}
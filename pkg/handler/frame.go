@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Socket protocol v2
+//
+// Every frame starts with a fixed prefix followed by a length prefixed header and the body:
+//
+//	magic         uint8   FrameMagic, v1 requests always start with a route name
+//	version       uint8   ProtocolV2
+//	header length uint16  length of the header
+//	header:
+//	  request id  uint64  echoed in the reply
+//	  flags       uint8   FrameFlagCompressed, FrameFlagAcceptCompressed
+//	  encoding    uint8   FrameEncodingJSON
+//	  status      uint16  http status code of replies, 0 in requests
+//	  body length uint32
+//	  route       remaining header bytes
+//	body
+//
+// v1 clients can upgrade a connection by calling RouteProtocol, all following requests are framed.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	// FrameMagic starts every v2 frame, it can not be the first byte of a v1 route
+	FrameMagic byte = 0xC5
+
+	// FrameFlagCompressed marks a gzip compressed body
+	FrameFlagCompressed uint8 = 1
+	// FrameFlagAcceptCompressed allows the server to compress the reply
+	FrameFlagAcceptCompressed uint8 = 2
+
+	// FrameEncodingJSON is the only body encoding so far
+	FrameEncodingJSON uint8 = 0
+
+	// FrameCompressionThreshold is the body size from which compression pays off
+	FrameCompressionThreshold = 1024
+
+	frameFixedHeaderLength = 16
+	// DefaultMaxFrameSize limits the body of a frame
+	DefaultMaxFrameSize = 256 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Frame is a request or reply of the socket protocol v2
+type Frame struct {
+	ID       uint64
+	Flags    uint8
+	Encoding uint8
+	Status   uint16
+	Route    Route
+	Body     []byte
+}
+
+// ReadFrame reads the next frame and decompresses its body,
+// bodies larger than maxSize are rejected with ErrFrameTooLarge and the frame without its body.
+func ReadFrame(r io.Reader, maxSize int) (*Frame, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != FrameMagic {
+		return nil, fmt.Errorf("invalid frame magic %#x", prefix[0])
+	}
+	if prefix[1] != ProtocolV2 {
+		return nil, fmt.Errorf("unsupported protocol version %d", prefix[1])
+	}
+	headerLength := int(binary.BigEndian.Uint16(prefix[2:]))
+	if headerLength < frameFixedHeaderLength {
+		return nil, fmt.Errorf("invalid frame header length %d", headerLength)
+	}
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	f := &Frame{
+		ID:       binary.BigEndian.Uint64(header[0:]),
+		Flags:    header[8],
+		Encoding: header[9],
+		Status:   binary.BigEndian.Uint16(header[10:]),
+		Route:    Route(header[frameFixedHeaderLength:]),
+	}
+	bodyLength := int(binary.BigEndian.Uint32(header[12:]))
+	if bodyLength > maxSize {
+		return f, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, bodyLength)
+	}
+	f.Body = make([]byte, bodyLength)
+	if _, err := io.ReadFull(r, f.Body); err != nil {
+		return nil, err
+	}
+	if f.Flags&FrameFlagCompressed != 0 {
+		body, err := gunzip(f.Body, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress frame: %w", err)
+		}
+		f.Body = body
+		f.Flags &^= FrameFlagCompressed
+	}
+	return f, nil
+}
+
+// WriteFrame writes the frame in a single write, the body is compressed if the compressed flag is set
+func WriteFrame(w io.Writer, f *Frame) error {
+	body := f.Body
+	if f.Flags&FrameFlagCompressed != 0 {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return err
+		}
+	}
+	headerLength := frameFixedHeaderLength + len(f.Route)
+	if headerLength > 0xFFFF {
+		return fmt.Errorf("route too long: %d bytes", len(f.Route))
+	}
+	buf := make([]byte, 4+headerLength, 4+headerLength+len(body))
+	buf[0] = FrameMagic
+	buf[1] = ProtocolV2
+	binary.BigEndian.PutUint16(buf[2:], uint16(headerLength))
+	binary.BigEndian.PutUint64(buf[4:], f.ID)
+	buf[12] = f.Flags
+	buf[13] = f.Encoding
+	binary.BigEndian.PutUint16(buf[14:], f.Status)
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(body)))
+	copy(buf[4+frameFixedHeaderLength:], f.Route)
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzip decompresses at most maxSize bytes
+func gunzip(data []byte, maxSize int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	ret, err := io.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) > maxSize {
+		return nil, ErrFrameTooLarge
+	}
+	return ret, nil
+}
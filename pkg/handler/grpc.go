@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	sourceGRPCServer = "grpcserver"
+
+	// GRPCServiceName is the full name of the grpc service
+	GRPCServiceName = "contentserver.ContentServer"
+	// GRPCCodecName is the content subtype of GRPCCodec, messages are the json of the requests and responses
+	GRPCCodecName = "contentserver-json"
+	// GRPCHeaderVersion is set in the header of every reply to the version of the repo that served it
+	GRPCHeaderVersion = "x-contentserver-version"
+)
+
+// GRPCMethods maps the routes to the unary methods and streams of the grpc service
+var GRPCMethods = map[Route]string{
+	RouteGetContent:      "GetContent",
+	RouteGetContentBatch: "GetContentBatch",
+	RouteGetNodes:        "GetNodes",
+	RouteGetURIs:         "GetURIs",
+	RouteStatus:          "Status",
+	RouteUpdate:          "Update",
+	RouteGetRepo:         "GetRepo",
+	RouteWatch:           "Watch",
+}
+
+type (
+	// GRPC serves the repo as grpc service. There is no protobuf definition, the messages are encoded
+	// with GRPCCodec. GetRepo streams one responses.RepoDimension per dimension
+	// and Watch streams a responses.Change for every update.
+	GRPC struct {
+		l          *zap.Logger
+		repo       *repo.Repo
+		dispatcher *Dispatcher
+	}
+	GRPCOption func(*GRPC)
+	// grpcServer is the handler type of the service description
+	grpcServer interface {
+		dispatch(ctx context.Context, route Route, value interface{}, body []byte) (interface{}, error)
+	}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewGRPC returns a grpc service, see Register
+func NewGRPC(l *zap.Logger, repo *repo.Repo, opts ...GRPCOption) *GRPC {
+	inst := &GRPC{
+		l:    l.Named("grpc"),
+		repo: repo,
+	}
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+	if inst.dispatcher == nil {
+		inst.dispatcher = NewDispatcher(l, repo)
+	}
+
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// GRPCWithDispatcher sets the dispatcher answering the unary methods, e.g. to share it with other transports
+func GRPCWithDispatcher(v *Dispatcher) GRPCOption {
+	return func(o *GRPC) {
+		o.dispatcher = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Register adds the service to a grpc server, the server needs grpc.ForceServerCodec(GRPCCodec{})
+func (h *GRPC) Register(s grpc.ServiceRegistrar) {
+	s.RegisterService(&grpcServiceDesc, h)
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// dispatch answers a unary method through the dispatcher, the body is the signed message of hmac credentials
+func (h *GRPC) dispatch(ctx context.Context, route Route, value interface{}, body []byte) (interface{}, error) {
+	// like the http handler
+	if !h.repo.Loaded() && !isServedBeforeLoad(route) {
+		return nil, status.Error(codes.Unavailable, "repo not loaded yet")
+	}
+	reply, replyErr := h.dispatcher.Dispatch(repo.ContextWithTrigger(ctx, repo.TriggerGRPC), &Request{
+		Route:       route,
+		Source:      sourceGRPCServer,
+		Value:       value,
+		Credentials: grpcCredentials(ctx, route, body),
+	})
+	header := metadata.Pairs(GRPCHeaderVersion, reply.Version)
+	if err := grpc.SetHeader(ctx, header); err != nil {
+		h.l.Debug("failed to set header", zap.Error(err))
+	}
+	if replyErr != nil {
+		return nil, status.Error(grpcCode(replyErr.Status), replyErr.Message)
+	}
+	return reply.Value, nil
+}
+
+func (h *GRPC) getRepo(stream grpc.ServerStream) error {
+	var body []byte
+	if err := stream.RecvMsg(&body); err != nil {
+		return err
+	}
+	reply, err := h.dispatch(stream.Context(), RouteGetRepo, &requests.Repo{}, body)
+	if err != nil {
+		return err
+	}
+	snapshot, ok := reply.(*repo.Snapshot)
+	if !ok {
+		return status.Error(codes.Internal, "unexpected reply")
+	}
+	for dimension, node := range snapshot.GetRepo() {
+		if err := stream.SendMsg(&responses.RepoDimension{Dimension: dimension, Node: node}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *GRPC) watch(stream grpc.ServerStream) error {
+	var body []byte
+	if err := stream.RecvMsg(&body); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	// sets the version header, too
+	if _, err := h.dispatch(ctx, RouteWatch, &struct{}{}, body); err != nil {
+		return err
+	}
+	changes, unsubscribe := h.repo.Subscribe()
+	defer unsubscribe()
+
+	metrics.NumWatchersGauge.WithLabelValues().Inc()
+	defer metrics.NumWatchersGauge.WithLabelValues().Dec()
+
+	// sends the header at once, the first change may take a while
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change, ok := <-changes:
+			if !ok {
+				// the repo has been stopped
+				return nil
+			}
+			if err := stream.SendMsg(change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Service description
+// ------------------------------------------------------------------------------------------------
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*grpcServer)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnaryMethod[requests.Content](RouteGetContent),
+		grpcUnaryMethod[requests.ContentBatch](RouteGetContentBatch),
+		grpcUnaryMethod[requests.Nodes](RouteGetNodes),
+		grpcUnaryMethod[requests.URIs](RouteGetURIs),
+		grpcUnaryMethod[requests.Status](RouteStatus),
+		grpcUnaryMethod[requests.Update](RouteUpdate),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    GRPCMethods[RouteGetRepo],
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*GRPC).getRepo(stream) //nolint:forcetypeassert
+			},
+		},
+		{
+			StreamName:    GRPCMethods[RouteWatch],
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*GRPC).watch(stream) //nolint:forcetypeassert
+			},
+		},
+	},
+}
+
+// grpcUnaryMethod describes a unary method decoding its request into Req
+func grpcUnaryMethod[Req any](route Route) grpc.MethodDesc {
+	method := GRPCMethods[route]
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			// the raw body is kept for hmac signatures
+			var body []byte
+			if err := dec(&body); err != nil {
+				return nil, status.Error(codes.InvalidArgument, "could not read incoming json "+err.Error())
+			}
+			req := new(Req)
+			if err := (GRPCCodec{}).Unmarshal(body, req); err != nil {
+				return nil, status.Error(codes.InvalidArgument, "could not read incoming json "+err.Error())
+			}
+			h := srv.(*GRPC) //nolint:forcetypeassert
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return h.dispatch(ctx, route, req, body)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + GRPCServiceName + "/" + method,
+			}, handler)
+		},
+	}
+}
+
+// grpcCredentials returns the bearer token of the authorization metadata or the hmac signature of the body
+func grpcCredentials(ctx context.Context, route Route, body []byte) *auth.Credentials {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	credentials := &auth.Credentials{
+		Key:       get(auth.HeaderKey),
+		Timestamp: get(auth.HeaderTimestamp),
+		Nonce:     get(auth.HeaderNonce),
+		Signature: get(auth.HeaderSignature),
+		Method:    auth.MethodGRPC,
+		Route:     string(route),
+		Body:      body,
+	}
+	if scheme, token, ok := strings.Cut(get("authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		credentials.Token = strings.TrimSpace(token)
+	}
+	return credentials
+}
+
+// grpcCode returns the grpc code of the http status of an error reply
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Codec
+// ------------------------------------------------------------------------------------------------
+
+// GRPCCodec encodes messages as json, raw []byte messages are passed through. It is not registered globally,
+// so it does not replace the codecs of other services: pass it with grpc.ForceServerCodec to servers and
+// grpc.ForceCodec to clients.
+type GRPCCodec struct{}
+
+func (GRPCCodec) Marshal(v interface{}) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return json.Marshal(v)
+}
+
+func (GRPCCodec) Unmarshal(data []byte, v interface{}) error {
+	if b, ok := v.(*[]byte); ok {
+		*b = append((*b)[:0], data...)
+		return nil
+	}
+	if len(data) == 0 {
+		// empty requests, e.g. of the status method
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (GRPCCodec) Name() string {
+	return GRPCCodecName
+}
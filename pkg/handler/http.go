@@ -1,26 +1,37 @@
 package handler
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/foomo/contentserver/pkg/auth"
+	"github.com/foomo/contentserver/pkg/graphql"
 	"github.com/foomo/contentserver/pkg/metrics"
 	"github.com/foomo/contentserver/pkg/repo"
-	"github.com/foomo/contentserver/requests"
 	"github.com/foomo/contentserver/responses"
-	httputils "github.com/foomo/keel/utils/net/http"
-	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+const (
+	sourceWebServer = "webserver"
+
+	// HeaderVersion is set on every response to the version of the repo that served it
+	HeaderVersion = "X-Contentserver-Version"
+)
+
 type (
 	HTTP struct {
-		l        *zap.Logger
-		repo     *repo.Repo
-		basePath string
+		l                      *zap.Logger
+		repo                   *repo.Repo
+		dispatcher             *Dispatcher
+		basePath               string
+		watchHeartbeatInterval time.Duration
+		cacheControl           string
+		maxRequestSize         int
 	}
 	HTTPOption func(*HTTP)
 )
@@ -32,14 +43,20 @@ type (
 // NewHTTP returns a shiny new web server
 func NewHTTP(l *zap.Logger, repo *repo.Repo, opts ...HTTPOption) http.Handler {
 	inst := &HTTP{
-		l:        l.Named("http"),
-		basePath: "/contentserver",
-		repo:     repo,
+		l:                      l.Named("http"),
+		basePath:               "/contentserver",
+		repo:                   repo,
+		watchHeartbeatInterval: 30 * time.Second,
+		cacheControl:           DefaultCacheControl,
+		maxRequestSize:         DefaultMaxRequestSize,
 	}
 
 	for _, opt := range opts {
 		opt(inst)
 	}
+	if inst.dispatcher == nil {
+		inst.dispatcher = NewDispatcher(l, repo)
+	}
 
 	return inst
 }
@@ -54,126 +71,325 @@ func WithBasePath(v string) HTTPOption {
 	}
 }
 
+// WithWatchHeartbeatInterval sets how often idle watch streams receive a keep alive comment
+func WithWatchHeartbeatInterval(v time.Duration) HTTPOption {
+	return func(o *HTTP) {
+		o.watchHeartbeatInterval = v
+	}
+}
+
+// WithCacheControl sets the Cache-Control header of the GET routes
+func WithCacheControl(v string) HTTPOption {
+	return func(o *HTTP) {
+		o.cacheControl = v
+	}
+}
+
+// WithMaxRequestSize limits the size of request bodies, larger requests are rejected
+func WithMaxRequestSize(v int) HTTPOption {
+	return func(o *HTTP) {
+		o.maxRequestSize = v
+	}
+}
+
+// WithDispatcher sets the dispatcher answering the requests, e.g. to share it with other transports
+func WithDispatcher(v *Dispatcher) HTTPOption {
+	return func(o *HTTP) {
+		o.dispatcher = v
+	}
+}
+
 // ------------------------------------------------------------------------------------------------
 // ~ Public methods
 // ------------------------------------------------------------------------------------------------
 
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		httputils.ServerError(h.l, w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
-		return
+	route := Route(strings.TrimPrefix(r.URL.Path, h.basePath+"/"))
+	switch {
+	case route == RouteWatch:
+		if r.Method != http.MethodGet {
+			h.writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		h.serveWatch(w, r)
+	case route == RouteGraphQL:
+		if !h.repo.Loaded() {
+			h.writeNotLoaded(w, r)
+			return
+		}
+		h.serveGraphQL(w, r)
+	case isGetRoute(route):
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h.writeMethodNotAllowed(w, r, http.MethodGet, http.MethodHead)
+			return
+		}
+		if !h.repo.Loaded() {
+			h.writeNotLoaded(w, r)
+			return
+		}
+		h.serveGet(w, r, route)
+	case h.dispatcher.Has(route):
+		if r.Method != http.MethodPost {
+			h.writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		if !h.repo.Loaded() && !isServedBeforeLoad(route) {
+			h.writeNotLoaded(w, r)
+			return
+		}
+		h.servePost(w, r, route)
+	default:
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusNotFound, responses.ErrorCodeUnknownRoute, "unknown route: "+string(route)))
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// readBody reads the request body up to the maximum request size, it writes the problem if it fails
+func (h *HTTP) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(h.maxRequestSize)))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusRequestEntityTooLarge, responses.ErrorCodeRequestTooLarge, fmt.Sprintf("request exceeds the maximum size of %d bytes", h.maxRequestSize)))
+		return nil, false
+	} else if err != nil {
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "failed to read incoming request: "+err.Error()))
+		return nil, false
 	}
+	return body, true
+}
+
+// servePost answers the rpc routes with json bodies
+func (h *HTTP) servePost(w http.ResponseWriter, r *http.Request, route Route) {
 	if r.Body == nil {
-		httputils.BadRequestServerError(h.l, w, r, errors.New("empty request body"))
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "empty request body"))
 		return
 	}
 
-	bytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		httputils.BadRequestServerError(h.l, w, r, errors.Wrap(err, "failed to read incoming request"))
+	bytes, ok := h.readBody(w, r)
+	if !ok {
 		return
 	}
 
-	route := Route(strings.TrimPrefix(r.URL.Path, h.basePath+"/"))
-	if route == RouteGetRepo {
+	reply, replyErr := h.dispatcher.Dispatch(repo.ContextWithTrigger(r.Context(), repo.TriggerHTTP), &Request{
+		Route:       route,
+		Source:      sourceWebServer,
+		Body:        bytes,
+		Credentials: httpCredentials(r, route, bytes),
+	})
+	if replyErr != nil {
+		h.writeProblem(w, r, replyErr)
+		return
+	}
+	if snapshot, ok := reply.Value.(*repo.Snapshot); ok && route == RouteGetRepo {
 		w.Header().Set("Content-Type", "application/json")
-		if err := h.repo.WriteRepoBytes(r.Context(), w); err != nil {
+		w.Header().Set(HeaderVersion, snapshot.Version())
+		if err := snapshot.WriteRepoBytes(w); err != nil {
 			h.l.Error("failed to write repo bytes", zap.Error(err))
-			http.Error(w, "failed to get repo", http.StatusInternalServerError)
 		}
 		return
 	}
+	replyBytes, err := h.encodeReply(reply.Value, reply.Version)
+	if err != nil {
+		h.writeProblem(w, r, responses.NewError(responses.ErrorCodeInternal, "could not encode reply"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderVersion, reply.Version)
+	_, _ = w.Write(replyBytes)
+}
 
-	reply, errReply := h.handleRequest(r.Context(), h.repo, route, bytes, "webserver")
-	if errReply != nil {
-		http.Error(w, errReply.Error(), http.StatusInternalServerError)
+// writeProblem writes the error as RFC 7807 problem details
+func (h *HTTP) writeProblem(w http.ResponseWriter, r *http.Request, err *responses.Error) {
+	version := h.repo.Snapshot().Version()
+	bytes, encodingErr := json.Marshal(responses.NewProblem(err, r.URL.Path, version))
+	if encodingErr != nil {
+		h.l.Error("could not encode problem", zap.Error(encodingErr))
+		http.Error(w, err.Message, err.Status)
 		return
 	}
-	_, _ = w.Write(reply)
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+	if err.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", responses.ContentTypeProblem)
+	if version != "" {
+		w.Header().Set(HeaderVersion, version)
+	}
+	w.WriteHeader(err.Status)
+	_, _ = w.Write(bytes)
 }
 
-// ------------------------------------------------------------------------------------------------
-// ~ Private methods
-// ------------------------------------------------------------------------------------------------
+func (h *HTTP) writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	h.writeProblem(w, r, responses.NewStatusError(http.StatusMethodNotAllowed, responses.ErrorCodeMethodNotAllowed, "method not allowed: "+r.Method))
+}
 
-func (h *HTTP) handleRequest(ctx context.Context, r *repo.Repo, route Route, jsonBytes []byte, source string) ([]byte, error) {
-	start := time.Now()
+func (h *HTTP) writeNotLoaded(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	h.writeProblem(w, r, responses.NewStatusError(http.StatusServiceUnavailable, responses.ErrorCodeNotLoaded, "repo not loaded yet"))
+}
 
-	reply, err := h.executeRequest(ctx, r, route, jsonBytes, source)
-	result := "success"
-	if err != nil {
-		result = "error"
+// serveWatch streams repo changes as server-sent events until the client goes away
+func (h *HTTP) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if _, replyErr := h.dispatcher.Dispatch(r.Context(), &Request{
+		Route:       RouteWatch,
+		Source:      sourceWebServer,
+		Credentials: httpCredentials(r, RouteWatch, []byte(r.URL.RawQuery)),
+	}); replyErr != nil {
+		h.writeProblem(w, r, replyErr)
+		return
 	}
 
-	metrics.ServiceRequestCounter.WithLabelValues(string(route), result, source).Inc()
-	metrics.ServiceRequestDuration.WithLabelValues(string(route), result, source).Observe(time.Since(start).Seconds())
+	changes, unsubscribe := h.repo.Subscribe()
+	defer unsubscribe()
 
-	return reply, err
-}
+	metrics.NumWatchersGauge.WithLabelValues().Inc()
+	defer metrics.NumWatchersGauge.WithLabelValues().Dec()
 
-func (h *HTTP) executeRequest(ctx context.Context, r *repo.Repo, route Route, jsonBytes []byte, source string) (replyBytes []byte, err error) {
-	var (
-		reply             interface{}
-		apiErr            error
-		jsonErr           error
-		processIfJSONIsOk = func(err error, processingFunc func()) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(HeaderVersion, h.repo.Snapshot().Version())
+	w.WriteHeader(http.StatusOK)
+
+	writeAndFlush := func(data string) bool {
+		if _, err := io.WriteString(w, data); err != nil {
+			h.l.Debug("failed to write to watch stream", zap.Error(err))
+			return false
+		}
+		if err := rc.Flush(); err != nil {
+			h.l.Error("failed to flush watch stream", zap.Error(err))
+			return false
+		}
+		return true
+	}
+
+	if !writeAndFlush(": connected\n\n") {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.watchHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if !writeAndFlush(": heartbeat\n\n") {
+				return
+			}
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(change)
 			if err != nil {
-				jsonErr = err
+				h.l.Error("could not encode change", zap.Error(err))
+				continue
+			}
+			if !writeAndFlush("event: " + EventChange + "\nid: " + change.Revision.ID + "\ndata: " + string(data) + "\n\n") {
 				return
 			}
-			processingFunc()
 		}
+	}
+}
+
+// serveGraphQL executes GET and POST graphql requests against the current snapshot
+func (h *HTTP) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var (
+		req  = &graphql.Request{}
+		body []byte
 	)
-	metrics.ContentRequestCounter.WithLabelValues(source).Inc()
-
-	// handle and process
-	switch route {
-	// case HandlerGetRepo: // This case is handled prior to handleRequest being called.
-	// since the resulting bytes are written directly in to the http.ResponseWriter / net.Connection
-	case RouteGetURIs:
-		getURIRequest := &requests.URIs{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &getURIRequest), func() {
-			reply = r.GetURIs(getURIRequest.Dimension, getURIRequest.IDs)
-		})
-	case RouteGetContent:
-		contentRequest := &requests.Content{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &contentRequest), func() {
-			reply, apiErr = r.GetContent(contentRequest)
-		})
-	case RouteGetNodes:
-		nodesRequest := &requests.Nodes{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &nodesRequest), func() {
-			reply = r.GetNodes(nodesRequest)
-		})
-	case RouteUpdate:
-		updateRequest := &requests.Update{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &updateRequest), func() {
-			reply = r.Update(ctx)
-		})
+	switch r.Method {
+	case http.MethodGet:
+		body = []byte(r.URL.RawQuery)
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "failed to decode variables: "+err.Error()))
+				return
+			}
+		}
+	case http.MethodPost:
+		if r.Body == nil {
+			h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "empty request body"))
+			return
+		}
+		var ok bool
+		if body, ok = h.readBody(w, r); !ok {
+			return
+		}
+		if err := json.Unmarshal(body, req); err != nil {
+			h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidJSON, "failed to decode graphql request: "+err.Error()))
+			return
+		}
 	default:
-		reply = responses.NewError(1, "unknown route: "+string(route))
+		h.writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		return
 	}
 
-	// error handling
-	if jsonErr != nil {
-		h.l.Error("could not read incoming json", zap.Error(jsonErr))
-		reply = responses.NewError(2, "could not read incoming json "+jsonErr.Error())
-	} else if apiErr != nil {
-		h.l.Error("an API error occurred", zap.Error(apiErr))
-		reply = responses.NewError(3, "internal error "+apiErr.Error())
+	reply, replyErr := h.dispatcher.Dispatch(r.Context(), &Request{
+		Route:       RouteGraphQL,
+		Source:      sourceWebServer,
+		Value:       req,
+		Credentials: httpCredentials(r, RouteGraphQL, body),
+	})
+	if replyErr != nil {
+		h.writeProblem(w, r, replyErr)
+		return
+	}
+	status := http.StatusOK
+	if res, ok := reply.Value.(*graphql.Response); ok && res.Data == nil {
+		// requests which can not be executed
+		status = http.StatusBadRequest
 	}
 
-	return h.encodeReply(reply)
+	bytes, err := json.Marshal(reply.Value)
+	if err != nil {
+		h.l.Error("could not encode graphql response", zap.Error(err))
+		h.writeProblem(w, r, responses.NewError(responses.ErrorCodeInternal, "could not encode response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(HeaderVersion, reply.Version)
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
 }
 
-// encodeReply takes an interface and encodes it as JSON
+// encodeReply takes an interface and encodes it as JSON along with the version of the repo
 // it returns the resulting JSON and a marshalling error
-func (h *HTTP) encodeReply(reply interface{}) (bytes []byte, err error) {
+func (h *HTTP) encodeReply(reply interface{}, version string) (bytes []byte, err error) {
 	bytes, err = json.Marshal(map[string]interface{}{
-		"reply": reply,
+		"reply":   reply,
+		"version": version,
 	})
 	if err != nil {
 		h.l.Error("could not encode reply", zap.Error(err))
 	}
 	return
 }
+
+// httpCredentials returns the bearer token or hmac signature of the request, the signed body of GET requests
+// is the raw query
+func httpCredentials(r *http.Request, route Route, body []byte) *auth.Credentials {
+	credentials := &auth.Credentials{
+		Key:       r.Header.Get(auth.HeaderKey),
+		Timestamp: r.Header.Get(auth.HeaderTimestamp),
+		Nonce:     r.Header.Get(auth.HeaderNonce),
+		Signature: r.Header.Get(auth.HeaderSignature),
+		Method:    r.Method,
+		Route:     string(route),
+		Body:      body,
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		credentials.Token = strings.TrimSpace(token)
+	}
+	return credentials
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// MiddlewareMetrics records the requests per route, result and source, it is added to every dispatcher
+func MiddlewareMetrics() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			start := time.Now()
+			metrics.ContentRequestCounter.WithLabelValues(req.Source).Inc()
+
+			reply, err := next(ctx, req)
+			result := "success"
+			if err != nil {
+				result = "error"
+			}
+
+			metrics.ServiceRequestCounter.WithLabelValues(string(req.Route), result, req.Source).Inc()
+			metrics.ServiceRequestDuration.WithLabelValues(string(req.Route), result, req.Source).Observe(time.Since(start).Seconds())
+			return reply, err
+		}
+	}
+}
+
+// MiddlewareLogger logs every request with its duration
+func MiddlewareLogger(l *zap.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			start := time.Now()
+			reply, err := next(ctx, req)
+			fields := []zap.Field{
+				zap.String("route", string(req.Route)),
+				zap.String("source", req.Source),
+				zap.Duration("duration", time.Since(start)),
+			}
+			if err != nil {
+				l.Info("request failed", append(fields, zap.Error(err))...)
+			} else {
+				l.Debug("request", fields...)
+			}
+			return reply, err
+		}
+	}
+}
+
+// MiddlewareRateLimit rejects requests exceeding the limit of the limiter, shared by all clients
+func MiddlewareRateLimit(limiter *rate.Limiter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			if !limiter.Allow() {
+				return nil, responses.NewStatusError(http.StatusTooManyRequests, responses.ErrorCodeRateLimited, "rate limit exceeded")
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// MiddlewareValidate rejects malformed requests to the repo routes with ErrorCodeInvalidRequest before they reach
+// the repo, the decoded request is passed on as Value
+func MiddlewareValidate() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			if validate, ok := validators[req.Route]; ok {
+				if err := validate(req); err != nil {
+					return nil, err
+				}
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// MiddlewareTracing starts a span for every request with the global tracer provider
+func MiddlewareTracing() Middleware {
+	tracer := otel.Tracer("github.com/foomo/contentserver/pkg/handler")
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Reply, error) {
+			ctx, span := tracer.Start(ctx, "contentserver."+string(req.Route),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("contentserver.route", string(req.Route)),
+					attribute.String("contentserver.source", req.Source),
+				),
+			)
+			defer span.End()
+			reply, err := next(ctx, req)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return reply, err
+		}
+	}
+}
+
+// validators of the requests of the repo routes, the items of content batches are validated by the repo one by one
+var validators = map[Route]func(req *Request) error{
+	RouteGetURIs: newValidator(func(value *requests.URIs) error {
+		if value.Dimension == "" {
+			return errors.New("dimension must not be empty")
+		}
+		return nil
+	}),
+	RouteGetContent: newValidator(func(value *requests.Content) error {
+		switch {
+		case value.URI == "":
+			return errors.New("uri must not be empty")
+		case value.Env == nil:
+			return errors.New("env must not be nil")
+		case len(value.Env.Dimensions) == 0:
+			return errors.New("env.dimensions must not be empty")
+		}
+		return validateNodes(value.Nodes)
+	}),
+	RouteGetNodes: newValidator(func(value *requests.Nodes) error {
+		switch {
+		case value.Env == nil:
+			return errors.New("env must not be nil")
+		case value.Nodes == nil:
+			return errors.New("nodes must not be nil")
+		}
+		return validateNodes(value.Nodes)
+	}),
+}
+
+// newValidator returns a validator decoding the request into Req, decoding errors are returned as they are
+func newValidator[Req any](fn func(value *Req) error) func(req *Request) error {
+	return func(req *Request) error {
+		value, err := requestValue[Req](req)
+		if err != nil {
+			return err
+		}
+		if err := fn(value); err != nil {
+			return responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidRequest, "invalid request: "+err.Error())
+		}
+		return nil
+	}
+}
+
+// validateNodes rejects nil node requests, node requests without an id are skipped by the repo
+func validateNodes(nodes map[string]*requests.Node) error {
+	for name, node := range nodes {
+		if node == nil {
+			return fmt.Errorf("node %q must not be nil", name)
+		}
+	}
+	return nil
+}
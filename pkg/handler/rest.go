@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foomo/contentserver/content"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultCacheControl lets caches store GET responses, but revalidate them with the ETag of the revision
+	DefaultCacheControl = "public, max-age=0, must-revalidate"
+	// PrivateCacheControl replaces the Cache-Control header of GET responses to requests with credentials,
+	// shared caches must not serve them to other clients
+	PrivateCacheControl = "private, max-age=0, must-revalidate"
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// serveGet serves the cacheable GET routes through the dispatcher, replies of the same revision are identical
+// for the same url
+func (h *HTTP) serveGet(w http.ResponseWriter, r *http.Request, route Route) {
+	var (
+		query = r.URL.Query()
+		id    string
+		req   = &Request{Source: sourceWebServer}
+		err   error
+	)
+	switch {
+	case route == RouteContent:
+		req.Route = RouteGetContent
+		req.Value, err = contentRequest(query)
+	case route == RouteURIs:
+		req.Route = RouteGetURIs
+		req.Value, err = urisRequest(query)
+	case strings.HasPrefix(string(route), string(RouteNodes)+"/"):
+		id = strings.TrimPrefix(string(route), string(RouteNodes)+"/")
+		req.Route = RouteGetNodes
+		req.Value, err = nodesRequest(query, id)
+	default:
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusNotFound, responses.ErrorCodeUnknownRoute, "unknown route: "+string(route)))
+		return
+	}
+	if err != nil {
+		h.writeProblem(w, r, responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	req.Credentials = httpCredentials(r, route, []byte(r.URL.RawQuery))
+	reply, replyErr := h.dispatcher.Dispatch(r.Context(), req)
+	if replyErr != nil {
+		h.writeProblem(w, r, replyErr)
+		return
+	}
+	value, status := reply.Value, http.StatusOK
+	switch v := reply.Value.(type) {
+	case *content.SiteContent:
+		// the status of the content is the status of the response, the body is returned in all cases
+		status = int(v.Status)
+	case map[string]*content.Node:
+		if v[id] == nil {
+			h.writeProblem(w, r, responses.NewStatusError(http.StatusNotFound, responses.ErrorCodeNotFound, "node not found: "+id))
+			return
+		}
+		value = v[id]
+	}
+
+	if reply.Version != "" {
+		etag := strconv.Quote(reply.Version + groupsETag(req.Groups))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Authorization")
+		if req.Credentials.Empty() {
+			w.Header().Set("Cache-Control", h.cacheControl)
+		} else {
+			w.Header().Set("Cache-Control", PrivateCacheControl)
+		}
+		w.Header().Set(HeaderVersion, reply.Version)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		h.l.Error("could not encode reply", zap.Error(err))
+		h.writeProblem(w, r, responses.NewError(responses.ErrorCodeInternal, "could not encode reply"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+// groupsETag returns the suffix of the ETag for the groups the reply was restricted to by the auth middleware,
+// the groups of the query are part of the url
+func groupsETag(groups []string) string {
+	if groups == nil {
+		return ""
+	}
+	groups = slices.Clone(groups)
+	slices.Sort(groups)
+	sum := sha256.Sum256([]byte(strings.Join(groups, "\n")))
+	return "-" + hex.EncodeToString(sum[:8])
+}
+
+// contentRequest reads /content?uri=&dimensions=&groups=&dataFields=&pathDataFields=
+func contentRequest(query url.Values) (*requests.Content, error) {
+	if !query.Has("uri") {
+		return nil, errors.New("missing uri")
+	}
+	return &requests.Content{
+		Env: &requests.Env{
+			Dimensions: queryList(query, "dimensions"),
+			Groups:     queryList(query, "groups"),
+		},
+		URI:            query.Get("uri"),
+		DataFields:     queryList(query, "dataFields"),
+		PathDataFields: queryList(query, "pathDataFields"),
+	}, nil
+}
+
+// urisRequest reads /uris?dimension=&ids=
+func urisRequest(query url.Values) (*requests.URIs, error) {
+	if query.Get("dimension") == "" {
+		return nil, errors.New("missing dimension")
+	}
+	return &requests.URIs{
+		Dimension: query.Get("dimension"),
+		IDs:       queryList(query, "ids"),
+	}, nil
+}
+
+// nodesRequest reads /nodes/{id}?dimension=&groups=&mimeTypes=&expand=&exposeHiddenNodes=&dataFields=,
+// the node is requested with its id as name
+func nodesRequest(query url.Values, id string) (*requests.Nodes, error) {
+	if id == "" || query.Get("dimension") == "" {
+		return nil, errors.New("missing id or dimension")
+	}
+	expand, err := queryBool(query, "expand")
+	if err != nil {
+		return nil, err
+	}
+	exposeHiddenNodes, err := queryBool(query, "exposeHiddenNodes")
+	if err != nil {
+		return nil, err
+	}
+	groups := queryList(query, "groups")
+	return &requests.Nodes{
+		Nodes: map[string]*requests.Node{
+			id: {
+				ID:                id,
+				Dimension:         query.Get("dimension"),
+				Groups:            groups,
+				MimeTypes:         queryList(query, "mimeTypes"),
+				Expand:            expand,
+				ExposeHiddenNodes: exposeHiddenNodes,
+				DataFields:        queryList(query, "dataFields"),
+			},
+		},
+		Env: &requests.Env{
+			Dimensions: []string{query.Get("dimension")},
+			Groups:     groups,
+		},
+	}, nil
+}
+
+// queryList returns the values of a repeated or comma separated query parameter
+func queryList(query url.Values, name string) []string {
+	var ret []string
+	for _, value := range query[name] {
+		for _, v := range strings.Split(value, ",") {
+			if v != "" {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+func queryBool(query url.Values, name string) (bool, error) {
+	values, ok := query[name]
+	if !ok || values[0] == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid %s", name)
+	}
+	return v, nil
+}
+
+// etagMatches reports whether the If-None-Match header matches the etag with a weak comparison
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -1,5 +1,9 @@
 package handler
 
+import (
+	"strings"
+)
+
 // Route type
 type Route string
 
@@ -8,10 +12,42 @@ const (
 	RouteGetURIs Route = "getURIs"
 	// RouteGetContent get (site) content
 	RouteGetContent Route = "getContent"
+	// RouteGetContentBatch get many (site) contents at once
+	RouteGetContentBatch Route = "getContentBatch"
 	// RouteGetNodes get nodes
 	RouteGetNodes Route = "getNodes"
 	// RouteUpdate update repo
 	RouteUpdate Route = "update"
 	// RouteGetRepo get the whole repo
 	RouteGetRepo Route = "getRepo"
+	// RouteStatus get the served revision and update status
+	RouteStatus Route = "status"
+	// RouteAuthenticate authenticate a socket connection, the reply is the principal of the credentials
+	RouteAuthenticate Route = "authenticate"
+	// RouteProtocol negotiate the protocol version of a socket connection (socket only)
+	RouteProtocol Route = "protocol"
+	// RouteWatch stream repo changes as server-sent events (http and grpc only)
+	RouteWatch Route = "watch"
+	// RouteGraphQL query the content tree with graphql
+	RouteGraphQL Route = "graphql"
+	// RouteContent get (site) content with a cacheable GET request (http only)
+	RouteContent Route = "content"
+	// RouteURIs get uris with a cacheable GET request (http only)
+	RouteURIs Route = "uris"
+	// RouteNodes get a node by the id in its path with a cacheable GET request (http only)
+	RouteNodes Route = "nodes"
 )
+
+// EventChange name of the server-sent event emitted for repo changes
+const EventChange = "change"
+
+// isGetRoute reports whether the route is served for cacheable GET requests over http
+func isGetRoute(route Route) bool {
+	return route == RouteContent || route == RouteURIs || strings.HasPrefix(string(route), string(RouteNodes)+"/")
+}
+
+// isServedBeforeLoad reports whether the route is answered before the repo has been loaded,
+// getRepo falls back to the snapshot in the storage
+func isServedBeforeLoad(route Route) bool {
+	return route == RouteStatus || route == RouteUpdate || route == RouteWatch || route == RouteGetRepo
+}
@@ -1,49 +1,173 @@
 package handler
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/foomo/contentserver/requests"
 	"go.uber.org/zap"
 
+	"github.com/foomo/contentserver/pkg/auth"
 	"github.com/foomo/contentserver/pkg/metrics"
 	"github.com/foomo/contentserver/pkg/repo"
 	"github.com/foomo/contentserver/responses"
 )
 
-const sourceSocketServer = "socketserver"
+const (
+	sourceSocketServer = "socketserver"
 
-type Socket struct {
-	l    *zap.Logger
-	repo *repo.Repo
-}
+	// DefaultMaxRequestSize limits the json of a request
+	DefaultMaxRequestSize = 16 << 20
+	// maxHeaderLength limits the v1 header <route>:<length>
+	maxHeaderLength = 1024
+)
+
+type (
+	Socket struct {
+		l                     *zap.Logger
+		repo                  *repo.Repo
+		dispatcher            *Dispatcher
+		maxConcurrentRequests int
+		maxRequestSize        int
+		idleTimeout           time.Duration
+		readTimeout           time.Duration
+		// connsMu guards conns and shutdown, conns tracks whether a connection waits for its next request
+		connsMu  sync.Mutex
+		conns    map[net.Conn]bool
+		shutdown bool
+		// ctx of the requests, it is canceled when the connections are closed by Shutdown
+		ctx    context.Context
+		cancel context.CancelFunc
+	}
+	SocketOption func(*Socket)
+	// socketSession is the state of a connection, it is shared by its concurrent requests
+	socketSession struct {
+		mu sync.Mutex
+		// principal the connection has been authenticated as through RouteAuthenticate
+		principal *auth.Principal
+	}
+)
 
 // ------------------------------------------------------------------------------------------------
 // ~ Constructor
 // ------------------------------------------------------------------------------------------------
 
 // NewSocket returns a shiny new socket server
-func NewSocket(l *zap.Logger, repo *repo.Repo) *Socket {
+func NewSocket(l *zap.Logger, repo *repo.Repo, opts ...SocketOption) *Socket {
 	inst := &Socket{
-		l:    l.Named("socket"),
-		repo: repo,
+		l:                     l.Named("socket"),
+		repo:                  repo,
+		maxConcurrentRequests: 64,
+		maxRequestSize:        DefaultMaxRequestSize,
+		conns:                 map[net.Conn]bool{},
+	}
+	inst.ctx, inst.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+	if inst.dispatcher == nil {
+		inst.dispatcher = NewDispatcher(l, repo)
 	}
 
 	return inst
 }
 
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// SocketWithDispatcher sets the dispatcher answering the requests, e.g. to share it with other transports
+func SocketWithDispatcher(v *Dispatcher) SocketOption {
+	return func(o *Socket) {
+		o.dispatcher = v
+	}
+}
+
+// SocketWithMaxConcurrentRequests limits the requests processed concurrently per v2 connection,
+// further requests are not read until a reply has been written
+func SocketWithMaxConcurrentRequests(v int) SocketOption {
+	return func(o *Socket) {
+		o.maxConcurrentRequests = max(v, 1)
+	}
+}
+
+// SocketWithMaxRequestSize limits the size of a request, larger requests are rejected and the connection is closed
+func SocketWithMaxRequestSize(v int) SocketOption {
+	return func(o *Socket) {
+		o.maxRequestSize = v
+	}
+}
+
+// SocketWithIdleTimeout closes connections which do not send a request within the timeout, 0 disables it
+func SocketWithIdleTimeout(v time.Duration) SocketOption {
+	return func(o *Socket) {
+		o.idleTimeout = v
+	}
+}
+
+// SocketWithReadTimeout closes connections which do not send a started request completely within the timeout,
+// 0 disables it
+func SocketWithReadTimeout(v time.Duration) SocketOption {
+	return func(o *Socket) {
+		o.readTimeout = v
+	}
+}
+
 // ------------------------------------------------------------------------------------------------
 // ~ Public methods
 // ------------------------------------------------------------------------------------------------
 
+// Shutdown stops serving: idle connections are released at once and active connections once their requests
+// have been replied. When the context is done the remaining connections are closed.
+// Serve returns for every connection, closing them is left to the caller.
+func (h *Socket) Shutdown(ctx context.Context) error {
+	h.connsMu.Lock()
+	h.shutdown = true
+	for conn, idle := range h.conns {
+		if idle {
+			// wakes up the read waiting for the next request
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+	h.connsMu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		h.connsMu.Lock()
+		remaining := len(h.conns)
+		h.connsMu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			h.cancel()
+			h.connsMu.Lock()
+			for conn := range h.conns {
+				_ = conn.Close()
+			}
+			h.connsMu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Serve handles the requests of a connection until it is closed.
+// The protocol is detected from the first byte, v1 connections can be upgraded to v2 through RouteProtocol.
 func (h *Socket) Serve(conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -59,21 +183,52 @@ func (h *Socket) Serve(conn net.Conn) {
 
 	// h.l.Debug("socketServer.handleConnection")
 	metrics.NumSocketsGauge.WithLabelValues(conn.RemoteAddr().String()).Inc()
+	defer metrics.NumSocketsGauge.WithLabelValues(conn.RemoteAddr().String()).Dec()
+
+	if !h.track(conn) {
+		return
+	}
+	defer h.untrack(conn)
+
+	reader := bufio.NewReader(conn)
+	if !h.awaitRequest(conn, reader) {
+		return
+	}
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	session := &socketSession{}
+	if first[0] == FrameMagic || h.serveV1(conn, reader, session) {
+		h.serveV2(conn, reader, session)
+	}
+}
 
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// serveV1 handles v1 requests, it returns true if the connection has been upgraded to v2
+func (h *Socket) serveV1(conn net.Conn, reader *bufio.Reader, session *socketSession) bool {
 	var (
 		headerBuffer [1]byte
 		header       = ""
 	)
 	for {
+		if header == "" && !h.awaitRequest(conn, reader) {
+			return false
+		}
 		// let us read with 1 byte steps on conn until we find "{"
-		_, readErr := conn.Read(headerBuffer[0:])
+		_, readErr := reader.Read(headerBuffer[0:])
 		if errors.Is(readErr, io.EOF) {
 			// client closed the connection
-			metrics.NumSocketsGauge.WithLabelValues(conn.RemoteAddr().String()).Dec()
-			return
+			return false
+		} else if errors.Is(readErr, os.ErrDeadlineExceeded) {
+			h.l.Warn("read timeout - giving up with this client connection")
+			return false
 		} else if readErr != nil {
 			h.l.Error("failed to read from connection", zap.Error(readErr))
-			return
+			return false
 		}
 		// read next byte
 		current := headerBuffer[0:]
@@ -84,15 +239,21 @@ func (h *Socket) Serve(conn net.Conn) {
 			header = ""
 			if headerErr != nil {
 				h.l.Error("invalid request could not read header", zap.Error(headerErr))
-				encodedErr, encodingErr := h.encodeReply(responses.NewError(4, "invalid header "+headerErr.Error()))
+				encodedErr, encodingErr := h.encodeReply(responses.NewError(responses.ErrorCodeInvalidHeader, "invalid header "+headerErr.Error()), h.repo.Snapshot().Version())
 				if encodingErr == nil {
 					h.writeResponse(conn, encodedErr)
 				} else {
 					h.l.Error("could not respond to invalid request", zap.Error(encodingErr))
 				}
-				return
+				return false
 			}
 			h.l.Debug("found json", zap.Int("length", jsonLength))
+			if jsonLength > h.maxRequestSize {
+				h.l.Warn("request too large - giving up with this client connection", zap.Int("length", jsonLength))
+				encodedErr, _ := h.encodeReply(responses.NewError(responses.ErrorCodeRequestTooLarge, "request too large"), h.repo.Snapshot().Version())
+				h.writeResponse(conn, encodedErr)
+				return false
+			}
 			if jsonLength > 0 {
 				var (
 					// let us try to read some json
@@ -106,13 +267,10 @@ func (h *Socket) Serve(conn net.Conn) {
 
 				for jsonLengthCurrent < jsonLength {
 					readRound++
-					readLength, jsonReadErr := conn.Read(jsonBytes[jsonLengthCurrent:jsonLength])
+					readLength, jsonReadErr := reader.Read(jsonBytes[jsonLengthCurrent:jsonLength])
 					if jsonReadErr != nil {
-						// @fixme we need to force a read timeout (SetReadDeadline?), if expected jsonLength is lower than really sent bytes (e.g. if client implements protocol wrong)
-						// @todo should we check for io.EOF here
 						h.l.Error("could not read json - giving up with this client connection", zap.Error(jsonReadErr))
-						metrics.NumSocketsGauge.WithLabelValues(conn.RemoteAddr().String()).Dec()
-						return
+						return false
 					}
 					jsonLengthCurrent += readLength
 					h.l.Debug("read cycle status",
@@ -124,22 +282,194 @@ func (h *Socket) Serve(conn net.Conn) {
 
 				h.l.Debug("read json", zap.Int("length", len(jsonBytes)))
 
-				h.writeResponse(conn, h.execute(handler, jsonBytes))
+				if handler == RouteProtocol {
+					version := h.negotiate(jsonBytes)
+					reply, _ := h.encodeReply(&responses.Protocol{Version: version}, h.repo.Snapshot().Version())
+					h.writeResponse(conn, reply)
+					if version == ProtocolV2 {
+						h.l.Debug("upgraded connection to protocol v2")
+						return true
+					}
+					continue
+				}
+
+				reply, _ := h.execute(session, handler, jsonBytes)
+				h.writeResponse(conn, reply)
 				// note: connection remains open
 				continue
 			}
 			h.l.Error("can not read empty json")
-			metrics.NumSocketsGauge.WithLabelValues(conn.RemoteAddr().String()).Dec()
-			return
+			return false
 		}
 		// adding to header byte by byte
 		header += string(headerBuffer[0:])
+		if len(header) > maxHeaderLength {
+			h.l.Warn("header too long - giving up with this client connection")
+			return false
+		}
 	}
 }
 
-// ------------------------------------------------------------------------------------------------
-// ~ Private methods
-// ------------------------------------------------------------------------------------------------
+// serveV2 handles framed requests until the connection is closed.
+// Requests are processed concurrently and their replies are written as soon as they are ready.
+func (h *Socket) serveV2(conn net.Conn, reader *bufio.Reader, session *socketSession) {
+	var (
+		writeMu  sync.Mutex
+		wg       sync.WaitGroup
+		inFlight = make(chan struct{}, h.maxConcurrentRequests)
+	)
+	defer wg.Wait()
+	for {
+		if !h.awaitRequest(conn, reader) {
+			return
+		}
+		request, err := ReadFrame(reader, h.maxRequestSize)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			return
+		} else if errors.Is(err, ErrFrameTooLarge) && request != nil {
+			h.l.Warn("request too large - giving up with this client connection", zap.Error(err))
+			body, _ := h.encodeReply(responses.NewError(responses.ErrorCodeRequestTooLarge, "request too large"), h.repo.Snapshot().Version())
+			writeMu.Lock()
+			_ = WriteFrame(conn, &Frame{ID: request.ID, Route: request.Route, Status: http.StatusRequestEntityTooLarge, Body: body})
+			writeMu.Unlock()
+			return
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			h.l.Warn("read timeout - giving up with this client connection")
+			return
+		} else if err != nil {
+			// the stream can not be resynchronized after an invalid frame
+			h.l.Error("failed to read frame - giving up with this client connection", zap.Error(err))
+			return
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			reply := h.executeFrameSafe(session, request)
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := WriteFrame(conn, reply); err != nil {
+				h.l.Error("failed to write frame", zap.Error(err))
+				// stops the read loop
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// track registers a new connection, it returns false when shutting down
+func (h *Socket) track(conn net.Conn) bool {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	if h.shutdown {
+		return false
+	}
+	h.conns[conn] = false
+	return true
+}
+
+func (h *Socket) untrack(conn net.Conn) {
+	h.connsMu.Lock()
+	defer h.connsMu.Unlock()
+	delete(h.conns, conn)
+}
+
+// awaitRequest waits for the first byte of the next request within the idle timeout and sets the read timeout
+// for the rest of the request. It returns false if the connection should be closed, e.g. when shutting down.
+func (h *Socket) awaitRequest(conn net.Conn, reader *bufio.Reader) bool {
+	h.connsMu.Lock()
+	if h.shutdown {
+		h.connsMu.Unlock()
+		return false
+	}
+	// pipelined requests are buffered already
+	idle := reader.Buffered() == 0
+	if idle {
+		var deadline time.Time
+		if h.idleTimeout > 0 {
+			deadline = time.Now().Add(h.idleTimeout)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			h.connsMu.Unlock()
+			return false
+		}
+		h.conns[conn] = true
+	}
+	h.connsMu.Unlock()
+
+	if idle {
+		_, err := reader.Peek(1)
+		h.connsMu.Lock()
+		h.conns[conn] = false
+		h.connsMu.Unlock()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			h.l.Debug("closing idle connection")
+			return false
+		} else if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				h.l.Error("failed to read from connection", zap.Error(err))
+			}
+			return false
+		}
+	}
+
+	var deadline time.Time
+	if h.readTimeout > 0 {
+		deadline = time.Now().Add(h.readTimeout)
+	}
+	return conn.SetReadDeadline(deadline) == nil
+}
+
+// executeFrameSafe executes the request and replies with an error if it panics
+func (h *Socket) executeFrameSafe(session *socketSession, request *Frame) (reply *Frame) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.l.Error("panic in execute frame", zap.String("route", string(request.Route)), zap.String("error", fmt.Sprint(r)))
+			body, _ := h.encodeReply(responses.NewError(responses.ErrorCodeInternal, "internal error"), h.repo.Snapshot().Version())
+			reply = &Frame{ID: request.ID, Route: request.Route, Status: http.StatusInternalServerError, Body: body}
+		}
+	}()
+	return h.executeFrame(session, request)
+}
+
+func (h *Socket) executeFrame(session *socketSession, request *Frame) *Frame {
+	reply := &Frame{
+		ID:       request.ID,
+		Route:    request.Route,
+		Encoding: FrameEncodingJSON,
+	}
+	var status int
+	if request.Encoding != FrameEncodingJSON {
+		status = http.StatusUnsupportedMediaType
+		reply.Body, _ = h.encodeReply(responses.NewError(responses.ErrorCodeInvalidJSON, fmt.Sprintf("unsupported encoding %d", request.Encoding)), h.repo.Snapshot().Version())
+	} else {
+		reply.Body, status = h.execute(session, request.Route, request.Body)
+	}
+	reply.Status = uint16(status) //nolint:gosec
+	if request.Flags&FrameFlagAcceptCompressed != 0 && len(reply.Body) > FrameCompressionThreshold {
+		reply.Flags |= FrameFlagCompressed
+	}
+	return reply
+}
+
+// negotiate returns the highest protocol version supported by both sides
+func (h *Socket) negotiate(jsonBytes []byte) int {
+	request := &requests.Protocol{}
+	if err := json.Unmarshal(jsonBytes, request); err != nil {
+		h.l.Error("could not read protocol request", zap.Error(err))
+		return ProtocolV1
+	}
+	version := ProtocolV1
+	for _, v := range request.Versions {
+		if v == ProtocolV2 {
+			version = ProtocolV2
+		}
+	}
+	return version
+}
 
 func (h *Socket) extractHandlerAndJSONLentgh(header string) (route Route, jsonLength int, err error) {
 	headerParts := strings.Split(header, ":")
@@ -153,24 +483,68 @@ func (h *Socket) extractHandlerAndJSONLentgh(header string) (route Route, jsonLe
 	return Route(headerParts[0]), jsonLength, err
 }
 
-func (h *Socket) execute(route Route, jsonBytes []byte) (reply []byte) {
+// execute returns the encoded reply and its http status code
+func (h *Socket) execute(session *socketSession, route Route, jsonBytes []byte) (reply []byte, status int) {
 	h.l.Debug("incoming json buffer", zap.Int("length", len(jsonBytes)))
 
-	if route == RouteGetRepo {
+	switch route {
+	case RouteProtocol:
+		// the connection is framed already
+		reply, _ = h.encodeReply(&responses.Protocol{Version: ProtocolV2}, h.repo.Snapshot().Version())
+		return reply, http.StatusOK
+	case RouteWatch:
+		reply, _ = h.encodeReply(responses.NewStatusError(http.StatusNotFound, responses.ErrorCodeUnknownRoute, "unknown route: "+string(route)), h.repo.Snapshot().Version())
+		return reply, http.StatusNotFound
+	}
+
+	req := &Request{
+		Route:     route,
+		Source:    sourceSocketServer,
+		Body:      jsonBytes,
+		Principal: session.getPrincipal(),
+	}
+	if route == RouteAuthenticate {
+		// authenticates the connection again
+		req.Principal = nil
+		value := &requests.Authenticate{}
+		if err := json.Unmarshal(jsonBytes, value); err == nil {
+			req.Credentials = &auth.Credentials{
+				Token:     value.Token,
+				Key:       value.Key,
+				Timestamp: value.Timestamp,
+				Nonce:     value.Nonce,
+				Signature: value.Signature,
+				Method:    auth.MethodSocket,
+				Route:     string(RouteAuthenticate),
+			}
+		}
+	}
+	result, replyErr := h.dispatcher.Dispatch(repo.ContextWithTrigger(h.ctx, repo.TriggerSocket), req)
+	if replyErr != nil {
+		reply, _ = h.encodeReply(replyErr, result.Version)
+		return reply, replyErr.Status
+	}
+
+	switch value := result.Value.(type) {
+	case *repo.Snapshot:
 		var b bytes.Buffer
-		if err := h.repo.WriteRepoBytes(context.Background(), &b); err != nil {
+		if err := value.WriteRepoBytes(&b); err != nil {
 			h.l.Error("failed to write repo bytes", zap.Error(err))
-			errorReply, _ := h.encodeReply(responses.NewError(5, "failed to get repo: "+err.Error()))
-			return errorReply
+			reply, _ = h.encodeReply(responses.NewError(responses.ErrorCodeRepo, "failed to get repo: "+err.Error()), result.Version)
+			return reply, http.StatusInternalServerError
+		}
+		return b.Bytes(), http.StatusOK
+	case *auth.Principal:
+		if route == RouteAuthenticate {
+			session.setPrincipal(value)
 		}
-		return b.Bytes()
 	}
-
-	reply, handlingError := h.handleRequest(h.repo, route, jsonBytes, sourceSocketServer)
-	if handlingError != nil {
-		h.l.Error("socketServer.execute failed", zap.Error(handlingError))
+	reply, err := h.encodeReply(result.Value, result.Version)
+	if err != nil {
+		h.l.Error("socketServer.execute failed", zap.Error(err))
+		return reply, http.StatusInternalServerError
 	}
-	return reply
+	return reply, http.StatusOK
 }
 
 func (h *Socket) writeResponse(conn net.Conn, reply []byte) {
@@ -192,85 +566,27 @@ func (h *Socket) writeResponse(conn net.Conn, reply []byte) {
 	h.l.Debug("replied. waiting for next request on open connection")
 }
 
-func (h *Socket) handleRequest(r *repo.Repo, route Route, jsonBytes []byte, source string) ([]byte, error) {
-	start := time.Now()
-
-	reply, err := h.executeRequest(r, route, jsonBytes, source)
-	result := "success"
-	if err != nil {
-		result = "error"
-	}
-
-	metrics.ServiceRequestCounter.WithLabelValues(string(route), result, source).Inc()
-	metrics.ServiceRequestDuration.WithLabelValues(string(route), result, source).Observe(time.Since(start).Seconds())
-
-	return reply, err
-}
-
-func (h *Socket) executeRequest(r *repo.Repo, route Route, jsonBytes []byte, source string) (replyBytes []byte, err error) {
-	var (
-		reply             interface{}
-		apiErr            error
-		jsonErr           error
-		processIfJSONIsOk = func(err error, processingFunc func()) {
-			if err != nil {
-				jsonErr = err
-				return
-			}
-			processingFunc()
-		}
-	)
-	metrics.ContentRequestCounter.WithLabelValues(source).Inc()
-
-	// handle and process
-	switch route {
-	// case RouteGetRepo: // This case is handled prior to handleRequest being called.
-	// since the resulting bytes are written directly in to the http.ResponseWriter / net.Connection
-	case RouteGetURIs:
-		getURIRequest := &requests.URIs{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &getURIRequest), func() {
-			reply = r.GetURIs(getURIRequest.Dimension, getURIRequest.IDs)
-		})
-	case RouteGetContent:
-		contentRequest := &requests.Content{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &contentRequest), func() {
-			reply, apiErr = r.GetContent(contentRequest)
-		})
-	case RouteGetNodes:
-		nodesRequest := &requests.Nodes{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &nodesRequest), func() {
-			reply = r.GetNodes(nodesRequest)
-		})
-	case RouteUpdate:
-		updateRequest := &requests.Update{}
-		processIfJSONIsOk(json.Unmarshal(jsonBytes, &updateRequest), func() {
-			reply = r.Update(context.Background())
-		})
-
-	default:
-		reply = responses.NewError(1, "unknown handler: "+string(route))
-	}
-
-	// error handling
-	if jsonErr != nil {
-		h.l.Error("could not read incoming json", zap.Error(jsonErr))
-		reply = responses.NewError(2, "could not read incoming json "+jsonErr.Error())
-	} else if apiErr != nil {
-		h.l.Error("an API error occurred", zap.Error(apiErr))
-		reply = responses.NewError(3, "internal error "+apiErr.Error())
-	}
-
-	return h.encodeReply(reply)
-}
-
-// encodeReply takes an interface and encodes it as JSON
+// encodeReply takes an interface and encodes it as JSON along with the version of the repo
 // it returns the resulting JSON and a marshalling error
-func (h *Socket) encodeReply(reply interface{}) (replyBytes []byte, err error) {
+func (h *Socket) encodeReply(reply interface{}, version string) (replyBytes []byte, err error) {
 	replyBytes, err = json.Marshal(map[string]interface{}{
-		"reply": reply,
+		"reply":   reply,
+		"version": version,
 	})
 	if err != nil {
 		h.l.Error("could not encode reply", zap.Error(err))
 	}
 	return
 }
+
+func (s *socketSession) getPrincipal() *auth.Principal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.principal
+}
+
+func (s *socketSession) setPrincipal(v *auth.Principal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.principal = v
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// socketReply is the json of a socket reply
+type socketReply[T any] struct {
+	Reply   T      `json:"reply"`
+	Version string `json:"version"`
+}
+
+// newTestSocket returns the client end of a connection served by a socket with the dispatcher
+func newTestSocket(t *testing.T, d *Dispatcher) net.Conn {
+	t.Helper()
+	h := NewSocket(zaptest.NewLogger(t), d.repo, SocketWithDispatcher(d))
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Serve(server)
+	}()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+		<-done
+	})
+	require.NoError(t, client.SetDeadline(time.Now().Add(10*time.Second)))
+	return client
+}
+
+// callV1 sends a v1 request and decodes its reply
+func callV1(t *testing.T, conn net.Conn, route Route, body string, reply interface{}) {
+	t.Helper()
+	_, err := conn.Write([]byte(string(route) + ":" + strconv.Itoa(len(body)) + body))
+	require.NoError(t, err)
+	// the reply is written at once as <length><json>
+	buf := make([]byte, 1<<16)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	i := 0
+	for i < n && buf[i] != '{' {
+		i++
+	}
+	length, err := strconv.Atoi(string(buf[:i]))
+	require.NoError(t, err)
+	require.Equal(t, length, n-i)
+	require.NoError(t, json.Unmarshal(buf[i:n], reply))
+}
+
+// callV2 sends a framed request and returns its reply
+func callV2(t *testing.T, conn net.Conn, route Route, body string) *Frame {
+	t.Helper()
+	require.NoError(t, WriteFrame(conn, &Frame{ID: 1, Route: route, Body: []byte(body)}))
+	reply, err := ReadFrame(conn, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), reply.ID)
+	return reply
+}
+
+func TestSocketWatch(t *testing.T) {
+	d := newTestDispatcher(t)
+	// watch is not served by sockets, even if the dispatcher has a handler
+	var called bool
+	d.Handle(RouteWatch, func(ctx context.Context, req *Request) (*Reply, error) {
+		called = true
+		return &Reply{}, nil
+	})
+
+	conn := newTestSocket(t, d)
+	var reply socketReply[responses.Error]
+	callV1(t, conn, RouteWatch, "{}", &reply)
+	assert.Equal(t, http.StatusNotFound, reply.Reply.Status)
+	assert.Equal(t, responses.ErrorCodeUnknownRoute, reply.Reply.Code)
+
+	// the connection remains usable
+	callV1(t, conn, "unknown", "{}", &reply)
+	assert.Equal(t, http.StatusNotFound, reply.Reply.Status)
+	assert.Equal(t, "unknown route: unknown", reply.Reply.Message)
+
+	frame := callV2(t, newTestSocket(t, d), RouteWatch, "{}")
+	assert.Equal(t, uint16(http.StatusNotFound), frame.Status)
+	require.NoError(t, json.Unmarshal(frame.Body, &reply))
+	assert.Equal(t, responses.ErrorCodeUnknownRoute, reply.Reply.Code)
+	assert.False(t, called)
+}
+
+func TestSocketProtocol(t *testing.T) {
+	d := newTestDispatcher(t)
+	var called bool
+	d.Handle(RouteProtocol, func(ctx context.Context, req *Request) (*Reply, error) {
+		called = true
+		return &Reply{}, nil
+	})
+	d.Handle("echo", func(ctx context.Context, req *Request) (*Reply, error) {
+		return &Reply{Value: req.Source}, nil
+	})
+
+	// v1 connections stay on v1 if the client does not support v2
+	conn := newTestSocket(t, d)
+	var protocol socketReply[responses.Protocol]
+	callV1(t, conn, RouteProtocol, `{"versions":[1]}`, &protocol)
+	assert.Equal(t, ProtocolV1, protocol.Reply.Version)
+	var echo socketReply[string]
+	callV1(t, conn, "echo", "{}", &echo)
+	assert.Equal(t, sourceSocketServer, echo.Reply)
+
+	// and are upgraded otherwise, all following requests are framed
+	callV1(t, conn, RouteProtocol, `{"versions":[1,2]}`, &protocol)
+	assert.Equal(t, ProtocolV2, protocol.Reply.Version)
+	frame := callV2(t, conn, "echo", "{}")
+	assert.Equal(t, uint16(http.StatusOK), frame.Status)
+	require.NoError(t, json.Unmarshal(frame.Body, &echo))
+	assert.Equal(t, sourceSocketServer, echo.Reply)
+
+	// framed connections are v2 already
+	frame = callV2(t, newTestSocket(t, d), RouteProtocol, `{"versions":[1]}`)
+	assert.Equal(t, uint16(http.StatusOK), frame.Status)
+	require.NoError(t, json.Unmarshal(frame.Body, &protocol))
+	assert.Equal(t, ProtocolV2, protocol.Reply.Version)
+	assert.False(t, called)
+}
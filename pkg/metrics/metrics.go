@@ -11,6 +11,8 @@ const (
 	metricLabelStatus  = "status"
 	metricLabelSource  = "source"
 	metricLabelRemote  = "remote"
+	metricLabelOp      = "operation"
+	metricLabelResult  = "result"
 )
 
 // Metrics is the structure that holds all prometheus metrics
@@ -59,11 +61,56 @@ var (
 		"Total number of currently open socket connections",
 		metricLabelRemote,
 	)
+	// SocketRejectedConnectionsCounter count the connections closed at once because of the connection limit
+	SocketRejectedConnectionsCounter = newCounterVec(
+		"socket_rejected_connections_count",
+		"Number of socket connections rejected because the maximum number of connections was reached",
+	)
+	// NumWatchersGauge keep track of the number of clients watching for changes
+	NumWatchersGauge = newGaugeVec(
+		"num_watchers",
+		"Number of clients currently watching for repo changes",
+	)
+	// LeaderGauge is 1 while the replica holds the leader lease
+	LeaderGauge = newGaugeVec(
+		"leader",
+		"Whether this replica is the leader",
+	)
+	// WebhookDeliveryCounter count the number of delivered and failed webhook notifications
+	WebhookDeliveryCounter = newCounterVec(
+		"webhook_delivery_count",
+		"Number of webhook notifications by delivery status",
+		metricLabelStatus,
+	)
 	// HistoryPersistFailedCounter count the number of failed attempts to persist the content history
 	HistoryPersistFailedCounter = newCounterVec(
 		"history_persist_failed_count",
 		"Number of failures to store the content history on the filesystem",
 	)
+	// StorageOperationCounter count the number of storage operations
+	StorageOperationCounter = newCounterVec(
+		"storage_operation_count",
+		"Number of storage operations by operation and status",
+		metricLabelOp, metricLabelStatus,
+	)
+	// StorageOperationDuration observe the duration of storage operations
+	StorageOperationDuration = newSummaryVec(
+		"storage_operation_duration_seconds",
+		"Duration in seconds of storage operations",
+		metricLabelOp, metricLabelStatus,
+	)
+	// StorageRetryCounter count the number of retried storage operations
+	StorageRetryCounter = newCounterVec(
+		"storage_retry_count",
+		"Number of storage operations retried after a transient error",
+		metricLabelOp,
+	)
+	// StorageCacheCounter count the hits and misses of the local storage cache
+	StorageCacheCounter = newCounterVec(
+		"storage_cache_count",
+		"Number of reads served by the local storage cache by result",
+		metricLabelResult,
+	)
 )
 
 func newSummaryVec(name, help string, labels ...string) *prometheus.SummaryVec {
@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/foomo/contentserver/content"
+	"github.com/foomo/contentserver/responses"
+)
+
+// maxChangeNodeIDs limits the number of node ids reported for a dimension,
+// if more nodes changed the whole dimension should be considered as changed
+const maxChangeNodeIDs = 1000
+
+// newChange compares two snapshots and collects the changed dimensions and nodes
+func newChange(previous, current *Snapshot) *responses.Change {
+	change := &responses.Change{
+		Revision:         current.Revision(),
+		PreviousRevision: previous.Revision(),
+		Dimensions:       []string{},
+		NodeIDs:          map[string][]string{},
+	}
+
+	for dimensionName, dimension := range current.Directory() {
+		previousDimension, ok := previous.Directory()[dimensionName]
+		if !ok {
+			change.Dimensions = append(change.Dimensions, dimensionName)
+			change.NodeIDs[dimensionName] = changedNodeIDs(nil, dimension.Directory)
+			continue
+		}
+		if ids := changedNodeIDs(previousDimension.Directory, dimension.Directory); ids == nil || len(ids) > 0 {
+			change.Dimensions = append(change.Dimensions, dimensionName)
+			change.NodeIDs[dimensionName] = ids
+		}
+	}
+	for dimensionName, previousDimension := range previous.Directory() {
+		if _, ok := current.Directory()[dimensionName]; !ok {
+			change.Dimensions = append(change.Dimensions, dimensionName)
+			change.NodeIDs[dimensionName] = changedNodeIDs(previousDimension.Directory, nil)
+		}
+	}
+
+	for dimensionName, ids := range change.NodeIDs {
+		if ids == nil {
+			delete(change.NodeIDs, dimensionName)
+		}
+	}
+	sort.Strings(change.Dimensions)
+	return change
+}
+
+// changedNodeIDs returns the sorted ids of all added, removed or modified nodes,
+// nil if there are more than maxChangeNodeIDs
+func changedNodeIDs(previous, current map[string]*content.RepoNode) []string {
+	ids := []string{}
+	for id, node := range current {
+		if previousNode, ok := previous[id]; !ok || !equalNodes(previousNode, node) {
+			ids = append(ids, id)
+		}
+		if len(ids) > maxChangeNodeIDs {
+			return nil
+		}
+	}
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			ids = append(ids, id)
+		}
+		if len(ids) > maxChangeNodeIDs {
+			return nil
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// equalNodes compares the payload of two nodes, child nodes are compared by their index only
+func equalNodes(a, b *content.RepoNode) bool {
+	return a.ID == b.ID &&
+		a.MimeType == b.MimeType &&
+		a.LinkID == b.LinkID &&
+		a.URI == b.URI &&
+		a.Name == b.Name &&
+		a.Hidden == b.Hidden &&
+		a.DestinationID == b.DestinationID &&
+		slices.Equal(a.Groups, b.Groups) &&
+		slices.Equal(a.Index, b.Index) &&
+		reflect.DeepEqual(a.Data, b.Data)
+}
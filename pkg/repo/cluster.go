@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/foomo/contentserver/pkg/cluster"
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+)
+
+// ClusterRoutine loads the snapshots announced by other replicas until the context is done
+func (r *Repo) ClusterRoutine(ctx context.Context) error {
+	l := r.l.Named("routine.cluster")
+	messages, err := r.cluster.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			l.Debug("routine canceled")
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if msg.Origin == r.nodeID || msg.Key == "" {
+				continue
+			}
+			l.Debug("loading announced snapshot", zap.String("origin", msg.Origin), zap.String("key", msg.Key))
+			if _, ok := r.loadFromHistory(ctx, msg.Key, msg.Revision); !ok {
+				return nil
+			}
+		}
+	}
+}
+
+// announce tells the other replicas to load the snapshot from the history
+func (r *Repo) announce(ctx context.Context, key string, revision *responses.Revision) {
+	if r.cluster == nil {
+		return
+	}
+	msg := &cluster.Message{
+		Origin:   r.nodeID,
+		Key:      key,
+		Revision: revision,
+	}
+	if err := r.cluster.Publish(ctx, msg); err != nil {
+		r.l.Error("failed to announce snapshot", zap.String("key", key), zap.Error(err))
+		return
+	}
+	r.l.Debug("announced snapshot", zap.String("key", key), zap.String("revision", revision.ID))
+}
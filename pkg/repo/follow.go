@@ -0,0 +1,66 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+)
+
+// FollowRoutine loads the current snapshot from the history storage whenever it changed
+func (r *Repo) FollowRoutine(ctx context.Context) error {
+	l := r.l.Named("routine.follow")
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	var last *StorageInfo
+	for {
+		select {
+		case <-ctx.Done():
+			l.Debug("routine canceled")
+			return nil
+		case <-ticker.C:
+			info, err := r.history.StatCurrent(ctx)
+			if err != nil {
+				l.Warn("failed to stat current snapshot", zap.Error(err))
+				continue
+			}
+			if info != nil && last != nil && *info == *last {
+				continue
+			}
+			response, ok := r.loadFromHistory(ctx, CurrentKey, nil)
+			if !ok {
+				return nil
+			}
+			if response.err == nil {
+				last = info
+			}
+		}
+	}
+}
+
+// loadFromHistory loads a history key through the update routine and notifies about failures and changes.
+// It returns false if the context is done before the update routine accepted the request.
+func (r *Repo) loadFromHistory(ctx context.Context, key string, revision *responses.Revision) (updateResponse, bool) {
+	l := r.l.With(zap.String("key", key))
+	req := updateRequest{
+		historyKey: key,
+		revision:   revision,
+		response:   make(chan updateResponse),
+	}
+	select {
+	case r.updateInProgressChannel <- req:
+	case <-ctx.Done():
+		return updateResponse{}, false
+	}
+	response := <-req.response
+	if response.err != nil {
+		l.Error("failed to load snapshot from history", zap.Error(response.err))
+	} else if response.change != nil {
+		l.Info("loaded snapshot from history", zap.String("revision", r.Snapshot().Version()))
+	}
+	if response.err != nil || response.change != nil {
+		r.updateDone(ctx, r.newUpdate(response), response.change)
+	}
+	return response, true
+}
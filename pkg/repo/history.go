@@ -3,7 +3,11 @@ package repo
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,9 +17,15 @@ import (
 )
 
 const (
+	// HistoryRepoJSONPrefix and CurrentKey are the keys of the legacy history,
+	// which stored a full copy of every snapshot under a timestamped key and as current.
 	HistoryRepoJSONPrefix = "contentserver-repo-"
 	HistoryRepoJSONSuffix = ".json"
 	CurrentKey            = HistoryRepoJSONPrefix + "current" + HistoryRepoJSONSuffix
+	// HistorySnapshotPrefix is the prefix of the snapshots, which are stored once under their content hash
+	HistorySnapshotPrefix = "contentserver-snapshot-"
+	// ManifestKey points to the current snapshot and lists the history
+	ManifestKey = "contentserver-manifest.json"
 )
 
 type (
@@ -24,9 +34,27 @@ type (
 		storage      Storage
 		historyDir   string // directory used for default filesystem storage
 		historyLimit int
-		mu           sync.RWMutex
+		retention    retentionPolicy
+		// legacyCurrent keeps writing the legacy current copy, see HistoryWithLegacyCurrent
+		legacyCurrent bool
+		// fence is checked right before the history is written, e.g. Lease.Check of the leader
+		fence func(ctx context.Context) error
+		mu    sync.RWMutex
 	}
 	HistoryOption func(*History)
+	// manifest is the small pointer file written instead of copying the snapshot
+	manifest struct {
+		// Current is the hash of the current snapshot
+		Current string `json:"current"`
+		// Snapshots lists the distinct snapshots, the most recently added first
+		Snapshots []*manifestEntry `json:"snapshots"`
+	}
+	manifestEntry struct {
+		Key   string    `json:"key"`
+		Hash  string    `json:"hash"`
+		Size  int       `json:"size"`
+		Added time.Time `json:"added"`
+	}
 )
 
 // ------------------------------------------------------------------------------------------------
@@ -39,6 +67,43 @@ func HistoryWithHistoryLimit(v int) HistoryOption {
 	}
 }
 
+// HistoryWithKeepWithin keeps all snapshots added within the duration
+func HistoryWithKeepWithin(v time.Duration) HistoryOption {
+	return func(o *History) {
+		o.retention.keepWithin = v
+	}
+}
+
+// HistoryWithKeepDaily keeps the newest snapshot of each of the last v days
+func HistoryWithKeepDaily(v int) HistoryOption {
+	return func(o *History) {
+		o.retention.keepDaily = v
+	}
+}
+
+// HistoryWithMaxBytes removes the oldest snapshots until the history is smaller than v bytes,
+// the current and pinned snapshots are always kept
+func HistoryWithMaxBytes(v int64) HistoryOption {
+	return func(o *History) {
+		o.retention.maxBytes = v
+	}
+}
+
+// HistoryWithPinned never removes the snapshots with the given keys or hash prefixes
+func HistoryWithPinned(v ...string) HistoryOption {
+	return func(o *History) {
+		o.retention.pinned = append(o.retention.pinned, v...)
+	}
+}
+
+// HistoryWithLegacyCurrent keeps writing a full copy of the current snapshot to CurrentKey, so releases
+// before the manifest still restore the current snapshot after a rollback. Default true, see RemoveLegacyCurrent.
+func HistoryWithLegacyCurrent(v bool) HistoryOption {
+	return func(o *History) {
+		o.legacyCurrent = v
+	}
+}
+
 func HistoryWithHistoryDir(v string) HistoryOption {
 	return func(o *History) {
 		o.historyDir = v
@@ -57,14 +122,16 @@ func HistoryWithStorage(s Storage) HistoryOption {
 
 func NewHistory(l *zap.Logger, opts ...HistoryOption) (*History, error) {
 	inst := &History{
-		l:            l,
-		historyDir:   "/var/lib/contentserver",
-		historyLimit: 2,
+		l:             l,
+		historyDir:    "/var/lib/contentserver",
+		historyLimit:  2,
+		legacyCurrent: true,
 	}
 
 	for _, opt := range opts {
 		opt(inst)
 	}
+	inst.retention.keepLast = inst.historyLimit
 
 	// If no storage provided, create a default filesystem storage
 	if inst.storage == nil {
@@ -82,38 +149,102 @@ func NewHistory(l *zap.Logger, opts ...HistoryOption) (*History, error) {
 // ~ Public methods
 // ------------------------------------------------------------------------------------------------
 
-// Add writes the JSON bytes to storage as both a backup and current file.
-func (h *History) Add(ctx context.Context, jsonBytes []byte) error {
+// Add stores the JSON bytes under their content hash and makes them the current snapshot.
+// Snapshots already in the history are not written again. It returns the key of the snapshot.
+func (h *History) Add(ctx context.Context, jsonBytes []byte) (string, error) {
+	return h.AddWithMetadata(ctx, jsonBytes, nil)
+}
+
+// AddWithMetadata adds the snapshot like Add and stores the metadata in a sidecar.
+// Key, hash, size and time of the metadata are set by the history.
+func (h *History) AddWithMetadata(ctx context.Context, jsonBytes []byte, metadata *SnapshotMetadata) (string, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	backupKey := HistoryRepoJSONPrefix + time.Now().Format(time.RFC3339Nano) + HistoryRepoJSONSuffix
+	hash := contentHash(jsonBytes)
+	key := snapshotKey(hash)
+
+	m, err := h.readManifest(ctx)
+	if errors.Is(err, os.ErrNotExist) {
+		m = &manifest{}
+	} else if errors.Is(err, ErrChecksumMismatch) {
+		// rebuild it instead of blocking all further updates
+		h.l.Warn("history manifest is corrupted, rebuilding it from the snapshots", zap.Error(err))
+		if m, err = h.rebuildManifest(ctx); err != nil {
+			return "", errors.Wrap(err, "failed to rebuild history manifest")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to read history manifest")
+	}
 
-	if err := h.storage.Write(ctx, backupKey, jsonBytes); err != nil {
-		return errors.Wrap(err, "failed to write backup history file")
+	if m.Current == hash {
+		h.l.Debug("snapshot is already current", zap.String("key", key))
+		return key, nil
 	}
 
-	h.l.Debug("writing files",
-		zap.String("backup", backupKey),
-		zap.String("current", CurrentKey),
-	)
+	// the manifest is written last, so it never points to missing data
+	var writes []StorageEntry
+	entry := m.remove(hash)
+	if entry == nil {
+		h.l.Debug("writing snapshot", zap.String("key", key))
+		writes = append(writes, StorageEntry{Key: key, Data: jsonBytes})
+		entry = &manifestEntry{Key: key, Hash: hash, Size: len(jsonBytes)}
+	} else {
+		h.l.Debug("snapshot exists, making it current", zap.String("key", key))
+	}
+	entry.Added = time.Now()
+	m.Snapshots = append([]*manifestEntry{entry}, m.Snapshots...)
+	m.Current = hash
 
-	if err := h.storage.Write(ctx, CurrentKey, jsonBytes); err != nil {
-		return errors.Wrap(err, "failed to write current history")
+	if metadata == nil {
+		metadata = &SnapshotMetadata{}
+	}
+	metadata.Key, metadata.Hash, metadata.Size, metadata.Added = entry.Key, entry.Hash, entry.Size, entry.Added
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode snapshot metadata")
+	}
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode history manifest")
+	}
+	writes = append(writes, StorageEntry{Key: metadataKey(hash), Data: metadataBytes})
+	if h.legacyCurrent {
+		writes = append(writes, StorageEntry{Key: CurrentKey, Data: jsonBytes})
+	}
+	writes = append(writes, StorageEntry{Key: ManifestKey, Data: manifestBytes})
+	if err := h.checkFence(ctx); err != nil {
+		return "", err
+	}
+	if err := h.write(ctx, writes); err != nil {
+		return "", errors.Wrap(err, "failed to write snapshot")
 	}
 
 	if err := h.cleanup(ctx); err != nil {
-		return errors.Wrap(err, "failed to clean up history")
+		return key, errors.Wrap(err, "failed to clean up history")
 	}
 
-	return nil
+	return key, nil
+}
+
+// RemoveLegacyCurrent removes the legacy current copy once no release before the manifest will be rolled back to.
+// The history must be written with HistoryWithLegacyCurrent(false) afterwards.
+func (h *History) RemoveLegacyCurrent(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.readManifest(ctx); err != nil {
+		// without a manifest the legacy copy is the current snapshot
+		return errors.Wrap(err, "failed to read history manifest")
+	}
+	return h.storage.Delete(ctx, CurrentKey)
 }
 
 // GetCurrent reads the current snapshot into the provided buffer.
+// If it is corrupted, the newest valid backup is read instead.
 func (h *History) GetCurrent(ctx context.Context, buf *bytes.Buffer) error {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	data, err := h.storage.Read(ctx, CurrentKey)
+	data, err := h.getCurrent(ctx)
 	if err != nil {
 		return err
 	}
@@ -121,6 +252,63 @@ func (h *History) GetCurrent(ctx context.Context, buf *bytes.Buffer) error {
 	return err
 }
 
+// Get reads the snapshot stored under the given key, CurrentKey resolves to the current snapshot.
+func (h *History) Get(ctx context.Context, key string) ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if key == CurrentKey {
+		return h.getCurrent(ctx)
+	}
+	return h.readSnapshot(ctx, key)
+}
+
+// List returns the metadata of all snapshots, newest first.
+// Snapshots without a sidecar, e.g. of the legacy history, only contain the basic fields.
+func (h *History) List(ctx context.Context) ([]*SnapshotMetadata, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	entries, err := h.getEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*SnapshotMetadata, 0, len(entries))
+	for _, entry := range entries {
+		metadata, err := h.readMetadata(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, metadata)
+	}
+	return ret, nil
+}
+
+// StatCurrent describes the current snapshot without reading it.
+// It returns nil if the storage does not support it.
+func (h *History) StatCurrent(ctx context.Context) (*StorageInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	stater, ok := h.storage.(Stater)
+	if !ok {
+		return nil, nil //nolint:nilnil
+	}
+	// the manifest changes with every new current snapshot
+	info, err := stater.Stat(ctx, ManifestKey)
+	if errors.Is(err, os.ErrNotExist) {
+		info, err = stater.Stat(ctx, CurrentKey)
+	}
+	if errors.Is(err, ErrNotSupported) {
+		return nil, nil //nolint:nilnil
+	}
+	return info, err
+}
+
+// Keys returns the keys of the snapshots in the history, newest first.
+func (h *History) Keys(ctx context.Context) ([]string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.getHistory(ctx)
+}
+
 // Close releases resources held by the history storage.
 func (h *History) Close() error {
 	h.mu.Lock()
@@ -135,7 +323,239 @@ func (h *History) Close() error {
 // ~ Private methods
 // ------------------------------------------------------------------------------------------------
 
+// getCurrent reads the current snapshot, falling back to the legacy current copy.
+// If the current snapshot is corrupted, the newest valid snapshot of the history is returned.
+func (h *History) getCurrent(ctx context.Context) ([]byte, error) {
+	data, err := h.readCurrent(ctx)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		return data, err
+	}
+	h.l.Warn("current snapshot is corrupted, falling back to the newest valid backup", zap.Error(err))
+	keys, fallbackErr := h.getFallbackKeys(ctx)
+	if fallbackErr != nil {
+		return nil, errors.Wrap(fallbackErr, "failed to list backups")
+	}
+	for _, key := range keys {
+		data, readErr := h.readSnapshot(ctx, key)
+		if readErr == nil {
+			h.l.Warn("restored backup", zap.String("key", key))
+			return data, nil
+		}
+		h.l.Warn("skipping invalid backup", zap.String("key", key), zap.Error(readErr))
+	}
+	return nil, err
+}
+
+func (h *History) readCurrent(ctx context.Context) ([]byte, error) {
+	m, err := h.readManifest(ctx)
+	if errors.Is(err, os.ErrNotExist) {
+		return h.storage.Read(ctx, CurrentKey)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read history manifest")
+	}
+	return h.readSnapshot(ctx, snapshotKey(m.Current))
+}
+
+// readSnapshot reads the snapshot and verifies the hash of content addressed keys
+func (h *History) readSnapshot(ctx context.Context, key string) ([]byte, error) {
+	data, err := h.storage.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if hash, ok := snapshotHash(key); ok && contentHash(data) != hash {
+		return nil, fmt.Errorf("%s: %w", key, ErrChecksumMismatch)
+	}
+	return data, nil
+}
+
+// getFallbackKeys returns the keys of the backups, newest first.
+// Without a readable manifest the snapshots are ordered by their modification time.
+func (h *History) getFallbackKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	if m, err := h.readManifest(ctx); err == nil {
+		for _, entry := range m.Snapshots {
+			if entry.Hash != m.Current {
+				keys = append(keys, entry.Key)
+			}
+		}
+	} else {
+		snapshots, err := h.storage.List(ctx, HistorySnapshotPrefix)
+		if err != nil {
+			return nil, err
+		}
+		modTimes := map[string]time.Time{}
+		if stater, ok := h.storage.(Stater); ok {
+			for _, key := range snapshots {
+				if info, err := stater.Stat(ctx, key); err == nil {
+					modTimes[key] = info.ModTime
+				}
+			}
+		}
+		sort.SliceStable(snapshots, func(i, j int) bool {
+			return modTimes[snapshots[i]].After(modTimes[snapshots[j]])
+		})
+		for _, key := range snapshots {
+			if _, ok := snapshotHash(key); ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	legacyFiles, err := h.getLegacyHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, legacyFiles...), nil
+}
+
+func (h *History) checkFence(ctx context.Context) error {
+	if h.fence == nil {
+		return nil
+	}
+	return h.fence(ctx)
+}
+
+func (h *History) readManifest(ctx context.Context) (*manifest, error) {
+	data, err := h.storage.Read(ctx, ManifestKey)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		// e.g. truncated, treated like a checksum mismatch of storages with checksums
+		return nil, errors.Wrap(ErrChecksumMismatch, "failed to decode history manifest: "+err.Error())
+	}
+	return m, nil
+}
+
+// rebuildManifest lists the snapshots of the storage, newest first, e.g. to replace a corrupted manifest.
+// The times they were added are read from the metadata sidecars, snapshots without one use their modification time.
+// The current snapshot is unknown, so Current is empty.
+func (h *History) rebuildManifest(ctx context.Context) (*manifest, error) {
+	keys, err := h.storage.List(ctx, HistorySnapshotPrefix)
+	if err != nil {
+		return nil, err
+	}
+	stater, _ := h.storage.(Stater)
+	m := &manifest{}
+	for _, key := range keys {
+		hash, ok := snapshotHash(key)
+		if !ok {
+			continue
+		}
+		entry := &manifestEntry{Key: key, Hash: hash}
+		data, err := h.storage.Read(ctx, metadataKey(hash))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, errors.Wrap(err, "failed to read snapshot metadata")
+		default:
+			metadata := &SnapshotMetadata{}
+			if err := json.Unmarshal(data, metadata); err != nil {
+				h.l.Warn("failed to decode snapshot metadata", zap.String("key", key), zap.Error(err))
+			} else {
+				entry.Size, entry.Added = metadata.Size, metadata.Added
+			}
+		}
+		if entry.Added.IsZero() && stater != nil {
+			if info, err := stater.Stat(ctx, key); err == nil {
+				entry.Size, entry.Added = int(info.Size), info.ModTime
+			}
+		}
+		m.Snapshots = append(m.Snapshots, entry)
+	}
+	sort.SliceStable(m.Snapshots, func(i, j int) bool {
+		return m.Snapshots[i].Added.After(m.Snapshots[j].Added)
+	})
+	return m, nil
+}
+
+func (h *History) writeManifest(ctx context.Context, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return h.storage.Write(ctx, ManifestKey, data)
+}
+
+// write stores the entries in one batch if the storage supports it, otherwise one after the other
+func (h *History) write(ctx context.Context, entries []StorageEntry) error {
+	if batchWriter, ok := h.storage.(BatchWriter); ok {
+		if err := batchWriter.WriteBatch(ctx, entries); !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := h.storage.Write(ctx, entry.Key, entry.Data); err != nil {
+			return errors.Wrapf(err, "failed to write %s", entry.Key)
+		}
+	}
+	return nil
+}
+
+func (h *History) readMetadata(ctx context.Context, entry *manifestEntry) (*SnapshotMetadata, error) {
+	metadata := &SnapshotMetadata{}
+	if entry.Hash != "" {
+		data, err := h.storage.Read(ctx, metadataKey(entry.Hash))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, errors.Wrap(err, "failed to read snapshot metadata")
+		default:
+			if err := json.Unmarshal(data, metadata); err != nil {
+				h.l.Warn("failed to decode snapshot metadata", zap.String("key", entry.Key), zap.Error(err))
+			}
+		}
+	}
+	metadata.Key, metadata.Hash, metadata.Size, metadata.Added = entry.Key, entry.Hash, entry.Size, entry.Added
+	return metadata, nil
+}
+
+// getHistory returns the keys of all snapshots, newest first.
 func (h *History) getHistory(ctx context.Context) (files []string, err error) {
+	entries, err := h.getEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Key)
+	}
+	return files, nil
+}
+
+// getEntries returns all snapshots, newest first.
+// Snapshots of the legacy history are listed after the ones in the manifest.
+func (h *History) getEntries(ctx context.Context) ([]*manifestEntry, error) {
+	var entries []*manifestEntry
+	m, err := h.readManifest(ctx)
+	if errors.Is(err, ErrChecksumMismatch) {
+		h.l.Warn("history manifest is corrupted, listing the snapshots of the storage", zap.Error(err))
+		m, err = h.rebuildManifest(ctx)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrap(err, "failed to read history manifest")
+	}
+	if m != nil {
+		entries = append(entries, m.Snapshots...)
+	}
+
+	legacyFiles, err := h.getLegacyHistory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stater, _ := h.storage.(Stater)
+	for _, key := range legacyFiles {
+		entry := &manifestEntry{Key: key, Added: legacyAdded(key)}
+		if stater != nil {
+			if info, err := stater.Stat(ctx, key); err == nil {
+				entry.Size = int(info.Size)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (h *History) getLegacyHistory(ctx context.Context) (files []string, err error) {
 	keys, err := h.storage.List(ctx, HistoryRepoJSONPrefix)
 	if err != nil {
 		return nil, err
@@ -152,31 +572,97 @@ func (h *History) getHistory(ctx context.Context) (files []string, err error) {
 }
 
 func (h *History) cleanup(ctx context.Context) error {
-	files, err := h.getFilesForCleanup(ctx, h.historyLimit)
+	files, err := h.getFilesForCleanup(ctx)
 	if err != nil {
 		return err
 	}
+	if len(files) == 0 {
+		return nil
+	}
+	if err := h.checkFence(ctx); err != nil {
+		return err
+	}
+
+	// drop the snapshots from the manifest first, so it never points to deleted data
+	m, err := h.readManifest(ctx)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if m != nil {
+		for _, f := range files {
+			m.removeKey(f)
+		}
+		if err := h.writeManifest(ctx, m); err != nil {
+			return err
+		}
+	}
 
 	for _, f := range files {
 		h.l.Debug("removing outdated backup", zap.String("file", f))
 		if err := h.storage.Delete(ctx, f); err != nil {
 			return fmt.Errorf("could not remove file %s: %w", f, err)
 		}
+		if hash, ok := snapshotHash(f); ok {
+			if err := h.storage.Delete(ctx, metadataKey(hash)); err != nil {
+				return fmt.Errorf("could not remove metadata of %s: %w", f, err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func (h *History) getFilesForCleanup(ctx context.Context, historyVersions int) (files []string, err error) {
-	contentFiles, err := h.getHistory(ctx)
+// getFilesForCleanup returns the keys of the snapshots the retention policy does not keep
+func (h *History) getFilesForCleanup(ctx context.Context) (files []string, err error) {
+	entries, err := h.getEntries(ctx)
 	if err != nil {
 		return nil, errors.New("could not generate file cleanup list: " + err.Error())
 	}
 
-	if len(contentFiles) > historyVersions {
-		for i := historyVersions; i < len(contentFiles); i++ {
-			files = append(files, contentFiles[i])
-		}
+	current := ""
+	if m, err := h.readManifest(ctx); err == nil {
+		current = m.Current
+	}
+	for _, entry := range h.retention.expired(entries, current, time.Now()) {
+		files = append(files, entry.Key)
 	}
 	return files, nil
 }
+
+// remove takes the entry with the given hash out of the manifest
+func (m *manifest) remove(hash string) *manifestEntry {
+	for i, entry := range m.Snapshots {
+		if entry.Hash == hash {
+			m.Snapshots = append(m.Snapshots[:i], m.Snapshots[i+1:]...)
+			return entry
+		}
+	}
+	return nil
+}
+
+// removeKey takes the entry with the given key out of the manifest
+func (m *manifest) removeKey(key string) {
+	for i, entry := range m.Snapshots {
+		if entry.Key == key {
+			m.Snapshots = append(m.Snapshots[:i], m.Snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func snapshotKey(hash string) string {
+	return HistorySnapshotPrefix + hash + HistoryRepoJSONSuffix
+}
+
+// snapshotHash returns the hash of a content addressed snapshot key
+func snapshotHash(key string) (string, bool) {
+	if !strings.HasPrefix(key, HistorySnapshotPrefix) || !strings.HasSuffix(key, HistoryRepoJSONSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(key, HistorySnapshotPrefix), HistoryRepoJSONSuffix), true
+}
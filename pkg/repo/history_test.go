@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -21,7 +23,7 @@ func TestHistoryCurrent(t *testing.T) {
 		test = []byte("test")
 		b    bytes.Buffer
 	)
-	err := h.Add(ctx, test)
+	_, err := h.Add(ctx, test)
 	require.NoError(t, err)
 	err = h.GetCurrent(ctx, &b)
 	require.NoError(t, err)
@@ -34,7 +36,7 @@ func TestHistoryCleanup(t *testing.T) {
 	ctx := context.Background()
 	h := testHistory(t)
 	for i := 0; i < 50; i++ {
-		err := h.Add(ctx, []byte(fmt.Sprint(i)))
+		_, err := h.Add(ctx, []byte(fmt.Sprint(i)))
 		require.NoError(t, err)
 		time.Sleep(time.Millisecond * 5)
 	}
@@ -65,7 +67,7 @@ func TestGetFilesForCleanup(t *testing.T) {
 	ctx := context.Background()
 	h := testHistoryWithTestdata(t)
 
-	files, err := h.getFilesForCleanup(ctx, 2)
+	files, err := h.getFilesForCleanup(ctx)
 	require.NoError(t, err)
 	assert.Len(t, files, 1)
 	assert.Equal(t, "contentserver-repo-2017-10-21.json", files[0])
@@ -80,7 +82,7 @@ func TestHistoryWithStorage(t *testing.T) {
 	h, err := NewHistory(l, HistoryWithStorage(storage), HistoryWithHistoryLimit(2))
 	require.NoError(t, err)
 
-	err = h.Add(ctx, []byte("test-data"))
+	_, err = h.Add(ctx, []byte("test-data"))
 	require.NoError(t, err)
 
 	var buf bytes.Buffer
@@ -89,11 +91,178 @@ func TestHistoryWithStorage(t *testing.T) {
 	assert.Equal(t, "test-data", buf.String())
 
 	// Verify storage was used
-	data, err := storage.Read(ctx, CurrentKey)
+	data, err := storage.Read(ctx, snapshotKey(contentHash([]byte("test-data"))))
 	require.NoError(t, err)
 	assert.Equal(t, []byte("test-data"), data)
 }
 
+func TestHistoryDeduplication(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithStorage(storage), HistoryWithHistoryLimit(3))
+	require.NoError(t, err)
+
+	keyA, err := h.Add(ctx, []byte("a"))
+	require.NoError(t, err)
+	// identical exports are not stored again
+	keyA2, err := h.Add(ctx, []byte("a"))
+	require.NoError(t, err)
+	assert.Equal(t, keyA, keyA2)
+
+	keyB, err := h.Add(ctx, []byte("b"))
+	require.NoError(t, err)
+	// going back to a known snapshot only moves the pointer
+	_, err = h.Add(ctx, []byte("a"))
+	require.NoError(t, err)
+
+	files, err := h.getHistory(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{keyA, keyB}, files)
+
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "a", buf.String())
+
+	keys, err := storage.List(ctx, HistorySnapshotPrefix)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestHistoryLegacyFallback(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, storage.Write(ctx, CurrentKey, []byte("legacy")))
+	require.NoError(t, storage.Write(ctx, HistoryRepoJSONPrefix+"2017-10-23"+HistoryRepoJSONSuffix, []byte("legacy")))
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithStorage(storage), HistoryWithHistoryLimit(2))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "legacy", buf.String())
+
+	key, err := h.Add(ctx, []byte("new"))
+	require.NoError(t, err)
+	files, err := h.getHistory(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key, HistoryRepoJSONPrefix + "2017-10-23" + HistoryRepoJSONSuffix}, files)
+
+	// releases before the manifest restore the legacy current copy after a rollback
+	data, err := storage.Read(ctx, CurrentKey)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	require.NoError(t, h.RemoveLegacyCurrent(ctx))
+	_, err = storage.Read(ctx, CurrentKey)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	buf.Reset()
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "new", buf.String())
+}
+
+func TestHistoryWithoutLegacyCurrent(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithStorage(storage), HistoryWithLegacyCurrent(false))
+	require.NoError(t, err)
+
+	// the legacy copy is the current snapshot as long as there is no manifest
+	require.Error(t, h.RemoveLegacyCurrent(ctx))
+
+	_, err = h.Add(ctx, []byte("new"))
+	require.NoError(t, err)
+	_, err = storage.Read(ctx, CurrentKey)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestHistoryCorruptedFallback(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewFilesystemStorage(dir)
+	require.NoError(t, err)
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithStorage(storage), HistoryWithHistoryLimit(3))
+	require.NoError(t, err)
+
+	keyA, err := h.Add(ctx, []byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, keyA), time.Now(), time.Now().Add(-time.Hour)))
+	keyB, err := h.Add(ctx, []byte("b"))
+	require.NoError(t, err)
+	keyC, err := h.Add(ctx, []byte("c"))
+	require.NoError(t, err)
+
+	// the current snapshot is truncated, the newest valid backup is b
+	truncate(t, filepath.Join(dir, keyC))
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "b", buf.String())
+
+	// without a manifest the snapshots are ordered by their modification time
+	truncate(t, filepath.Join(dir, ManifestKey))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, keyB), []byte("not b"), 0600))
+	buf.Reset()
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "a", buf.String())
+
+	// a corrupted manifest does not block further updates
+	_, err = h.Add(ctx, []byte("d"))
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "d", buf.String())
+}
+
+func TestHistoryCorruptedManifest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithHistoryDir(dir), HistoryWithHistoryLimit(5))
+	require.NoError(t, err)
+
+	var keys []string
+	for _, data := range []string{"a", "b", "c"} {
+		key, err := h.AddWithMetadata(ctx, []byte(data), &SnapshotMetadata{Trigger: TriggerPoll})
+		require.NoError(t, err)
+		keys = append(keys, key)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the snapshots are listed from the storage until the manifest is written again
+	truncate(t, filepath.Join(dir, ManifestKey))
+	list, err := h.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, []string{keys[2], keys[1], keys[0]}, []string{list[0].Key, list[1].Key, list[2].Key})
+	assert.Equal(t, TriggerPoll, list[2].Trigger)
+
+	// the next snapshot rebuilds the manifest, the older snapshots are kept
+	keyD, err := h.Add(ctx, []byte("d"))
+	require.NoError(t, err)
+	list, err = h.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	assert.Equal(t, []string{keyD, keys[2], keys[1], keys[0]}, []string{list[0].Key, list[1].Key, list[2].Key, list[3].Key})
+	assert.Equal(t, 1, list[3].Size)
+	assert.Equal(t, TriggerPoll, list[3].Trigger)
+
+	// and can be restored
+	data, err := h.Get(ctx, keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "d", buf.String())
+
+	// snapshots which are added again become current without being written
+	_, err = h.Add(ctx, []byte("b"))
+	require.NoError(t, err)
+	list, err = h.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 4)
+	assert.Equal(t, keys[1], list[0].Key)
+}
+
 func TestHistoryWithBlobStorage(t *testing.T) {
 	ctx := context.Background()
 	bucket, err := blob.OpenBucket(ctx, "mem://")
@@ -106,7 +275,7 @@ func TestHistoryWithBlobStorage(t *testing.T) {
 	require.NoError(t, err)
 
 	// Test Add
-	err = h.Add(ctx, []byte("test-data"))
+	_, err = h.Add(ctx, []byte("test-data"))
 	require.NoError(t, err)
 
 	// Test GetCurrent
@@ -118,7 +287,7 @@ func TestHistoryWithBlobStorage(t *testing.T) {
 	// Test cleanup - add more entries
 	for i := 0; i < 5; i++ {
 		time.Sleep(time.Millisecond * 5) // Ensure unique timestamps
-		err = h.Add(ctx, []byte(fmt.Sprintf("data-%d", i)))
+		_, err = h.Add(ctx, []byte(fmt.Sprintf("data-%d", i)))
 		require.NoError(t, err)
 	}
 
@@ -152,3 +321,10 @@ func testHistoryWithTestdata(t *testing.T) *History {
 	require.NoError(t, err)
 	return h
 }
+
+func truncate(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)-1], 0600))
+}
@@ -0,0 +1,50 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// LeaderRoutine renews or acquires the leader lease until the context is done
+func (r *Repo) LeaderRoutine(ctx context.Context) error {
+	l := r.l.Named("routine.leader")
+	// renew well before the lease expires
+	ticker := time.NewTicker(r.leaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Debug("routine canceled")
+			if err := r.lease.Release(context.WithoutCancel(ctx)); err != nil {
+				l.Warn("failed to release lease", zap.Error(err))
+			}
+			metrics.LeaderGauge.WithLabelValues().Set(0)
+			return nil
+		case <-ticker.C:
+			r.tryAcquireLease(ctx)
+		}
+	}
+}
+
+func (r *Repo) tryAcquireLease(ctx context.Context) {
+	wasLeader := r.leading
+	leader, err := r.lease.TryAcquire(ctx)
+	if err != nil {
+		r.l.Warn("failed to acquire or renew lease", zap.Error(err), zap.Bool("leader", leader))
+	}
+	switch {
+	case leader && !wasLeader:
+		r.l.Info("became leader")
+	case !leader && wasLeader:
+		r.l.Warn("lost leadership")
+	}
+	r.leading = leader
+	if leader {
+		metrics.LeaderGauge.WithLabelValues().Set(1)
+	} else {
+		metrics.LeaderGauge.WithLabelValues().Set(0)
+	}
+}
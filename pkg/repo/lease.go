@@ -0,0 +1,248 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// LeaseKeyPrefix is the storage key prefix of the leader lease generations, it does not match the history prefix
+const LeaseKeyPrefix = "contentserver-lease-"
+
+// ErrLeaseLost is returned by Check if another replica holds the lease or it has expired
+var ErrLeaseLost = errors.New("lease lost")
+
+type (
+	// Lease elects a single leader among replicas sharing a storage.
+	// Every acquisition, renewal and release creates the next generation of the lease with a conditional write,
+	// so only one replica can succeed the generation it read. Other replicas may only take the lease over once
+	// it has expired.
+	Lease struct {
+		l       *zap.Logger
+		storage Storage
+		writer  ConditionalWriter
+		owner   string
+		ttl     time.Duration
+		expires time.Time
+		// generation is the generation this lease created last
+		generation uint64
+		expiresMu  sync.RWMutex
+	}
+	leaseRecord struct {
+		Owner   string    `json:"owner"`
+		Expires time.Time `json:"expires"`
+		// generation is the generation of the key the record was read from
+		generation uint64
+	}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewLease returns a lease for the owner, the storage must implement ConditionalWriter
+func NewLease(l *zap.Logger, storage Storage, owner string, ttl time.Duration) (*Lease, error) {
+	writer, ok := storage.(ConditionalWriter)
+	if !ok {
+		return nil, errors.New("storage does not support conditional writes")
+	}
+	return &Lease{
+		l:       l.Named("lease"),
+		storage: storage,
+		writer:  writer,
+		owner:   owner,
+		ttl:     ttl,
+	}, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Held reports whether the lease is held and has not expired locally.
+// A leader which can not renew its lease steps down once the lease expires.
+func (l *Lease) Held() bool {
+	l.expiresMu.RLock()
+	defer l.expiresMu.RUnlock()
+	return time.Now().Before(l.expires)
+}
+
+// Check re-reads the newest generation of the lease and fails with ErrLeaseLost unless it is still held by
+// the owner and has not expired. It fences writes of a leader which may have lost the lease since Held was checked.
+func (l *Lease) Check(ctx context.Context) error {
+	l.expiresMu.RLock()
+	expires, generation := l.expires, l.generation
+	l.expiresMu.RUnlock()
+	now := time.Now()
+	if !now.Before(expires) {
+		return ErrLeaseLost
+	}
+	record, err := l.read(ctx)
+	if errors.Is(err, os.ErrExist) {
+		// a newer generation was created meanwhile, see read
+		record, err = l.read(ctx)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read lease")
+	}
+	// renewals by the owner create newer generations
+	if record.Owner != l.owner || record.generation < generation || !now.Before(record.Expires) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// TryAcquire acquires or renews the lease and reports whether it is held
+func (l *Lease) TryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	record, err := l.read(ctx)
+	switch {
+	case errors.Is(err, os.ErrExist):
+		// another replica was faster
+		l.setExpires(time.Time{}, 0)
+		return false, nil
+	case err != nil:
+		// keep the local expiry, the lease might still be ours
+		return l.Held(), err
+	case record.Owner != l.owner && now.Before(record.Expires):
+		l.setExpires(time.Time{}, 0)
+		return false, nil
+	case record.Owner != "" && record.Owner != l.owner:
+		l.l.Info("taking over expired lease", zap.String("previous", record.Owner))
+	}
+	expires := now.Add(l.ttl)
+	if err := l.next(ctx, record, leaseRecord{Owner: l.owner, Expires: expires}); errors.Is(err, os.ErrExist) {
+		// another replica was faster
+		l.setExpires(time.Time{}, 0)
+		return false, nil
+	} else if err != nil {
+		return l.Held(), err
+	}
+	l.setExpires(expires, record.generation+1)
+	return true, nil
+}
+
+// Release gives up the lease if it is held by the owner
+func (l *Lease) Release(ctx context.Context) error {
+	if !l.Held() {
+		return nil
+	}
+	l.setExpires(time.Time{}, 0)
+	record, err := l.read(ctx)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if record.Owner != l.owner {
+		return nil
+	}
+	if err := l.next(ctx, record, leaseRecord{}); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// read returns the record of the newest generation, an expired record without owner if there is none
+func (l *Lease) read(ctx context.Context) (*leaseRecord, error) {
+	keys, err := l.storage.List(ctx, LeaseKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		key        string
+		generation uint64
+	)
+	for _, k := range keys {
+		if v, ok := leaseGeneration(k); ok {
+			key, generation = k, v
+			break
+		}
+	}
+	if key == "" {
+		return &leaseRecord{}, nil
+	}
+	data, err := l.storage.Read(ctx, key)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed as an outdated generation meanwhile, there is a newer one
+		return nil, os.ErrExist
+	} else if err != nil {
+		return nil, err
+	}
+	record := &leaseRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		// a broken lease is treated as expired
+		l.l.Warn("failed to decode lease", zap.String("key", key), zap.Error(err))
+		record = &leaseRecord{}
+	}
+	record.generation = generation
+	return record, nil
+}
+
+// next creates the generation following the previous record, it fails with os.ErrExist if another
+// replica created it first. Generations older than the previous one are removed.
+func (l *Lease) next(ctx context.Context, previous *leaseRecord, record leaseRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := l.writer.Create(ctx, leaseKey(previous.generation+1), data); err != nil {
+		return err
+	}
+	if previous.generation > 0 {
+		l.cleanup(ctx, previous.generation)
+	}
+	return nil
+}
+
+// cleanup removes the generations before the given one, readers may still be about to read the given one
+func (l *Lease) cleanup(ctx context.Context, generation uint64) {
+	keys, err := l.storage.List(ctx, LeaseKeyPrefix)
+	if err != nil {
+		l.l.Warn("failed to list lease generations", zap.Error(err))
+		return
+	}
+	for _, key := range keys {
+		if v, ok := leaseGeneration(key); ok && v < generation {
+			if err := l.storage.Delete(ctx, key); err != nil {
+				l.l.Warn("failed to remove lease generation", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (l *Lease) setExpires(v time.Time, generation uint64) {
+	l.expiresMu.Lock()
+	defer l.expiresMu.Unlock()
+	l.expires = v
+	l.generation = generation
+}
+
+// leaseKey returns the key of a generation, generations are zero padded so the newest is listed first
+func leaseKey(generation uint64) string {
+	return fmt.Sprintf("%s%020d.json", LeaseKeyPrefix, generation)
+}
+
+func leaseGeneration(key string) (uint64, bool) {
+	v, ok := strings.CutPrefix(key, LeaseKeyPrefix)
+	if !ok {
+		return 0, false
+	}
+	v, ok = strings.CutSuffix(v, ".json")
+	if !ok {
+		return 0, false
+	}
+	generation, err := strconv.ParseUint(v, 10, 64)
+	return generation, err == nil
+}
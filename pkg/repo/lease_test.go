@@ -0,0 +1,174 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLease(t *testing.T) {
+	fsStorage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+
+	for name, storage := range map[string]Storage{
+		"filesystem": fsStorage,
+		"blob":       newTestBlobStorage(t, "prefix"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := zaptest.NewLogger(t)
+			ctx := t.Context()
+			ttl := 200 * time.Millisecond
+
+			a, err := NewLease(l, storage, "a", ttl)
+			require.NoError(t, err)
+			b, err := NewLease(l, storage, "b", ttl)
+			require.NoError(t, err)
+
+			ok, err := a.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = b.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			require.NoError(t, a.Check(ctx))
+			require.ErrorIs(t, b.Check(ctx), ErrLeaseLost)
+
+			// renewing keeps the lease
+			time.Sleep(ttl / 2)
+			ok, err = a.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			require.NoError(t, a.Check(ctx))
+
+			// a stops renewing, b takes over once the lease expired
+			time.Sleep(ttl + 10*time.Millisecond)
+			assert.False(t, a.Held())
+			ok, err = b.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = a.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			require.ErrorIs(t, a.Check(ctx), ErrLeaseLost)
+			require.NoError(t, b.Check(ctx))
+
+			require.NoError(t, b.Release(ctx))
+			ok, err = a.TryAcquire(ctx)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			require.NoError(t, a.Release(ctx))
+
+			// outdated generations are removed
+			keys, err := storage.List(ctx, LeaseKeyPrefix)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(keys), 2)
+		})
+	}
+}
+
+func TestLeaseTakeOverIsExclusive(t *testing.T) {
+	fsStorage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+
+	for name, storage := range map[string]Storage{
+		"filesystem": fsStorage,
+		"blob":       newTestBlobStorage(t, "prefix"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := zaptest.NewLogger(t)
+			ctx := t.Context()
+			ttl := 100 * time.Millisecond
+
+			// an expired lease of a replica which went away
+			previous, err := NewLease(l, storage, "previous", ttl)
+			require.NoError(t, err)
+			ok, err := previous.TryAcquire(ctx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			time.Sleep(ttl + 10*time.Millisecond)
+
+			var (
+				wg      sync.WaitGroup
+				leaders atomic.Int32
+			)
+			for i := range 10 {
+				lease, err := NewLease(l, storage, fmt.Sprintf("replica-%d", i), time.Minute)
+				require.NoError(t, err)
+				wg.Go(func() {
+					if ok, err := lease.TryAcquire(ctx); err == nil && ok {
+						leaders.Add(1)
+					}
+				})
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), leaders.Load())
+		})
+	}
+}
+
+// readHookStorage calls onRead before reading a key
+type readHookStorage struct {
+	*BlobStorage
+	onRead func(key string)
+}
+
+func (s *readHookStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	if onRead := s.onRead; onRead != nil {
+		onRead(key)
+	}
+	return s.BlobStorage.Read(ctx, key)
+}
+
+func TestLeaseFencesHistory(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	ctx := t.Context()
+	ttl := 100 * time.Millisecond
+	storage := &readHookStorage{BlobStorage: newTestBlobStorage(t, "")}
+	h, err := NewHistory(l, HistoryWithStorage(storage))
+	require.NoError(t, err)
+	r := New(l, "", h)
+	lease, err := NewLease(l, storage, "leader", ttl)
+	require.NoError(t, err)
+	ok, err := lease.TryAcquire(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	r.useLease(lease)
+	other, err := NewLease(l, storage, "other", ttl)
+	require.NoError(t, err)
+
+	keyA, err := r.addToHistory(ctx, []byte("a"), nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, keyA)
+
+	// the lease expires and is taken over after Leader was checked, while the manifest is read
+	require.True(t, r.Leader())
+	storage.onRead = func(key string) {
+		if key != ManifestKey {
+			return
+		}
+		storage.onRead = nil
+		time.Sleep(ttl + 10*time.Millisecond)
+		ok, err := other.TryAcquire(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	keyB, err := r.addToHistory(ctx, []byte("b"), nil)
+	require.NoError(t, err)
+	assert.Empty(t, keyB)
+
+	// the new leader's history is not overwritten
+	keys, err := h.Keys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{keyA}, keys)
+	_, err = storage.Read(ctx, snapshotKey(contentHash([]byte("b"))))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
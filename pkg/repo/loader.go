@@ -9,6 +9,7 @@ import (
 
 	"github.com/foomo/contentserver/content"
 	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/responses"
 	"github.com/google/uuid"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
@@ -19,12 +20,28 @@ import (
 var (
 	json              = jsoniter.ConfigCompatibleWithStandardLibrary
 	ErrUpdateRejected = errors.New("update rejected: queue full")
+	// ErrNotLoaded is returned by RepoSnapshot if nothing has been loaded and the storage has no snapshot either
+	ErrNotLoaded = errors.New("repo not loaded yet")
 )
 
-type updateResponse struct {
-	repoRuntime int64
-	err         error
-}
+type (
+	updateRequest struct {
+		// historyKey loads a snapshot from the history instead of the repository url
+		historyKey string
+		// revision announced for the history key
+		revision *responses.Revision
+		// trigger is recorded in the snapshot metadata
+		trigger  string
+		response chan updateResponse
+	}
+	updateResponse struct {
+		repoRuntime int64
+		// historyKey the update was persisted to, empty if nothing has been written
+		historyKey string
+		change     *responses.Change
+		err        error
+	}
+)
 
 func (r *Repo) PollRoutine(ctx context.Context) error {
 	l := r.l.Named("routine.poll")
@@ -35,35 +52,54 @@ func (r *Repo) PollRoutine(ctx context.Context) error {
 			l.Debug("routine canceled")
 			return nil
 		case <-ticker.C:
-			chanReponse := make(chan updateResponse)
-			r.updateInProgressChannel <- chanReponse
-			response := <-chanReponse
+			req := updateRequest{trigger: TriggerPoll, response: make(chan updateResponse)}
+			r.updateInProgressChannel <- req
+			response := <-req.response
+			update := r.newUpdate(response)
 			if response.err == nil {
-				l.Info("update success", zap.String("revision", r.pollVersion))
+				l.Info("update success", zap.String("revision", r.Snapshot().Version()))
 			} else {
 				l.Error("update failed", zap.Error(response.err))
 			}
+			r.updateDone(ctx, update, response.change)
 		}
 	}
 }
 
 func (r *Repo) UpdateRoutine(ctx context.Context) error {
 	l := r.l.Named("routine.update")
+	defer r.closeSubscribers()
 	for {
 		select {
 		case <-ctx.Done():
 			l.Debug("routine canceled")
 			return nil
-		case resChan := <-r.updateInProgressChannel:
+		case req := <-r.updateInProgressChannel:
 			start := time.Now()
 			l := l.With(zap.String("run_id", uuid.New().String()))
 
-			l.Info("update started")
-
-			repoRuntime, err := r.update(context.WithoutCancel(ctx))
+			var (
+				change      *responses.Change
+				previous    = r.Snapshot()
+				repoRuntime int64
+				historyKey  string
+				err         error
+			)
+			if req.historyKey == "" && !r.Leader() {
+				// followers load what the leader persisted, they never contact the repository
+				req.historyKey = CurrentKey
+			}
+			if req.historyKey != "" {
+				l.Info("update from history started", zap.String("key", req.historyKey))
+				repoRuntime, err = r.loadHistoryKey(context.WithoutCancel(ctx), req.historyKey, req.revision)
+			} else {
+				l.Info("update started")
+				repoRuntime, historyKey, err = r.update(context.WithoutCancel(ctx), req.trigger)
+			}
 			if err != nil {
 				l.Error("update failed", zap.Error(err))
 				metrics.UpdatesFailedCounter.WithLabelValues().Inc()
+				r.setLastError(err)
 			} else {
 				if !r.Loaded() {
 					r.loaded.Store(true)
@@ -75,10 +111,19 @@ func (r *Repo) UpdateRoutine(ctx context.Context) error {
 					l.Info("update success")
 				}
 				metrics.UpdatesCompletedCounter.WithLabelValues().Inc()
+				if current := r.Snapshot(); current != previous {
+					change = newChange(previous, current)
+					r.publishChange(change)
+					if historyKey != "" {
+						r.announce(ctx, historyKey, current.Revision())
+					}
+				}
 			}
 
-			resChan <- updateResponse{
+			req.response <- updateResponse{
 				repoRuntime: repoRuntime,
+				historyKey:  historyKey,
+				change:      change,
 				err:         err,
 			}
 
@@ -87,38 +132,9 @@ func (r *Repo) UpdateRoutine(ctx context.Context) error {
 	}
 }
 
-func (r *Repo) DimensionUpdateRoutine(ctx context.Context) error {
-	l := r.l.Named("routine.dimensionUpdate")
-	for {
-		select {
-		case <-ctx.Done():
-			l.Debug("routine canceled")
-			return nil
-		case newDimension := <-r.dimensionUpdateChannel:
-			l.Debug("received a new dimension", zap.String("dimension", newDimension.Dimension))
-
-			err := r._updateDimension(newDimension.Dimension, newDimension.Node)
-			l.Info("received result")
-			if err != nil {
-				l.Debug("update failed", zap.Error(err))
-			}
-			r.dimensionUpdateDoneChannel <- err
-		}
-	}
-}
-
-func (r *Repo) updateDimension(dimension string, node *content.RepoNode) error {
-	r.l.Debug("trying to push dimension into update channel", zap.String("dimension", dimension), zap.String("nodeName", node.Name))
-	r.dimensionUpdateChannel <- &RepoDimension{
-		Dimension: dimension,
-		Node:      node,
-	}
-	r.l.Debug("waiting for done signal")
-	return <-r.dimensionUpdateDoneChannel
-}
-
-// do not call directly, but only through channel
-func (r *Repo) _updateDimension(dimension string, newNode *content.RepoNode) error {
+// buildDimension builds the lookup directories for a dimension.
+// The resulting dimension is not visible before it is part of a snapshot.
+func buildDimension(dimension string, newNode *content.RepoNode) (*Dimension, error) {
 	newNode.WireParents()
 
 	var (
@@ -127,44 +143,18 @@ func (r *Repo) _updateDimension(dimension string, newNode *content.RepoNode) err
 		err             = buildDirectory(newNode, newDirectory, newURIDirectory)
 	)
 	if err != nil {
-		return errors.New("update dimension \"" + dimension + "\" failed when building its directory:: " + err.Error())
+		return nil, errors.New("update dimension \"" + dimension + "\" failed when building its directory:: " + err.Error())
 	}
 	err = wireAliases(newDirectory)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// ---------------------------------------------
-
-	// copy old datastructure to prevent concurrent map access
-	// collect other dimension in the Directory
-	newRepoDirectory := map[string]*Dimension{}
-	for d, D := range r.Directory() {
-		if d != dimension {
-			newRepoDirectory[d] = D
-		}
-	}
-
-	// add the new dimension
-	newRepoDirectory[dimension] = &Dimension{
+	return &Dimension{
 		Node:         newNode,
 		Directory:    newDirectory,
 		URIDirectory: newURIDirectory,
-	}
-	r.SetDirectory(newRepoDirectory)
-
-	// ---------------------------------------------
-
-	// @TODO: why not update only the dimension that has changed instead?
-	// repo.Directory[dimension] = &Dimension{
-	// 	Node:         newNode,
-	// 	Directory:    newDirectory,
-	// 	URIDirectory: newURIDirectory,
-	// }
-
-	// ---------------------------------------------
-
-	return nil
+	}, nil
 }
 
 func buildDirectory(dirNode *content.RepoNode, directory map[string]*content.RepoNode, uRIDirectory map[string]*content.RepoNode) error {
@@ -200,9 +190,9 @@ func wireAliases(directory map[string]*content.RepoNode) error {
 	return nil
 }
 
-func (r *Repo) loadNodesFromJSON() (nodes map[string]*content.RepoNode, err error) {
+func (r *Repo) loadNodesFromJSON(data []byte) (nodes map[string]*content.RepoNode, err error) {
 	nodes = make(map[string]*content.RepoNode)
-	err = json.Unmarshal(r.JSONBufferBytes(), &nodes)
+	err = json.Unmarshal(data, &nodes)
 	if err != nil {
 		r.l.Error("Failed to deserialize nodes", zap.Error(err))
 		return nil, errors.New("failed to deserialize nodes")
@@ -217,22 +207,23 @@ func (r *Repo) tryToRestoreCurrent(ctx context.Context) error {
 		return err
 	}
 	r.SetJSONBuffer(buffer)
-	return r.loadJSONBytes(ctx)
+	return r.loadJSONBytes(ctx, "")
 }
 
-func (r *Repo) get(ctx context.Context, url string) error {
+// get loads the repo json into the buffer and returns the etag reported by the repository
+func (r *Repo) get(ctx context.Context, url string) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return errors.Wrap(err, "failed to create get repo request")
+		return "", errors.Wrap(err, "failed to create get repo request")
 	}
 	response, err := r.httpClient.Do(req)
 	if err != nil {
-		return errors.Wrap(err, "failed to get repo")
+		return "", errors.Wrap(err, "failed to get repo")
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return errors.Errorf("bad response code from repository %q want %q", response.Status, http.StatusOK)
+		return "", errors.Errorf("bad response code from repository %q want %q", response.Status, http.StatusOK)
 	}
 
 	// Log.Info(ansi.Red + "RESETTING BUFFER" + ansi.Reset)
@@ -241,33 +232,35 @@ func (r *Repo) get(ctx context.Context, url string) error {
 	// Log.Info(ansi.Green + "LOADING DATA INTO BUFFER" + ansi.Reset)
 	_, err = io.Copy(buffer, response.Body)
 	if err != nil {
-		return errors.Wrap(err, "failed to copy IO stream")
+		return "", errors.Wrap(err, "failed to copy IO stream")
 	}
 	r.SetJSONBuffer(buffer)
 
-	return nil
+	return response.Header.Get("Etag"), nil
 }
 
-func (r *Repo) update(ctx context.Context) (repoRuntime int64, err error) {
-	startTimeRepo := time.Now().UnixNano()
+// update downloads and loads the repo, it returns the history key the repo was persisted to
+func (r *Repo) update(ctx context.Context, trigger string) (repoRuntime int64, historyKey string, err error) {
+	start := time.Now()
+	startTimeRepo := start.UnixNano()
 
 	repoURL := r.url
 	if r.poll {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
 		if err != nil {
-			return repoRuntime, err
+			return repoRuntime, "", err
 		}
 		resp, err := r.httpClient.Do(req)
 		if err != nil {
-			return repoRuntime, err
+			return repoRuntime, "", err
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
-			return repoRuntime, errors.New("could not poll latest repo download url - non 200 response")
+			return repoRuntime, "", errors.New("could not poll latest repo download url - non 200 response")
 		}
 		responseBytes, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return repoRuntime, errors.New("could not poll latest repo download url, could not read body")
+			return repoRuntime, "", errors.New("could not poll latest repo download url, could not read body")
 		}
 		repoURL = string(responseBytes)
 		if repoURL == r.pollVersion {
@@ -276,7 +269,7 @@ func (r *Repo) update(ctx context.Context) (repoRuntime int64, err error) {
 				zap.String("pollVersion", r.pollVersion),
 			)
 			// already up to date
-			return repoRuntime, nil
+			return repoRuntime, "", nil
 		}
 		r.l.Info(
 			"new repo poll version",
@@ -284,58 +277,101 @@ func (r *Repo) update(ctx context.Context) (repoRuntime int64, err error) {
 		)
 	}
 
-	err = r.get(ctx, repoURL)
+	etag, err := r.get(ctx, repoURL)
 	repoRuntime = time.Now().UnixNano() - startTimeRepo
 	if err != nil {
 		// we have no json to load - the repo server did not reply
 		r.l.Debug("failed to load json", zap.Error(err))
-		return repoRuntime, err
+		return repoRuntime, "", err
 	}
-	r.l.Debug("loading json", zap.String("server", repoURL), zap.Int("length", len(r.JSONBufferBytes())))
-	nodes, err := r.loadNodesFromJSON()
+	data := r.JSONBufferBytes()
+	r.l.Debug("loading json", zap.String("server", repoURL), zap.Int("length", len(data)))
+	nodes, err := r.loadNodesFromJSON(data)
 	if err != nil {
 		// could not load nodes from json
-		return repoRuntime, err
+		return repoRuntime, "", err
 	}
-	err = r.loadNodes(nodes)
+	sourceVersion := etag
+	if r.poll {
+		sourceVersion = repoURL
+	}
+	err = r.loadNodes(data, nodes, newRevision(data, sourceVersion, time.Now()))
 	if err != nil {
 		// repo failed to load nodes
-		return repoRuntime, err
+		return repoRuntime, "", err
 	}
 	if r.poll {
 		r.pollVersion = repoURL
 	}
 
 	// Persist the JSON buffer after successful update
-	if err := r.history.Add(ctx, r.JSONBufferBytes()); err != nil {
-		r.l.Error("Failed to persist repo after update", zap.Error(err))
+	metadata := r.newSnapshotMetadata(trigger, start)
+	metadata.SourceURL = repoURL
+	metadata.ETag = etag
+	if r.poll {
+		metadata.PollVersion = repoURL
+	}
+	historyKey, errHistory := r.addToHistory(ctx, data, metadata)
+	if errHistory != nil {
+		r.l.Error("Failed to persist repo after update", zap.Error(errHistory))
 		metrics.HistoryPersistFailedCounter.WithLabelValues().Inc()
 	} else {
 		r.l.Info("Successfully persisted repo after update")
 	}
 
+	return repoRuntime, historyKey, nil
+}
+
+// loadHistoryKey loads a snapshot another replica has written to the shared history.
+// The announced revision is kept if it matches the data, so all replicas serve the same version.
+func (r *Repo) loadHistoryKey(ctx context.Context, key string, revision *responses.Revision) (repoRuntime int64, err error) {
+	start := time.Now()
+	data, err := r.history.Get(ctx, key)
+	repoRuntime = time.Since(start).Nanoseconds()
+	if err != nil {
+		return repoRuntime, errors.Wrap(err, "failed to read history key "+key)
+	}
+	loaded := newRevision(data, "", time.Now())
+	if revision != nil && revision.Hash == loaded.Hash {
+		loaded = revision
+	}
+	if current := r.Snapshot().Revision(); current != nil && (current.ID == loaded.ID || revision == nil && current.Hash == loaded.Hash) {
+		// already serving this revision
+		return repoRuntime, nil
+	}
+	nodes, err := r.loadNodesFromJSON(data)
+	if err != nil {
+		return repoRuntime, err
+	}
+	if err := r.loadNodes(data, nodes, loaded); err != nil {
+		return repoRuntime, err
+	}
+	r.SetJSONBuffer(bytes.NewBuffer(data))
+	if r.poll && loaded.SourceVersion != "" {
+		// do not download what has already been loaded
+		r.pollVersion = loaded.SourceVersion
+	}
 	return repoRuntime, nil
 }
 
 // limit ressources and allow only one update request at once
-func (r *Repo) tryUpdate() (repoRuntime int64, err error) {
-	c := make(chan updateResponse)
+func (r *Repo) tryUpdate(trigger string) updateResponse {
+	req := updateRequest{trigger: trigger, response: make(chan updateResponse)}
 	select {
-	case r.updateInProgressChannel <- c:
+	case r.updateInProgressChannel <- req:
 		r.l.Debug("update request added to queue")
-		ur := <-c
-		return ur.repoRuntime, ur.err
+		return <-req.response
 	default:
 		r.l.Info("update request accepted, will be processed after the previous update")
-		return 0, ErrUpdateRejected
+		return updateResponse{err: ErrUpdateRejected}
 	}
 }
 
-func (r *Repo) loadJSONBytes(ctx context.Context) error {
-	nodes, err := r.loadNodesFromJSON()
+func (r *Repo) loadJSONBytes(ctx context.Context, sourceVersion string) error {
+	start := time.Now()
+	data := r.JSONBufferBytes()
+	nodes, err := r.loadNodesFromJSON(data)
 	if err != nil {
-		data := r.JSONBufferBytes()
-
 		if len(data) > 10 {
 			r.l.Debug("could not parse json",
 				zap.String("jsonStart", string(data[:10])),
@@ -345,9 +381,9 @@ func (r *Repo) loadJSONBytes(ctx context.Context) error {
 		return err
 	}
 
-	err = r.loadNodes(nodes)
+	err = r.loadNodes(data, nodes, newRevision(data, sourceVersion, time.Now()))
 	if err == nil {
-		errHistory := r.history.Add(ctx, r.JSONBufferBytes())
+		_, errHistory := r.addToHistory(ctx, data, r.newSnapshotMetadata(TriggerRestore, start))
 		if errHistory != nil {
 			r.l.Error("Could not add valid JSON to history", zap.Error(errHistory))
 			metrics.HistoryPersistFailedCounter.WithLabelValues().Inc()
@@ -358,37 +394,28 @@ func (r *Repo) loadJSONBytes(ctx context.Context) error {
 	return err
 }
 
-func (r *Repo) loadNodes(newNodes map[string]*content.RepoNode) error {
+// loadNodes builds all dimensions and replaces the current snapshot at once,
+// dimensions which are not part of the new nodes are dropped.
+func (r *Repo) loadNodes(data []byte, newNodes map[string]*content.RepoNode, revision *responses.Revision) error {
 	var err error
-	newDimensions := make([]string, 0, len(newNodes))
+	directory := make(map[string]*Dimension, len(newNodes))
 	for dimension, newNode := range newNodes {
-		newDimensions = append(newDimensions, dimension)
 		r.l.Debug("loading nodes for dimension", zap.String("dimension", dimension))
-		errLoad := r.updateDimension(dimension, newNode)
+		newDimension, errLoad := buildDimension(dimension, newNode)
 		if errLoad != nil {
 			err = multierr.Append(err, errLoad)
+			continue
 		}
+		directory[dimension] = newDimension
 	}
 	if err != nil {
 		return errors.Wrap(err, "failed to update dimension")
 	}
-	dimensionIsValid := func(dimension string) bool {
-		for _, newDimension := range newDimensions {
-			if dimension == newDimension {
-				return true
-			}
-		}
-		return false
-	}
-	// we need to throw away orphaned dimensions
-	directory := map[string]*Dimension{}
-	for dimension, value := range r.Directory() {
-		if !dimensionIsValid(dimension) {
+	for dimension := range r.Directory() {
+		if _, ok := directory[dimension]; !ok {
 			r.l.Info("removing orphaned dimension", zap.String("dimension", dimension))
-			continue
 		}
-		directory[dimension] = value
 	}
-	r.SetDirectory(directory)
+	r.setSnapshot(newSnapshot(r.l, revision, data, directory))
 	return nil
 }
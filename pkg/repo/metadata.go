@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/foomo/contentserver/responses"
+)
+
+// Triggers record what caused a snapshot to be loaded
+const (
+	TriggerPoll    = "poll"
+	TriggerHTTP    = "http"
+	TriggerSocket  = "socket"
+	TriggerGRPC    = "grpc"
+	TriggerStartup = "startup"
+	TriggerRestore = "restore"
+)
+
+// HistoryMetadataPrefix is the prefix of the metadata sidecars stored next to the snapshots
+const HistoryMetadataPrefix = "contentserver-metadata-"
+
+type (
+	// SnapshotMetadata describes a snapshot in the history
+	SnapshotMetadata struct {
+		Key   string    `json:"key"`
+		Hash  string    `json:"hash"`
+		Size  int       `json:"size"`
+		Added time.Time `json:"added"`
+		// RevisionID of the revision which was served when the snapshot was added
+		RevisionID string `json:"revisionId,omitempty"`
+		// SourceURL the snapshot was downloaded from
+		SourceURL string `json:"sourceUrl,omitempty"`
+		// PollVersion is the polled version, if the repo polls
+		PollVersion string `json:"pollVersion,omitempty"`
+		// ETag reported by the repository
+		ETag string `json:"etag,omitempty"`
+		// Dimensions contains the node and uri counts of each dimension
+		Dimensions map[string]responses.DimensionStatus `json:"dimensions,omitempty"`
+		// LoadDuration covers downloading and loading the snapshot
+		LoadDuration time.Duration `json:"loadDuration,omitempty"`
+		// Trigger of the update, see the Trigger constants
+		Trigger string `json:"trigger,omitempty"`
+	}
+	triggerContextKey struct{}
+)
+
+// ContextWithTrigger returns a context recording what triggered an update
+func ContextWithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerContextKey{}, trigger)
+}
+
+func triggerFromContext(ctx context.Context) string {
+	if v, ok := ctx.Value(triggerContextKey{}).(string); ok {
+		return v
+	}
+	return ""
+}
+
+func metadataKey(hash string) string {
+	return HistoryMetadataPrefix + hash + HistoryRepoJSONSuffix
+}
@@ -7,15 +7,15 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/foomo/contentserver/content"
-	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/pkg/cluster"
 	"github.com/foomo/contentserver/requests"
 	"github.com/foomo/contentserver/responses"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
@@ -26,24 +26,38 @@ const maxGetURIForNodeRecursionLevel = 1000
 // Repo content repository
 type (
 	Repo struct {
-		l                          *zap.Logger
-		url                        string
-		poll                       bool
-		pollInterval               time.Duration
-		pollVersion                string
-		onLoaded                   func()
-		loaded                     *atomic.Bool
-		history                    *History
-		httpClient                 *http.Client
-		dimensionUpdateChannel     chan *RepoDimension
-		dimensionUpdateDoneChannel chan error
-		updateInProgressChannel    chan chan updateResponse
-		directory                  map[string]*Dimension
-		directoryLock              sync.RWMutex
-		jsonBuffer                 *bytes.Buffer
-		jsonBufferLock             sync.RWMutex
+		l                       *zap.Logger
+		url                     string
+		poll                    bool
+		follow                  bool
+		pollInterval            time.Duration
+		pollVersion             string
+		onLoaded                func()
+		updateHooks             []UpdateHook
+		leaderUpdateHooks       []UpdateHook
+		loaded                  *atomic.Bool
+		history                 *History
+		httpClient              *http.Client
+		updateInProgressChannel chan updateRequest
+		snapshot                *Snapshot
+		snapshotLock            sync.RWMutex
+		lastUpdate              *responses.UpdateResult
+		lastError               *responses.StatusError
+		statusLock              sync.RWMutex
+		subscribers             map[chan *responses.Change]struct{}
+		subscribersClosed       bool
+		subscribersLock         sync.Mutex
+		cluster                 cluster.PubSub
+		leaseTTL                time.Duration
+		lease                   *Lease
+		leading                 bool
+		nodeID                  string
+		jsonBuffer              *bytes.Buffer
+		jsonBufferLock          sync.RWMutex
 	}
 	Option func(*Repo)
+	// UpdateHook is called after every failed update and every update which replaced the served revision
+	UpdateHook func(ctx context.Context, notification *responses.UpdateNotification)
 )
 
 // ------------------------------------------------------------------------------------------------
@@ -52,18 +66,18 @@ type (
 
 func New(l *zap.Logger, url string, history *History, opts ...Option) *Repo {
 	inst := &Repo{
-		l:                          l.Named("repo"),
-		url:                        url,
-		poll:                       false,
-		loaded:                     &atomic.Bool{},
-		pollInterval:               time.Minute,
-		history:                    history,
-		httpClient:                 http.DefaultClient,
-		directory:                  map[string]*Dimension{},
-		dimensionUpdateChannel:     make(chan *RepoDimension),
-		dimensionUpdateDoneChannel: make(chan error),
-		updateInProgressChannel:    make(chan chan updateResponse),
-	}
+		l:                       l.Named("repo"),
+		url:                     url,
+		poll:                    false,
+		loaded:                  &atomic.Bool{},
+		pollInterval:            time.Minute,
+		history:                 history,
+		httpClient:              http.DefaultClient,
+		updateInProgressChannel: make(chan updateRequest),
+		nodeID:                  uuid.New().String(),
+		subscribers:             map[chan *responses.Change]struct{}{},
+	}
+	inst.snapshot = newSnapshot(inst.l, nil, nil, nil)
 
 	for _, opt := range opts {
 		opt(inst)
@@ -94,6 +108,45 @@ func WithPollInterval(v time.Duration) Option {
 	}
 }
 
+// WithFollowStorage never contacts the repository url, the repo only loads the
+// current snapshot from the history storage, checking for changes every poll interval.
+func WithFollowStorage(v bool) Option {
+	return func(o *Repo) {
+		o.follow = v
+	}
+}
+
+// WithUpdateHook adds a hook which is called after updates, hooks must not block
+func WithUpdateHook(v UpdateHook) Option {
+	return func(o *Repo) {
+		o.updateHooks = append(o.updateHooks, v)
+	}
+}
+
+// WithLeaderUpdateHook adds a hook which is only called after updates of the leader,
+// so a hook with side effects fires once per update across all replicas. Hooks must not block.
+func WithLeaderUpdateHook(v UpdateHook) Option {
+	return func(o *Repo) {
+		o.leaderUpdateHooks = append(o.leaderUpdateHooks, v)
+	}
+}
+
+// WithCluster shares updates with the other replicas subscribed to the pub sub.
+// All replicas must use the same history storage.
+func WithCluster(v cluster.PubSub) Option {
+	return func(o *Repo) {
+		o.cluster = v
+	}
+}
+
+// WithLeaderElection lets only the replica holding the lease in the history storage
+// download updates and write the history, the others follow its current snapshot.
+func WithLeaderElection(ttl time.Duration) Option {
+	return func(o *Repo) {
+		o.leaseTTL = ttl
+	}
+}
+
 // ------------------------------------------------------------------------------------------------
 // ~ Getter
 // ------------------------------------------------------------------------------------------------
@@ -102,16 +155,28 @@ func (r *Repo) Loaded() bool {
 	return r.loaded.Load()
 }
 
-func (r *Repo) Directory() map[string]*Dimension {
-	r.directoryLock.RLock()
-	defer r.directoryLock.RUnlock()
-	return r.directory
+// Leader reports whether the repo is in charge of updates and the history,
+// always true without leader election and never when following the storage.
+func (r *Repo) Leader() bool {
+	return !r.follow && (r.lease == nil || r.lease.Held())
+}
+
+// Snapshot returns the currently loaded, immutable state of the repo.
+// Use it to answer all parts of a request from the same version.
+func (r *Repo) Snapshot() *Snapshot {
+	r.snapshotLock.RLock()
+	defer r.snapshotLock.RUnlock()
+	return r.snapshot
 }
 
-func (r *Repo) SetDirectory(v map[string]*Dimension) {
-	r.directoryLock.Lock()
-	defer r.directoryLock.Unlock()
-	r.directory = v
+func (r *Repo) setSnapshot(v *Snapshot) {
+	r.snapshotLock.Lock()
+	defer r.snapshotLock.Unlock()
+	r.snapshot = v
+}
+
+func (r *Repo) Directory() map[string]*Dimension {
+	return r.Snapshot().Directory()
 }
 
 func (r *Repo) JSONBufferBytes() []byte {
@@ -136,119 +201,97 @@ func (r *Repo) OnLoaded(fn func()) {
 
 // GetURIs get many uris at once
 func (r *Repo) GetURIs(dimension string, ids []string) map[string]string {
-	uris := map[string]string{}
-	for _, id := range ids {
-		uris[id] = r.getURI(dimension, id)
-	}
-	return uris
+	return r.Snapshot().GetURIs(dimension, ids)
 }
 
 // GetNodes get nodes
 func (r *Repo) GetNodes(nodes *requests.Nodes) map[string]*content.Node {
-	return r.getNodes(nodes.Nodes, nodes.Env)
-}
-
-// GetContent resolves content and fetches nodes in one call. It combines those
-// two tasks for performance reasons.
-//
-// In the first step it uses r.URI to look up content in all given
-// r.Env.Dimensions of repo.Directory.
-//
-// In the second step it collects the requested nodes.
-//
-// those two steps are independent.
+	return r.Snapshot().GetNodes(nodes)
+}
+
+// GetContent resolves content and fetches nodes in one call.
+// See Snapshot.GetContent for details.
 func (r *Repo) GetContent(req *requests.Content) (*content.SiteContent, error) {
-	// add more input validation
-	err := r.validateContentRequest(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "repo.GetContent invalid request")
-	}
-	r.l.Debug("repo.GetContent", zap.String("URI", req.URI))
-	c := content.NewSiteContent()
-	resolved, resolvedURI, resolvedDimension, node := r.resolveContent(req.Env.Dimensions, req.URI)
-	if resolved {
-		if !node.CanBeAccessedByGroups(req.Env.Groups) {
-			r.l.Warn("Resolved content cannot be accessed by specified group", zap.String("uri", req.URI))
-			c.Status = content.StatusForbidden
-		} else {
-			r.l.Info("Content resolved", zap.String("uri", req.URI))
-			c.Status = content.StatusOk
-			c.Data = node.Data
-		}
-		c.MimeType = node.MimeType
-		c.Dimension = resolvedDimension
-		c.URI = resolvedURI
-		c.Item = node.ToItem(req.DataFields)
-		c.Path = node.GetPath(req.PathDataFields)
-		// fetch URIs for all dimensions
-		uris := make(map[string]string)
-		for dimensionName := range r.Directory() {
-			uris[dimensionName] = r.getURI(dimensionName, node.ID)
-		}
-		c.URIs = uris
-	} else {
-		r.l.Info("Content not found", zap.String("URI", req.URI))
-		c.Status = content.StatusNotFound
-		c.Dimension = req.Env.Dimensions[0]
-
-		r.l.Debug("Failed to resolve, falling back to default dimension",
-			zap.String("uri", req.URI),
-			zap.String("default_dimension", req.Env.Dimensions[0]),
-		)
-		// r.Env.Dimensions is validated => we can access it
-		resolvedDimension = req.Env.Dimensions[0]
-	}
-
-	// add navigation trees
-	for _, node := range req.Nodes {
-		if node.Dimension == "" {
-			node.Dimension = resolvedDimension
-		}
-	}
-	c.Nodes = r.getNodes(req.Nodes, req.Env)
-	return c, nil
+	return r.Snapshot().GetContent(req)
+}
+
+// GetContentBatch resolves many content requests at once. All requests are
+// answered from the same snapshot, so the results are consistent even if an
+// update lands while the batch is processed.
+func (r *Repo) GetContentBatch(req *requests.ContentBatch) ([]*responses.ContentBatchItem, error) {
+	return r.Snapshot().GetContentBatch(req)
 }
 
 // GetRepo get the whole repo in all dimensions
 func (r *Repo) GetRepo() map[string]*content.RepoNode {
-	response := make(map[string]*content.RepoNode)
-	for dimensionName, dimension := range r.Directory() {
-		response[dimensionName] = dimension.Node
+	return r.Snapshot().GetRepo()
+}
+
+// RepoSnapshot returns the current snapshot for serving the raw repo JSON.
+// If nothing has been loaded yet, it falls back to the current version in storage,
+// ErrNotLoaded is returned if there is none.
+func (r *Repo) RepoSnapshot(ctx context.Context) (*Snapshot, error) {
+	if s := r.Snapshot(); len(s.data) > 0 {
+		return s, nil
+	}
+	// Fallback to storage (cold start or not yet loaded)
+	var buf bytes.Buffer
+	if err := r.history.GetCurrent(ctx, &buf); errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotLoaded
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read repo from storage: %w", err)
+	}
+	nodes, err := r.loadNodesFromJSON(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repo from storage: %w", err)
+	}
+	// only the nodes are served, the directories are built by the first load
+	directory := make(map[string]*Dimension, len(nodes))
+	for dimension, node := range nodes {
+		directory[dimension] = &Dimension{Node: node}
 	}
-	return response
+	return newSnapshot(r.l, newRevision(buf.Bytes(), "", time.Now()), buf.Bytes(), directory), nil
 }
 
 // WriteRepoBytes writes the whole repo in all dimensions to the provided writer.
-// It serves from the in-memory buffer, falling back to storage only when empty.
-// The result is wrapped as service response, e.g: {"reply": <contentData>}
+// It serves from the current snapshot, falling back to storage only when empty.
+// The result is wrapped as service response, e.g: {"reply": <contentData>, "version": <version>}
 func (r *Repo) WriteRepoBytes(ctx context.Context, w io.Writer) error {
-	r.jsonBufferLock.RLock()
-	var data []byte
-	if r.jsonBuffer != nil && r.jsonBuffer.Len() > 0 {
-		data = make([]byte, r.jsonBuffer.Len())
-		copy(data, r.jsonBuffer.Bytes())
-	}
-	r.jsonBufferLock.RUnlock()
-
-	if len(data) == 0 {
-		// Fallback to storage (cold start or not yet loaded)
-		var buf bytes.Buffer
-		if err := r.history.GetCurrent(ctx, &buf); err != nil {
-			return fmt.Errorf("failed to read repo from storage: %w", err)
-		}
-		data = buf.Bytes()
+	s, err := r.RepoSnapshot(ctx)
+	if err != nil {
+		return err
 	}
+	return s.WriteRepoBytes(w)
+}
 
-	if _, err := w.Write([]byte(`{"reply":`)); err != nil {
-		return fmt.Errorf("failed to write repo JSON prefix: %w", err)
-	}
-	if _, err := w.Write(data); err != nil {
-		return fmt.Errorf("failed to write repo JSON data: %w", err)
-	}
-	if _, err := w.Write([]byte(`}`)); err != nil {
-		return fmt.Errorf("failed to write repo JSON suffix: %w", err)
+// Status reports the served revision, the most recent update results and the history
+func (r *Repo) Status(ctx context.Context) (*responses.Status, error) {
+	history, err := r.history.Keys(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list history")
+	}
+	if history == nil {
+		history = []string{}
+	}
+	snapshot := r.Snapshot()
+	r.statusLock.RLock()
+	defer r.statusLock.RUnlock()
+	role := ""
+	if r.lease != nil || r.follow {
+		role = responses.StatusRoleFollower
+		if r.Leader() {
+			role = responses.StatusRoleLeader
+		}
 	}
-	return nil
+	return &responses.Status{
+		Loaded:     r.Loaded(),
+		Role:       role,
+		Revision:   snapshot.Revision(),
+		Dimensions: snapshot.DimensionStatus(),
+		LastUpdate: r.lastUpdate,
+		LastError:  r.lastError,
+		History:    history,
+	}, nil
 }
 
 func (r *Repo) Update(ctx context.Context) (updateResponse *responses.Update) {
@@ -260,9 +303,10 @@ func (r *Repo) Update(ctx context.Context) (updateResponse *responses.Update) {
 	// Log.Info(ansi.Yellow + "BUFFER LENGTH BEFORE tryUpdate(): " + strconv.Itoa(len(repo.jsonBuf.Bytes())) + ansi.Reset)
 
 	start := time.Now()
-	updateRepotime, err := r.tryUpdate()
+	ur := r.tryUpdate(triggerFromContext(ctx))
+	err := ur.err
 	updateResponse = &responses.Update{}
-	updateResponse.Stats.RepoRuntime = floatSeconds(updateRepotime)
+	updateResponse.Stats.RepoRuntime = floatSeconds(ur.repoRuntime)
 
 	if err != nil {
 		updateResponse.Success = false
@@ -286,25 +330,35 @@ func (r *Repo) Update(ctx context.Context) (updateResponse *responses.Update) {
 		}
 	} else {
 		updateResponse.Success = true
-		// persist the currently loaded one
-		historyErr := r.history.Add(ctx, r.JSONBufferBytes())
-		if historyErr != nil {
-			r.l.Error("Could not persist current repo in history", zap.Error(historyErr))
-			metrics.HistoryPersistFailedCounter.WithLabelValues().Inc()
-		} else {
-			r.l.Info("Successfully persisted current repo to history")
+		// the update routine has already persisted it with its metadata
+		if ur.historyKey != "" {
+			r.l.Debug("Current repo is persisted in history", zap.String("key", ur.historyKey))
 		}
 		// add some stats
-		for _, dimension := range r.Directory() {
+		snapshot := r.Snapshot()
+		for _, dimension := range snapshot.Directory() {
 			updateResponse.Stats.NumberOfNodes += len(dimension.Directory)
 			updateResponse.Stats.NumberOfURIs += len(dimension.URIDirectory)
 		}
+		updateResponse.Revision = snapshot.Revision()
 	}
 	updateResponse.Stats.OwnRuntime = floatSeconds(time.Since(start).Nanoseconds()) - updateResponse.Stats.RepoRuntime
+	if !errors.Is(err, ErrUpdateRejected) {
+		r.updateDone(ctx, updateResponse, ur.change)
+	}
 	return updateResponse
 }
 
 func (r *Repo) Start(ctx context.Context) error {
+	// the routines read the lease, it must be set before they start
+	if r.leaseTTL > 0 && !r.follow {
+		lease, err := NewLease(r.l, r.history.storage, r.nodeID, r.leaseTTL)
+		if err != nil {
+			return errors.Wrap(err, "failed to create leader election")
+		}
+		r.useLease(lease)
+	}
+
 	g, gCtx := errgroup.WithContext(ctx)
 
 	l := r.l.Named("start")
@@ -318,13 +372,13 @@ func (r *Repo) Start(ctx context.Context) error {
 	l.Debug("waiting for UpdateRoutine")
 	<-up
 
-	g.Go(func() error {
-		l.Debug("starting dimension update routine")
-		up <- true
-		return r.DimensionUpdateRoutine(gCtx)
-	})
-	l.Debug("waiting for DimensionUpdateRoutine")
-	<-up
+	if r.lease != nil {
+		r.tryAcquireLease(ctx)
+		g.Go(func() error {
+			l.Debug("starting leader routine")
+			return r.LeaderRoutine(gCtx)
+		})
+	}
 
 	l.Debug("trying to restore previous repo")
 	if err := r.tryToRestoreCurrent(ctx); errors.Is(err, os.ErrNotExist) {
@@ -335,7 +389,19 @@ func (r *Repo) Start(ctx context.Context) error {
 		l.Info("restored previous repo")
 	}
 
-	if r.poll {
+	if r.cluster != nil {
+		g.Go(func() error {
+			l.Debug("starting cluster routine")
+			return r.ClusterRoutine(gCtx)
+		})
+	}
+
+	if r.follow {
+		g.Go(func() error {
+			l.Debug("starting follow routine")
+			return r.FollowRoutine(gCtx)
+		})
+	} else if r.poll {
 		g.Go(func() error {
 			l.Debug("starting poll routine")
 			return r.PollRoutine(gCtx)
@@ -344,7 +410,7 @@ func (r *Repo) Start(ctx context.Context) error {
 
 	if !r.Loaded() {
 		l.Debug("trying to update initial state")
-		if resp := r.Update(ctx); !resp.Success {
+		if resp := r.Update(ContextWithTrigger(ctx, TriggerStartup)); !resp.Success {
 			l.Error("failed to update initial state",
 				zap.String("error", resp.ErrorMessage),
 				zap.Int("num_modes", resp.Stats.NumberOfNodes),
@@ -362,169 +428,101 @@ func (r *Repo) Start(ctx context.Context) error {
 // ~ Private methods
 // ------------------------------------------------------------------------------------------------
 
-func (r *Repo) getNodes(nodeRequests map[string]*requests.Node, env *requests.Env) map[string]*content.Node {
-	var (
-		path  []*content.Item
-		nodes = map[string]*content.Node{}
-	)
-	for nodeName, nodeRequest := range nodeRequests {
-		if nodeName == "" || nodeRequest.ID == "" {
-			r.l.Warn("invalid node request", zap.Error(errors.New("nodeName or nodeRequest.ID empty")))
-			continue
-		}
-		r.l.Debug("adding node", zap.String("name", nodeName), zap.String("requestID", nodeRequest.ID))
-
-		groups := env.Groups
-		if len(nodeRequest.Groups) > 0 {
-			groups = nodeRequest.Groups
-		}
-
-		dimensionNode, ok := r.Directory()[nodeRequest.Dimension]
-		nodes[nodeName] = nil
-
-		if !ok && nodeRequest.Dimension == "" {
-			r.l.Debug("Could not get dimension root node", zap.String("dimension", nodeRequest.Dimension))
-			for _, dimension := range env.Dimensions {
-				dimensionNode, ok = r.Directory()[dimension]
-				if ok {
-					r.l.Debug("Found root node in env.Dimensions", zap.String("dimension", dimension))
-					break
-				}
-				r.l.Debug("Could NOT find root node in env.Dimensions", zap.String("dimension", dimension))
-			}
-		}
-
-		if !ok {
-			r.l.Error("could not get dimension root node", zap.String("nodeRequest.Dimension", nodeRequest.Dimension))
-			continue
-		}
+// useLease elects the leader with the lease, history writes are fenced by it as the lease may be lost
+// between checking Leader and writing
+func (r *Repo) useLease(lease *Lease) {
+	r.lease = lease
+	r.history.fence = lease.Check
+}
 
-		treeNode, ok := dimensionNode.Directory[nodeRequest.ID]
-		if !ok {
-			r.l.Error("Invalid tree node requested",
-				zap.String("nodeName", nodeName),
-				zap.String("nodeID", nodeRequest.ID),
-			)
-			metrics.InvalidNodeTreeRequests.WithLabelValues().Inc()
-			continue
-		}
-		nodes[nodeName] = r.getNode(treeNode, nodeRequest.Expand, nodeRequest.MimeTypes, path, 0, groups, nodeRequest.DataFields, nodeRequest.ExposeHiddenNodes)
+// addToHistory persists the data unless another replica is in charge of the history
+func (r *Repo) addToHistory(ctx context.Context, data []byte, metadata *SnapshotMetadata) (string, error) {
+	if !r.Leader() {
+		r.l.Debug("not persisting repo, another replica is the leader")
+		return "", nil
+	}
+	key, err := r.history.AddWithMetadata(ctx, data, metadata)
+	if errors.Is(err, ErrLeaseLost) {
+		r.l.Warn("not persisting repo, the lease has been lost")
+		return key, nil
 	}
-	return nodes
+	return key, err
 }
 
-// resolveContent find content in a repository
-func (r *Repo) resolveContent(dimensions []string, uri string) (resolved bool, resolvedURI string, resolvedDimension string, repoNode *content.RepoNode) {
-	parts := strings.Split(uri, content.PathSeparator)
-	r.l.Debug("repo.ResolveContent", zap.String("URI", uri))
-	for i := len(parts); i > 0; i-- {
-		testURI := strings.Join(parts[0:i], content.PathSeparator)
-		if testURI == "" {
-			testURI = content.PathSeparator
-		}
-		for _, dimension := range dimensions {
-			if d, ok := r.Directory()[dimension]; ok {
-				r.l.Debug("Checking node",
-					zap.String("dimension", dimension),
-					zap.String("URI", testURI),
-				)
-				if repoNode, ok := d.URIDirectory[testURI]; ok {
-					resolved = true
-					r.l.Debug("Node found", zap.String("URI", testURI), zap.String("destination", repoNode.DestinationID))
-					if len(repoNode.DestinationID) > 0 {
-						if destionationNode, destinationNodeOk := d.Directory[repoNode.DestinationID]; destinationNodeOk {
-							repoNode = destionationNode
-						}
-					}
-					return resolved, testURI, dimension, repoNode
-				}
-			}
-		}
+// newSnapshotMetadata describes the currently served snapshot
+func (r *Repo) newSnapshotMetadata(trigger string, start time.Time) *SnapshotMetadata {
+	snapshot := r.Snapshot()
+	return &SnapshotMetadata{
+		RevisionID:   snapshot.Version(),
+		Dimensions:   snapshot.DimensionStatus(),
+		LoadDuration: time.Since(start),
+		Trigger:      trigger,
 	}
-	return
 }
 
-func (r *Repo) getURIForNode(dimension string, repoNode *content.RepoNode, recursionLevel int64) (uri string) {
-	if len(repoNode.LinkID) == 0 {
-		uri = repoNode.URI
-		return
-	}
-	linkedNode, ok := r.Directory()[dimension].Directory[repoNode.LinkID]
-	if ok {
-		if recursionLevel > maxGetURIForNodeRecursionLevel {
-			r.l.Error("maxGetURIForNodeRecursionLevel reached", zap.String("repoNode.ID", repoNode.ID), zap.String("linkID", repoNode.LinkID), zap.String("dimension", dimension))
-			return ""
-		}
-		return r.getURIForNode(dimension, linkedNode, recursionLevel+1)
-	}
-	return
-}
-
-func (r *Repo) getURI(dimension string, id string) string {
-	directory, ok := r.Directory()[dimension]
-	if !ok {
-		return ""
-	}
-	repoNode, ok := directory.Directory[id]
-	if !ok {
-		return ""
-	}
-	return r.getURIForNode(dimension, repoNode, 0)
-}
-
-func (r *Repo) getNode(
-	repoNode *content.RepoNode,
-	expanded bool,
-	mimeTypes []string,
-	path []*content.Item,
-	level int,
-	groups []string,
-	dataFields []string,
-	exposeHiddenNodes bool,
-) *content.Node {
-	node := content.NewNode()
-	node.Item = repoNode.ToItem(dataFields)
-	r.l.Debug("getNode", zap.String("ID", repoNode.ID))
-	for _, childID := range repoNode.Index {
-		childNode := repoNode.Nodes[childID]
-		if (level == 0 || expanded || !expanded && childNode.InPath(path)) && (!childNode.Hidden || exposeHiddenNodes) && childNode.CanBeAccessedByGroups(groups) && childNode.IsOneOfTheseMimeTypes(mimeTypes) {
-			node.Nodes[childID] = r.getNode(childNode, expanded, mimeTypes, path, level+1, groups, dataFields, exposeHiddenNodes)
-			node.Index = append(node.Index, childID)
+// newUpdate creates the update stats for a response of the update routine
+func (r *Repo) newUpdate(response updateResponse) *responses.Update {
+	update := &responses.Update{
+		Success: response.err == nil,
+	}
+	update.Stats.RepoRuntime = float64(response.repoRuntime) / float64(time.Second)
+	if response.err == nil {
+		snapshot := r.Snapshot()
+		for _, dimension := range snapshot.DimensionStatus() {
+			update.Stats.NumberOfNodes += dimension.NumberOfNodes
+			update.Stats.NumberOfURIs += dimension.NumberOfURIs
 		}
+		update.Revision = snapshot.Revision()
+	} else {
+		update.ErrorMessage = response.err.Error()
 	}
-	return node
+	return update
 }
 
-func (r *Repo) validateContentRequest(req *requests.Content) (err error) {
-	if req == nil {
-		return errors.New("request must not be nil")
+// updateDone records the update result and notifies the update hooks
+func (r *Repo) updateDone(ctx context.Context, update *responses.Update, change *responses.Change) {
+	r.setLastUpdate(update)
+	if update.Success && change == nil {
+		// nothing new e.g. the polled version did not change
+		return
 	}
-	if len(req.URI) == 0 {
-		return errors.New("request URI must not be empty")
+	notification := &responses.UpdateNotification{
+		Event:      responses.UpdateNotificationEventSuccess,
+		Time:       time.Now(),
+		Update:     update,
+		Revision:   r.Snapshot().Revision(),
+		Dimensions: []string{},
 	}
-	if req.Env == nil {
-		return errors.New("request.Env must not be nil")
+	if !update.Success {
+		notification.Event = responses.UpdateNotificationEventFailure
 	}
-	if len(req.Env.Dimensions) == 0 {
-		return errors.New("request.Env.Dimensions must not be empty")
+	if change != nil {
+		notification.Dimensions = change.Dimensions
 	}
-	for _, envDimension := range req.Env.Dimensions {
-		if !r.hasDimension(envDimension) {
-			availableDimensions := make([]string, 0, len(r.Directory()))
-			for availableDimension := range r.Directory() {
-				availableDimensions = append(availableDimensions, availableDimension)
-			}
-			return errors.New(fmt.Sprint(
-				"unknown dimension ", envDimension,
-				" in r.Env must be one of ", availableDimensions,
-				" repo has ", len(availableDimensions), " dimensions",
-			))
+	for _, hook := range r.updateHooks {
+		hook(ctx, notification)
+	}
+	if r.Leader() {
+		for _, hook := range r.leaderUpdateHooks {
+			hook(ctx, notification)
 		}
 	}
-	return nil
 }
 
-func (r *Repo) hasDimension(d string) bool {
-	_, hasDimension := r.Directory()[d]
-	return hasDimension
+func (r *Repo) setLastUpdate(v *responses.Update) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.lastUpdate = &responses.UpdateResult{
+		Time:   time.Now(),
+		Update: v,
+	}
+}
+
+func (r *Repo) setLastError(err error) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.lastError = &responses.StatusError{
+		Time:    time.Now(),
+		Message: err.Error(),
+	}
 }
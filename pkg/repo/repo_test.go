@@ -3,29 +3,61 @@ package repo
 import (
 	"bytes"
 	"context"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/foomo/contentserver/pkg/cluster"
 	"github.com/foomo/contentserver/pkg/repo/mock"
 	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
-func NewTestRepo(ctx context.Context, l *zap.Logger, url, varDir string) *Repo {
+func NewTestRepo(tb testing.TB, l *zap.Logger, url, varDir string) *Repo {
+	tb.Helper()
 	h, err := NewHistory(l, HistoryWithHistoryLimit(2), HistoryWithHistoryDir(varDir))
 	if err != nil {
 		panic(err)
 	}
 	r := New(l, url, h)
-	go r.Start(ctx) //nolint:errcheck
-	time.Sleep(100 * time.Millisecond)
+	startTestRepo(tb, r)
+	waitForStartupUpdate(tb, r)
 	return r
 }
 
+// startTestRepo runs the repo until the test is done, the routines must not log after the test completed
+func startTestRepo(tb testing.TB, r *Repo) {
+	tb.Helper()
+	ctx, cancel := context.WithCancel(tb.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = r.Start(ctx)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForStartupUpdate waits until the update of Start is done, successful or not.
+// Afterwards only updates of the test read the url, so tests may change it in between.
+func waitForStartupUpdate(tb testing.TB, r *Repo) {
+	tb.Helper()
+	require.Eventually(tb, func() bool {
+		r.statusLock.RLock()
+		defer r.statusLock.RUnlock()
+		return r.lastUpdate != nil
+	}, 5*time.Second, 5*time.Millisecond, "startup update did not finish")
+}
+
 func assertRepoIsEmpty(t *testing.T, r *Repo, empty bool) {
 	t.Helper()
 	if empty {
@@ -44,7 +76,7 @@ func TestLoad404(t *testing.T) {
 		l                  = zaptest.NewLogger(t)
 		mockServer, varDir = mock.GetMockData(t)
 		url                = mockServer.URL + "/repo-no-have"
-		r                  = NewTestRepo(t.Context(), l, url, varDir)
+		r                  = NewTestRepo(t, l, url, varDir)
 	)
 
 	response := r.Update(t.Context())
@@ -58,7 +90,7 @@ func TestLoadBrokenRepo(t *testing.T) {
 		l                  = zaptest.NewLogger(t)
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-broken-json.json"
-		r                  = NewTestRepo(t.Context(), l, server, varDir)
+		r                  = NewTestRepo(t, l, server, varDir)
 	)
 
 	response := r.Update(t.Context())
@@ -72,7 +104,7 @@ func TestLoadRepo(t *testing.T) {
 		l                  = zaptest.NewLogger(t)
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-ok.json"
-		r                  = NewTestRepo(t.Context(), l, server, varDir)
+		r                  = NewTestRepo(t, l, server, varDir)
 	)
 	assertRepoIsEmpty(t, r, false)
 
@@ -89,6 +121,17 @@ func TestLoadRepo(t *testing.T) {
 		t.Fatal("the server was too fast")
 	}
 
+	require.NotNil(t, response.Revision)
+	assert.Equal(t, r.Snapshot().Version(), response.Revision.ID)
+
+	status, err := r.Status(t.Context())
+	require.NoError(t, err)
+	assert.True(t, status.Loaded)
+	assert.Equal(t, response.Revision, status.Revision)
+	require.NotNil(t, status.LastUpdate)
+	assert.True(t, status.LastUpdate.Update.Success)
+	assert.Nil(t, status.LastError)
+
 	// see what happens if we try to start it up again
 	// nr := NewTestRepo(l, server, varDir)
 	// assertRepoIsEmpty(t, nr, false)
@@ -100,7 +143,7 @@ func BenchmarkLoadRepo(b *testing.B) {
 		t                  = &testing.T{}
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-ok.json"
-		r                  = NewTestRepo(b.Context(), l, server, varDir)
+		r                  = NewTestRepo(b, l, server, varDir)
 	)
 
 	b.ReportAllocs()
@@ -122,7 +165,7 @@ func TestLoadRepoDuplicateUris(t *testing.T) {
 		l                  = zaptest.NewLogger(t)
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-duplicate-uris.json"
-		r                  = NewTestRepo(t.Context(), l, server, varDir)
+		r                  = NewTestRepo(t, l, server, varDir)
 	)
 
 	response := r.Update(t.Context())
@@ -136,7 +179,7 @@ func TestDimensionHygiene(t *testing.T) {
 
 	mockServer, varDir := mock.GetMockData(t)
 	server := mockServer.URL + "/repo-two-dimensions.json"
-	r := NewTestRepo(t.Context(), l, server, varDir)
+	r := NewTestRepo(t, l, server, varDir)
 
 	response := r.Update(t.Context())
 	require.True(t, response.Success, "well those two dimension should be fine")
@@ -148,13 +191,290 @@ func TestDimensionHygiene(t *testing.T) {
 	assert.Lenf(t, r.Directory(), 1, "directory hygiene failed")
 }
 
+func TestSnapshotIsImmutable(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	server := mockServer.URL + "/repo-two-dimensions.json"
+	r := NewTestRepo(t, l, server, varDir)
+
+	response := r.Update(t.Context())
+	require.True(t, response.Success)
+
+	snapshot := r.Snapshot()
+	require.NotEmpty(t, snapshot.Version())
+	require.Len(t, snapshot.Directory(), 2)
+
+	r.url = mockServer.URL + "/repo-ok.json"
+	response = r.Update(t.Context())
+	require.True(t, response.Success)
+
+	// the pinned snapshot must not see the update
+	assert.Len(t, snapshot.Directory(), 2)
+	assert.Len(t, r.Snapshot().Directory(), 1)
+	assert.NotEqual(t, snapshot.Version(), r.Snapshot().Version())
+}
+
+func TestSubscribe(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	server := mockServer.URL + "/repo-two-dimensions.json"
+	r := NewTestRepo(t, l, server, varDir)
+	previous := r.Snapshot()
+
+	changes, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	r.url = mockServer.URL + "/repo-ok.json"
+	response := r.Update(t.Context())
+	require.True(t, response.Success)
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, r.Snapshot().Version(), change.Revision.ID)
+		assert.Equal(t, previous.Version(), change.PreviousRevision.ID)
+		// dimension_bar was removed, dimension_foo has different content
+		assert.Contains(t, change.Dimensions, "dimension_bar")
+		assert.NotEmpty(t, change.NodeIDs["dimension_bar"])
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+
+	unsubscribe()
+	_, ok := <-changes
+	assert.False(t, ok, "channel should be closed after unsubscribe")
+}
+
+func TestUpdateHook(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	h, err := NewHistory(l, HistoryWithHistoryDir(varDir))
+	require.NoError(t, err)
+
+	notifications := make(chan *responses.UpdateNotification, 2)
+	r := New(l, mockServer.URL+"/repo-two-dimensions.json", h, WithUpdateHook(func(ctx context.Context, notification *responses.UpdateNotification) {
+		notifications <- notification
+	}))
+	startTestRepo(t, r)
+	waitForStartupUpdate(t, r)
+	// initial load
+	assert.Equal(t, responses.UpdateNotificationEventSuccess, (<-notifications).Event)
+
+	r.url = mockServer.URL + "/repo-ok.json"
+	require.True(t, r.Update(t.Context()).Success)
+	notification := <-notifications
+	assert.Equal(t, responses.UpdateNotificationEventSuccess, notification.Event)
+	assert.Equal(t, r.Snapshot().Version(), notification.Revision.ID)
+	assert.Contains(t, notification.Dimensions, "dimension_bar")
+
+	r.url = mockServer.URL + "/repo-broken-json.json"
+	require.False(t, r.Update(t.Context()).Success)
+	notification = <-notifications
+	assert.Equal(t, responses.UpdateNotificationEventFailure, notification.Event)
+	assert.NotEmpty(t, notification.Update.ErrorMessage)
+}
+
+func TestLeaderUpdateHook(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	h, err := NewHistory(l, HistoryWithHistoryDir(varDir))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(t.Context())
+	defer wg.Wait()
+	defer cancel()
+
+	leaderNotifications := make(chan *responses.UpdateNotification, 2)
+	leader := New(l.Named("leader"), mockServer.URL+"/repo-two-dimensions.json", h,
+		WithLeaderUpdateHook(func(ctx context.Context, notification *responses.UpdateNotification) {
+			leaderNotifications <- notification
+		}),
+	)
+	wg.Go(func() { _ = leader.Start(ctx) })
+	assert.Equal(t, responses.UpdateNotificationEventSuccess, (<-leaderNotifications).Event)
+
+	// the follower loads the same revision, but only calls the hooks of all replicas
+	var followerNotifications, followerLeaderNotifications atomic.Int32
+	follower := New(l.Named("follower"), "", h, WithFollowStorage(true), WithPollInterval(20*time.Millisecond),
+		WithUpdateHook(func(ctx context.Context, notification *responses.UpdateNotification) {
+			followerNotifications.Add(1)
+		}),
+		WithLeaderUpdateHook(func(ctx context.Context, notification *responses.UpdateNotification) {
+			followerLeaderNotifications.Add(1)
+		}),
+	)
+	wg.Go(func() { _ = follower.Start(ctx) })
+	assert.Eventually(t, follower.Loaded, time.Second, 10*time.Millisecond)
+
+	leader.url = mockServer.URL + "/repo-ok.json"
+	require.True(t, leader.Update(t.Context()).Success)
+	assert.Equal(t, leader.Snapshot().Version(), (<-leaderNotifications).Revision.ID)
+	assert.Eventually(t, func() bool { return followerNotifications.Load() > 0 }, time.Second, 10*time.Millisecond)
+	assert.Zero(t, followerLeaderNotifications.Load())
+}
+
+func TestCluster(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	h, err := NewHistory(l, HistoryWithHistoryDir(varDir))
+	require.NoError(t, err)
+	pubSub := cluster.NewLocal()
+
+	// stop all routines before the test logger goes away
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(t.Context())
+	defer wg.Wait()
+	defer cancel()
+
+	// the follower can not reach the repository and depends on the leader
+	follower := New(l.Named("follower"), mockServer.URL+"/not-found.json", h, WithCluster(pubSub))
+	wg.Go(func() { _ = follower.Start(ctx) })
+	time.Sleep(100 * time.Millisecond)
+	assertRepoIsEmpty(t, follower, true)
+
+	leader := New(l.Named("leader"), mockServer.URL+"/repo-ok.json", h, WithCluster(pubSub))
+	wg.Go(func() { _ = leader.Start(ctx) })
+
+	assert.Eventually(t, func() bool {
+		return leader.Loaded() && follower.Snapshot().Version() == leader.Snapshot().Version()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, leader.Snapshot().Revision(), follower.Snapshot().Revision())
+	assertRepoIsEmpty(t, follower, false)
+}
+
+func TestLeaderElection(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	h, err := NewHistory(l, HistoryWithHistoryDir(varDir), HistoryWithHistoryLimit(10))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(t.Context())
+	defer wg.Wait()
+	defer cancel()
+
+	leader := New(l.Named("leader"), mockServer.URL+"/repo-ok.json", h, WithLeaderElection(time.Minute))
+	wg.Go(func() { _ = leader.Start(ctx) })
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, leader.Loaded())
+	require.True(t, leader.Leader())
+	keys, err := h.Keys(t.Context())
+	require.NoError(t, err)
+
+	// the follower never contacts its repository url
+	follower := New(l.Named("follower"), mockServer.URL+"/not-found.json", h, WithLeaderElection(time.Minute))
+	wg.Go(func() { _ = follower.Start(ctx) })
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, follower.Loaded())
+	assert.False(t, follower.Leader())
+	assert.Equal(t, leader.Snapshot().Revision().Hash, follower.Snapshot().Revision().Hash)
+
+	require.True(t, follower.Update(t.Context()).Success)
+	status, err := follower.Status(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, responses.StatusRoleFollower, status.Role)
+	// only the leader writes the history
+	assert.Equal(t, keys, status.History)
+}
+
+func TestFollowStorage(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	h, err := NewHistory(l, HistoryWithHistoryDir(varDir), HistoryWithHistoryLimit(10))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(t.Context())
+	defer wg.Wait()
+	defer cancel()
+
+	writer := New(l.Named("writer"), mockServer.URL+"/repo-two-dimensions.json", h)
+	wg.Go(func() { _ = writer.Start(ctx) })
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, writer.Loaded())
+
+	follower := New(l.Named("follower"), "", h, WithFollowStorage(true), WithPollInterval(20*time.Millisecond))
+	wg.Go(func() { _ = follower.Start(ctx) })
+	assert.Eventually(t, follower.Loaded, time.Second, 10*time.Millisecond)
+	assert.Equal(t, writer.Snapshot().Revision().Hash, follower.Snapshot().Revision().Hash)
+
+	writer.url = mockServer.URL + "/repo-ok.json"
+	require.True(t, writer.Update(t.Context()).Success)
+	assert.Eventually(t, func() bool {
+		return follower.Snapshot().Revision().Hash == writer.Snapshot().Revision().Hash
+	}, time.Second, 10*time.Millisecond)
+
+	// the follower does not write the history
+	keys, err := h.Keys(t.Context())
+	require.NoError(t, err)
+	require.True(t, follower.Update(t.Context()).Success)
+	status, err := follower.Status(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, responses.StatusRoleFollower, status.Role)
+	assert.Equal(t, keys, status.History)
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	mockServer, varDir := mock.GetMockData(t)
+	server := mockServer.URL + "/repo-two-dimensions.json"
+	r := NewTestRepo(t, l, server, varDir)
+
+	// the startup update is done, no other update reads the url meanwhile
+	updateURL := mockServer.URL + "/repo-ok.json"
+	r.url = updateURL
+	require.True(t, r.Update(ContextWithTrigger(t.Context(), TriggerHTTP)).Success)
+
+	snapshots, err := r.history.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+
+	latest := snapshots[0]
+	assert.Equal(t, TriggerHTTP, latest.Trigger)
+	assert.Equal(t, updateURL, latest.SourceURL)
+	assert.Equal(t, r.Snapshot().Version(), latest.RevisionID)
+	assert.Equal(t, r.Snapshot().Revision().Hash, latest.Hash)
+	assert.Equal(t, len(r.JSONBufferBytes()), latest.Size)
+	assert.Equal(t, r.Snapshot().DimensionStatus(), latest.Dimensions)
+	assert.Positive(t, latest.LoadDuration)
+
+	assert.Equal(t, TriggerStartup, snapshots[1].Trigger)
+	assert.Equal(t, server, snapshots[1].SourceURL)
+}
+
+func TestUpdatePersistsOnce(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	l := zap.New(core)
+	mockServer, varDir := mock.GetMockData(t)
+	r := NewTestRepo(t, l, mockServer.URL+"/repo-two-dimensions.json", varDir)
+
+	// the update routine persists the snapshot with its metadata, the update does not add it again
+	r.url = mockServer.URL + "/repo-ok.json"
+	logs.TakeAll()
+	require.True(t, r.Update(ContextWithTrigger(t.Context(), TriggerHTTP)).Success)
+	assert.Equal(t, 1, logs.FilterMessage("writing snapshot").Len())
+	assert.Zero(t, logs.FilterMessage("snapshot is already current").Len())
+	snapshots, err := r.history.List(t.Context())
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, TriggerHTTP, snapshots[0].Trigger)
+}
+
 func getTestRepo(t *testing.T, path string) *Repo {
 	t.Helper()
 	l := zaptest.NewLogger(t)
 
 	mockServer, varDir := mock.GetMockData(t)
 	server := mockServer.URL + path
-	r := NewTestRepo(t.Context(), l, server, varDir)
+	r := NewTestRepo(t, l, server, varDir)
 	response := r.Update(t.Context())
 
 	require.True(t, response.Success, "well those two dimension should be fine")
@@ -199,13 +519,45 @@ func TestResolveContent(t *testing.T) {
 	assert.Equal(t, contentRequest.URI, siteContent.URI, "failed to resolve uri")
 }
 
+func TestGetContentBatch(t *testing.T) {
+	r := getTestRepo(t, "/repo-two-dimensions.json")
+
+	requestA := mock.MakeValidContentRequest()
+	requestB := mock.MakeValidContentRequest()
+	requestB.URI = "/b"
+	requestInvalid := mock.MakeValidContentRequest()
+	requestInvalid.Env = nil
+
+	items, err := r.GetContentBatch(&requests.ContentBatch{
+		Requests: []*requests.Content{requestA, requestInvalid, requestB},
+	})
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+
+	require.Nil(t, items[0].Error)
+	assert.Equal(t, "/a", items[0].Content.URI)
+
+	// invalid requests fail like single requests
+	require.NotNil(t, items[1].Error)
+	assert.Equal(t, http.StatusBadRequest, items[1].Error.Status)
+	assert.Equal(t, responses.ErrorCodeInvalidRequest, items[1].Error.Code)
+	assert.Contains(t, items[1].Error.Message, "invalid request")
+	assert.Nil(t, items[1].Content)
+
+	require.Nil(t, items[2].Error)
+	assert.Equal(t, "/b", items[2].Content.URI)
+
+	_, err = r.GetContentBatch(nil)
+	require.Error(t, err)
+}
+
 func TestLinkIds(t *testing.T) {
 	l := zaptest.NewLogger(t)
 
 	var (
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-link-ok.json"
-		r                  = NewTestRepo(t.Context(), l, server, varDir)
+		r                  = NewTestRepo(t, l, server, varDir)
 		response           = r.Update(t.Context())
 	)
 
@@ -224,7 +576,7 @@ func TestLinkIds(t *testing.T) {
 func TestInvalidRequest(t *testing.T) {
 	r := getTestRepo(t, "/repo-two-dimensions.json")
 
-	if r.validateContentRequest(mock.MakeValidContentRequest()) != nil {
+	if r.Snapshot().validateContentRequest(mock.MakeValidContentRequest()) != nil {
 		t.Fatal("failed validation a valid request")
 	}
 
@@ -247,7 +599,7 @@ func TestInvalidRequest(t *testing.T) {
 	// tests["nodes must have a valid id"] = rNodesValidID
 
 	for comment, req := range tests {
-		if r.validateContentRequest(req) == nil {
+		if r.Snapshot().validateContentRequest(req) == nil {
 			t.Fatal(comment, "should have failed")
 		}
 	}
@@ -258,7 +610,7 @@ func TestWriteRepoBytesRace(t *testing.T) {
 		l                  = zaptest.NewLogger(t)
 		mockServer, varDir = mock.GetMockData(t)
 		server             = mockServer.URL + "/repo-ok.json"
-		r                  = NewTestRepo(t.Context(), l, server, varDir)
+		r                  = NewTestRepo(t, l, server, varDir)
 	)
 
 	response := r.Update(t.Context())
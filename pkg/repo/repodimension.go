@@ -1,10 +0,0 @@
-package repo
-
-import (
-	"github.com/foomo/contentserver/content"
-)
-
-type RepoDimension struct {
-	Dimension string
-	Node      *content.RepoNode
-}
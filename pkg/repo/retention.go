@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"strings"
+	"time"
+)
+
+// retentionPolicy decides which snapshots of the history are kept.
+// A snapshot is kept if any of the keep rules matches or if it is pinned,
+// maxBytes then removes the oldest snapshots which are neither current nor pinned.
+type retentionPolicy struct {
+	// keepLast keeps the newest snapshots
+	keepLast int
+	// keepWithin keeps all snapshots added within the duration
+	keepWithin time.Duration
+	// keepDaily keeps the newest snapshot of each of the last days
+	keepDaily int
+	// maxBytes caps the total size of the history, 0 means unlimited
+	maxBytes int64
+	// pinned keys or hash prefixes are never removed
+	pinned []string
+}
+
+// expired returns the entries to remove, entries must be sorted newest first
+func (p retentionPolicy) expired(entries []*manifestEntry, current string, now time.Time) []*manifestEntry {
+	keep := make([]bool, len(entries))
+	fixed := make([]bool, len(entries))
+	days := map[string]bool{}
+	dailySince := now.AddDate(0, 0, -p.keepDaily)
+	for i, entry := range entries {
+		if (current != "" && entry.Hash == current) || p.isPinned(entry) {
+			keep[i] = true
+			fixed[i] = true
+		}
+		if i < p.keepLast {
+			keep[i] = true
+		}
+		if p.keepWithin > 0 && !entry.Added.IsZero() && now.Sub(entry.Added) <= p.keepWithin {
+			keep[i] = true
+		}
+		if p.keepDaily > 0 && !entry.Added.IsZero() && entry.Added.After(dailySince) {
+			if day := entry.Added.Format(time.DateOnly); !days[day] {
+				days[day] = true
+				keep[i] = true
+			}
+		}
+	}
+
+	if p.maxBytes > 0 {
+		var size int64
+		for i, entry := range entries {
+			if keep[i] {
+				size += int64(entry.Size)
+			}
+		}
+		for i := len(entries) - 1; i >= 0 && size > p.maxBytes; i-- {
+			if keep[i] && !fixed[i] {
+				keep[i] = false
+				size -= int64(entries[i].Size)
+			}
+		}
+	}
+
+	var ret []*manifestEntry
+	for i, entry := range entries {
+		if !keep[i] {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+func (p retentionPolicy) isPinned(entry *manifestEntry) bool {
+	for _, pin := range p.pinned {
+		if pin == "" {
+			continue
+		}
+		if pin == entry.Key || (entry.Hash != "" && strings.HasPrefix(entry.Hash, pin)) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyAdded parses the time from the key of a legacy backup
+func legacyAdded(key string) time.Time {
+	value := strings.TrimSuffix(strings.TrimPrefix(key, HistoryRepoJSONPrefix), HistoryRepoJSONSuffix)
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
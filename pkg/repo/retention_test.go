@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	entry := func(name string, age time.Duration, size int) *manifestEntry {
+		return &manifestEntry{Key: name, Hash: name + "-hash", Added: now.Add(-age), Size: size}
+	}
+	// newest first
+	entries := []*manifestEntry{
+		entry("current", time.Hour, 10),
+		entry("today", 2*time.Hour, 10),
+		entry("yesterday-late", 13*time.Hour, 10),
+		entry("yesterday-early", 20*time.Hour, 10),
+		entry("last-week", 7*24*time.Hour, 10),
+		entry("last-year", 365*24*time.Hour, 10),
+	}
+	keys := func(entries []*manifestEntry) []string {
+		ret := []string{}
+		for _, e := range entries {
+			ret = append(ret, e.Key)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   []string
+	}{
+		{
+			name:   "keep last",
+			policy: retentionPolicy{keepLast: 2},
+			want:   []string{"yesterday-late", "yesterday-early", "last-week", "last-year"},
+		},
+		{
+			name:   "keep within",
+			policy: retentionPolicy{keepWithin: 24 * time.Hour},
+			want:   []string{"last-week", "last-year"},
+		},
+		{
+			name:   "keep daily",
+			policy: retentionPolicy{keepDaily: 30},
+			want:   []string{"today", "yesterday-early", "last-year"},
+		},
+		{
+			name:   "pinned",
+			policy: retentionPolicy{keepLast: 1, pinned: []string{"last-year-h", "today"}},
+			want:   []string{"yesterday-late", "yesterday-early", "last-week"},
+		},
+		{
+			name:   "max bytes",
+			policy: retentionPolicy{keepLast: 6, maxBytes: 30, pinned: []string{"last-year"}},
+			want:   []string{"yesterday-late", "yesterday-early", "last-week"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, keys(tt.policy.expired(entries, "current-hash", now)))
+		})
+	}
+}
+
+func TestLegacyAdded(t *testing.T) {
+	assert.Equal(t, time.Date(2017, 10, 23, 0, 0, 0, 0, time.UTC), legacyAdded("contentserver-repo-2017-10-23.json"))
+	assert.True(t, legacyAdded("contentserver-repo-foo.json").IsZero())
+}
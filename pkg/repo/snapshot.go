@@ -0,0 +1,397 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foomo/contentserver/content"
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/requests"
+	"github.com/foomo/contentserver/responses"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// revisionIDLength number of hex characters of a revision id
+const revisionIDLength = 20
+
+// ErrInvalidRequest is wrapped by the errors of requests which can not be answered as they are
+var ErrInvalidRequest = errors.New("invalid request")
+
+// Snapshot is an immutable view of the repo at a single version. A request
+// should be answered from one snapshot only, so that an update landing while
+// the request is processed can not mix two versions of the repo.
+type Snapshot struct {
+	l         *zap.Logger
+	revision  *responses.Revision
+	directory map[string]*Dimension
+	data      []byte
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func newSnapshot(l *zap.Logger, revision *responses.Revision, data []byte, directory map[string]*Dimension) *Snapshot {
+	if directory == nil {
+		directory = map[string]*Dimension{}
+	}
+	return &Snapshot{
+		l:         l,
+		revision:  revision,
+		directory: directory,
+		data:      data,
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Getter
+// ------------------------------------------------------------------------------------------------
+
+// Version returns the revision id of the snapshot.
+// It is empty as long as nothing has been loaded.
+func (s *Snapshot) Version() string {
+	if s.revision == nil {
+		return ""
+	}
+	return s.revision.ID
+}
+
+// Revision returns the revision of the snapshot, nil if nothing has been loaded.
+func (s *Snapshot) Revision() *responses.Revision {
+	return s.revision
+}
+
+// Directory returns the dimensions of the snapshot. It must not be modified.
+func (s *Snapshot) Directory() map[string]*Dimension {
+	return s.directory
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// GetURIs get many uris at once
+func (s *Snapshot) GetURIs(dimension string, ids []string) map[string]string {
+	uris := map[string]string{}
+	for _, id := range ids {
+		uris[id] = s.getURI(dimension, id)
+	}
+	return uris
+}
+
+// GetNodes get nodes
+func (s *Snapshot) GetNodes(nodes *requests.Nodes) map[string]*content.Node {
+	return s.getNodes(nodes.Nodes, nodes.Env)
+}
+
+// GetContent resolves content and fetches nodes in one call. It combines those
+// two tasks for performance reasons.
+//
+// In the first step it uses r.URI to look up content in all given
+// r.Env.Dimensions of repo.Directory.
+//
+// In the second step it collects the requested nodes.
+//
+// those two steps are independent.
+func (s *Snapshot) GetContent(req *requests.Content) (*content.SiteContent, error) {
+	// add more input validation
+	err := s.validateContentRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("repo.GetContent %w: %w", ErrInvalidRequest, err)
+	}
+	s.l.Debug("repo.GetContent", zap.String("URI", req.URI))
+	c := content.NewSiteContent()
+	resolved, resolvedURI, resolvedDimension, node := s.resolveContent(req.Env.Dimensions, req.URI)
+	if resolved {
+		if !node.CanBeAccessedByGroups(req.Env.Groups) {
+			s.l.Warn("Resolved content cannot be accessed by specified group", zap.String("uri", req.URI))
+			c.Status = content.StatusForbidden
+		} else {
+			s.l.Info("Content resolved", zap.String("uri", req.URI))
+			c.Status = content.StatusOk
+			c.Data = node.Data
+		}
+		c.MimeType = node.MimeType
+		c.Dimension = resolvedDimension
+		c.URI = resolvedURI
+		c.Item = node.ToItem(req.DataFields)
+		c.Path = node.GetPath(req.PathDataFields)
+		// fetch URIs for all dimensions
+		uris := make(map[string]string)
+		for dimensionName := range s.directory {
+			uris[dimensionName] = s.getURI(dimensionName, node.ID)
+		}
+		c.URIs = uris
+	} else {
+		s.l.Info("Content not found", zap.String("URI", req.URI))
+		c.Status = content.StatusNotFound
+		c.Dimension = req.Env.Dimensions[0]
+
+		s.l.Debug("Failed to resolve, falling back to default dimension",
+			zap.String("uri", req.URI),
+			zap.String("default_dimension", req.Env.Dimensions[0]),
+		)
+		// r.Env.Dimensions is validated => we can access it
+		resolvedDimension = req.Env.Dimensions[0]
+	}
+
+	// add navigation trees
+	for _, node := range req.Nodes {
+		if node.Dimension == "" {
+			node.Dimension = resolvedDimension
+		}
+	}
+	c.Nodes = s.getNodes(req.Nodes, req.Env)
+	return c, nil
+}
+
+// GetContentBatch resolves many content requests at once. Results are returned
+// in the order of the requests, a failing request does not fail the whole batch.
+func (s *Snapshot) GetContentBatch(req *requests.ContentBatch) ([]*responses.ContentBatchItem, error) {
+	if req == nil {
+		return nil, fmt.Errorf("repo.GetContentBatch %w: request must not be nil", ErrInvalidRequest)
+	}
+	s.l.Debug("repo.GetContentBatch", zap.Int("size", len(req.Requests)))
+	items := make([]*responses.ContentBatchItem, len(req.Requests))
+	for i, contentRequest := range req.Requests {
+		item := &responses.ContentBatchItem{}
+		siteContent, err := s.GetContent(contentRequest)
+		switch {
+		case errors.Is(err, ErrInvalidRequest):
+			// like invalid single requests, see handler.Dispatcher
+			item.Error = responses.NewStatusError(http.StatusBadRequest, responses.ErrorCodeInvalidRequest, err.Error())
+		case err != nil:
+			item.Error = responses.NewError(responses.ErrorCodeInternal, "internal error "+err.Error())
+		default:
+			item.Content = siteContent
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+// DimensionStatus returns node and uri counts for every dimension
+func (s *Snapshot) DimensionStatus() map[string]responses.DimensionStatus {
+	dimensions := make(map[string]responses.DimensionStatus, len(s.directory))
+	for dimensionName, dimension := range s.directory {
+		dimensions[dimensionName] = responses.DimensionStatus{
+			NumberOfNodes: len(dimension.Directory),
+			NumberOfURIs:  len(dimension.URIDirectory),
+		}
+	}
+	return dimensions
+}
+
+// GetRepo get the whole repo in all dimensions
+func (s *Snapshot) GetRepo() map[string]*content.RepoNode {
+	response := make(map[string]*content.RepoNode)
+	for dimensionName, dimension := range s.directory {
+		response[dimensionName] = dimension.Node
+	}
+	return response
+}
+
+// WriteRepoBytes writes the raw repo JSON the snapshot was loaded from.
+// The result is wrapped as service response, e.g: {"reply": <contentData>, "version": <version>}
+func (s *Snapshot) WriteRepoBytes(w io.Writer) error {
+	if _, err := w.Write([]byte(`{"reply":`)); err != nil {
+		return fmt.Errorf("failed to write repo JSON prefix: %w", err)
+	}
+	if _, err := w.Write(s.data); err != nil {
+		return fmt.Errorf("failed to write repo JSON data: %w", err)
+	}
+	if _, err := w.Write([]byte(`,"version":"` + s.Version() + `"}`)); err != nil {
+		return fmt.Errorf("failed to write repo JSON suffix: %w", err)
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+func (s *Snapshot) getNodes(nodeRequests map[string]*requests.Node, env *requests.Env) map[string]*content.Node {
+	var (
+		path  []*content.Item
+		nodes = map[string]*content.Node{}
+	)
+	for nodeName, nodeRequest := range nodeRequests {
+		if nodeName == "" || nodeRequest.ID == "" {
+			s.l.Warn("invalid node request", zap.Error(errors.New("nodeName or nodeRequest.ID empty")))
+			continue
+		}
+		s.l.Debug("adding node", zap.String("name", nodeName), zap.String("requestID", nodeRequest.ID))
+
+		groups := env.Groups
+		if len(nodeRequest.Groups) > 0 {
+			groups = nodeRequest.Groups
+		}
+
+		dimensionNode, ok := s.directory[nodeRequest.Dimension]
+		nodes[nodeName] = nil
+
+		if !ok && nodeRequest.Dimension == "" {
+			s.l.Debug("Could not get dimension root node", zap.String("dimension", nodeRequest.Dimension))
+			for _, dimension := range env.Dimensions {
+				dimensionNode, ok = s.directory[dimension]
+				if ok {
+					s.l.Debug("Found root node in env.Dimensions", zap.String("dimension", dimension))
+					break
+				}
+				s.l.Debug("Could NOT find root node in env.Dimensions", zap.String("dimension", dimension))
+			}
+		}
+
+		if !ok {
+			s.l.Error("could not get dimension root node", zap.String("nodeRequest.Dimension", nodeRequest.Dimension))
+			continue
+		}
+
+		treeNode, ok := dimensionNode.Directory[nodeRequest.ID]
+		if !ok {
+			s.l.Error("Invalid tree node requested",
+				zap.String("nodeName", nodeName),
+				zap.String("nodeID", nodeRequest.ID),
+			)
+			metrics.InvalidNodeTreeRequests.WithLabelValues().Inc()
+			continue
+		}
+		nodes[nodeName] = s.getNode(treeNode, nodeRequest.Expand, nodeRequest.MimeTypes, path, 0, groups, nodeRequest.DataFields, nodeRequest.ExposeHiddenNodes)
+	}
+	return nodes
+}
+
+// resolveContent find content in a repository
+func (s *Snapshot) resolveContent(dimensions []string, uri string) (resolved bool, resolvedURI string, resolvedDimension string, repoNode *content.RepoNode) {
+	parts := strings.Split(uri, content.PathSeparator)
+	s.l.Debug("repo.ResolveContent", zap.String("URI", uri))
+	for i := len(parts); i > 0; i-- {
+		testURI := strings.Join(parts[0:i], content.PathSeparator)
+		if testURI == "" {
+			testURI = content.PathSeparator
+		}
+		for _, dimension := range dimensions {
+			if d, ok := s.directory[dimension]; ok {
+				s.l.Debug("Checking node",
+					zap.String("dimension", dimension),
+					zap.String("URI", testURI),
+				)
+				if repoNode, ok := d.URIDirectory[testURI]; ok {
+					resolved = true
+					s.l.Debug("Node found", zap.String("URI", testURI), zap.String("destination", repoNode.DestinationID))
+					if len(repoNode.DestinationID) > 0 {
+						if destionationNode, destinationNodeOk := d.Directory[repoNode.DestinationID]; destinationNodeOk {
+							repoNode = destionationNode
+						}
+					}
+					return resolved, testURI, dimension, repoNode
+				}
+			}
+		}
+	}
+	return
+}
+
+func (s *Snapshot) getURIForNode(dimension string, repoNode *content.RepoNode, recursionLevel int64) (uri string) {
+	if len(repoNode.LinkID) == 0 {
+		uri = repoNode.URI
+		return
+	}
+	linkedNode, ok := s.directory[dimension].Directory[repoNode.LinkID]
+	if ok {
+		if recursionLevel > maxGetURIForNodeRecursionLevel {
+			s.l.Error("maxGetURIForNodeRecursionLevel reached", zap.String("repoNode.ID", repoNode.ID), zap.String("linkID", repoNode.LinkID), zap.String("dimension", dimension))
+			return ""
+		}
+		return s.getURIForNode(dimension, linkedNode, recursionLevel+1)
+	}
+	return
+}
+
+func (s *Snapshot) getURI(dimension string, id string) string {
+	directory, ok := s.directory[dimension]
+	if !ok {
+		return ""
+	}
+	repoNode, ok := directory.Directory[id]
+	if !ok {
+		return ""
+	}
+	return s.getURIForNode(dimension, repoNode, 0)
+}
+
+func (s *Snapshot) getNode(
+	repoNode *content.RepoNode,
+	expanded bool,
+	mimeTypes []string,
+	path []*content.Item,
+	level int,
+	groups []string,
+	dataFields []string,
+	exposeHiddenNodes bool,
+) *content.Node {
+	node := content.NewNode()
+	node.Item = repoNode.ToItem(dataFields)
+	s.l.Debug("getNode", zap.String("ID", repoNode.ID))
+	for _, childID := range repoNode.Index {
+		childNode := repoNode.Nodes[childID]
+		if (level == 0 || expanded || !expanded && childNode.InPath(path)) && (!childNode.Hidden || exposeHiddenNodes) && childNode.CanBeAccessedByGroups(groups) && childNode.IsOneOfTheseMimeTypes(mimeTypes) {
+			node.Nodes[childID] = s.getNode(childNode, expanded, mimeTypes, path, level+1, groups, dataFields, exposeHiddenNodes)
+			node.Index = append(node.Index, childID)
+		}
+	}
+	return node
+}
+
+func (s *Snapshot) validateContentRequest(req *requests.Content) (err error) {
+	if req == nil {
+		return errors.New("request must not be nil")
+	}
+	if len(req.URI) == 0 {
+		return errors.New("request URI must not be empty")
+	}
+	if req.Env == nil {
+		return errors.New("request.Env must not be nil")
+	}
+	if len(req.Env.Dimensions) == 0 {
+		return errors.New("request.Env.Dimensions must not be empty")
+	}
+	for _, envDimension := range req.Env.Dimensions {
+		if !s.hasDimension(envDimension) {
+			availableDimensions := make([]string, 0, len(s.directory))
+			for availableDimension := range s.directory {
+				availableDimensions = append(availableDimensions, availableDimension)
+			}
+			return errors.New(fmt.Sprint(
+				"unknown dimension ", envDimension,
+				" in r.Env must be one of ", availableDimensions,
+				" repo has ", len(availableDimensions), " dimensions",
+			))
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) hasDimension(d string) bool {
+	_, hasDimension := s.directory[d]
+	return hasDimension
+}
+
+// newRevision identifies repo content loaded from the given source version.
+// The id changes whenever the content, the source version or the load time change.
+func newRevision(data []byte, sourceVersion string, loadedAt time.Time) *responses.Revision {
+	hash := contentHash(data)
+	idSum := sha256.Sum256([]byte(hash + "\n" + sourceVersion + "\n" + loadedAt.UTC().Format(time.RFC3339Nano)))
+	return &responses.Revision{
+		ID:            hex.EncodeToString(idSum[:])[:revisionIDLength],
+		Hash:          hash,
+		SourceVersion: sourceVersion,
+		LoadedAt:      loadedAt,
+	}
+}
@@ -2,6 +2,15 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrChecksumMismatch is returned by storages which detected corrupted or truncated data
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNotSupported is returned by wrapping storages if the wrapped storage lacks an optional interface
+	ErrNotSupported = errors.New("not supported by the storage")
 )
 
 // Storage defines the contract for snapshot persistence backends.
@@ -24,3 +33,38 @@ type Storage interface {
 	// Close releases any resources held by the storage backend.
 	Close() error
 }
+
+// ConditionalWriter is implemented by storages which support conditional writes,
+// it is required for leader election.
+type ConditionalWriter interface {
+	// Create stores data with the given key only if the key does not exist yet.
+	// Returns os.ErrExist if the key exists.
+	Create(ctx context.Context, key string, data []byte) error
+}
+
+// StorageInfo describes the data stored with a key
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+	// ETag is empty if the backend does not provide one
+	ETag string
+}
+
+// Stater is implemented by storages which can describe a key without reading it.
+type Stater interface {
+	// Stat returns information about the data stored with the given key.
+	// Returns os.ErrNotExist if the key does not exist.
+	Stat(ctx context.Context, key string) (*StorageInfo, error)
+}
+
+// StorageEntry is a key and its data
+type StorageEntry struct {
+	Key  string
+	Data []byte
+}
+
+// BatchWriter is implemented by storages which can write several keys atomically.
+type BatchWriter interface {
+	// WriteBatch stores all entries or none of them.
+	WriteBatch(ctx context.Context, entries []StorageEntry) error
+}
@@ -72,6 +72,17 @@ func (b *BlobStorage) Write(ctx context.Context, key string, data []byte) error
 	return nil
 }
 
+// Create writes the blob only if it does not exist yet, it fails with os.ErrExist otherwise
+func (b *BlobStorage) Create(ctx context.Context, key string, data []byte) error {
+	if err := b.bucket.WriteAll(ctx, b.fullKey(key), data, &blob.WriterOptions{IfNotExist: true}); err != nil {
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+			return os.ErrExist
+		}
+		return fmt.Errorf("failed to create blob %q: %w", key, err)
+	}
+	return nil
+}
+
 func (b *BlobStorage) Read(ctx context.Context, key string) ([]byte, error) {
 	data, err := b.bucket.ReadAll(ctx, b.fullKey(key))
 	if err != nil {
@@ -83,6 +94,21 @@ func (b *BlobStorage) Read(ctx context.Context, key string) ([]byte, error) {
 	return data, nil
 }
 
+func (b *BlobStorage) Stat(ctx context.Context, key string) (*StorageInfo, error) {
+	attrs, err := b.bucket.Attributes(ctx, b.fullKey(key))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("failed to stat blob %q: %w", key, err)
+	}
+	return &StorageInfo{
+		Size:    attrs.Size,
+		ModTime: attrs.ModTime,
+		ETag:    attrs.ETag,
+	}, nil
+}
+
 func (b *BlobStorage) List(ctx context.Context, prefix string) ([]string, error) {
 	iter := b.bucket.List(&blob.ListOptions{
 		Prefix: b.fullKey(prefix),
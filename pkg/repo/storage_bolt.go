@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("contentserver")
+
+// BoltStorage implements Storage using an embedded bbolt database.
+// All keys are stored in a single file, every write is a crash safe transaction
+// and WriteBatch stores several keys atomically.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens or creates the database file at path.
+// The file is locked, so only one process can use it at a time.
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %q: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create bolt bucket: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (b *BoltStorage) Write(_ context.Context, key string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), data)
+	})
+}
+
+// WriteBatch stores all entries in one transaction
+func (b *BoltStorage) WriteBatch(_ context.Context, entries []StorageEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, entry := range entries {
+			if err := bucket.Put([]byte(entry.Key), entry.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Create stores the data only if the key does not exist yet, it fails with os.ErrExist otherwise
+func (b *BoltStorage) Create(_ context.Context, key string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket.Get([]byte(key)) != nil {
+			return os.ErrExist
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+func (b *BoltStorage) Read(_ context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBucket).Get([]byte(key))
+		if value == nil {
+			return os.ErrNotExist
+		}
+		// values are only valid within the transaction
+		data = bytes.Clone(value)
+		return nil
+	})
+	return data, err
+}
+
+// Stat reports the size and a content hash as ETag, bolt does not track modification times
+func (b *BoltStorage) Stat(_ context.Context, key string) (*StorageInfo, error) {
+	var info *StorageInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBucket).Get([]byte(key))
+		if value == nil {
+			return os.ErrNotExist
+		}
+		sum := sha256.Sum256(value)
+		info = &StorageInfo{
+			Size: int64(len(value)),
+			ETag: hex.EncodeToString(sum[:]),
+		}
+		return nil
+	})
+	return info, err
+}
+
+func (b *BoltStorage) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys, nil
+}
+
+func (b *BoltStorage) Delete(_ context.Context, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestBoltStorage(t *testing.T) *BoltStorage {
+	t.Helper()
+	storage, err := NewBoltStorage(filepath.Join(t.TempDir(), "contentserver.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = storage.Close() })
+	return storage
+}
+
+func TestBoltStorage_Write(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestBoltStorage(t)
+
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("original")))
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("updated")))
+
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("updated"), data)
+}
+
+func TestBoltStorage_Read_NotFound(t *testing.T) {
+	storage := newTestBoltStorage(t)
+
+	_, err := storage.Read(context.Background(), "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = storage.Stat(context.Background(), "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBoltStorage_List(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestBoltStorage(t)
+
+	for _, key := range []string{"prefix-a", "prefix-c", "other", "prefix-b"} {
+		require.NoError(t, storage.Write(ctx, key, []byte(key)))
+	}
+
+	keys, err := storage.List(ctx, "prefix-")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"prefix-c", "prefix-b", "prefix-a"}, keys)
+}
+
+func TestBoltStorage_Delete(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestBoltStorage(t)
+
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("data")))
+	require.NoError(t, storage.Delete(ctx, "test-key"))
+	require.NoError(t, storage.Delete(ctx, "test-key"))
+
+	_, err := storage.Read(ctx, "test-key")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBoltStorage_Create(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestBoltStorage(t)
+
+	require.NoError(t, storage.Create(ctx, "test-key", []byte("first")))
+	require.ErrorIs(t, storage.Create(ctx, "test-key", []byte("second")), os.ErrExist)
+
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), data)
+}
+
+func TestBoltStorage_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "contentserver.db")
+	l := zaptest.NewLogger(t)
+
+	storage, err := NewBoltStorage(path)
+	require.NoError(t, err)
+	h, err := NewHistory(l, HistoryWithStorage(storage))
+	require.NoError(t, err)
+	_, err = h.Add(ctx, []byte("test-data"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	storage, err = NewBoltStorage(path)
+	require.NoError(t, err)
+	h, err = NewHistory(l, HistoryWithStorage(storage))
+	require.NoError(t, err)
+	defer h.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "test-data", buf.String())
+	snapshots, err := h.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, len("test-data"), snapshots[0].Size)
+}
@@ -0,0 +1,169 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type (
+	// CacheStorage reads through a local cache storage, e.g. a FilesystemStorage in front of a BlobStorage.
+	// Only keys which never change once written are cached, by default the content addressed snapshots
+	// and their metadata. All other keys, e.g. the manifest, are always read from the wrapped storage,
+	// which is the source of truth for listing as well.
+	CacheStorage struct {
+		l        *zap.Logger
+		storage  Storage
+		cache    Storage
+		prefixes []string
+	}
+	CacheStorageOption func(*CacheStorage)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// CacheStorageWithPrefixes caches the keys with the given prefixes instead of the snapshots and their metadata
+func CacheStorageWithPrefixes(v ...string) CacheStorageOption {
+	return func(o *CacheStorage) {
+		o.prefixes = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewCacheStorage(l *zap.Logger, storage, cache Storage, opts ...CacheStorageOption) *CacheStorage {
+	inst := &CacheStorage{
+		l:        l.Named("storage"),
+		storage:  storage,
+		cache:    cache,
+		prefixes: []string{HistorySnapshotPrefix, HistoryMetadataPrefix},
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (c *CacheStorage) Write(ctx context.Context, key string, data []byte) error {
+	if err := c.storage.Write(ctx, key, data); err != nil {
+		return err
+	}
+	c.fill(ctx, key, data)
+	return nil
+}
+
+func (c *CacheStorage) WriteBatch(ctx context.Context, entries []StorageEntry) error {
+	batchWriter, ok := c.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := batchWriter.WriteBatch(ctx, entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		c.fill(ctx, entry.Key, entry.Data)
+	}
+	return nil
+}
+
+func (c *CacheStorage) Create(ctx context.Context, key string, data []byte) error {
+	writer, ok := c.storage.(ConditionalWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := writer.Create(ctx, key, data); err != nil {
+		return err
+	}
+	c.fill(ctx, key, data)
+	return nil
+}
+
+func (c *CacheStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	if !c.cached(key) {
+		return c.storage.Read(ctx, key)
+	}
+	data, err := c.cache.Read(ctx, key)
+	if err == nil {
+		metrics.StorageCacheCounter.WithLabelValues("hit").Inc()
+		return data, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		// e.g. a corrupted cache file, it is replaced by the data of the wrapped storage
+		c.l.Warn("failed to read from storage cache", zap.String("key", key), zap.Error(err))
+	}
+	metrics.StorageCacheCounter.WithLabelValues("miss").Inc()
+	data, err = c.storage.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.fill(ctx, key, data)
+	return data, nil
+}
+
+func (c *CacheStorage) Stat(ctx context.Context, key string) (*StorageInfo, error) {
+	stater, ok := c.storage.(Stater)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return stater.Stat(ctx, key)
+}
+
+func (c *CacheStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return c.storage.List(ctx, prefix)
+}
+
+func (c *CacheStorage) Delete(ctx context.Context, key string) error {
+	if err := c.storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	if c.cached(key) {
+		if err := c.cache.Delete(ctx, key); err != nil {
+			c.l.Warn("failed to delete from storage cache", zap.String("key", key), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Close closes the wrapped storage and the cache
+func (c *CacheStorage) Close() error {
+	err := c.storage.Close()
+	if cacheErr := c.cache.Close(); err == nil {
+		err = cacheErr
+	}
+	return err
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+func (c *CacheStorage) cached(key string) bool {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fill writes the data to the cache, failures only cost a later cache miss
+func (c *CacheStorage) fill(ctx context.Context, key string, data []byte) {
+	if !c.cached(key) {
+		return
+	}
+	if err := c.cache.Write(ctx, key, data); err != nil {
+		c.l.Warn("failed to write to storage cache", zap.String("key", key), zap.Error(err))
+	}
+}
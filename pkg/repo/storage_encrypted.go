@@ -0,0 +1,200 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedMagic starts all data written by the EncryptedStorage
+var encryptedMagic = []byte("CSENC1")
+
+const encryptedKeyIDSize = 4
+
+type (
+	// EncryptedStorage wraps a Storage and encrypts all data with AES-GCM.
+	// Data is written with the first key and read with the key it was written with,
+	// so keys can be rotated by adding a new key in front of the old ones.
+	// The storage key is authenticated as well, so data can not be moved to another key.
+	EncryptedStorage struct {
+		storage   Storage
+		keys      []*encryptionKey
+		plaintext bool
+	}
+	EncryptedStorageOption func(*EncryptedStorage)
+	encryptionKey          struct {
+		id   []byte
+		aead cipher.AEAD
+	}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// EncryptedStorageWithPlaintext returns unencrypted data as it is instead of failing,
+// e.g. to read a history written before encryption was enabled.
+func EncryptedStorageWithPlaintext(v bool) EncryptedStorageOption {
+	return func(o *EncryptedStorage) {
+		o.plaintext = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+// NewEncryptedStorage wraps the storage, keys must be 16, 24 or 32 bytes long.
+// The first key encrypts, all keys decrypt.
+func NewEncryptedStorage(storage Storage, keys [][]byte, opts ...EncryptedStorageOption) (*EncryptedStorage, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one encryption key is required")
+	}
+	inst := &EncryptedStorage{
+		storage: storage,
+	}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid encryption key %d", i)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid encryption key %d", i)
+		}
+		sum := sha256.Sum256(key)
+		inst.keys = append(inst.keys, &encryptionKey{id: sum[:encryptedKeyIDSize], aead: aead})
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	return inst, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (e *EncryptedStorage) Write(ctx context.Context, key string, data []byte) error {
+	encrypted, err := e.encrypt(key, data)
+	if err != nil {
+		return err
+	}
+	return e.storage.Write(ctx, key, encrypted)
+}
+
+// WriteBatch encrypts the entries and writes them in one batch,
+// it returns ErrNotSupported if the wrapped storage is no BatchWriter.
+func (e *EncryptedStorage) WriteBatch(ctx context.Context, entries []StorageEntry) error {
+	batchWriter, ok := e.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	encrypted := make([]StorageEntry, len(entries))
+	for i, entry := range entries {
+		data, err := e.encrypt(entry.Key, entry.Data)
+		if err != nil {
+			return err
+		}
+		encrypted[i] = StorageEntry{Key: entry.Key, Data: data}
+	}
+	return batchWriter.WriteBatch(ctx, encrypted)
+}
+
+// Create encrypts the data and creates the key,
+// it returns ErrNotSupported if the wrapped storage is no ConditionalWriter.
+func (e *EncryptedStorage) Create(ctx context.Context, key string, data []byte) error {
+	writer, ok := e.storage.(ConditionalWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	encrypted, err := e.encrypt(key, data)
+	if err != nil {
+		return err
+	}
+	return writer.Create(ctx, key, encrypted)
+}
+
+func (e *EncryptedStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	data, err := e.storage.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.decrypt(key, data)
+}
+
+// Stat describes the encrypted data,
+// it returns ErrNotSupported if the wrapped storage is no Stater.
+func (e *EncryptedStorage) Stat(ctx context.Context, key string) (*StorageInfo, error) {
+	stater, ok := e.storage.(Stater)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return stater.Stat(ctx, key)
+}
+
+func (e *EncryptedStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return e.storage.List(ctx, prefix)
+}
+
+func (e *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return e.storage.Delete(ctx, key)
+}
+
+func (e *EncryptedStorage) Close() error {
+	return e.storage.Close()
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// encrypt returns magic, key id, nonce and the sealed data
+func (e *EncryptedStorage) encrypt(key string, data []byte) ([]byte, error) {
+	k := e.keys[0]
+	header := make([]byte, 0, len(encryptedMagic)+encryptedKeyIDSize+k.aead.NonceSize())
+	header = append(header, encryptedMagic...)
+	header = append(header, k.id...)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	header = append(header, nonce...)
+	return k.aead.Seal(header, nonce, data, []byte(key)), nil
+}
+
+func (e *EncryptedStorage) decrypt(key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		if e.plaintext {
+			return data, nil
+		}
+		return nil, fmt.Errorf("%s: data is not encrypted", key)
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < encryptedKeyIDSize {
+		return nil, fmt.Errorf("%s: %w", key, ErrChecksumMismatch)
+	}
+	id, data := data[:encryptedKeyIDSize], data[encryptedKeyIDSize:]
+	for _, k := range e.keys {
+		if !bytes.Equal(k.id, id) {
+			continue
+		}
+		if len(data) < k.aead.NonceSize() {
+			return nil, fmt.Errorf("%s: %w", key, ErrChecksumMismatch)
+		}
+		nonce, sealed := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+		plain, err := k.aead.Open(nil, nonce, sealed, []byte(key))
+		if err != nil {
+			// authentication failed, the data has been corrupted or tampered with
+			return nil, fmt.Errorf("%s: %w", key, ErrChecksumMismatch)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%s: no encryption key with id %x", key, id)
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestEncryptedStorage_Write(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	storage, err := NewEncryptedStorage(base, [][]byte{bytes.Repeat([]byte("a"), 32)})
+	require.NoError(t, err)
+
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("secret prices")))
+
+	raw, err := base.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "secret prices")
+
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret prices"), data)
+}
+
+func TestEncryptedStorage_Rotation(t *testing.T) {
+	ctx := context.Background()
+	oldKey, newKey := bytes.Repeat([]byte("o"), 32), bytes.Repeat([]byte("n"), 32)
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+
+	oldStorage, err := NewEncryptedStorage(base, [][]byte{oldKey})
+	require.NoError(t, err)
+	require.NoError(t, oldStorage.Write(ctx, "old", []byte("old data")))
+
+	rotated, err := NewEncryptedStorage(base, [][]byte{newKey, oldKey})
+	require.NoError(t, err)
+	data, err := rotated.Read(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old data"), data)
+
+	// new data is written with the new key only
+	require.NoError(t, rotated.Write(ctx, "new", []byte("new data")))
+	_, err = oldStorage.Read(ctx, "new")
+	require.Error(t, err)
+}
+
+func TestEncryptedStorage_Tampered(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	storage, err := NewEncryptedStorage(base, [][]byte{bytes.Repeat([]byte("a"), 32)})
+	require.NoError(t, err)
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("data")))
+
+	raw, err := base.Read(ctx, "test-key")
+	require.NoError(t, err)
+	raw[len(raw)-1] ^= 1
+	require.NoError(t, base.Write(ctx, "test-key", raw))
+	_, err = storage.Read(ctx, "test-key")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// data can not be moved to another key
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("data")))
+	raw, err = base.Read(ctx, "test-key")
+	require.NoError(t, err)
+	require.NoError(t, base.Write(ctx, "other-key", raw))
+	_, err = storage.Read(ctx, "other-key")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestEncryptedStorage_Plaintext(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, base.Write(ctx, "test-key", []byte("plain")))
+	key := bytes.Repeat([]byte("a"), 32)
+
+	storage, err := NewEncryptedStorage(base, [][]byte{key})
+	require.NoError(t, err)
+	_, err = storage.Read(ctx, "test-key")
+	require.Error(t, err)
+
+	storage, err = NewEncryptedStorage(base, [][]byte{key}, EncryptedStorageWithPlaintext(true))
+	require.NoError(t, err)
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plain"), data)
+}
+
+func TestEncryptedStorage_InvalidKey(t *testing.T) {
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	_, err = NewEncryptedStorage(base, nil)
+	require.Error(t, err)
+	_, err = NewEncryptedStorage(base, [][]byte{[]byte("short")})
+	require.Error(t, err)
+}
+
+func TestEncryptedStorage_History(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	storage, err := NewEncryptedStorage(base, [][]byte{bytes.Repeat([]byte("a"), 32)})
+	require.NoError(t, err)
+	h, err := NewHistory(zaptest.NewLogger(t), HistoryWithStorage(storage))
+	require.NoError(t, err)
+
+	// the filesystem storage is no batch writer, the history writes the keys one by one
+	_, err = h.Add(ctx, []byte("data"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "data", buf.String())
+}
@@ -1,46 +1,140 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-// FilesystemStorage implements Storage using the local filesystem.
-type FilesystemStorage struct {
-	baseDir string
-	mu      sync.RWMutex
+const (
+	// fsChecksumHeader starts the first line of files written with checksums,
+	// it is followed by the hex encoded sha256 of the data and a newline
+	fsChecksumHeader = "#contentserver-sha256:"
+	// fsTempPrefix is the prefix of the temporary files renamed into place
+	fsTempPrefix = ".tmp-"
+)
+
+type (
+	// FilesystemStorage implements Storage using the local filesystem.
+	// Files are written to a temporary file and renamed into place, so a crash never leaves a partial file.
+	FilesystemStorage struct {
+		baseDir   string
+		sync      bool
+		checksums bool
+		mu        sync.RWMutex
+	}
+	FilesystemStorageOption func(*FilesystemStorage)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// FilesystemStorageWithSync flushes every file and its directory to disk before a write returns
+func FilesystemStorageWithSync(v bool) FilesystemStorageOption {
+	return func(o *FilesystemStorage) {
+		o.sync = v
+	}
 }
 
+// FilesystemStorageWithChecksums stores a sha256 checksum in the first line of every file,
+// Read returns ErrChecksumMismatch if the data does not match it. The files are no plain JSON anymore,
+// so older versions and other tools can not read them. Files without a checksum are read as they are.
+func FilesystemStorageWithChecksums(v bool) FilesystemStorageOption {
+	return func(o *FilesystemStorage) {
+		o.checksums = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
 // NewFilesystemStorage creates a new filesystem-backed storage.
-func NewFilesystemStorage(baseDir string) (*FilesystemStorage, error) {
+// Outdated temporary files left behind by a crash are removed.
+func NewFilesystemStorage(baseDir string, opts ...FilesystemStorageOption) (*FilesystemStorage, error) {
 	if err := os.MkdirAll(baseDir, 0700); err != nil {
 		return nil, err
 	}
-	return &FilesystemStorage{baseDir: baseDir}, nil
+	inst := &FilesystemStorage{
+		baseDir: baseDir,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	if err := inst.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	return inst, nil
 }
 
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
 func (f *FilesystemStorage) Write(_ context.Context, key string, data []byte) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	path := filepath.Join(f.baseDir, key)
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	tmp, err := f.writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
 		return err
 	}
-	return os.WriteFile(path, data, 0600)
+	return f.syncDir(filepath.Dir(path))
+}
+
+// Create writes the file exclusively, it fails with os.ErrExist if the file exists
+func (f *FilesystemStorage) Create(_ context.Context, key string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := filepath.Join(f.baseDir, key)
+	tmp, err := f.writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	// unlike rename, link fails if the target exists
+	if err := os.Link(tmp, path); err != nil {
+		return err
+	}
+	return f.syncDir(filepath.Dir(path))
 }
 
 func (f *FilesystemStorage) Read(_ context.Context, key string) ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	path := filepath.Join(f.baseDir, key)
-	return os.ReadFile(path)
+	data, err := os.ReadFile(filepath.Join(f.baseDir, key))
+	if err != nil {
+		return nil, err
+	}
+	return verifyChecksum(key, data)
+}
+
+func (f *FilesystemStorage) Stat(_ context.Context, key string) (*StorageInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	info, err := os.Stat(filepath.Join(f.baseDir, key))
+	if err != nil {
+		return nil, err
+	}
+	return &StorageInfo{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
 }
 
 // List returns keys matching the prefix.
@@ -57,7 +151,7 @@ func (f *FilesystemStorage) List(_ context.Context, prefix string) ([]string, er
 
 	var keys []string
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) && !strings.HasPrefix(entry.Name(), fsTempPrefix) {
 			keys = append(keys, entry.Name())
 		}
 	}
@@ -80,3 +174,86 @@ func (f *FilesystemStorage) Delete(_ context.Context, key string) error {
 func (f *FilesystemStorage) Close() error {
 	return nil
 }
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// writeTemp writes the data to a temporary file next to path and returns its name
+func (f *FilesystemStorage) writeTemp(path string, data []byte) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, fsTempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return "", err
+	}
+	if err := f.writeFile(file, data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (f *FilesystemStorage) writeFile(file *os.File, data []byte) error {
+	if f.checksums {
+		if _, err := file.WriteString(fsChecksumHeader + contentHash(data) + "\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if f.sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// syncDir flushes the directory entry of a renamed file
+func (f *FilesystemStorage) syncDir(dir string) error {
+	if !f.sync {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *FilesystemStorage) removeTempFiles() error {
+	matches, err := filepath.Glob(filepath.Join(f.baseDir, fsTempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		// skip files another process might still be writing
+		if info, err := os.Stat(match); err != nil || time.Since(info.ModTime()) < time.Minute {
+			continue
+		}
+		if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChecksum strips the checksum line and verifies the data, files without it are returned as they are
+func verifyChecksum(key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(fsChecksumHeader)) {
+		return data, nil
+	}
+	line, body, ok := bytes.Cut(data[len(fsChecksumHeader):], []byte("\n"))
+	if !ok || string(line) != contentHash(body) {
+		return nil, fmt.Errorf("%s: %w", key, ErrChecksumMismatch)
+	}
+	return body, nil
+}
@@ -3,6 +3,7 @@ package repo
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -148,3 +149,54 @@ func TestFilesystemStorage_Close(t *testing.T) {
 	err = storage.Close()
 	require.NoError(t, err)
 }
+
+func TestFilesystemStorage_PlainFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewFilesystemStorage(dir)
+	require.NoError(t, err)
+
+	// without checksums older versions and other tools can read the files
+	require.NoError(t, storage.Write(ctx, "test-key", []byte(`{"test":"data"}`)))
+	raw, err := os.ReadFile(filepath.Join(dir, "test-key"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"test":"data"}`, string(raw))
+}
+
+func TestFilesystemStorage_Checksum(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := NewFilesystemStorage(dir, FilesystemStorageWithSync(true), FilesystemStorageWithChecksums(true))
+	require.NoError(t, err)
+
+	require.NoError(t, storage.Write(ctx, "test-key", []byte("test-data")))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary files are left behind")
+
+	// truncate the file as a crash during an in place write would
+	raw, err := os.ReadFile(filepath.Join(dir, "test-key"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test-key"), raw[:len(raw)-2], 0600))
+	_, err = storage.Read(ctx, "test-key")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// files without a checksum are read as they are
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy-key"), []byte("legacy"), 0600))
+	data, err := storage.Read(ctx, "legacy-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), data)
+}
+
+func TestFilesystemStorage_Create(t *testing.T) {
+	ctx := context.Background()
+	storage, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, storage.Create(ctx, "test-key", []byte("first")))
+	require.ErrorIs(t, storage.Create(ctx, "test-key", []byte("second")), os.ErrExist)
+
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), data)
+}
@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// StorageMiddleware wraps a storage, e.g. to add retries, metrics or caching.
+// Wrapped storages implement all optional interfaces and return ErrNotSupported
+// if the storage they wrap lacks one.
+type StorageMiddleware func(Storage) Storage
+
+// ChainStorage wraps the storage with the middlewares, the first middleware is the outermost
+func ChainStorage(storage Storage, middlewares ...StorageMiddleware) Storage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		storage = middlewares[i](storage)
+	}
+	return storage
+}
+
+// RetryMiddleware retries transient errors, see NewRetryStorage
+func RetryMiddleware(l *zap.Logger, opts ...RetryStorageOption) StorageMiddleware {
+	return func(storage Storage) Storage {
+		return NewRetryStorage(l, storage, opts...)
+	}
+}
+
+// MetricsMiddleware records every operation, see NewMetricsStorage
+func MetricsMiddleware() StorageMiddleware {
+	return func(storage Storage) Storage {
+		return NewMetricsStorage(storage)
+	}
+}
+
+// CacheMiddleware reads through a local cache, see NewCacheStorage
+func CacheMiddleware(l *zap.Logger, cache Storage, opts ...CacheStorageOption) StorageMiddleware {
+	return func(storage Storage) Storage {
+		return NewCacheStorage(l, storage, cache, opts...)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ MetricsStorage
+// ------------------------------------------------------------------------------------------------
+
+// MetricsStorage counts and times every operation of the wrapped storage
+type MetricsStorage struct {
+	storage Storage
+}
+
+func NewMetricsStorage(storage Storage) *MetricsStorage {
+	return &MetricsStorage{storage: storage}
+}
+
+func (m *MetricsStorage) Write(ctx context.Context, key string, data []byte) (err error) {
+	defer m.observe("write", time.Now(), &err)
+	return m.storage.Write(ctx, key, data)
+}
+
+func (m *MetricsStorage) WriteBatch(ctx context.Context, entries []StorageEntry) (err error) {
+	batchWriter, ok := m.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	defer m.observe("write_batch", time.Now(), &err)
+	return batchWriter.WriteBatch(ctx, entries)
+}
+
+func (m *MetricsStorage) Create(ctx context.Context, key string, data []byte) (err error) {
+	writer, ok := m.storage.(ConditionalWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	defer m.observe("create", time.Now(), &err)
+	return writer.Create(ctx, key, data)
+}
+
+func (m *MetricsStorage) Read(ctx context.Context, key string) (_ []byte, err error) {
+	defer m.observe("read", time.Now(), &err)
+	return m.storage.Read(ctx, key)
+}
+
+func (m *MetricsStorage) Stat(ctx context.Context, key string) (_ *StorageInfo, err error) {
+	stater, ok := m.storage.(Stater)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	defer m.observe("stat", time.Now(), &err)
+	return stater.Stat(ctx, key)
+}
+
+func (m *MetricsStorage) List(ctx context.Context, prefix string) (_ []string, err error) {
+	defer m.observe("list", time.Now(), &err)
+	return m.storage.List(ctx, prefix)
+}
+
+func (m *MetricsStorage) Delete(ctx context.Context, key string) (err error) {
+	defer m.observe("delete", time.Now(), &err)
+	return m.storage.Delete(ctx, key)
+}
+
+func (m *MetricsStorage) Close() error {
+	return m.storage.Close()
+}
+
+func (m *MetricsStorage) observe(op string, start time.Time, err *error) {
+	status := "success"
+	switch {
+	case *err == nil:
+	case errors.Is(*err, os.ErrNotExist):
+		status = "not_found"
+	case errors.Is(*err, os.ErrExist):
+		status = "exists"
+	default:
+		status = "error"
+	}
+	metrics.StorageOperationCounter.WithLabelValues(op, status).Inc()
+	metrics.StorageOperationDuration.WithLabelValues(op, status).Observe(time.Since(start).Seconds())
+}
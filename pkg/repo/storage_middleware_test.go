@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// flakyStorage fails the first reads with a timeout and counts all reads
+type flakyStorage struct {
+	Storage
+	failures int
+	reads    int
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (f *flakyStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	f.reads++
+	if f.failures > 0 {
+		f.failures--
+		return nil, timeoutError{}
+	}
+	return f.Storage.Read(ctx, key)
+}
+
+func TestRetryStorage(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, base.Write(ctx, "test-key", []byte("data")))
+	flaky := &flakyStorage{Storage: base, failures: 2}
+	storage := NewRetryStorage(zaptest.NewLogger(t), flaky, RetryStorageWithBackoff(time.Millisecond, time.Millisecond))
+
+	data, err := storage.Read(ctx, "test-key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+	assert.Equal(t, 3, flaky.reads)
+
+	// missing keys are not retried
+	flaky.reads = 0
+	_, err = storage.Read(ctx, "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, 1, flaky.reads)
+
+	// the last error is returned after the last attempt
+	flaky.reads, flaky.failures = 0, 10
+	_, err = NewRetryStorage(zaptest.NewLogger(t), flaky,
+		RetryStorageWithMaxAttempts(3),
+		RetryStorageWithBackoff(time.Millisecond, time.Millisecond),
+	).Read(ctx, "test-key")
+	require.ErrorIs(t, err, timeoutError{})
+	assert.Equal(t, 3, flaky.reads)
+}
+
+func TestCacheStorage(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	cache, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	counting := &flakyStorage{Storage: base}
+	storage := NewCacheStorage(zaptest.NewLogger(t), counting, cache)
+
+	key := snapshotKey(contentHash([]byte("data")))
+	require.NoError(t, base.Write(ctx, key, []byte("data")))
+	require.NoError(t, base.Write(ctx, ManifestKey, []byte("manifest")))
+
+	for range 2 {
+		data, err := storage.Read(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("data"), data)
+		_, err = storage.Read(ctx, ManifestKey)
+		require.NoError(t, err)
+	}
+	// snapshots are read once, the manifest is never cached
+	assert.Equal(t, 3, counting.reads)
+	_, err = cache.Read(ctx, ManifestKey)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, storage.Delete(ctx, key))
+	_, err = cache.Read(ctx, key)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestChainStorage(t *testing.T) {
+	ctx := context.Background()
+	base, err := NewBoltStorage(t.TempDir() + "/contentserver.db")
+	require.NoError(t, err)
+	cache, err := NewFilesystemStorage(t.TempDir())
+	require.NoError(t, err)
+	l := zaptest.NewLogger(t)
+	storage := ChainStorage(base,
+		CacheMiddleware(l, cache),
+		RetryMiddleware(l),
+		MetricsMiddleware(),
+	)
+	_, ok := storage.(*CacheStorage)
+	assert.True(t, ok, "the first middleware is the outermost")
+
+	h, err := NewHistory(l, HistoryWithStorage(storage))
+	require.NoError(t, err)
+	key, err := h.Add(ctx, []byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	// a new history restores the snapshot from the cache
+	data, err := cache.Read(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+	var buf bytes.Buffer
+	base, err = NewBoltStorage(t.TempDir() + "/empty.db")
+	require.NoError(t, err)
+	require.NoError(t, base.Write(ctx, ManifestKey, []byte(`{"current":"`+contentHash([]byte("data"))+`"}`)))
+	h, err = NewHistory(l, HistoryWithStorage(ChainStorage(base, CacheMiddleware(l, cache))))
+	require.NoError(t, err)
+	require.NoError(t, h.GetCurrent(ctx, &buf))
+	assert.Equal(t, "data", buf.String())
+	require.NoError(t, h.Close())
+}
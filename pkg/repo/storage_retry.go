@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gocloud.dev/gcerrors"
+)
+
+type (
+	// RetryStorage retries transient errors of the wrapped storage with exponential backoff.
+	// Create is not retried, as a retry could fail with os.ErrExist after the first attempt succeeded.
+	RetryStorage struct {
+		l           *zap.Logger
+		storage     Storage
+		maxAttempts int
+		backoff     time.Duration
+		maxBackoff  time.Duration
+		retryable   func(error) bool
+	}
+	RetryStorageOption func(*RetryStorage)
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// RetryStorageWithMaxAttempts sets how often an operation is attempted, default 5
+func RetryStorageWithMaxAttempts(v int) RetryStorageOption {
+	return func(o *RetryStorage) {
+		o.maxAttempts = v
+	}
+}
+
+// RetryStorageWithBackoff sets the initial and maximum delay between attempts, default 100ms and 5s
+func RetryStorageWithBackoff(initial, maxBackoff time.Duration) RetryStorageOption {
+	return func(o *RetryStorage) {
+		o.backoff = initial
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// RetryStorageWithRetryable decides which errors are retried, default IsTransientStorageError
+func RetryStorageWithRetryable(v func(error) bool) RetryStorageOption {
+	return func(o *RetryStorage) {
+		o.retryable = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewRetryStorage(l *zap.Logger, storage Storage, opts ...RetryStorageOption) *RetryStorage {
+	inst := &RetryStorage{
+		l:           l.Named("storage"),
+		storage:     storage,
+		maxAttempts: 5,
+		backoff:     100 * time.Millisecond,
+		maxBackoff:  5 * time.Second,
+		retryable:   IsTransientStorageError,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (r *RetryStorage) Write(ctx context.Context, key string, data []byte) error {
+	return r.do(ctx, "write", func() error {
+		return r.storage.Write(ctx, key, data)
+	})
+}
+
+func (r *RetryStorage) WriteBatch(ctx context.Context, entries []StorageEntry) error {
+	batchWriter, ok := r.storage.(BatchWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return r.do(ctx, "write_batch", func() error {
+		return batchWriter.WriteBatch(ctx, entries)
+	})
+}
+
+func (r *RetryStorage) Create(ctx context.Context, key string, data []byte) error {
+	writer, ok := r.storage.(ConditionalWriter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return writer.Create(ctx, key, data)
+}
+
+func (r *RetryStorage) Read(ctx context.Context, key string) (data []byte, err error) {
+	err = r.do(ctx, "read", func() error {
+		data, err = r.storage.Read(ctx, key)
+		return err
+	})
+	return data, err
+}
+
+func (r *RetryStorage) Stat(ctx context.Context, key string) (info *StorageInfo, err error) {
+	stater, ok := r.storage.(Stater)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = r.do(ctx, "stat", func() error {
+		info, err = stater.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (r *RetryStorage) List(ctx context.Context, prefix string) (keys []string, err error) {
+	err = r.do(ctx, "list", func() error {
+		keys, err = r.storage.List(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (r *RetryStorage) Delete(ctx context.Context, key string) error {
+	return r.do(ctx, "delete", func() error {
+		return r.storage.Delete(ctx, key)
+	})
+}
+
+func (r *RetryStorage) Close() error {
+	return r.storage.Close()
+}
+
+// IsTransientStorageError reports whether the error is worth retrying,
+// e.g. an internal error or throttling of the blob service or a network timeout.
+func IsTransientStorageError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch gcerrors.Code(err) {
+	case gcerrors.ResourceExhausted, gcerrors.DeadlineExceeded, gcerrors.Internal:
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+func (r *RetryStorage) do(ctx context.Context, op string, fn func() error) error {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.maxAttempts || !r.retryable(err) {
+			return err
+		}
+		metrics.StorageRetryCounter.WithLabelValues(op).Inc()
+		r.l.Warn("storage operation failed, retrying",
+			zap.String("operation", op),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, r.maxBackoff)
+	}
+}
@@ -0,0 +1,56 @@
+package repo
+
+import (
+	"github.com/foomo/contentserver/responses"
+	"go.uber.org/zap"
+)
+
+// changeBufferSize number of changes buffered for a subscriber
+const changeBufferSize = 8
+
+// Subscribe registers for changes of the repo. The returned channel receives
+// a change whenever an update replaced the served revision. Changes are dropped
+// for subscribers which do not keep up. The channel is closed when the repo
+// stops or the returned unsubscribe function is called.
+func (r *Repo) Subscribe() (<-chan *responses.Change, func()) {
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+
+	changes := make(chan *responses.Change, changeBufferSize)
+	if r.subscribersClosed {
+		close(changes)
+		return changes, func() {}
+	}
+	r.subscribers[changes] = struct{}{}
+
+	return changes, func() {
+		r.subscribersLock.Lock()
+		defer r.subscribersLock.Unlock()
+		if _, ok := r.subscribers[changes]; ok {
+			delete(r.subscribers, changes)
+			close(changes)
+		}
+	}
+}
+
+func (r *Repo) publishChange(change *responses.Change) {
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	for changes := range r.subscribers {
+		select {
+		case changes <- change:
+		default:
+			r.l.Warn("dropping change for slow subscriber", zap.String("revision", change.Revision.ID))
+		}
+	}
+}
+
+func (r *Repo) closeSubscribers() {
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	for changes := range r.subscribers {
+		delete(r.subscribers, changes)
+		close(changes)
+	}
+	r.subscribersClosed = true
+}
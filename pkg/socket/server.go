@@ -0,0 +1,186 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+type (
+	// Server accepts connections for a socket handler, it implements a keel service
+	Server struct {
+		l              *zap.Logger
+		name           string
+		ln             net.Listener
+		handler        *handler.Socket
+		maxConnections int
+		startAfter     <-chan struct{}
+		connections    atomic.Int64
+		running        atomic.Bool
+		// mu guards closed, so no connection is added to wg once Close waits for it
+		mu     sync.Mutex
+		closed bool
+		wg     sync.WaitGroup
+	}
+	ServerOption func(*Server)
+)
+
+// ErrServerNotRunning is returned by Healthz before the server has been started and after it has been closed
+var ErrServerNotRunning = errors.New("socket server not running")
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewServer(l *zap.Logger, name string, ln net.Listener, handler *handler.Socket, opts ...ServerOption) *Server {
+	inst := &Server{
+		l:       l.With(zap.String("service", name)),
+		name:    name,
+		ln:      ln,
+		handler: handler,
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// ServerWithMaxConnections closes further connections at once while the limit is reached, 0 disables it
+func ServerWithMaxConnections(v int) ServerOption {
+	return func(o *Server) {
+		o.maxConnections = v
+	}
+}
+
+// ServerWithStartAfter accepts connections only once the channel is closed, e.g. when the repo has been loaded.
+// Clients connecting earlier wait in the listen backlog.
+func ServerWithStartAfter(v <-chan struct{}) ServerOption {
+	return func(o *Server) {
+		o.startAfter = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) Healthz() error {
+	if !s.running.Load() {
+		return ErrServerNotRunning
+	}
+	return nil
+}
+
+func (s *Server) String() string {
+	return fmt.Sprintf("socket server on `%s`", s.ln.Addr())
+}
+
+// Start accepts connections until the listener is closed or the context is done
+func (s *Server) Start(ctx context.Context) error {
+	if s.startAfter != nil {
+		select {
+		case <-s.startAfter:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	s.l.Info("starting socket server", zap.String("address", s.ln.Addr().String()))
+	s.running.Store(true)
+	defer s.running.Store(false)
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.ln.Close()
+	})
+	defer stop()
+
+	var backoff time.Duration
+	for {
+		conn, err := s.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			// e.g. too many open files, retry like net/http
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			s.l.Error("failed to accept connection", zap.Error(err), zap.Duration("retry", backoff))
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if s.maxConnections > 0 && s.connections.Load() >= int64(s.maxConnections) {
+			s.l.Warn("rejecting connection, too many connections", zap.String("source", conn.RemoteAddr().String()))
+			metrics.SocketRejectedConnectionsCounter.WithLabelValues().Inc()
+			_ = conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.connections.Add(1)
+		s.wg.Add(1)
+		s.mu.Unlock()
+		// a goroutine handles conn so that the loop can accept other connections
+		go func() {
+			defer func() {
+				s.connections.Add(-1)
+				s.wg.Done()
+			}()
+			s.l.Debug("accepted connection", zap.String("source", conn.RemoteAddr().String()))
+			s.handler.Serve(conn)
+			if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				s.l.Warn("failed to close connection", zap.Error(err))
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections and drains the open ones until the context is done
+func (s *Server) Close(ctx context.Context) error {
+	s.l.Info("stopping socket server")
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.running.Store(false)
+	if err := s.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.l.Warn("failed to close listener", zap.Error(err))
+	}
+	err := s.handler.Shutdown(ctx)
+
+	// the connections have been closed once the context is done, but their handlers may still be busy
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drain connections: %w", err)
+	}
+	return nil
+}
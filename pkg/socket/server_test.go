@@ -0,0 +1,94 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/handler"
+	"github.com/foomo/contentserver/pkg/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/nettest"
+)
+
+// newTestServer starts a server whose dispatcher answers the route block once release is closed
+func newTestServer(t *testing.T, entered chan<- struct{}, release <-chan struct{}) *Server {
+	t.Helper()
+	l := zaptest.NewLogger(t)
+	h, err := repo.NewHistory(l, repo.HistoryWithHistoryDir(t.TempDir()))
+	require.NoError(t, err)
+	r := repo.New(l, "", h)
+	d := handler.NewDispatcher(l, r)
+	d.Handle("block", func(ctx context.Context, req *handler.Request) (*handler.Reply, error) {
+		entered <- struct{}{}
+		<-release
+		return &handler.Reply{Value: true}, nil
+	})
+	ln, err := nettest.NewLocalListener("tcp")
+	require.NoError(t, err)
+	s := NewServer(l, "socket", ln, handler.NewSocket(l, r, handler.SocketWithDispatcher(d)))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Start(t.Context()))
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		<-done
+	})
+	require.Eventually(t, func() bool { return s.Healthz() == nil }, time.Second, time.Millisecond)
+	return s
+}
+
+func TestServerClose(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	s := newTestServer(t, entered, release)
+
+	conn, err := net.Dial("tcp", s.ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("block:2{}"))
+	require.NoError(t, err)
+	<-entered
+
+	// the busy handler does not block the shutdown beyond the context
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.Close(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorIs(t, s.Healthz(), ErrServerNotRunning)
+}
+
+func TestServerCloseWhileAccepting(t *testing.T) {
+	entered := make(chan struct{}, 100)
+	release := make(chan struct{})
+	close(release)
+	s := newTestServer(t, entered, release)
+
+	// connections accepted while closing are either drained or closed at once
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				conn, err := net.Dial("tcp", s.ln.Addr().String())
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, s.Close(t.Context()))
+	wg.Wait()
+}
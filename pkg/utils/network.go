@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"strings"
+)
+
+// NetworkAddress splits an address into the network and the address for net.Dial and net.Listen,
+// e.g. unix:///run/contentserver.sock or tcp://localhost:8081, addresses without a scheme are tcp
+func NetworkAddress(address string) (network, addr string) {
+	if network, addr, ok := strings.Cut(address, "://"); ok {
+		return network, addr
+	}
+	return "tcp", address
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const certificateReloadInterval = 10 * time.Second
+
+// CertificateReloader serves a certificate from files which are reloaded once they change,
+// e.g. when they are renewed by cert-manager. A certificate which fails to load is ignored
+// and the previous one is kept.
+type CertificateReloader struct {
+	l        *zap.Logger
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+// LoadCertPool reads PEM encoded certificates, e.g. the CA verifying client certificates
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + file)
+		}
+	}
+	return pool, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func NewCertificateReloader(l *zap.Logger, certFile, keyFile string) (*CertificateReloader, error) {
+	inst := &CertificateReloader{
+		l:        l.Named("tls"),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := inst.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := inst.load(modTime); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// certificate returns the current certificate, the files are checked at most every certificateReloadInterval
+func (r *CertificateReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certificateReloadInterval {
+		return r.cert
+	}
+	r.checked = time.Now()
+	modTime, err := r.stat()
+	if err != nil {
+		r.l.Warn("failed to check certificate", zap.Error(err))
+		return r.cert
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert
+	}
+	if err := r.load(modTime); err != nil {
+		// e.g. the certificate has been written but not yet the key
+		r.l.Warn("failed to reload certificate, keeping the previous one", zap.Error(err))
+		return r.cert
+	}
+	r.l.Info("reloaded certificate", zap.String("file", r.certFile))
+	return r.cert
+}
+
+// stat returns the latest modification time of the certificate and the key
+func (r *CertificateReloader) stat() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (r *CertificateReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
@@ -0,0 +1,258 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foomo/contentserver/pkg/metrics"
+	"github.com/foomo/contentserver/responses"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// HeaderEvent contains the notification event
+	HeaderEvent = "X-Contentserver-Event"
+	// HeaderTimestamp contains the unix timestamp the request was signed at
+	HeaderTimestamp = "X-Contentserver-Timestamp"
+	// HeaderSignature contains the hmac signature of the request, see Sign
+	HeaderSignature = "X-Contentserver-Signature"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// Webhook posts update notifications to a list of urls.
+// A single worker delivers the notifications in the order they were queued, failed
+// deliveries are retried with exponential backoff before the next notification is sent.
+type (
+	Webhook struct {
+		l           *zap.Logger
+		urls        []string
+		secret      []byte
+		httpClient  *http.Client
+		maxAttempts int
+		backoff     time.Duration
+		maxBackoff  time.Duration
+		queueSize   int
+		queue       chan notification
+		closed      bool
+		mu          sync.Mutex
+		done        chan struct{}
+		ctx         context.Context //nolint:containedctx
+		cancel      context.CancelFunc
+	}
+	Option func(*Webhook)
+	// notification is a queued notification
+	notification struct {
+		event string
+		body  []byte
+	}
+)
+
+// ------------------------------------------------------------------------------------------------
+// ~ Constructor
+// ------------------------------------------------------------------------------------------------
+
+func New(l *zap.Logger, urls []string, opts ...Option) *Webhook {
+	inst := &Webhook{
+		l:           l.Named("webhook"),
+		urls:        urls,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 5,
+		backoff:     time.Second,
+		maxBackoff:  time.Minute,
+		queueSize:   100,
+		done:        make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(inst)
+	}
+
+	inst.ctx, inst.cancel = context.WithCancel(context.Background())
+	inst.queue = make(chan notification, inst.queueSize)
+	go inst.run()
+
+	return inst
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Options
+// ------------------------------------------------------------------------------------------------
+
+// WithSecret signs every request with the given secret
+func WithSecret(v string) Option {
+	return func(o *Webhook) {
+		o.secret = []byte(v)
+	}
+}
+
+func WithHTTPClient(v *http.Client) Option {
+	return func(o *Webhook) {
+		o.httpClient = v
+	}
+}
+
+// WithMaxAttempts sets how often a delivery is tried before it is given up
+func WithMaxAttempts(v int) Option {
+	return func(o *Webhook) {
+		o.maxAttempts = v
+	}
+}
+
+// WithBackoff sets the initial and the maximum delay between attempts
+func WithBackoff(initial, maxBackoff time.Duration) Option {
+	return func(o *Webhook) {
+		o.backoff = initial
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithQueueSize sets how many notifications may wait for their delivery, further ones are dropped
+func WithQueueSize(v int) Option {
+	return func(o *Webhook) {
+		o.queueSize = v
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Public methods
+// ------------------------------------------------------------------------------------------------
+
+// Notify queues the notification for all urls without blocking, it can be used as repo.UpdateHook
+func (w *Webhook) Notify(_ context.Context, n *responses.UpdateNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		w.l.Error("could not encode notification", zap.Error(err))
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		w.l.Warn("dropping notification, the webhook is closed", zap.String("event", n.Event))
+		return
+	}
+	select {
+	case w.queue <- notification{event: n.Event, body: body}:
+	default:
+		w.l.Error("dropping notification, the queue is full", zap.String("event", n.Event), zap.Int("size", w.queueSize))
+		metrics.WebhookDeliveryCounter.WithLabelValues("failure").Add(float64(len(w.urls)))
+	}
+}
+
+// Close waits for queued deliveries until the context is done and cancels the remaining ones
+func (w *Webhook) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	defer w.cancel()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sign returns the signature for a request body sent at the given unix timestamp.
+// Receivers should compare it to the HeaderSignature value using hmac.Equal.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ------------------------------------------------------------------------------------------------
+// ~ Private methods
+// ------------------------------------------------------------------------------------------------
+
+// run delivers the queued notifications one after another until the queue is closed
+func (w *Webhook) run() {
+	defer close(w.done)
+	for n := range w.queue {
+		if w.ctx.Err() != nil {
+			metrics.WebhookDeliveryCounter.WithLabelValues("failure").Add(float64(len(w.urls)))
+			continue
+		}
+		// the urls do not wait for each other, but for the previous notification
+		var wg sync.WaitGroup
+		for _, url := range w.urls {
+			wg.Go(func() {
+				w.deliver(url, n.event, n.body)
+			})
+		}
+		wg.Wait()
+	}
+}
+
+func (w *Webhook) deliver(url, event string, body []byte) {
+	l := w.l.With(zap.String("url", url), zap.String("event", event))
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(url, event, body)
+		if err == nil {
+			l.Debug("delivered notification", zap.Int("attempt", attempt))
+			metrics.WebhookDeliveryCounter.WithLabelValues("success").Inc()
+			return
+		}
+		if !retry || attempt >= w.maxAttempts {
+			l.Error("failed to deliver notification", zap.Int("attempt", attempt), zap.Error(err))
+			metrics.WebhookDeliveryCounter.WithLabelValues("failure").Inc()
+			return
+		}
+		l.Warn("failed to deliver notification, retrying", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-w.ctx.Done():
+			metrics.WebhookDeliveryCounter.WithLabelValues("failure").Inc()
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, w.maxBackoff)
+	}
+}
+
+// post sends a single request and reports whether a failure may be retried
+func (w *Webhook) post(url, event string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create request")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if len(w.secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(w.secret, timestamp, body))
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected response status %q", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected response status %q", resp.Status)
+	}
+}
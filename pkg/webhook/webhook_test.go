@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foomo/contentserver/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestNotify(t *testing.T) {
+	var (
+		secret   = []byte("secret")
+		attempts atomic.Int32
+		received = make(chan *responses.UpdateNotification, 1)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		signature := Sign(secret, r.Header.Get(HeaderTimestamp), body)
+		assert.True(t, hmac.Equal([]byte(signature), []byte(r.Header.Get(HeaderSignature))))
+		assert.Equal(t, responses.UpdateNotificationEventSuccess, r.Header.Get(HeaderEvent))
+
+		// fail the first attempt to test the retry
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		notification := &responses.UpdateNotification{}
+		assert.NoError(t, json.Unmarshal(body, notification))
+		received <- notification
+	}))
+	defer server.Close()
+
+	w := New(zaptest.NewLogger(t), []string{server.URL},
+		WithSecret(string(secret)),
+		WithBackoff(10*time.Millisecond, 10*time.Millisecond),
+	)
+	w.Notify(t.Context(), &responses.UpdateNotification{
+		Event:      responses.UpdateNotificationEventSuccess,
+		Revision:   &responses.Revision{ID: "abc"},
+		Dimensions: []string{"dimension_foo"},
+	})
+	require.NoError(t, w.Close(t.Context()))
+
+	notification := <-received
+	assert.Equal(t, "abc", notification.Revision.ID)
+	assert.Equal(t, []string{"dimension_foo"}, notification.Dimensions)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+func TestNotifyDoesNotRetryClientErrors(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	w := New(zaptest.NewLogger(t), []string{server.URL}, WithBackoff(time.Millisecond, time.Millisecond))
+	w.Notify(t.Context(), &responses.UpdateNotification{Event: responses.UpdateNotificationEventFailure})
+	require.NoError(t, w.Close(t.Context()))
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestNotifyInOrder(t *testing.T) {
+	var (
+		attempts atomic.Int32
+		mu       sync.Mutex
+		received []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := &responses.UpdateNotification{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(notification))
+		// the retries of the first notification must not be overtaken
+		if attempts.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, notification.Revision.ID)
+	}))
+	defer server.Close()
+
+	w := New(zaptest.NewLogger(t), []string{server.URL}, WithBackoff(10*time.Millisecond, 10*time.Millisecond))
+	for _, id := range []string{"a", "b", "c"} {
+		w.Notify(t.Context(), &responses.UpdateNotification{
+			Event:    responses.UpdateNotificationEventSuccess,
+			Revision: &responses.Revision{ID: id},
+		})
+	}
+	require.NoError(t, w.Close(t.Context()))
+	assert.Equal(t, []string{"a", "b", "c"}, received)
+
+	// notifications after closing are dropped
+	w.Notify(t.Context(), &responses.UpdateNotification{Event: responses.UpdateNotificationEventSuccess})
+	assert.Equal(t, int32(5), attempts.Load())
+}
+
+func TestNotifyQueueFull(t *testing.T) {
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		<-release
+	}))
+	defer server.Close()
+
+	w := New(zaptest.NewLogger(t), []string{server.URL}, WithQueueSize(1))
+	notification := &responses.UpdateNotification{Event: responses.UpdateNotificationEventSuccess}
+	// the first one is delivered, the second one waits and the third one is dropped
+	w.Notify(t.Context(), notification)
+	require.Eventually(t, func() bool { return attempts.Load() == 1 }, time.Second, time.Millisecond)
+	w.Notify(t.Context(), notification)
+	w.Notify(t.Context(), notification)
+	close(release)
+	require.NoError(t, w.Close(t.Context()))
+	assert.Equal(t, int32(2), attempts.Load())
+}
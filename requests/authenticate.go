@@ -0,0 +1,11 @@
+package requests
+
+// Authenticate - the credentials of a socket connection, a bearer token or an hmac signature
+type Authenticate struct {
+	Token     string `json:"token,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	// Signature of the method SOCKET, the timestamp, the nonce and the route authenticate without a body
+	Signature string `json:"signature,omitempty"`
+}
@@ -0,0 +1,6 @@
+package requests
+
+// ContentBatch - many content requests, resolved against the same repo state
+type ContentBatch struct {
+	Requests []*Content `json:"requests"`
+}
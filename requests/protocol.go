@@ -0,0 +1,7 @@
+package requests
+
+// Protocol - negotiate the socket protocol version of the connection
+type Protocol struct {
+	// protocol versions supported by the client
+	Versions []int `json:"versions"`
+}
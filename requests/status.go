@@ -0,0 +1,4 @@
+package requests
+
+// Status - query the server status
+type Status struct{}
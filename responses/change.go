@@ -0,0 +1,14 @@
+package responses
+
+// Change - describes how the repo changed with an update
+type Change struct {
+	// the revision served after the update
+	Revision *Revision `json:"revision"`
+	// the revision that was replaced
+	PreviousRevision *Revision `json:"previousRevision,omitempty"`
+	// added, removed or modified dimensions
+	Dimensions []string `json:"dimensions"`
+	// ids of added, removed or modified nodes for each changed dimension,
+	// a changed dimension is missing if too many of its nodes changed
+	NodeIDs map[string][]string `json:"nodeIds"`
+}
@@ -0,0 +1,13 @@
+package responses
+
+import (
+	"github.com/foomo/contentserver/content"
+)
+
+// ContentBatchItem - result of a single request within a content batch
+type ContentBatchItem struct {
+	// set if the request could be resolved
+	Content *content.SiteContent `json:"content,omitempty"`
+	// set if the request failed
+	Error *Error `json:"error,omitempty"`
+}
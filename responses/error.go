@@ -2,6 +2,37 @@ package responses
 
 import (
 	"fmt"
+	"net/http"
+)
+
+// Error codes of the replies, they are stable across servers and transports
+const (
+	// ErrorCodeUnknownRoute the route does not exist
+	ErrorCodeUnknownRoute = 1
+	// ErrorCodeInvalidJSON the request body could not be decoded
+	ErrorCodeInvalidJSON = 2
+	// ErrorCodeInternal the request failed on the server
+	ErrorCodeInternal = 3
+	// ErrorCodeInvalidHeader the socket request header could not be read
+	ErrorCodeInvalidHeader = 4
+	// ErrorCodeRepo the repo could not be read
+	ErrorCodeRepo = 5
+	// ErrorCodeRequestTooLarge the request exceeds the size limit
+	ErrorCodeRequestTooLarge = 6
+	// ErrorCodeMethodNotAllowed the route does not support the http method
+	ErrorCodeMethodNotAllowed = 7
+	// ErrorCodeNotLoaded the repo has not been loaded yet
+	ErrorCodeNotLoaded = 8
+	// ErrorCodeInvalidRequest the request was decoded, but is not valid
+	ErrorCodeInvalidRequest = 9
+	// ErrorCodeNotFound the requested node does not exist
+	ErrorCodeNotFound = 10
+	// ErrorCodeRateLimited the request exceeds the rate limit
+	ErrorCodeRateLimited = 11
+	// ErrorCodeUnauthorized the request has no or invalid credentials
+	ErrorCodeUnauthorized = 12
+	// ErrorCodeForbidden the client does not have the permission of the route
+	ErrorCodeForbidden = 13
 )
 
 // Error describes an error for humans and machines
@@ -12,13 +43,18 @@ type Error struct {
 }
 
 func (e Error) Error() string {
-	return fmt.Sprintf("status:%q, code: %q, message: %q", e.Status, e.Code, e.Message)
+	return fmt.Sprintf("status: %d, code: %d, message: %q", e.Status, e.Code, e.Message)
 }
 
 // NewError - a brand new error
 func NewError(code int, message string) *Error {
+	return NewStatusError(http.StatusInternalServerError, code, message)
+}
+
+// NewStatusError - a brand new error with the http status of the reply
+func NewStatusError(status, code int, message string) *Error {
 	return &Error{
-		Status:  500,
+		Status:  status,
 		Code:    code,
 		Message: message,
 	}
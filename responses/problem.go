@@ -0,0 +1,41 @@
+package responses
+
+import (
+	"net/http"
+)
+
+// ContentTypeProblem media type of RFC 7807 problem details
+const ContentTypeProblem = "application/problem+json"
+
+// Problem - RFC 7807 problem details of failed http requests, extended by the error code and repo version
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     int    `json:"code"`
+	Version  string `json:"version,omitempty"`
+}
+
+// NewProblem - problem details of an error
+func NewProblem(err *Error, instance, version string) *Problem {
+	return &Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(err.Status),
+		Status:   err.Status,
+		Detail:   err.Message,
+		Instance: instance,
+		Code:     err.Code,
+		Version:  version,
+	}
+}
+
+// ToError returns the problem as error
+func (p *Problem) ToError() Error {
+	return Error{
+		Status:  p.Status,
+		Code:    p.Code,
+		Message: p.Detail,
+	}
+}
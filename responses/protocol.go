@@ -0,0 +1,6 @@
+package responses
+
+// Protocol - the socket protocol version used for all following requests on the connection
+type Protocol struct {
+	Version int `json:"version"`
+}
@@ -0,0 +1,11 @@
+package responses
+
+import (
+	"github.com/foomo/contentserver/content"
+)
+
+// RepoDimension - the repo of one dimension, the grpc GetRepo stream sends one per dimension
+type RepoDimension struct {
+	Dimension string            `json:"dimension"`
+	Node      *content.RepoNode `json:"node"`
+}
@@ -0,0 +1,17 @@
+package responses
+
+import (
+	"time"
+)
+
+// Revision - identifies a loaded version of the repo
+type Revision struct {
+	// unique id derived from the hash, the source version and the load time
+	ID string `json:"id"`
+	// sha256 of the repo json
+	Hash string `json:"hash"`
+	// version reported by the repo source e.g. the poll version or etag
+	SourceVersion string `json:"sourceVersion"`
+	// when the revision was loaded
+	LoadedAt time.Time `json:"loadedAt"`
+}
@@ -0,0 +1,46 @@
+package responses
+
+import (
+	"time"
+)
+
+const (
+	StatusRoleLeader   = "leader"
+	StatusRoleFollower = "follower"
+)
+
+// Status - information about the state of the server
+type Status struct {
+	// is there a repo to serve
+	Loaded bool `json:"loaded"`
+	// leader or follower, empty without leader election
+	Role string `json:"role,omitempty"`
+	// the revision currently served
+	Revision *Revision `json:"revision"`
+	// node and uri counts for each dimension
+	Dimensions map[string]DimensionStatus `json:"dimensions"`
+	// result of the most recent update
+	LastUpdate *UpdateResult `json:"lastUpdate,omitempty"`
+	// most recent update error
+	LastError *StatusError `json:"lastError,omitempty"`
+	// keys of the snapshots in the history, newest first
+	History []string `json:"history"`
+}
+
+// DimensionStatus - information about a dimension
+type DimensionStatus struct {
+	NumberOfNodes int `json:"numberOfNodes"`
+	NumberOfURIs  int `json:"numberOfURIs"`
+}
+
+// UpdateResult - an update and when it finished
+type UpdateResult struct {
+	Time   time.Time `json:"time"`
+	Update *Update   `json:"update"`
+}
+
+// StatusError - an error and when it occurred
+type StatusError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
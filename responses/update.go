@@ -7,4 +7,6 @@ type Update struct {
 	// this is for humans
 	ErrorMessage string `json:"errorMessage"`
 	Stats        Stats  `json:"stats"`
+	// the revision served after the update
+	Revision *Revision `json:"revision,omitempty"`
 }
@@ -0,0 +1,26 @@
+package responses
+
+import (
+	"time"
+)
+
+const (
+	// UpdateNotificationEventSuccess an update replaced the served revision
+	UpdateNotificationEventSuccess = "update.success"
+	// UpdateNotificationEventFailure an update failed
+	UpdateNotificationEventFailure = "update.failure"
+)
+
+// UpdateNotification - sent to listeners after an update
+type UpdateNotification struct {
+	// one of the UpdateNotificationEvent constants
+	Event string `json:"event"`
+	// when the update finished
+	Time time.Time `json:"time"`
+	// the update result and its stats
+	Update *Update `json:"update"`
+	// the revision served after the update
+	Revision *Revision `json:"revision,omitempty"`
+	// added, removed or modified dimensions
+	Dimensions []string `json:"dimensions"`
+}